@@ -0,0 +1,107 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package readonly protects an agent from being modified, e.g. when gensign simulates a request.
+// The requests reading the agent are forwarded to it, and the requests modifying it are answered without forwarding.
+package readonly
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxMessageBytes is the maximum size of a message accepted. It is a sanity check, not a limit in the spec.
+const maxMessageBytes = 16 << 20
+
+// Agent protocol numbers, https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent#section-7.
+const (
+	agentFailure                  = 5
+	agentSuccess                  = 6
+	agentAddIdentity              = 17
+	agentRemoveIdentity           = 18
+	agentRemoveAllIdentities      = 19
+	agentAddSmartcardKey          = 20
+	agentRemoveSmartcardKey       = 21
+	agentLock                     = 22
+	agentUnlock                   = 23
+	agentAddIDConstrained         = 25
+	agentAddSmartcardKeyConstrain = 26
+	// yubiagentAddHardCert and yubiagentGenerateKey are the extensions of yubiagent.
+	yubiagentAddHardCert = 31
+	yubiagentGenerateKey = 37
+)
+
+// responses are the responses to the requests modifying the agent.
+// The key generation fails, since the key cannot be generated without modifying the device.
+// Other modifications succeed as if the agent were modified.
+var responses = map[byte][]byte{
+	agentAddIdentity:              {agentSuccess},
+	agentRemoveIdentity:           {agentSuccess},
+	agentRemoveAllIdentities:      {agentSuccess},
+	agentAddSmartcardKey:          {agentSuccess},
+	agentRemoveSmartcardKey:       {agentSuccess},
+	agentLock:                     {agentSuccess},
+	agentUnlock:                   {agentSuccess},
+	agentAddIDConstrained:         {agentSuccess},
+	agentAddSmartcardKeyConstrain: {agentSuccess},
+	// The yubiagent client expects "SUCCESS" instead of the protocol number.
+	yubiagentAddHardCert: []byte("SUCCESS"),
+	yubiagentGenerateKey: {agentFailure},
+}
+
+// NewConn returns a connection to the agent at upstream, which does not forward the requests modifying the agent.
+// The returned connection is closed when the upstream connection fails.
+func NewConn(upstream net.Conn) net.Conn {
+	conn, peer := net.Pipe()
+	go serve(peer, upstream)
+	return conn
+}
+
+// serve forwards the requests from c to upstream, except the requests modifying the agent.
+func serve(c io.ReadWriteCloser, upstream io.ReadWriter) {
+	defer c.Close()
+	for {
+		req, err := read(c)
+		if err != nil {
+			return
+		}
+		resp, ok := responses[req[0]]
+		if !ok {
+			if err := write(upstream, req); err != nil {
+				return
+			}
+			if resp, err = read(upstream); err != nil {
+				return
+			}
+		}
+		if err := write(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+func read(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(length[:])
+	if l == 0 || l > maxMessageBytes {
+		return nil, fmt.Errorf("invalid message size %d", l)
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func write(w io.Writer, data []byte) error {
+	msg := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(msg, uint32(len(data)))
+	copy(msg[4:], data)
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package readonly
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestNewConn(t *testing.T) {
+	t.Parallel()
+	keyring := agent.NewKeyring()
+	existing := newKey(t)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: existing, Comment: "existing"}); err != nil {
+		t.Fatal(err)
+	}
+	upstream, peer := net.Pipe()
+	defer upstream.Close()
+	go func() {
+		_ = agent.ServeAgent(keyring, peer)
+	}()
+
+	conn := NewConn(upstream)
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	// The modifications succeed without forwarding to the agent.
+	if err := client.Add(agent.AddedKey{PrivateKey: newKey(t), Comment: "added", LifetimeSecs: 60}); err != nil {
+		t.Errorf("Add() unexpected error: %v", err)
+	}
+	if err := client.RemoveAll(); err != nil {
+		t.Errorf("RemoveAll() unexpected error: %v", err)
+	}
+	if err := client.Lock([]byte("passphrase")); err != nil {
+		t.Errorf("Lock() unexpected error: %v", err)
+	}
+
+	// The reads are forwarded to the agent, which is not modified.
+	keys, err := client.List()
+	if err != nil {
+		t.Fatalf("List() unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "existing" {
+		t.Fatalf("List() got %v, want the existing key only", keys)
+	}
+	pub, err := ssh.NewPublicKey(existing.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := client.Sign(pub, []byte("challenge"))
+	if err != nil {
+		t.Fatalf("Sign() unexpected error: %v", err)
+	}
+	if err := pub.Verify([]byte("challenge"), sig); err != nil {
+		t.Errorf("Verify() unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/keyid"
+	certutil "github.com/theparanoids/ysshra/sshutils/cert"
+	keyutil "github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SignEvent describes a signing request handled by the shim agent.
+type SignEvent struct {
+	// Time is the time the request is received.
+	Time time.Time `json:"time"`
+	// KeyType is the type of the requested key, e.g. "ssh-rsa-cert-v01@openssh.com".
+	KeyType string `json:"key_type"`
+	// Fingerprint is the SHA256 fingerprint of the requested key, or of the key of the requested certificate.
+	Fingerprint string `json:"fingerprint"`
+	// CertType is the type of the YSSHCA certificate, e.g. "TouchSudo". It is empty for other keys.
+	CertType string `json:"cert_type,omitempty"`
+	// KeyID is the key ID of the requested certificate.
+	KeyID string `json:"key_id,omitempty"`
+	// Flags is the signature flags of the request.
+	Flags agent.SignatureFlags `json:"flags,omitempty"`
+	// Bound indicates the connection has been bound to SSH sessions.
+	// The destination is unknown for an unbound connection, e.g. from OpenSSH prior to 8.9.
+	Bound bool `json:"bound"`
+	// DestinationHostKey is the SHA256 fingerprint of the host key of the session the signature is for.
+	// It is empty if the connection is not bound for authentication.
+	DestinationHostKey string `json:"destination_host_key,omitempty"`
+	// SessionID is the hex encoded ID of the last bound session.
+	SessionID string `json:"session_id,omitempty"`
+	// Forwarded indicates the connection is forwarded through another host.
+	Forwarded bool `json:"forwarded"`
+	// Err is the error of the request. It is empty if the data is signed.
+	Err string `json:"error,omitempty"`
+}
+
+// newSignEvent returns the event of signing with key on a connection with the session binds.
+func newSignEvent(key ssh.PublicKey, flags agent.SignatureFlags, binds []SessionBind) *SignEvent {
+	event := &SignEvent{
+		Time:  time.Now(),
+		Flags: flags,
+		Bound: len(binds) != 0,
+	}
+	if key != nil {
+		event.KeyType = key.Type()
+		event.Fingerprint = ssh.FingerprintSHA256(key)
+		if cert, err := keyutil.CastSSHPublicKeyToCertificate(key); err == nil {
+			event.Fingerprint = ssh.FingerprintSHA256(cert.Key)
+			event.KeyID = cert.KeyId
+			event.CertType = certutil.GetType(cert).String()
+		}
+	}
+	event.Forwarded = isForwarded(binds)
+	if hostKey := destination(binds); hostKey != nil {
+		event.DestinationHostKey = ssh.FingerprintSHA256(hostKey)
+	}
+	if len(binds) != 0 {
+		event.SessionID = hex.EncodeToString(binds[len(binds)-1].SessionID)
+	}
+	return event
+}
+
+// hasSSHCACert checks if any of the certificates is issued by YSSHCA.
+func hasSSHCACert(certs []*ssh.Certificate) bool {
+	for _, cert := range certs {
+		if _, err := keyid.Unmarshal(cert.KeyId); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJSONSignAuditor returns a sign auditor which writes each event to w as a line of JSON.
+func NewJSONSignAuditor(w io.Writer) func(SignEvent) {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(event SignEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = encoder.Encode(event)
+	}
+}
+
+// AllowForwardingTo returns a forwarded sign policy, which only allows signing on forwarded connections
+// for the sessions with the given host keys.
+func AllowForwardingTo(hostKeys ...ssh.PublicKey) func(ssh.PublicKey) bool {
+	allowed := make(map[string]struct{}, len(hostKeys))
+	for _, hostKey := range hostKeys {
+		allowed[string(hostKey.Marshal())] = struct{}{}
+	}
+	return func(hostKey ssh.PublicKey) bool {
+		if hostKey == nil {
+			return false
+		}
+		_, ok := allowed[string(hostKey.Marshal())]
+		return ok
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	certutil "github.com/theparanoids/ysshra/sshutils/cert"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultConfirmTimeout is the default time to wait for a confirmation.
+const defaultConfirmTimeout = 30 * time.Second
+
+// defaultConfirmCertTypes are the certificate types requiring confirmation by default,
+// whose private keys are in the agent and thus are never confirmed by a touch.
+var defaultConfirmCertTypes = []certutil.Type{certutil.TouchlessInAgentCert, certutil.TouchlessSudoInAgentCert}
+
+// errConfirmDenied is returned by the built-in confirmers when a signing request is denied.
+var errConfirmDenied = errors.New("denied")
+
+// ConfirmFunc confirms a signing request described by the event before the shim agent signs.
+// It returns nil to approve the request, or an error to deny it.
+// The context is canceled when the confirmation times out.
+type ConfirmFunc func(ctx context.Context, event SignEvent) error
+
+// NewAskpassConfirmer returns a ConfirmFunc which asks the user with an askpass program, e.g. ssh-askpass.
+// As ssh-agent does for keys added with `ssh-add -c`, the program is run with the prompt as its argument
+// and SSH_ASKPASS_PROMPT=confirm in its environment, and the request is approved if it exits successfully.
+func NewAskpassConfirmer(program string) ConfirmFunc {
+	return func(ctx context.Context, event SignEvent) error {
+		cmd := exec.CommandContext(ctx, program, confirmPrompt(event))
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errConfirmDenied
+		}
+		return nil
+	}
+}
+
+// NewListConfirmer returns a ConfirmFunc which decides by lists of SHA256 fingerprints,
+// matching either the key (the key of a certificate) or the destination host key of the request.
+// A request matching deny is denied, otherwise a request matching allow is approved.
+// The other requests are passed to fallback, or denied if fallback is nil.
+func NewListConfirmer(allow, deny []string, fallback ConfirmFunc) ConfirmFunc {
+	toSet := func(fingerprints []string) map[string]struct{} {
+		set := make(map[string]struct{}, len(fingerprints))
+		for _, fp := range fingerprints {
+			set[fp] = struct{}{}
+		}
+		return set
+	}
+	allowed, denied := toSet(allow), toSet(deny)
+	match := func(set map[string]struct{}, event SignEvent) bool {
+		for _, fp := range []string{event.Fingerprint, event.DestinationHostKey} {
+			if _, ok := set[fp]; ok && fp != "" {
+				return true
+			}
+		}
+		return false
+	}
+	return func(ctx context.Context, event SignEvent) error {
+		switch {
+		case match(denied, event):
+			return errConfirmDenied
+		case match(allowed, event):
+			return nil
+		case fallback != nil:
+			return fallback(ctx, event)
+		default:
+			return errConfirmDenied
+		}
+	}
+}
+
+// confirmPrompt returns the message shown to the user to confirm the signing request.
+func confirmPrompt(event SignEvent) string {
+	var b strings.Builder
+	b.WriteString("Allow use of key ")
+	b.WriteString(event.Fingerprint)
+	if event.CertType != "" {
+		fmt.Fprintf(&b, " (%s certificate)", event.CertType)
+	}
+	if event.DestinationHostKey != "" {
+		fmt.Fprintf(&b, " to authenticate to host %s", event.DestinationHostKey)
+	}
+	if event.Forwarded {
+		b.WriteString(" through a forwarded agent")
+	}
+	b.WriteString("?")
+	return b.String()
+}
+
+// requiresConfirmation checks if any of the certificates signing the request is of the types requiring confirmation.
+func (s *Server) requiresConfirmation(certs []*ssh.Certificate) bool {
+	if s.confirm == nil {
+		return false
+	}
+	for _, cert := range certs {
+		certType := certutil.GetType(cert)
+		for _, t := range s.confirmCertTypes {
+			if t == certType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// confirmSign asks the confirmation of the signing request described by the event.
+func (s *Server) confirmSign(event SignEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.confirmTimeout)
+	defer cancel()
+	if err := s.confirm(ctx, event); err != nil {
+		return fmt.Errorf("agent: signing is not confirmed: %v", err)
+	}
+	return nil
+}
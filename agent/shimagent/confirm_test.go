@@ -0,0 +1,242 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+func TestNewListConfirmer(t *testing.T) {
+	t.Parallel()
+	approve := func(ctx context.Context, event SignEvent) error { return nil }
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		fallback ConfirmFunc
+		event    SignEvent
+		wantErr  bool
+	}{
+		{name: "allowed key", allow: []string{"SHA256:key"}, event: SignEvent{Fingerprint: "SHA256:key"}},
+		{name: "allowed host", allow: []string{"SHA256:host"}, event: SignEvent{Fingerprint: "SHA256:key", DestinationHostKey: "SHA256:host"}},
+		{
+			name:    "denied host",
+			allow:   []string{"SHA256:key"},
+			deny:    []string{"SHA256:host"},
+			event:   SignEvent{Fingerprint: "SHA256:key", DestinationHostKey: "SHA256:host"},
+			wantErr: true,
+		},
+		{name: "denied key", deny: []string{"SHA256:key"}, fallback: approve, event: SignEvent{Fingerprint: "SHA256:key"}, wantErr: true},
+		{name: "unlisted without fallback", allow: []string{"SHA256:host"}, event: SignEvent{Fingerprint: "SHA256:key"}, wantErr: true},
+		{name: "unlisted with fallback", allow: []string{"SHA256:host"}, fallback: approve, event: SignEvent{Fingerprint: "SHA256:key"}},
+		{name: "empty entry", allow: []string{""}, event: SignEvent{Fingerprint: "SHA256:key"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := NewListConfirmer(tt.allow, tt.deny, tt.fallback)(context.Background(), tt.event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("confirm error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeAskpass writes an askpass program running the script.
+func writeAskpass(t *testing.T, script string) string {
+	t.Helper()
+	program := path.Join(t.TempDir(), "askpass")
+	if err := os.WriteFile(program, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func TestNewAskpassConfirmer(t *testing.T) {
+	t.Parallel()
+	event := SignEvent{Fingerprint: "SHA256:key", CertType: "TouchlessInAgent", DestinationHostKey: "SHA256:host"}
+	tests := []struct {
+		name        string
+		script      string
+		timeout     time.Duration
+		wantErr     bool
+		wantTimeout bool
+	}{
+		{name: "approved", script: `[ "$SSH_ASKPASS_PROMPT" = confirm ] && [ "$1" = "` + confirmPrompt(event) + `" ]`},
+		{name: "denied", script: "exit 1", wantErr: true},
+		{name: "timeout", script: "exec sleep 10", timeout: 100 * time.Millisecond, wantErr: true, wantTimeout: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			err := NewAskpassConfirmer(writeAskpass(t, tt.script))(ctx, event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("confirm error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, context.DeadlineExceeded) != tt.wantTimeout {
+				t.Errorf("confirm error = %v, wantTimeout %v", err, tt.wantTimeout)
+			}
+		})
+	}
+
+	if err := NewAskpassConfirmer(path.Join(t.TempDir(), "nonexistent"))(context.Background(), event); err == nil {
+		t.Error("expect error for nonexistent askpass program")
+	}
+}
+
+func TestConfirmPrompt(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		event SignEvent
+		want  string
+	}{
+		{name: "plain key", event: SignEvent{Fingerprint: "SHA256:key"}, want: "Allow use of key SHA256:key?"},
+		{
+			name:  "forwarded certificate",
+			event: SignEvent{Fingerprint: "SHA256:key", CertType: "TouchlessInAgent", DestinationHostKey: "SHA256:host", Forwarded: true},
+			want:  "Allow use of key SHA256:key (TouchlessInAgent certificate) to authenticate to host SHA256:host through a forwarded agent?",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := confirmPrompt(tt.event); got != tt.want {
+				t.Errorf("confirmPrompt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_SignConfirm(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	priv, keyInAgent, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert := func(keyID string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:         signer.PublicKey(),
+			KeyId:       keyID,
+			ValidAfter:  uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore: uint64(now.Add(time.Hour).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	certInAgent := newCert(`{"prins":[],"transID":"a7af667d","reqUser":"","reqIP":"","reqHost":"","isFirefighter":true,"isHWKey":false,"isHeadless":false,"isNonce":false,"touchPolicy":1,"ver":1}`)
+	certTouch := newCert(`{"prins":[],"transID":"a7af667d","reqUser":"","reqIP":"","reqHost":"","isFirefighter":false,"isHWKey":true,"isHeadless":false,"isNonce":false,"touchPolicy":2,"ver":1}`)
+
+	deny := func(ctx context.Context, event SignEvent) error { return errors.New("denied by test") }
+	block := func(ctx context.Context, event SignEvent) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tests := []struct {
+		name string
+		opt  Option
+		cert *ssh.Certificate
+		// signBare signs with the underlying key of cert instead of cert.
+		signBare bool
+		// locked locks the agent before signing.
+		locked      bool
+		wantErr     bool
+		wantConfirm bool
+	}{
+		{name: "no confirmer", cert: certInAgent},
+		{name: "in-agent cert denied", opt: Option{Confirm: deny}, cert: certInAgent, wantErr: true, wantConfirm: true},
+		{name: "touch cert not confirmed", opt: Option{Confirm: deny}, cert: certTouch},
+		{name: "selected cert type denied", opt: Option{Confirm: deny, ConfirmCertTypes: defaultConfirmCertTypes[:1]}, cert: certInAgent, wantErr: true, wantConfirm: true},
+		{name: "timeout", opt: Option{Confirm: block, ConfirmTimeout: 100 * time.Millisecond}, cert: certInAgent, wantErr: true, wantConfirm: true},
+		{name: "approved", opt: Option{Confirm: NewListConfirmer([]string{ssh.FingerprintSHA256(keyInAgent)}, nil, nil)}, cert: certInAgent, wantConfirm: true},
+		{name: "underlying key of in-agent cert denied", opt: Option{Confirm: deny}, cert: certInAgent, signBare: true, wantErr: true, wantConfirm: true},
+		{name: "underlying key of touch cert not confirmed", opt: Option{Confirm: deny}, cert: certTouch, signBare: true},
+		{name: "locked agent not confirmed", opt: Option{Confirm: deny}, cert: certInAgent, locked: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			keyring, address := newTestUpstream(t)
+			if err := keyring.Add(ag.AddedKey{PrivateKey: priv}); err != nil {
+				t.Fatal(err)
+			}
+			confirmed := false
+			opt := tt.opt
+			opt.Address = address
+			if confirm := opt.Confirm; confirm != nil {
+				opt.Confirm = func(ctx context.Context, event SignEvent) error {
+					confirmed = true
+					return confirm(ctx, event)
+				}
+			}
+			s, err := New(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if err := s.AddHardCert(tt.cert, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.locked {
+				if err := s.Lock([]byte("passphrase")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data := []byte("data")
+			var key ssh.PublicKey = tt.cert
+			if tt.signBare {
+				key = tt.cert.Key
+			}
+			sig, err := s.Sign(key, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			wantMsg := "not confirmed"
+			if tt.locked {
+				wantMsg = "locked"
+			}
+			if err != nil && !strings.Contains(err.Error(), wantMsg) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil {
+				if err := keyInAgent.Verify(data, sig); err != nil {
+					t.Errorf("failed to verify signature: %v", err)
+				}
+			}
+			if confirmed != tt.wantConfirm {
+				t.Errorf("confirmed = %v, want %v", confirmed, tt.wantConfirm)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The message types of the operations done by the shim agent, the same as the ssh agent protocol numbers in message.go.
+const (
+	msgSignRequest         = 13
+	msgRequestIdentities   = 11
+	msgAddIdentity         = 17
+	msgRemoveIdentity      = 18
+	msgRemoveAllIdentities = 19
+	msgLock                = 22
+	msgUnlock              = 23
+	msgAddIDConstrained    = 25
+	msgExtension           = 27
+	msgAddHardCert         = 31
+)
+
+// subscriberBufferSize is the number of events buffered for a subscriber.
+// Events are dropped for a subscriber whose buffer is full.
+const subscriberBufferSize = 16
+
+// Event describes an operation done by the shim agent.
+type Event struct {
+	// Type is the message type of the operation, defined in message.go.
+	Type byte
+	// Time is the time when the operation is done.
+	Time time.Time
+	// Key is the key added, removed or used by the operation. It is nil if the operation is not about a key.
+	Key ssh.PublicKey
+	// Session identifies the connection requesting the operation.
+	// It is 0 if the operation is not requested through a Session, e.g. it is called on the Server directly.
+	Session uint64
+	// Err is the error of the operation, or nil if the operation succeeded.
+	Err error
+}
+
+// subscriber receives the events of the message types.
+type subscriber struct {
+	// types are the message types to receive. All the events are received if it is empty.
+	types map[byte]struct{}
+	ch    chan Event
+}
+
+// eventBus delivers the events to the subscribers.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// Subscribe returns a channel receiving the events of the operations of msgTypes, or of all operations if msgTypes is empty.
+// The channel is closed after ctx is done. The events are dropped if the channel is not drained in time.
+func (s *Server) Subscribe(ctx context.Context, msgTypes ...byte) <-chan Event {
+	sub := &subscriber{
+		types: make(map[byte]struct{}, len(msgTypes)),
+		ch:    make(chan Event, subscriberBufferSize),
+	}
+	for _, msgType := range msgTypes {
+		sub.types[msgType] = struct{}{}
+	}
+
+	bus := &s.events
+	bus.mu.Lock()
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[*subscriber]struct{})
+	}
+	bus.subscribers[sub] = struct{}{}
+	bus.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		bus.mu.Lock()
+		delete(bus.subscribers, sub)
+		close(sub.ch)
+		bus.mu.Unlock()
+	}()
+	return sub.ch
+}
+
+// publish sends the event to the subscribers of its message type.
+func (s *Server) publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus := &s.events
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for sub := range bus.subscribers {
+		if _, ok := sub.types[event.Type]; !ok && len(sub.types) != 0 {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+		}
+	}
+}
+
+// Broadcast notifies the subscribers that an operation is done, for the operations not done by the Server,
+// e.g. the YubiKey operations of yubiagent.
+// The value of msg is defined in message.go.
+func (s *Server) Broadcast(msg byte) error {
+	s.publish(Event{Type: msg})
+	return nil
+}
+
+// Wait gets blocked until a specific operation is done.
+// The value of msg is defined in message.go.
+func (s *Server) Wait(msg byte) error {
+	return s.WaitContext(context.Background(), msg)
+}
+
+// WaitContext gets blocked until a specific operation is done, or ctx is done.
+// The value of msg is defined in message.go.
+func (s *Server) WaitContext(ctx context.Context, msg byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, ok := <-s.Subscribe(ctx, msg); !ok {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// addedKeyMessage returns the message type of adding the key.
+func addedKeyMessage(key agent.AddedKey) byte {
+	if key.LifetimeSecs != 0 || key.ConfirmBeforeUse || len(key.ConstraintExtensions) != 0 {
+		return msgAddIDConstrained
+	}
+	return msgAddIdentity
+}
+
+// addedPublicKey returns the public key of the added key, or nil if the key is invalid.
+func addedPublicKey(key agent.AddedKey) ssh.PublicKey {
+	if key.Certificate != nil {
+		return key.Certificate
+	}
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil
+	}
+	return signer.PublicKey()
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+// receiveEvent receives an event from the channel within a second.
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("the event channel is closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event is received")
+	}
+	return Event{}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	t.Parallel()
+	priv, pub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, false).(*Server)
+	t.Cleanup(func() { s.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keyEvents := s.Subscribe(ctx, msgAddIdentity, msgRemoveIdentity)
+	allEvents := s.Subscribe(ctx)
+
+	session := s.NewSession()
+	if session.ID() == 0 || session.ID() == s.NewSession().ID() {
+		t.Errorf("session ID %d is not unique", session.ID())
+	}
+	if err := session.Add(ag.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(pub); err == nil {
+		t.Fatal("expect error to remove a removed key")
+	}
+
+	tests := []struct {
+		msgType     byte
+		wantSession uint64
+		wantErr     bool
+	}{
+		{msgType: msgAddIdentity, wantSession: session.ID()},
+		{msgType: msgRemoveIdentity},
+		{msgType: msgRemoveIdentity, wantErr: true},
+	}
+	for _, tt := range tests {
+		event := receiveEvent(t, keyEvents)
+		if event.Type != tt.msgType || event.Session != tt.wantSession || (event.Err != nil) != tt.wantErr ||
+			event.Key == nil || !bytes.Equal(event.Key.Marshal(), pub.Marshal()) || event.Time.IsZero() {
+			t.Errorf("unexpected event %+v, want type %d, session %d, wantErr %v", event, tt.msgType, tt.wantSession, tt.wantErr)
+		}
+	}
+	for _, msgType := range []byte{msgAddIdentity, msgRequestIdentities, msgRemoveIdentity, msgRemoveIdentity} {
+		if event := receiveEvent(t, allEvents); event.Type != msgType {
+			t.Errorf("got event of type %d, want %d", event.Type, msgType)
+		}
+	}
+
+	cancel()
+	for _, events := range []<-chan Event{keyEvents, allEvents} {
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Error("unexpected event after the subscription is canceled")
+			}
+		case <-time.After(time.Second):
+			t.Error("the event channel is not closed after the subscription is canceled")
+		}
+	}
+}
+
+func TestServer_Wait(t *testing.T) {
+	t.Parallel()
+	s := testServer(t, false).(*Server)
+	t.Cleanup(func() { s.Close() })
+
+	// Wait is not blocked by other operations, and any message type can be waited for.
+	const msgListSlots = 200
+	var wg sync.WaitGroup
+	for _, msg := range []byte{msgRequestIdentities, msgListSlots} {
+		msg := msg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Wait(msg); err != nil {
+				t.Errorf("Wait(%d) unexpected error: %v", msg, err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Keep notifying until the waiters, which may subscribe late, are done.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			if err := s.RemoveAll(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.List(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Broadcast(msgListSlots); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("Wait() is not unblocked")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitContext(ctx, msgLock); err != context.DeadlineExceeded {
+		t.Errorf("WaitContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"errors"
+	"time"
+
+	"github.com/theparanoids/ysshra/internal/backoff"
+)
+
+// defaultUnlockLockoutMax is the default upper bound of the lockout after failed Unlock calls.
+const defaultUnlockLockoutMax = 10 * time.Minute
+
+// errUnlockLockedOut is returned by Unlock during the lockout after failed Unlock calls.
+var errUnlockLockedOut = errors.New("agent: too many failed unlock attempts, try again later")
+
+// LockReason is the reason why the agent is locked.
+type LockReason string
+
+const (
+	// LockReasonRequest indicates the agent is locked by a Lock call, e.g. `ssh-add -x`.
+	LockReasonRequest LockReason = "request"
+	// LockReasonIdle indicates the agent is locked after being idle for Option.IdleLockTimeout.
+	LockReasonIdle LockReason = "idle"
+)
+
+// LockEvent describes the agent being locked.
+type LockEvent struct {
+	// Time is the time when the agent is locked.
+	Time time.Time `json:"time"`
+	// Reason is the reason why the agent is locked.
+	Reason LockReason `json:"reason"`
+}
+
+// touch records an activity of the agent, which postpones the idle lock.
+// The caller must hold the mutex before calling this method.
+func (s *Server) touch() {
+	s.lastActive = time.Now()
+}
+
+// startIdleLock schedules the idle lock in d if the idle lock is enabled.
+// The caller must hold the mutex before calling this method.
+func (s *Server) startIdleLock(d time.Duration) {
+	if s.idleLockTimeout <= 0 || s.closed {
+		return
+	}
+	if s.idleTimer == nil {
+		s.idleTimer = time.AfterFunc(d, s.idleLock)
+		return
+	}
+	s.idleTimer.Reset(d)
+}
+
+// idleLock locks the agent if it has been idle for the idle lock timeout,
+// otherwise it reschedules itself for the remaining time.
+func (s *Server) idleLock() {
+	s.mu.Lock()
+	if s.locked || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if idle := time.Since(s.lastActive); idle < s.idleLockTimeout {
+		s.startIdleLock(s.idleLockTimeout - idle)
+		s.mu.Unlock()
+		return
+	}
+	if err := s.agent.Lock(s.idleLockPassphrase); err != nil {
+		// Retry later, e.g. the underlying agent is temporarily unavailable.
+		s.startIdleLock(s.idleLockTimeout)
+		s.mu.Unlock()
+		return
+	}
+	s.locked = true
+	s.mu.Unlock()
+
+	s.publish(Event{Type: msgLock})
+	s.notifyLock(LockReasonIdle)
+}
+
+// notifyLock calls the lock hook with the event of the agent being locked for the reason.
+func (s *Server) notifyLock(reason LockReason) {
+	if s.lockHook != nil {
+		s.lockHook(LockEvent{Time: time.Now(), Reason: reason})
+	}
+}
+
+// checkUnlockLockout returns errUnlockLockedOut if Unlock is refused by the lockout.
+// The caller must hold the mutex before calling this method.
+func (s *Server) checkUnlockLockout() error {
+	if s.unlockBackoff == nil || s.unlockFailures == 0 {
+		return nil
+	}
+	if time.Now().Before(s.unlockNotBefore) {
+		return errUnlockLockedOut
+	}
+	return nil
+}
+
+// recordUnlock updates the lockout with the result of an Unlock call.
+// Each consecutive failure extends the lockout exponentially, and a success resets it.
+// The caller must hold the mutex before calling this method.
+func (s *Server) recordUnlock(success bool) {
+	if s.unlockBackoff == nil {
+		return
+	}
+	if success {
+		s.unlockFailures = 0
+		return
+	}
+	s.unlockNotBefore = time.Now().Add(s.unlockBackoff.Backoff(s.unlockFailures))
+	s.unlockFailures++
+}
+
+// newUnlockBackoff returns the backoff configuration of the lockout after failed Unlock calls,
+// or nil if the lockout is disabled.
+func newUnlockBackoff(base, max time.Duration) *backoff.Config {
+	if base <= 0 {
+		return nil
+	}
+	if max <= 0 {
+		max = defaultUnlockLockoutMax
+	}
+	return &backoff.Config{
+		BaseDelay:  base,
+		Multiplier: 2,
+		MaxDelay:   max,
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"testing"
+	"time"
+
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+// waitLockEvent waits for an event from the lock hook.
+func waitLockEvent(t *testing.T, events <-chan LockEvent, timeout time.Duration) (LockEvent, bool) {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event, true
+	case <-time.After(timeout):
+		return LockEvent{}, false
+	}
+}
+
+func TestNew_IdleLockPassphrase(t *testing.T) {
+	t.Parallel()
+	_, address := newTestUpstream(t)
+	// An idle lock with an empty passphrase is undone by `ssh-add -X`.
+	if _, err := New(Option{Address: address, IdleLockTimeout: time.Minute}); err == nil {
+		t.Error("expect error for an idle lock without passphrase")
+	}
+	s, err := New(Option{Address: address, IdleLockTimeout: time.Minute, IdleLockPassphrase: []byte("passphrase")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestServer_IdleLock(t *testing.T) {
+	t.Parallel()
+	priv, _, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, address := newTestUpstream(t)
+	if err := keyring.Add(ag.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = 200 * time.Millisecond
+	events := make(chan LockEvent, 2)
+	s, err := New(Option{
+		Address:            address,
+		IdleLockTimeout:    timeout,
+		IdleLockPassphrase: []byte("passphrase"),
+		LockHook:           func(event LockEvent) { events <- event },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Unlock([]byte("passphrase"))
+		s.Close()
+	})
+
+	// Activities postpone the idle lock.
+	for i := 0; i < 4; i++ {
+		time.Sleep(timeout / 2)
+		if keys, err := s.List(); err != nil || len(keys) != 1 {
+			t.Fatalf("List() = %v, %v, want 1 key while active", keys, err)
+		}
+	}
+	if event, ok := waitLockEvent(t, events, 0); ok {
+		t.Fatalf("unexpected lock event while active: %+v", event)
+	}
+
+	event, ok := waitLockEvent(t, events, 5*timeout)
+	if !ok {
+		t.Fatal("the agent is not locked after being idle")
+	}
+	if event.Reason != LockReasonIdle {
+		t.Errorf("lock event reason = %v, want %v", event.Reason, LockReasonIdle)
+	}
+	if keys, err := s.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List() = %v, %v, want no keys after idle lock", keys, err)
+	}
+	// The underlying agent is locked as well.
+	if keys, err := keyring.List(); err != nil || len(keys) != 0 {
+		t.Errorf("upstream List() = %v, %v, want no keys after idle lock", keys, err)
+	}
+
+	if err := s.Unlock([]byte("wrong")); err == nil {
+		t.Error("expect error for wrong passphrase")
+	}
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatalf("Unlock() unexpected error: %v", err)
+	}
+	if keys, err := s.List(); err != nil || len(keys) != 1 {
+		t.Errorf("List() = %v, %v, want 1 key after unlock", keys, err)
+	}
+
+	// The idle lock is rescheduled after unlock.
+	if _, ok := waitLockEvent(t, events, 5*timeout); !ok {
+		t.Error("the agent is not locked again after being idle")
+	}
+}
+
+func TestServer_LockHook(t *testing.T) {
+	t.Parallel()
+	_, address := newTestUpstream(t)
+	events := make(chan LockEvent, 1)
+	s, err := New(Option{Address: address, LockHook: func(event LockEvent) { events <- event }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	event, ok := waitLockEvent(t, events, time.Second)
+	if !ok || event.Reason != LockReasonRequest || event.Time.IsZero() {
+		t.Errorf("unexpected lock event %+v, received %v", event, ok)
+	}
+	// Locking a locked agent does not emit an event.
+	if err := s.Lock([]byte("passphrase")); err == nil {
+		t.Error("expect error to lock a locked agent")
+	}
+	if event, ok := waitLockEvent(t, events, 0); ok {
+		t.Errorf("unexpected lock event %+v", event)
+	}
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_UnlockLockout(t *testing.T) {
+	t.Parallel()
+	_, address := newTestUpstream(t)
+	const base = 200 * time.Millisecond
+	s, err := New(Option{Address: address, UnlockLockoutBase: base, UnlockLockoutMax: 3 * base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lockout grows with consecutive failures: base, 2*base, then capped by the max.
+	for _, lockout := range []time.Duration{base, 2 * base, 3 * base} {
+		if err := s.Unlock([]byte("wrong")); err == nil || err == errUnlockLockedOut {
+			t.Fatalf("Unlock() error = %v, want incorrect passphrase", err)
+		}
+		if err := s.Unlock([]byte("passphrase")); err != errUnlockLockedOut {
+			t.Fatalf("Unlock() error = %v, want %v", err, errUnlockLockedOut)
+		}
+		time.Sleep(lockout / 2)
+		if err := s.Unlock([]byte("passphrase")); err != errUnlockLockedOut {
+			t.Fatalf("Unlock() error = %v, want %v within the lockout of %v", err, errUnlockLockedOut, lockout)
+		}
+		time.Sleep(lockout/2 + base/4)
+	}
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatalf("Unlock() unexpected error after the lockout: %v", err)
+	}
+
+	// A successful unlock resets the lockout.
+	srv := s.(*Server)
+	srv.mu.Lock()
+	failures := srv.unlockFailures
+	srv.mu.Unlock()
+	if failures != 0 {
+		t.Errorf("unlockFailures = %v, want 0 after a successful unlock", failures)
+	}
+}
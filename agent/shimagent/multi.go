@@ -0,0 +1,171 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// multiAgent multiplexes several underlying agents, e.g. the system ssh-agent and a hardware token agent.
+// The first agent is the primary agent, which receives the added keys.
+// A key held by more than one agent is listed once, and is used through the first agent holding it.
+type multiAgent struct {
+	agents []agent.ExtendedAgent
+}
+
+// newMultiAgent returns an agent multiplexing the agents, with the first one as the primary agent.
+func newMultiAgent(agents []agent.ExtendedAgent) agent.ExtendedAgent {
+	if len(agents) == 1 {
+		return agents[0]
+	}
+	return &multiAgent{agents: agents}
+}
+
+// List returns the identities known to all the agents, without duplicates.
+func (m *multiAgent) List() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	seen := make(map[hashcode]struct{})
+	for _, a := range m.agents {
+		agentKeys, err := a.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range agentKeys {
+			h := hash(key.Marshal())
+			if _, ok := seen[h]; ok {
+				continue
+			}
+			seen[h] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// holder returns the first agent holding the key.
+func (m *multiAgent) holder(key ssh.PublicKey) (agent.ExtendedAgent, error) {
+	h := hash(key.Marshal())
+	for _, a := range m.agents {
+		keys, err := a.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if hash(k.Marshal()) == h {
+				return a, nil
+			}
+		}
+	}
+	return nil, errAgentNotFoundKey
+}
+
+// Sign signs the data with the agent holding the key.
+func (m *multiAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return m.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs the data with the agent holding the key.
+func (m *multiAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a, err := m.holder(key)
+	if err != nil {
+		return nil, err
+	}
+	return a.SignWithFlags(key, data, flags)
+}
+
+// Add adds the key to the primary agent.
+func (m *multiAgent) Add(key agent.AddedKey) error {
+	return m.agents[0].Add(key)
+}
+
+// Remove removes the key from all the agents holding it.
+// It fails only if none of the agents removes the key.
+func (m *multiAgent) Remove(key ssh.PublicKey) error {
+	var firstErr error
+	removed := false
+	for _, a := range m.agents {
+		if err := a.Remove(key); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		removed = true
+	}
+	if removed {
+		return nil
+	}
+	return firstErr
+}
+
+// RemoveAll removes all the keys from all the agents.
+func (m *multiAgent) RemoveAll() error {
+	var firstErr error
+	for _, a := range m.agents {
+		if err := a.RemoveAll(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Lock locks all the agents. If any agent fails, the agents already locked are unlocked again.
+func (m *multiAgent) Lock(passphrase []byte) error {
+	for i, a := range m.agents {
+		if err := a.Lock(passphrase); err != nil {
+			for _, locked := range m.agents[:i] {
+				_ = locked.Unlock(passphrase)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlock unlocks all the agents. If any agent fails, the agents already unlocked are locked again.
+func (m *multiAgent) Unlock(passphrase []byte) error {
+	for i, a := range m.agents {
+		if err := a.Unlock(passphrase); err != nil {
+			for _, unlocked := range m.agents[:i] {
+				_ = unlocked.Lock(passphrase)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Signers returns the signers of all the agents, without duplicates.
+func (m *multiAgent) Signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	seen := make(map[hashcode]struct{})
+	for _, a := range m.agents {
+		agentSigners, err := a.Signers()
+		if err != nil {
+			return nil, err
+		}
+		for _, signer := range agentSigners {
+			h := hash(signer.PublicKey().Marshal())
+			if _, ok := seen[h]; ok {
+				continue
+			}
+			seen[h] = struct{}{}
+			signers = append(signers, signer)
+		}
+	}
+	return signers, nil
+}
+
+// Extension sends the extension request to the agents in order, until one of them supports it.
+func (m *multiAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	for _, a := range m.agents {
+		resp, err := a.Extension(extensionType, contents)
+		if err == agent.ErrExtensionUnsupported {
+			continue
+		}
+		return resp, err
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+func TestServer_MultipleUpstreams(t *testing.T) {
+	t.Parallel()
+
+	primary, primaryAddress := newTestUpstream(t)
+	secondary, secondaryAddress := newTestUpstream(t)
+
+	sharedPriv, sharedPub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenPriv, tokenPub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyring := range []ag.Agent{primary, secondary} {
+		if err := keyring.Add(ag.AddedKey{PrivateKey: sharedPriv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := secondary.Add(ag.AddedKey{PrivateKey: tokenPriv}); err != nil {
+		t.Fatal(err)
+	}
+	expiredPriv, expiredCert := newTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(-time.Minute))
+	if err := secondary.Add(ag.AddedKey{PrivateKey: expiredPriv, Certificate: expiredCert}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(Option{
+		Address:            primaryAddress,
+		SecondaryAddresses: []string{secondaryAddress},
+		PubKeyComp: func(x, y ssh.PublicKey) bool {
+			return bytes.Compare(x.Marshal(), y.Marshal()) < 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	// The keys are merged without duplicates, and the expired certificate in the secondary agent is removed.
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("List() got %d keys, want 2: %v", len(keys), keys)
+	}
+	if bytes.Compare(keys[0].Marshal(), keys[1].Marshal()) >= 0 {
+		t.Error("List() keys are not ordered by PubKeyComp")
+	}
+	if secondaryKeys, _ := secondary.List(); len(secondaryKeys) != 2 {
+		t.Errorf("the expired certificate is not removed from the secondary agent: %v", secondaryKeys)
+	}
+
+	// Signing requests are routed to the agent holding the key.
+	data := []byte("data")
+	for _, pub := range []ssh.PublicKey{sharedPub, tokenPub} {
+		sig, err := s.Sign(pub, data)
+		if err != nil {
+			t.Fatalf("Sign() unexpected error: %v", err)
+		}
+		if err := pub.Verify(data, sig); err != nil {
+			t.Errorf("failed to verify signature: %v", err)
+		}
+	}
+
+	// Added keys go to the primary agent.
+	addedPriv, addedPub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(ag.AddedKey{PrivateKey: addedPriv}); err != nil {
+		t.Fatal(err)
+	}
+	if primaryKeys, _ := primary.List(); len(primaryKeys) != 2 {
+		t.Errorf("the added key is not in the primary agent: %v", primaryKeys)
+	}
+	if secondaryKeys, _ := secondary.List(); len(secondaryKeys) != 2 {
+		t.Errorf("unexpected keys in the secondary agent: %v", secondaryKeys)
+	}
+
+	// A hard cert of the key in the secondary agent is an orphan once the key is removed.
+	signer, err := ssh.NewSignerFromKey(tokenPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenCert := &ssh.Certificate{
+		Key:         tokenPub,
+		KeyId:       "keyid",
+		ValidAfter:  uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := tokenCert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddHardCert(tokenCert, ""); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := s.Sign(tokenCert, data)
+	if err != nil {
+		t.Fatalf("Sign() unexpected error: %v", err)
+	}
+	if err := tokenPub.Verify(data, sig); err != nil {
+		t.Errorf("failed to verify signature: %v", err)
+	}
+	if err := secondary.Remove(tokenPub); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.List(); len(keys) != 2 {
+		t.Errorf("List() got %v, want the orphan cert removed", keys)
+	}
+
+	// Removing a key held by both agents removes it from both.
+	if err := s.Remove(sharedPub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sign(sharedPub, data); err == nil {
+		t.Error("expect error to sign with the removed key")
+	}
+	if keys, _ := s.List(); len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), addedPub.Marshal()) {
+		t.Errorf("List() got %v, want only the added key", keys)
+	}
+
+	// Lock and unlock apply to all the agents.
+	if err := s.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.Add(ag.AddedKey{PrivateKey: tokenPriv}); err == nil {
+		t.Error("the secondary agent is not locked")
+	}
+	if err := s.Unlock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.Add(ag.AddedKey{PrivateKey: tokenPriv}); err != nil {
+		t.Errorf("the secondary agent is not unlocked: %v", err)
+	}
+}
+
+func TestMultiAgent_LockRollback(t *testing.T) {
+	t.Parallel()
+	primary, secondary := ag.NewKeyring().(ag.ExtendedAgent), ag.NewKeyring().(ag.ExtendedAgent)
+	if err := secondary.Lock([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	m := newMultiAgent([]ag.ExtendedAgent{primary, secondary})
+
+	// Locking fails on the locked secondary agent, and the primary agent is unlocked again.
+	if err := m.Lock([]byte("passphrase")); err == nil {
+		t.Fatal("expect error to lock a locked agent")
+	}
+	if err := primary.Unlock([]byte("passphrase")); err == nil {
+		t.Error("the primary agent is not unlocked after the failed lock")
+	}
+
+	// Unlocking fails on the secondary agent with another passphrase, and the primary agent is locked again.
+	if err := primary.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unlock([]byte("passphrase")); err == nil {
+		t.Fatal("expect error to unlock with a wrong passphrase")
+	}
+	if err := primary.Unlock([]byte("passphrase")); err != nil {
+		t.Errorf("the primary agent is not locked after the failed unlock: %v", err)
+	}
+
+	if _, err := m.Extension("unsupported@example.com", nil); err != ag.ErrExtensionUnsupported {
+		t.Errorf("Extension() error = %v, want %v", err, ag.ErrExtensionUnsupported)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/theparanoids/ysshra/internal/backoff"
+	"github.com/theparanoids/ysshra/keyid"
+	certutil "github.com/theparanoids/ysshra/sshutils/cert"
+	keyutil "github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	defaultRenewLeadTime      = 30 * time.Minute
+	defaultRenewCheckInterval = time.Minute
+	defaultRenewTimeout       = 5 * time.Minute
+	defaultRenewRetryBase     = time.Minute
+	defaultRenewRetryMax      = 30 * time.Minute
+)
+
+// ErrRenewalImpossible is returned (possibly wrapped) by a RenewFunc when the certificate cannot be renewed
+// without the user, e.g. a touch is required. The renewal is not retried.
+var ErrRenewalImpossible = errors.New("renewal requires user action")
+
+// errRenewTouchRequired indicates a certificate cannot be renewed in background, since its key requires a touch.
+var errRenewTouchRequired = fmt.Errorf("%w: the key requires a touch", ErrRenewalImpossible)
+
+// RenewalRequest describes a YSSHCA certificate to be renewed.
+type RenewalRequest struct {
+	// Certificate is the certificate approaching its expiry.
+	Certificate *ssh.Certificate
+	// KeyID is the decoded key ID of the certificate.
+	KeyID *keyid.KeyID
+	// Type is the type of the certificate.
+	Type certutil.Type
+}
+
+// ExpiresAt returns the expiry of the certificate.
+func (r RenewalRequest) ExpiresAt() time.Time {
+	return time.Unix(int64(r.Certificate.ValidBefore), 0)
+}
+
+// RenewFunc renews the certificate in the request, typically by requesting a new certificate
+// which is added to the agent. The context is canceled when the renewal times out.
+type RenewFunc func(ctx context.Context, req RenewalRequest) error
+
+// RenewalStatus is the outcome of a renewal attempt.
+type RenewalStatus string
+
+const (
+	// RenewalSucceeded indicates the certificate is renewed.
+	RenewalSucceeded RenewalStatus = "succeeded"
+	// RenewalRetrying indicates the renewal failed and will be retried.
+	RenewalRetrying RenewalStatus = "retrying"
+	// RenewalImpossible indicates the certificate cannot be renewed in background, and the user needs to renew it.
+	RenewalImpossible RenewalStatus = "impossible"
+)
+
+// RenewalEvent is the notification of a renewal attempt.
+type RenewalEvent struct {
+	// Time is the time of the attempt.
+	Time time.Time `json:"time"`
+	// Status is the outcome of the attempt.
+	Status RenewalStatus `json:"status"`
+	// CertType is the type of the certificate.
+	CertType string `json:"certType"`
+	// Principals are the principals of the certificate.
+	Principals []string `json:"principals"`
+	// ExpiresAt is the expiry of the certificate.
+	ExpiresAt time.Time `json:"expiresAt"`
+	// NextAttempt is the time of the next attempt if the status is RenewalRetrying.
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	// Err is the error of the attempt.
+	Err string `json:"error,omitempty"`
+}
+
+// RenewerOption encapsulates the parameters of NewRenewer.
+type RenewerOption struct {
+	// Renew is called to renew a certificate, e.g. NewRenewCommand.
+	Renew RenewFunc
+	// Notify is called with the outcome of every renewal attempt,
+	// so that the user can be told to renew the certificates which cannot be renewed in background.
+	Notify func(RenewalEvent)
+	// LeadTime is the time before the expiry of a certificate to renew it.
+	// The default value is 30 minutes.
+	LeadTime time.Duration
+	// CheckInterval is the interval to check the certificates in the agent.
+	// The default value is 1 minute.
+	CheckInterval time.Duration
+	// Timeout is the time limit of a renewal attempt.
+	// The default value is 5 minutes.
+	Timeout time.Duration
+	// RetryBaseDelay is the delay before retrying a failed renewal.
+	// It doubles with each consecutive failure up to RetryMaxDelay.
+	// The default value is 1 minute.
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay is the upper bound of the delay before retrying a failed renewal.
+	// The default value is 30 minutes.
+	RetryMaxDelay time.Duration
+}
+
+// renewal is the renewal state of a certificate.
+type renewal struct {
+	// done indicates the certificate is renewed, or cannot be renewed in background.
+	done bool
+	// failures is the number of consecutive failed attempts.
+	failures uint
+	// next is the time of the next attempt.
+	next time.Time
+}
+
+// Renewer renews the YSSHCA certificates in an agent before they expire.
+// The touch-required certificates are not renewed in background; the user is notified to renew them instead.
+type Renewer struct {
+	agent    agent.Agent
+	opt      RenewerOption
+	backoff  backoff.Config
+	renewals map[hashcode]*renewal
+}
+
+// NewRenewer returns a Renewer watching the certificates in the agent, e.g. a shim agent Server.
+func NewRenewer(ag agent.Agent, opt RenewerOption) (*Renewer, error) {
+	if opt.Renew == nil {
+		return nil, errors.New("renew function is required")
+	}
+	if opt.LeadTime <= 0 {
+		opt.LeadTime = defaultRenewLeadTime
+	}
+	if opt.CheckInterval <= 0 {
+		opt.CheckInterval = defaultRenewCheckInterval
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultRenewTimeout
+	}
+	if opt.RetryBaseDelay <= 0 {
+		opt.RetryBaseDelay = defaultRenewRetryBase
+	}
+	if opt.RetryMaxDelay <= 0 {
+		opt.RetryMaxDelay = defaultRenewRetryMax
+	}
+	return &Renewer{
+		agent: ag,
+		opt:   opt,
+		backoff: backoff.Config{
+			BaseDelay:  opt.RetryBaseDelay,
+			Multiplier: 2,
+			MaxDelay:   opt.RetryMaxDelay,
+			Jitter:     0.2,
+		},
+		renewals: make(map[hashcode]*renewal),
+	}, nil
+}
+
+// Run checks the certificates every check interval and renews the ones due, until ctx is canceled.
+func (r *Renewer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.opt.CheckInterval)
+	defer ticker.Stop()
+	for {
+		// Failing to list the certificates, e.g. the agent is locked, is retried on the next check.
+		_ = r.check(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// check renews the certificates due at now.
+func (r *Renewer) check(ctx context.Context, now time.Time) error {
+	keys, err := r.agent.List()
+	if err != nil {
+		return err
+	}
+	var reqs []RenewalRequest
+	for _, key := range keys {
+		cert, err := keyutil.CastSSHPublicKeyToCertificate(key)
+		if err != nil {
+			continue
+		}
+		kid, err := keyid.Unmarshal(cert.KeyId)
+		if err != nil {
+			// Only YSSHCA certificates are renewed.
+			continue
+		}
+		certType := certutil.GetType(cert)
+		if certType == certutil.NonceCert {
+			continue
+		}
+		reqs = append(reqs, RenewalRequest{Certificate: cert, KeyID: kid, Type: certType})
+	}
+
+	present := make(map[hashcode]struct{}, len(reqs))
+	for _, req := range reqs {
+		h := hash(req.Certificate.Marshal())
+		present[h] = struct{}{}
+		if !r.due(req, reqs, now) {
+			continue
+		}
+		state, ok := r.renewals[h]
+		if !ok {
+			state = &renewal{}
+			r.renewals[h] = state
+		}
+		if state.done || now.Before(state.next) {
+			continue
+		}
+		r.renew(ctx, req, state, now)
+	}
+	// Forget the certificates removed from the agent.
+	for h := range r.renewals {
+		if _, ok := present[h]; !ok {
+			delete(r.renewals, h)
+		}
+	}
+	return nil
+}
+
+// due checks if the certificate in req is within the lead time of its expiry,
+// and there is no other certificate for the same principals outliving the lead time, e.g. a renewed one.
+func (r *Renewer) due(req RenewalRequest, reqs []RenewalRequest, now time.Time) bool {
+	if now.Before(req.ExpiresAt().Add(-r.opt.LeadTime)) || !now.Before(req.ExpiresAt()) {
+		return false
+	}
+	for _, other := range reqs {
+		if other.Type == req.Type && equalPrincipals(other.KeyID.Principals, req.KeyID.Principals) &&
+			now.Before(other.ExpiresAt().Add(-r.opt.LeadTime)) {
+			return false
+		}
+	}
+	return true
+}
+
+// renew attempts to renew the certificate in req, and updates its renewal state.
+func (r *Renewer) renew(ctx context.Context, req RenewalRequest, state *renewal, now time.Time) {
+	var err error
+	if req.KeyID.TouchPolicy == keyid.AlwaysTouch || req.KeyID.TouchPolicy == keyid.CachedTouch {
+		err = errRenewTouchRequired
+	} else {
+		renewCtx, cancel := context.WithTimeout(ctx, r.opt.Timeout)
+		err = r.opt.Renew(renewCtx, req)
+		cancel()
+	}
+
+	event := RenewalEvent{
+		Time:       now,
+		Status:     RenewalSucceeded,
+		CertType:   req.Type.String(),
+		Principals: req.KeyID.Principals,
+		ExpiresAt:  req.ExpiresAt(),
+	}
+	switch {
+	case err == nil:
+		state.done = true
+	case errors.Is(err, ErrRenewalImpossible):
+		state.done = true
+		event.Status = RenewalImpossible
+	default:
+		state.next = now.Add(r.backoff.Backoff(state.failures))
+		state.failures++
+		event.Status = RenewalRetrying
+		if !state.next.Before(event.ExpiresAt) {
+			// The certificate expires before the next attempt.
+			state.done = true
+			event.Status = RenewalImpossible
+		} else {
+			event.NextAttempt = state.next
+		}
+	}
+	if err != nil {
+		event.Err = err.Error()
+	}
+	if r.opt.Notify != nil {
+		r.opt.Notify(event)
+	}
+}
+
+// equalPrincipals checks if two lists of principals are the same.
+func equalPrincipals(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRenewCommand returns a RenewFunc running a command, e.g. an ssh command to the gensign server with agent forwarding.
+// The certificate to renew is described to the command by the environment variables
+// YSSHRA_RENEW_CERT_TYPE, YSSHRA_RENEW_PRINCIPALS (comma separated) and YSSHRA_RENEW_EXPIRES_AT (RFC 3339).
+func NewRenewCommand(name string, args ...string) RenewFunc {
+	return func(ctx context.Context, req RenewalRequest) error {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = append(os.Environ(),
+			"YSSHRA_RENEW_CERT_TYPE="+req.Type.String(),
+			"YSSHRA_RENEW_PRINCIPALS="+strings.Join(req.KeyID.Principals, ","),
+			"YSSHRA_RENEW_EXPIRES_AT="+req.ExpiresAt().Format(time.RFC3339),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("renew command failed: %v, output: %q", err, out)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/keyid"
+	certutil "github.com/theparanoids/ysshra/sshutils/cert"
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+// addRenewalTestCert adds a certificate with the key ID to the keyring, which expires at validBefore.
+func addRenewalTestCert(t *testing.T, keyring ag.Agent, kid *keyid.KeyID, validBefore time.Time) *ssh.Certificate {
+	t.Helper()
+	priv, _, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := "not-a-ysshca-keyid"
+	if kid != nil {
+		if keyID, err = kid.Marshal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		KeyId:       keyID,
+		ValidAfter:  uint64(validBefore.Add(-24 * time.Hour).Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(ag.AddedKey{PrivateKey: priv, Certificate: cert}); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newRenewalTestKeyID(principal string, touchPolicy keyid.TouchPolicy) *keyid.KeyID {
+	return &keyid.KeyID{
+		Principals:  []string{principal},
+		TransID:     "a7af667d",
+		Version:     keyid.DefaultVersion,
+		IsHWKey:     true,
+		TouchPolicy: touchPolicy,
+	}
+}
+
+func TestRenewer_check(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Truncate(time.Second)
+	errRenew := errors.New("gensign unavailable")
+
+	tests := []struct {
+		name string
+		// setup adds the certificates to the keyring.
+		setup func(t *testing.T, keyring ag.Agent)
+		// renewErrs are the results of the consecutive renew calls.
+		renewErrs []error
+		// checks are the offsets from now of the consecutive checks.
+		checks     []time.Duration
+		wantRenews int
+		wantEvents []RenewalStatus
+	}{
+		{
+			name: "not due",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(2*time.Hour))
+			},
+			checks: []time.Duration{0},
+		},
+		{
+			name: "renewed once",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(10*time.Minute))
+			},
+			renewErrs:  []error{nil},
+			checks:     []time.Duration{0, time.Minute},
+			wantRenews: 1,
+			wantEvents: []RenewalStatus{RenewalSucceeded},
+		},
+		{
+			name: "retried with backoff",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(14*time.Minute))
+			},
+			renewErrs: []error{errRenew, nil},
+			// The first retry is scheduled in 1 minute with jitter, so it is not due after 30 seconds.
+			checks:     []time.Duration{0, 30 * time.Second, 2 * time.Minute},
+			wantRenews: 2,
+			wantEvents: []RenewalStatus{RenewalRetrying, RenewalSucceeded},
+		},
+		{
+			name: "expires before retry",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(30*time.Second))
+			},
+			renewErrs:  []error{errRenew},
+			checks:     []time.Duration{0, 20 * time.Second},
+			wantRenews: 1,
+			wantEvents: []RenewalStatus{RenewalImpossible},
+		},
+		{
+			name: "touch required",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.AlwaysTouch), now.Add(10*time.Minute))
+			},
+			checks:     []time.Duration{0, time.Minute},
+			wantEvents: []RenewalStatus{RenewalImpossible},
+		},
+		{
+			name: "impossible by renew function",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(10*time.Minute))
+			},
+			renewErrs:  []error{fmt.Errorf("no agent forwarding: %w", ErrRenewalImpossible)},
+			checks:     []time.Duration{0, time.Minute},
+			wantRenews: 1,
+			wantEvents: []RenewalStatus{RenewalImpossible},
+		},
+		{
+			name: "already renewed",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(10*time.Minute))
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(10*time.Hour))
+			},
+			checks: []time.Duration{0},
+		},
+		{
+			name: "other principals",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(10*time.Minute))
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("bob", keyid.NeverTouch), now.Add(10*time.Hour))
+			},
+			renewErrs:  []error{nil},
+			checks:     []time.Duration{0},
+			wantRenews: 1,
+			wantEvents: []RenewalStatus{RenewalSucceeded},
+		},
+		{
+			name: "not YSSHCA certificate",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, nil, now.Add(10*time.Minute))
+			},
+			checks: []time.Duration{0},
+		},
+		{
+			name: "expired",
+			setup: func(t *testing.T, keyring ag.Agent) {
+				addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), now.Add(-time.Minute))
+			},
+			checks: []time.Duration{0},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			keyring := ag.NewKeyring()
+			tt.setup(t, keyring)
+
+			renews := 0
+			var events []RenewalStatus
+			r, err := NewRenewer(keyring, RenewerOption{
+				Renew: func(ctx context.Context, req RenewalRequest) error {
+					if req.Type != certutil.TouchlessCert || len(req.KeyID.Principals) != 1 {
+						t.Errorf("unexpected renewal request %+v", req)
+					}
+					renews++
+					if renews > len(tt.renewErrs) {
+						t.Fatalf("unexpected renew call #%d", renews)
+					}
+					return tt.renewErrs[renews-1]
+				},
+				Notify:   func(event RenewalEvent) { events = append(events, event.Status) },
+				LeadTime: 15 * time.Minute,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, offset := range tt.checks {
+				if err := r.check(context.Background(), now.Add(offset)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if renews != tt.wantRenews {
+				t.Errorf("got %d renew calls, want %d", renews, tt.wantRenews)
+			}
+			if strings.Join(statusStrings(events), ",") != strings.Join(statusStrings(tt.wantEvents), ",") {
+				t.Errorf("got events %v, want %v", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func statusStrings(statuses []RenewalStatus) []string {
+	var s []string
+	for _, status := range statuses {
+		s = append(s, string(status))
+	}
+	return s
+}
+
+func TestRenewer_Run(t *testing.T) {
+	t.Parallel()
+	keyring := ag.NewKeyring()
+	addRenewalTestCert(t, keyring, newRenewalTestKeyID("alice", keyid.NeverTouch), time.Now().Add(10*time.Minute))
+
+	renewed := make(chan struct{}, 1)
+	r, err := NewRenewer(keyring, RenewerOption{
+		Renew: func(ctx context.Context, req RenewalRequest) error {
+			renewed <- struct{}{}
+			return nil
+		},
+		CheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+
+	select {
+	case <-renewed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the certificate is not renewed")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run() error = %v, want %v", err, context.Canceled)
+	}
+
+	if _, err := NewRenewer(keyring, RenewerOption{}); err == nil {
+		t.Error("expect error without renew function")
+	}
+}
+
+func TestNewRenewCommand(t *testing.T) {
+	t.Parallel()
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := RenewalRequest{
+		Certificate: &ssh.Certificate{ValidBefore: uint64(expiresAt.Unix())},
+		KeyID:       &keyid.KeyID{Principals: []string{"alice", "alice:touch"}},
+		Type:        certutil.TouchlessCert,
+	}
+	dir := t.TempDir()
+	output := path.Join(dir, "env")
+	script := path.Join(dir, "renew")
+	content := "#!/bin/sh\n" +
+		`echo "$YSSHRA_RENEW_CERT_TYPE $YSSHRA_RENEW_PRINCIPALS $YSSHRA_RENEW_EXPIRES_AT" > "$1"` + "\n" +
+		`[ "$2" = ok ]` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewRenewCommand(script, output, "ok")(context.Background(), req); err != nil {
+		t.Fatalf("renew command unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s alice,alice:touch %s\n", certutil.TouchlessCert, expiresAt.Local().Format(time.RFC3339))
+	if string(got) != want {
+		t.Errorf("renew command got environment %q, want %q", got, want)
+	}
+
+	if err := NewRenewCommand(script, output, "fail")(context.Background(), req); err == nil {
+		t.Error("expect error for failed renew command")
+	}
+}
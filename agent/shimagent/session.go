@@ -0,0 +1,208 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SessionBindExtension is the agent extension sent by OpenSSH 8.9 and later to bind an agent connection
+// to the SSH session it is used for.
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent
+const SessionBindExtension = "session-bind@openssh.com"
+
+// maxSessionBinds limits the number of session binds tracked for a connection, as OpenSSH does.
+const maxSessionBinds = 16
+
+// SessionBind is a session bind received on an agent connection.
+type SessionBind struct {
+	// HostKey is the host key of the server the SSH session is established with.
+	HostKey ssh.PublicKey
+	// SessionID is the exchange hash of the SSH session.
+	SessionID []byte
+	// Forwarding indicates the agent connection is forwarded to the server,
+	// instead of being used to authenticate to it.
+	Forwarding bool
+}
+
+// parseSessionBind parses the contents of a session bind extension, and verifies the signature
+// of the session ID by the host key.
+func parseSessionBind(contents []byte) (*SessionBind, error) {
+	var msg struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, fmt.Errorf("invalid session bind: %v", err)
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session bind host key: %v", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(msg.Signature, sig); err != nil {
+		return nil, fmt.Errorf("invalid session bind signature: %v", err)
+	}
+	if err := hostKey.Verify(msg.SessionID, sig); err != nil {
+		return nil, fmt.Errorf("failed to verify session bind: %v", err)
+	}
+	return &SessionBind{HostKey: hostKey, SessionID: msg.SessionID, Forwarding: msg.Forwarding}, nil
+}
+
+// isForwarded checks if a connection with the session binds is forwarded through another host.
+func isForwarded(binds []SessionBind) bool {
+	for _, bind := range binds {
+		if bind.Forwarding {
+			return true
+		}
+	}
+	return false
+}
+
+// destination returns the host key of the session a connection with the session binds authenticates to.
+// It returns nil if the last bind is not for authentication, where the destination is unknown.
+func destination(binds []SessionBind) ssh.PublicKey {
+	if len(binds) == 0 || binds[len(binds)-1].Forwarding {
+		return nil
+	}
+	return binds[len(binds)-1].HostKey
+}
+
+// Session is a connection to the shim agent.
+// It tracks the session binds of the connection, which tell the destination hosts the signatures are for.
+// Session implements ShimAgent by delegating the operations to the shim agent server.
+// The operations requested through a Session are identified by its ID in the events, see Server.Subscribe.
+type Session struct {
+	*Server
+	id uint64
+
+	mu    sync.Mutex
+	binds []SessionBind
+}
+
+// NewSession returns a Session for a new connection to the server.
+func (s *Server) NewSession() *Session {
+	return &Session{Server: s, id: atomic.AddUint64(&s.sessions, 1)}
+}
+
+// ID returns the ID of the session, which is unique in the server.
+func (c *Session) ID() uint64 {
+	return c.id
+}
+
+// Binds returns the session binds received on the connection.
+func (c *Session) Binds() []SessionBind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]SessionBind(nil), c.binds...)
+}
+
+// Extension processes a custom extension request.
+// The session bind extension is tracked by the session, and the others are sent to the server.
+func (c *Session) Extension(extensionType string, contents []byte) ([]byte, error) {
+	resp, err := c.extension(extensionType, contents)
+	c.publish(Event{Type: msgExtension, Session: c.id, Err: err})
+	return resp, err
+}
+
+// extension processes a custom extension request.
+func (c *Session) extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != SessionBindExtension {
+		return c.Server.extension(extensionType, contents)
+	}
+	bind, err := parseSessionBind(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Same as OpenSSH, a connection used for authentication cannot be bound again,
+	// and a session cannot be bound twice.
+	for _, b := range c.binds {
+		if !b.Forwarding {
+			return nil, errors.New("agent: connection already bound for authentication")
+		}
+		if string(b.SessionID) == string(bind.SessionID) {
+			return nil, errors.New("agent: session already bound")
+		}
+	}
+	if len(c.binds) >= maxSessionBinds {
+		return nil, errors.New("agent: too many session binds")
+	}
+	c.binds = append(c.binds, *bind)
+	return nil, nil
+}
+
+// Sign has the same semantics as SignWithFlags.
+func (c *Session) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs the data with the key, taking the session binds of the connection into account.
+func (c *Session) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return c.Server.signWithFlags(key, data, flags, c.Binds(), c.id)
+}
+
+// List returns the identities known to the agent.
+func (c *Session) List() ([]*agent.Key, error) {
+	keys, err := c.list()
+	c.publish(Event{Type: msgRequestIdentities, Session: c.id, Err: err})
+	return keys, err
+}
+
+// Add adds the given key to the agent.
+func (c *Session) Add(key agent.AddedKey) error {
+	err := c.add(key)
+	c.publish(Event{Type: addedKeyMessage(key), Key: addedPublicKey(key), Session: c.id, Err: err})
+	return err
+}
+
+// AddHardCert adds a certificate with private key in the underlying agent.
+func (c *Session) AddHardCert(key ssh.PublicKey, suffix string) error {
+	err := c.addHardCert(key, suffix)
+	c.publish(Event{Type: msgAddHardCert, Key: key, Session: c.id, Err: err})
+	return err
+}
+
+// Remove removes the key from the agent.
+func (c *Session) Remove(key ssh.PublicKey) error {
+	err := c.removeKey(key)
+	c.publish(Event{Type: msgRemoveIdentity, Key: key, Session: c.id, Err: err})
+	return err
+}
+
+// RemoveAll removes all the keys from the agent.
+func (c *Session) RemoveAll() error {
+	err := c.removeAll()
+	c.publish(Event{Type: msgRemoveAllIdentities, Session: c.id, Err: err})
+	return err
+}
+
+// Lock locks the shim agent.
+func (c *Session) Lock(passphrase []byte) error {
+	return c.lock(passphrase, c.id)
+}
+
+// Unlock unlocks the shim agent.
+func (c *Session) Unlock(passphrase []byte) error {
+	err := c.unlock(passphrase)
+	c.publish(Event{Type: msgUnlock, Session: c.id, Err: err})
+	return err
+}
+
+// Close ends the session. Unlike Server.Close, it keeps the connection with the underlying agent.
+func (c *Session) Close() error {
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+// newHostKey returns a new host key signer.
+func newHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sessionBind returns the contents of a session bind extension signed by the host key.
+func sessionBind(t *testing.T, hostKey ssh.Signer, sessionID string, forwarding bool) []byte {
+	t.Helper()
+	sig, err := hostKey.Sign(rand.Reader, []byte(sessionID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.Marshal(struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}{hostKey.PublicKey().Marshal(), []byte(sessionID), ssh.Marshal(sig), forwarding})
+}
+
+func TestSession_Extension(t *testing.T) {
+	t.Parallel()
+
+	hostA, hostB := newHostKey(t), newHostKey(t)
+	forged := sessionBind(t, hostA, "session-1", false)
+	forged[len(forged)-2] ^= 0xff
+
+	tests := []struct {
+		name      string
+		binds     [][]byte
+		wantErr   bool
+		wantBinds int
+	}{
+		{name: "authentication", binds: [][]byte{sessionBind(t, hostA, "session-1", false)}, wantBinds: 1},
+		{
+			name:      "forwarded then authentication",
+			binds:     [][]byte{sessionBind(t, hostA, "session-1", true), sessionBind(t, hostB, "session-2", false)},
+			wantBinds: 2,
+		},
+		{
+			name:      "rebind after authentication",
+			binds:     [][]byte{sessionBind(t, hostA, "session-1", false), sessionBind(t, hostB, "session-2", false)},
+			wantErr:   true,
+			wantBinds: 1,
+		},
+		{
+			name:      "same session twice",
+			binds:     [][]byte{sessionBind(t, hostA, "session-1", true), sessionBind(t, hostA, "session-1", false)},
+			wantErr:   true,
+			wantBinds: 1,
+		},
+		{name: "forged signature", binds: [][]byte{forged}, wantErr: true},
+		{name: "malformed", binds: [][]byte{{0x01}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			session := testServer(t, false).(*Server).NewSession()
+			var err error
+			for _, bind := range tt.binds {
+				if _, err = session.Extension(SessionBindExtension, bind); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Extension() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := len(session.Binds()); got != tt.wantBinds {
+				t.Errorf("got %d binds, want %d", got, tt.wantBinds)
+			}
+		})
+	}
+}
+
+func TestSession_SignWithFlags(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	priv, keyInAgent, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSSHCA := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		KeyId:       `{"prins":[],"transID":"a7af667d","reqUser":"","reqIP":"","reqHost":"","isFirefighter":false,"isHWKey":true,"isHeadless":false,"isNonce":false,"touchPolicy":2,"ver":1}`,
+		ValidAfter:  uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore: uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := certSSHCA.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	plainPriv, plainKey, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumpHost, approvedHost, otherHost := newHostKey(t), newHostKey(t), newHostKey(t)
+
+	tests := []struct {
+		name          string
+		key           ssh.PublicKey
+		binds         [][]byte
+		wantErr       bool
+		wantForwarded bool
+		wantDest      ssh.PublicKey
+		wantCertType  string
+	}{
+		{name: "unbound", key: certSSHCA, wantCertType: "TouchSudo"},
+		{
+			name:         "direct",
+			key:          certSSHCA,
+			binds:        [][]byte{sessionBind(t, otherHost, "session-1", false)},
+			wantDest:     otherHost.PublicKey(),
+			wantCertType: "TouchSudo",
+		},
+		{
+			name:          "forwarded to approved host",
+			key:           certSSHCA,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true), sessionBind(t, approvedHost, "session-2", false)},
+			wantForwarded: true,
+			wantDest:      approvedHost.PublicKey(),
+			wantCertType:  "TouchSudo",
+		},
+		{
+			name:          "forwarded to other host",
+			key:           certSSHCA,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true), sessionBind(t, otherHost, "session-2", false)},
+			wantErr:       true,
+			wantForwarded: true,
+			wantDest:      otherHost.PublicKey(),
+			wantCertType:  "TouchSudo",
+		},
+		{
+			name:          "forwarded to unknown host",
+			key:           certSSHCA,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true)},
+			wantErr:       true,
+			wantForwarded: true,
+			wantCertType:  "TouchSudo",
+		},
+		{
+			// The underlying key of a YSSHCA certificate is subject to the policy of the certificate.
+			name:          "forwarded underlying key to other host",
+			key:           keyInAgent,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true), sessionBind(t, otherHost, "session-2", false)},
+			wantErr:       true,
+			wantForwarded: true,
+			wantDest:      otherHost.PublicKey(),
+		},
+		{
+			name:          "forwarded underlying key to approved host",
+			key:           keyInAgent,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true), sessionBind(t, approvedHost, "session-2", false)},
+			wantForwarded: true,
+			wantDest:      approvedHost.PublicKey(),
+		},
+		{
+			name:          "forwarded plain key",
+			key:           plainKey,
+			binds:         [][]byte{sessionBind(t, jumpHost, "session-1", true), sessionBind(t, otherHost, "session-2", false)},
+			wantForwarded: true,
+			wantDest:      otherHost.PublicKey(),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			keyring, address := newTestUpstream(t)
+			for _, k := range []interface{}{priv, plainPriv} {
+				if err := keyring.Add(ag.AddedKey{PrivateKey: k}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			signKey := keyInAgent
+			if tt.key == plainKey {
+				signKey = plainKey
+			}
+			var events bytes.Buffer
+			s, err := New(Option{
+				Address:             address,
+				SignAuditor:         NewJSONSignAuditor(&events),
+				ForwardedSignPolicy: AllowForwardingTo(approvedHost.PublicKey()),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if err := s.AddHardCert(certSSHCA, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			session := s.(*Server).NewSession()
+			for _, bind := range tt.binds {
+				if _, err := session.Extension(SessionBindExtension, bind); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := []byte("data")
+			sig, err := session.SignWithFlags(tt.key, data, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SignWithFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := signKey.Verify(data, sig); err != nil {
+					t.Errorf("failed to verify signature: %v", err)
+				}
+			}
+
+			var event SignEvent
+			if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+				t.Fatalf("invalid sign event %q: %v", events.String(), err)
+			}
+			wantDest := ""
+			if tt.wantDest != nil {
+				wantDest = ssh.FingerprintSHA256(tt.wantDest)
+			}
+			if event.Fingerprint != ssh.FingerprintSHA256(signKey) || event.CertType != tt.wantCertType ||
+				event.Forwarded != tt.wantForwarded || event.DestinationHostKey != wantDest ||
+				event.Bound != (len(tt.binds) != 0) || (event.Err != "") != tt.wantErr {
+				t.Errorf("unexpected sign event %+v", event)
+			}
+		})
+	}
+}
+
+func TestServer_ExtensionSessionBind(t *testing.T) {
+	t.Parallel()
+	s := testServer(t, false)
+	if _, err := s.Extension(SessionBindExtension, sessionBind(t, newHostKey(t), "session-1", false)); err != nil {
+		t.Errorf("Extension() unexpected error: %v", err)
+	}
+	if _, err := s.Extension(SessionBindExtension, []byte{0x01}); err == nil {
+		t.Error("Extension() expected error for malformed session bind")
+	}
+}
@@ -12,8 +12,11 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/theparanoids/ysshra/agent/ssh/connection"
+	"github.com/theparanoids/ysshra/internal/backoff"
 	"github.com/theparanoids/ysshra/keyid"
 	certutil "github.com/theparanoids/ysshra/sshutils/cert"
 	keyutil "github.com/theparanoids/ysshra/sshutils/key"
@@ -26,6 +29,8 @@ var (
 	errAgentLocked      = errors.New("agent: locked")
 	errAgentUnlocked    = errors.New("agent: not locked")
 	errAgentNotFoundKey = errors.New("agent: key not found")
+	// errForwardedSignDenied is returned when the forwarded sign policy refuses a signing request.
+	errForwardedSignDenied = errors.New("agent: signing with YSSHCA certificate on forwarded connection is denied")
 )
 
 type certificate struct {
@@ -83,17 +88,19 @@ type Server struct {
 	// mu protects the server's status and the connection with the underlying agent.
 	mu sync.RWMutex
 
-	// conn is the connection to the underlying ssh-agent.
+	// conn is the connection to the primary underlying ssh-agent.
 	conn io.ReadWriteCloser
-	// agent is the underlying ssh-agent created from Conn
+	// conns are the connections to all the underlying ssh-agents, starting with conn.
+	conns []io.ReadWriteCloser
+	// agent is the underlying ssh-agent created from conns, which multiplexes them if there are more than one.
 	agent agent.ExtendedAgent
 	// certs stores the certificates with private key in hardware
 	certs map[hashcode]*certificate
 
-	// conds is used by Wait function to wait for a
-	// specific message. Each index is corresponding
-	// to a message code defined in message.go.
-	conds [40]*sync.Cond
+	// sessions is the number of sessions created by NewSession, used to identify them.
+	sessions uint64
+	// events delivers the events of the operations to the subscribers, e.g. the Wait function.
+	events eventBus
 
 	// locked is prepared for Lock and Unlock functions,
 	// when it is true, Sign and Remove will fail, and
@@ -110,6 +117,39 @@ type Server struct {
 	// pubKeyComp is the compare function to compare ssh public keys.
 	// The function is useful to list credentials in a specific order.
 	pubKeyComp func(ssh.PublicKey, ssh.PublicKey) bool
+
+	// store persists the in-memory certificates. It is nil if no state file is configured.
+	store *certStore
+	// certsChanged indicates the in-memory certificates have changed since they were last persisted.
+	certsChanged bool
+
+	// signAuditor receives an event for every signing request.
+	signAuditor func(SignEvent)
+	// forwardedSignPolicy decides whether YSSHCA certificates can sign on forwarded connections.
+	forwardedSignPolicy func(hostKey ssh.PublicKey) bool
+
+	// confirm confirms the signing requests with the certificates of confirmCertTypes.
+	confirm          ConfirmFunc
+	confirmCertTypes []certutil.Type
+	confirmTimeout   time.Duration
+
+	// closed indicates the connection with the underlying agent is closed.
+	closed bool
+	// lastActive is the time of the last operation, used to decide whether the agent is idle.
+	lastActive time.Time
+	// idleLockTimeout is the inactivity after which the agent locks itself with idleLockPassphrase.
+	idleLockTimeout    time.Duration
+	idleLockPassphrase []byte
+	// idleTimer fires the idle lock. It is nil if the idle lock is disabled.
+	idleTimer *time.Timer
+	// lockHook is called after the agent is locked.
+	lockHook func(LockEvent)
+	// unlockBackoff decides the lockout after failed Unlock calls. It is nil if the lockout is disabled.
+	unlockBackoff *backoff.Config
+	// unlockFailures is the number of consecutive failed Unlock calls.
+	unlockFailures uint
+	// unlockNotBefore is the time until which Unlock is refused.
+	unlockNotBefore time.Time
 }
 
 // Option encapsulates the parameters of New function that create new ShimAgent objects.
@@ -119,6 +159,10 @@ type Option struct {
 	// For Darwin and Linux, address is a unix socket.
 	// For Windows, address is a named pipe.
 	Address string
+	// SecondaryAddresses are the addresses of additional underlying agents, e.g. a hardware token agent.
+	// The keys of all the underlying agents are listed together, and a signing request is sent to the agent holding the key.
+	// Added keys and unknown requests are sent to the agent at Address, which is the primary agent.
+	SecondaryAddresses []string
 	// NoUpstream indicates whether the server can access to the underlying agent through conn. If it
 	// is set to true, an in-memory agent is created to handle the request.
 	// The default value is false.
@@ -127,15 +171,73 @@ type Option struct {
 	// The function is useful to list credentials in a specific order.
 	// The default behavior is to compare the keys by their marshaled key value.
 	PubKeyComp func(ssh.PublicKey, ssh.PublicKey) bool
+	// StatePath is the path of the state file persisting the certificates added by AddHardCert.
+	// If it is set, the certificates are reloaded on start, and the orphan and expired ones are dropped.
+	// The state file and its integrity key (StatePath with ".key" suffix) are only accessible by the current user.
+	// The key is stored next to the state file with the same owner, so the MAC only detects accidental corruption,
+	// e.g. a truncated write; anyone able to rewrite the state file can also read the key and forge the MAC.
+	// A corrupted state file is logged and discarded.
+	// The default value is empty, which keeps the certificates in memory only.
+	StatePath string
+	// SignAuditor is called with an event after every signing request, e.g. NewJSONSignAuditor.
+	// The destination of the signature is only known on the connections served by a Session.
+	SignAuditor func(SignEvent)
+	// ForwardedSignPolicy decides whether a YSSHCA certificate, or the underlying key of one, can sign on a forwarded connection,
+	// given the host key of the destination session, e.g. AllowForwardingTo.
+	// The host key is nil if the forwarded connection is not bound to the destination.
+	// The default value is nil, which allows signing on any connection.
+	ForwardedSignPolicy func(hostKey ssh.PublicKey) bool
+	// Confirm is called to confirm a signing request with a certificate of ConfirmCertTypes, or its underlying key, before signing,
+	// e.g. NewAskpassConfirmer and NewListConfirmer.
+	// The default value is nil, which signs without confirmation.
+	Confirm ConfirmFunc
+	// ConfirmCertTypes are the certificate types requiring confirmation.
+	// The default value is TouchlessInAgentCert and TouchlessSudoInAgentCert, which are not confirmed by a touch.
+	ConfirmCertTypes []certutil.Type
+	// ConfirmTimeout is the time to wait for a confirmation before denying the request.
+	// The default value is 30 seconds.
+	ConfirmTimeout time.Duration
+	// IdleLockTimeout is the inactivity after which the agent locks itself, as if Lock is called with IdleLockPassphrase.
+	// The default value is 0, which disables the idle lock.
+	IdleLockTimeout time.Duration
+	// IdleLockPassphrase is the passphrase to unlock the agent after an idle lock.
+	// It is required if IdleLockTimeout is set, otherwise anyone at the idle machine could unlock the agent by `ssh-add -X`.
+	IdleLockPassphrase []byte
+	// LockHook is called after the agent is locked, either by a Lock call or by the idle lock.
+	LockHook func(LockEvent)
+	// UnlockLockoutBase is the time Unlock is refused after a failed Unlock call.
+	// It doubles with each consecutive failure up to UnlockLockoutMax, and is reset by a successful Unlock call.
+	// The default value is 0, which disables the lockout.
+	UnlockLockoutBase time.Duration
+	// UnlockLockoutMax is the upper bound of the lockout after failed Unlock calls.
+	// The default value is 10 minutes.
+	UnlockLockoutMax time.Duration
 }
 
 // New will return a new ShimAgent object.
 func New(opt Option) (ShimAgent, error) {
-	conn, err := connection.GetConn(opt.Address)
+	if opt.IdleLockTimeout > 0 && len(opt.IdleLockPassphrase) == 0 {
+		return nil, errors.New("cannot start a shimagent with an idle lock but no IdleLockPassphrase")
+	}
+	var conns []io.ReadWriteCloser
+	closeConns := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	for _, address := range append([]string{opt.Address}, opt.SecondaryAddresses...) {
+		conn, err := connection.GetConn(address)
+		if err != nil {
+			closeConns()
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	ag, err := newShimAgent(conns, opt.NoUpstream)
 	if err != nil {
+		closeConns()
 		return nil, err
 	}
-	ag, err := newShimAgent(conn, opt.NoUpstream)
 
 	if opt.PubKeyComp == nil {
 		opt.PubKeyComp = func(x, y ssh.PublicKey) bool {
@@ -143,29 +245,101 @@ func New(opt Option) (ShimAgent, error) {
 		}
 	}
 	ag.pubKeyComp = opt.PubKeyComp
-	return ag, err
+	ag.signAuditor = opt.SignAuditor
+	ag.forwardedSignPolicy = opt.ForwardedSignPolicy
+	ag.confirm = opt.Confirm
+	ag.confirmCertTypes = opt.ConfirmCertTypes
+	if len(ag.confirmCertTypes) == 0 {
+		ag.confirmCertTypes = defaultConfirmCertTypes
+	}
+	ag.confirmTimeout = opt.ConfirmTimeout
+	if ag.confirmTimeout <= 0 {
+		ag.confirmTimeout = defaultConfirmTimeout
+	}
+	ag.lockHook = opt.LockHook
+	ag.unlockBackoff = newUnlockBackoff(opt.UnlockLockoutBase, opt.UnlockLockoutMax)
+
+	if opt.StatePath != "" {
+		if err := ag.restore(opt.StatePath); err != nil {
+			closeConns()
+			return nil, fmt.Errorf("failed to restore state: %v", err)
+		}
+	}
+
+	ag.mu.Lock()
+	ag.idleLockTimeout = opt.IdleLockTimeout
+	ag.idleLockPassphrase = opt.IdleLockPassphrase
+	ag.touch()
+	ag.startIdleLock(ag.idleLockTimeout)
+	ag.mu.Unlock()
+	return ag, nil
 }
 
-// newShimAgent returns a new ShimAgent object from an io.ReadWriteCloser.
+// restore reloads the in-memory certificates from the state file at path,
+// and re-validates them against the underlying agent.
+func (s *Server) restore(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	store, err := openCertStore(path)
+	if err != nil {
+		return err
+	}
+	certs, err := store.load()
+	if err != nil {
+		// A corrupted state must not keep the agent from starting; the certificates can be requested again.
+		log.Error().Err(err).Str("path", path).Msg("failed to load shimagent state, discard the state")
+		certs = nil
+	}
+	s.store = store
+	for _, cert := range certs {
+		s.certs[hash(cert.Blob)] = cert
+	}
+	if _, _, err := s.filter(); err != nil {
+		return err
+	}
+	s.certsChanged = true
+	return s.persist()
+}
+
+// persist writes the in-memory certificates to the state file if they have changed.
+// The caller must hold the write lock of the mutex before calling this method.
+func (s *Server) persist() error {
+	if s.store == nil || !s.certsChanged {
+		return nil
+	}
+	if err := s.store.save(s.certs); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	s.certsChanged = false
+	return nil
+}
+
+// newShimAgent returns a new ShimAgent object from the connections to the underlying agents,
+// with the first one as the primary agent.
 // noUpstream indicates whether the server can access to the underlying agent through conn. If it
 // is set to true, an in-memory agent is created to handle the request.
-func newShimAgent(conn io.ReadWriteCloser, noUpstream bool) (*Server, error) {
-	if conn == nil {
-		return nil, errors.New("cannot start a shimagent with nil conn")
+func newShimAgent(conns []io.ReadWriteCloser, noUpstream bool) (*Server, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("cannot start a shimagent without conn")
+	}
+	agents := make([]agent.ExtendedAgent, 0, len(conns))
+	for _, conn := range conns {
+		if conn == nil {
+			return nil, errors.New("cannot start a shimagent with nil conn")
+		}
+		agents = append(agents, agent.NewClient(conn))
 	}
 
 	srv := &Server{
-		conn:                   conn,
-		agent:                  agent.NewClient(conn),
+		conn:                   conns[0],
+		conns:                  conns,
+		agent:                  newMultiAgent(agents),
 		certs:                  make(map[hashcode]*certificate),
 		noUpstreamSSHCACert:    noUpstream,
 		upstreamSSHCACertCache: make(map[hashcode]struct{}),
 	}
 
-	for i := range srv.conds {
-		srv.conds[i] = sync.NewCond(&sync.Mutex{})
-	}
-
 	// Build cache to drop YSSHCA certs from upstream.
 	if noUpstream {
 		keys, err := srv.agent.List()
@@ -194,6 +368,7 @@ func (s *Server) remove(key ssh.PublicKey) error {
 	if _, ok := s.certs[h]; ok {
 		delete(s.certs, h)
 		removed = true
+		s.certsChanged = true
 	}
 
 	// Remove the in-agent key.
@@ -217,7 +392,7 @@ func (s *Server) remove(key ssh.PublicKey) error {
 // 1. It removes the orphan certs in the memory. If the underlying agent returns an empty list, it
 // might be locked by user. To support such case, we don't remove orphan certs.
 // 2. It removes the expired certs in the memory and the underlying agent.
-// The caller must hold the mutex before calling this method.
+// The caller must hold the write lock of the mutex before calling this method.
 func (s *Server) filter() (inMemoryCerts map[hashcode]*certificate, inAgentKeys []*agent.Key, err error) {
 	inMemoryCerts = s.certs
 	inAgentKeys, err = s.agent.List()
@@ -250,35 +425,14 @@ func (s *Server) filter() (inMemoryCerts map[hashcode]*certificate, inAgentKeys
 		return nil, nil, err
 	}
 
-	return inMemoryCerts, inAgentKeys, nil
-}
-
-// Broadcast wakes all goroutines waiting on a specific operation.
-// The value of msg is defined in message.go.
-func (s *Server) Broadcast(msg byte) error {
-	if msg < byte(len(s.conds)) {
-		s.conds[msg].L.Lock()
-		defer s.conds[msg].L.Unlock()
+	// Failing to persist the filtered certificates is not fatal, since they are filtered again on restart.
+	_ = s.persist()
 
-		s.conds[msg].Broadcast()
-	}
-	return nil
-}
-
-// Wait gets blocked until a specific operation is done.
-// The value of msg is defined in message.go.
-func (s *Server) Wait(msg byte) error {
-	if msg < byte(len(s.conds)) {
-		s.conds[msg].L.Lock()
-		defer s.conds[msg].L.Unlock()
-
-		s.conds[msg].Wait()
-	}
-	return nil
+	return inMemoryCerts, inAgentKeys, nil
 }
 
-// Close closes the underlying `conn`.
-// The underlying `agent` will be unreachable if it is created by the `conn`.
+// Close closes the connections to the underlying agents.
+// The underlying `agent` will be unreachable since it is created by the connections.
 func (s *Server) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -287,17 +441,35 @@ func (s *Server) Close() error {
 		return errAgentLocked
 	}
 
-	return s.conn.Close()
+	s.closed = true
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	var err error
+	for _, conn := range s.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 // List returns the identities known to the agent.
 func (s *Server) List() ([]*agent.Key, error) {
+	keys, err := s.list()
+	s.publish(Event{Type: msgRequestIdentities, Err: err})
+	return keys, err
+}
+
+// list returns the identities known to the agent.
+func (s *Server) list() ([]*agent.Key, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.locked {
 		return []*agent.Key{}, nil
 	}
+	s.touch()
 
 	certsInMemory, keysInAgent, err := s.filter()
 	if err != nil {
@@ -343,7 +515,7 @@ func (s *Server) List() ([]*agent.Key, error) {
 	return keys, err
 }
 
-// Forward forwards the unknown OpenSSH requests to the underlying ssh-agent.
+// Forward forwards the unknown OpenSSH requests to the primary underlying ssh-agent.
 func (s *Server) Forward(req []byte) (resp []byte, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -357,12 +529,20 @@ func (s *Server) Forward(req []byte) (resp []byte, err error) {
 // AddHardCert adds a certificate with private key in the underlying agent.
 // If key is not a certificate, it will be ignored.
 func (s *Server) AddHardCert(key ssh.PublicKey, suffix string) error {
+	err := s.addHardCert(key, suffix)
+	s.publish(Event{Type: msgAddHardCert, Key: key, Err: err})
+	return err
+}
+
+// addHardCert adds a certificate with private key in the underlying agent.
+func (s *Server) addHardCert(key ssh.PublicKey, suffix string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.locked {
 		return errAgentLocked
 	}
+	s.touch()
 
 	if key == nil {
 		return errors.New("null key provided")
@@ -391,7 +571,8 @@ func (s *Server) AddHardCert(key ssh.PublicKey, suffix string) error {
 	for _, agentKey := range agentKeys {
 		if bytes.Equal(agentKey.Marshal(), cert.Key.Marshal()) {
 			s.certs[keyHash] = &certificate{cert, cert.Marshal(), label}
-			return nil
+			s.certsChanged = true
+			return s.persist()
 		}
 	}
 	return errAgentNotFoundKey
@@ -402,17 +583,69 @@ func (s *Server) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 }
 
 func (s *Server) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.signWithFlags(key, data, flags, nil, 0)
+}
 
-	if s.locked {
-		return nil, errors.New("agent is locked")
+// signWithFlags signs the data on a connection with the session binds, and audits the request.
+// session identifies the connection, see Event.Session.
+func (s *Server) signWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags, binds []SessionBind, session uint64) (*ssh.Signature, error) {
+	event := newSignEvent(key, flags, binds)
+	sig, err := s.checkAndSign(key, data, flags, binds, event)
+	if err != nil {
+		event.Err = err.Error()
 	}
+	if s.signAuditor != nil {
+		s.signAuditor(*event)
+	}
+	s.publish(Event{Type: msgSignRequest, Key: key, Session: session, Err: err})
+	return sig, err
+}
 
+// checkAndSign signs the data if the forwarded sign policy allows signing on a connection with the session binds,
+// and the request described by event is confirmed if required.
+// A bare public key is checked against the certificates of the key, since it signs on their behalf.
+func (s *Server) checkAndSign(key ssh.PublicKey, data []byte, flags agent.SignatureFlags, binds []SessionBind, event *SignEvent) (*ssh.Signature, error) {
 	if key == nil {
 		return nil, errors.New("null key provided")
 	}
 
+	// A locked agent rejects the request before the user is asked for a confirmation.
+	s.mu.Lock()
+	if s.locked {
+		s.mu.Unlock()
+		return nil, errors.New("agent is locked")
+	}
+	var certs []*ssh.Certificate
+	var err error
+	if (s.forwardedSignPolicy != nil && isForwarded(binds)) || s.confirm != nil {
+		certs, err = s.certsOf(key)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.forwardedSignPolicy != nil && isForwarded(binds) && hasSSHCACert(certs) {
+		if !s.forwardedSignPolicy(destination(binds)) {
+			return nil, errForwardedSignDenied
+		}
+	}
+	// The confirmation may take a while, so it is done without holding the mutex.
+	if s.requiresConfirmation(certs) {
+		if err := s.confirmSign(*event); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The agent may be locked while waiting for the confirmation.
+	if s.locked {
+		return nil, errors.New("agent is locked")
+	}
+	s.touch()
+
 	if _, _, err := s.filter(); err != nil {
 		return nil, err
 	}
@@ -435,55 +668,126 @@ func (s *Server) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.Signa
 	return s.agent.SignWithFlags(key, data, flags)
 }
 
+// certsOf returns the certificates signing with key: the key itself if it is a certificate,
+// or the in-memory and in-agent certificates of the key if it is a bare public key,
+// since a client can sign with the underlying key of a certificate directly.
+// The caller must hold the mutex before calling this method.
+func (s *Server) certsOf(key ssh.PublicKey) ([]*ssh.Certificate, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if cert, err := keyutil.CastSSHPublicKeyToCertificate(key); err == nil {
+		return []*ssh.Certificate{cert}, nil
+	}
+
+	keyBytes := key.Marshal()
+	var certs []*ssh.Certificate
+	for _, cert := range s.certs {
+		if bytes.Equal(cert.Key.Marshal(), keyBytes) {
+			certs = append(certs, cert.Certificate)
+		}
+	}
+	agentKeys, err := s.agent.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, agentKey := range agentKeys {
+		pub, err := ssh.ParsePublicKey(agentKey.Blob)
+		if err != nil {
+			continue
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok && bytes.Equal(cert.Key.Marshal(), keyBytes) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
 // Add adds the given key to the agent.
-func (s *Server) Add(key agent.AddedKey) (err error) {
+func (s *Server) Add(key agent.AddedKey) error {
+	err := s.add(key)
+	s.publish(Event{Type: addedKeyMessage(key), Key: addedPublicKey(key), Err: err})
+	return err
+}
+
+// add adds the given key to the agent.
+func (s *Server) add(key agent.AddedKey) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.locked {
 		return errAgentLocked
 	}
+	s.touch()
 
 	return s.agent.Add(key)
 }
 
 // Remove removes the key from the agent.
 func (s *Server) Remove(key ssh.PublicKey) error {
+	err := s.removeKey(key)
+	s.publish(Event{Type: msgRemoveIdentity, Key: key, Err: err})
+	return err
+}
+
+// removeKey removes the key from the agent.
+func (s *Server) removeKey(key ssh.PublicKey) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.locked {
 		return errAgentLocked
 	}
+	s.touch()
 
 	if key == nil {
 		return errors.New("null key provided")
 	}
 
-	return s.remove(key)
+	if err := s.remove(key); err != nil {
+		return err
+	}
+	return s.persist()
 }
 
 // RemoveAll removes all the keys from the agent.
 func (s *Server) RemoveAll() error {
+	err := s.removeAll()
+	s.publish(Event{Type: msgRemoveAllIdentities, Err: err})
+	return err
+}
+
+// removeAll removes all the keys from the agent.
+func (s *Server) removeAll() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.locked {
 		return errAgentLocked
 	}
+	s.touch()
 
 	s.certs = make(map[hashcode]*certificate)
 	s.upstreamSSHCACertCache = make(map[hashcode]struct{})
+	s.certsChanged = true
+	if err := s.persist(); err != nil {
+		return err
+	}
 	return s.agent.RemoveAll()
 }
 
 // Lock locks the shim agent.
 // List, Sign, SignWithFlags, Add, Remove and operations of the agent will raise an errAgentLocked error.
 func (s *Server) Lock(passphrase []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.lock(passphrase, 0)
+}
 
+// lock locks the shim agent on the request from session, see Event.Session.
+func (s *Server) lock(passphrase []byte, session uint64) error {
+	s.mu.Lock()
 	if s.locked {
+		s.mu.Unlock()
+		s.publish(Event{Type: msgLock, Session: session, Err: errAgentLocked})
 		return errAgentLocked
 	}
 
@@ -491,29 +795,50 @@ func (s *Server) Lock(passphrase []byte) error {
 	if err == nil {
 		s.locked = true
 	}
+	s.mu.Unlock()
+
+	s.publish(Event{Type: msgLock, Session: session, Err: err})
+	if err == nil {
+		s.notifyLock(LockReasonRequest)
+	}
 	return err
 }
 
 // Unlock unlocks the shim agent.
+// If the lockout is enabled, Unlock is refused for a while after a failed Unlock call.
 func (s *Server) Unlock(passphrase []byte) error {
+	err := s.unlock(passphrase)
+	s.publish(Event{Type: msgUnlock, Err: err})
+	return err
+}
+
+// unlock unlocks the shim agent.
+func (s *Server) unlock(passphrase []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if !s.locked {
 		return errAgentUnlocked
 	}
+	if err := s.checkUnlockLockout(); err != nil {
+		return err
+	}
 
 	err := s.agent.Unlock(passphrase)
+	s.recordUnlock(err == nil)
 	if err == nil {
 		s.locked = false
+		s.touch()
+		s.startIdleLock(s.idleLockTimeout)
 	}
 	return err
 }
 
 // Signers returns the available singers from the in-memory certs and underlying agent.
 func (s *Server) Signers() ([]ssh.Signer, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	// filter drops and persists the orphan and expired certificates, and the cache of upstream certificates is updated.
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	if s.locked {
 		return nil, errors.New("agent is locked")
@@ -564,7 +889,22 @@ func (s *Server) Signers() ([]ssh.Signer, error) {
 }
 
 // Extension processes a custom extension request.
+// The session bind extension is not sent to the underlying agent, since the connection with it is shared
+// by all the clients. Serve the connections with NewSession to track the session binds.
 func (s *Server) Extension(extensionType string, contents []byte) ([]byte, error) {
+	resp, err := s.extension(extensionType, contents)
+	s.publish(Event{Type: msgExtension, Err: err})
+	return resp, err
+}
+
+// extension processes a custom extension request.
+func (s *Server) extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == SessionBindExtension {
+		if _, err := parseSessionBind(contents); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
 	return s.agent.Extension(extensionType, contents)
 }
 
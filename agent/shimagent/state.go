@@ -0,0 +1,199 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	keyutil "github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// stateVersion is the version of the state file format.
+	stateVersion = 1
+	// stateKeySuffix is appended to the state file path to store the integrity key of the state file.
+	stateKeySuffix = ".key"
+	// stateKeySize is the size of the integrity key in bytes.
+	stateKeySize = 32
+	// statePerm is the permission of the state file and its key.
+	statePerm os.FileMode = 0600
+)
+
+// stateEntry is an in-memory certificate recorded in the state file.
+type stateEntry struct {
+	Cert    []byte `json:"cert"`
+	Comment string `json:"comment"`
+}
+
+// statePayload is the content of the state file protected by the MAC.
+type statePayload struct {
+	Version int          `json:"version"`
+	Certs   []stateEntry `json:"certs"`
+}
+
+// stateEnvelope is the on-disk format of the state file.
+// MAC is the HMAC-SHA256 of Payload, keyed by the content of the key file next to the state file.
+// It detects accidental corruption only, since the key file has the same owner as the state file.
+type stateEnvelope struct {
+	Payload []byte `json:"payload"`
+	MAC     []byte `json:"mac"`
+}
+
+// certStore persists the in-memory certificates of the shim agent in a state file,
+// so that they survive the restarts of the shim agent.
+type certStore struct {
+	path string
+	key  []byte
+}
+
+// openCertStore opens the state file at path, and loads or creates its integrity key.
+// The state file and the key must be only accessible by the current user.
+func openCertStore(path string) (*certStore, error) {
+	keyPath := path + stateKeySuffix
+	key, err := readStateFile(keyPath)
+	if err == nil && len(key) != stateKeySize {
+		// Replace the corrupted key, which cannot verify any state.
+		log.Error().Str("path", keyPath).Msgf("invalid state key size %d, discard the state", len(key))
+		err = os.ErrNotExist
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, stateKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := writeStateFile(keyPath, key); err != nil {
+			return nil, fmt.Errorf("failed to create state key: %v", err)
+		}
+		// The previous state cannot be verified without its key.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state key: %v", err)
+	}
+	return &certStore{path: path, key: key}, nil
+}
+
+// load returns the certificates recorded in the state file.
+// It returns nil if the state file does not exist.
+func (c *certStore) load() ([]*certificate, error) {
+	data, err := readStateFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope stateEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid state file: %v", err)
+	}
+	if !hmac.Equal(envelope.MAC, c.mac(envelope.Payload)) {
+		return nil, errors.New("state file integrity check failed")
+	}
+	var payload statePayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid state file payload: %v", err)
+	}
+	if payload.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d", payload.Version)
+	}
+
+	certs := make([]*certificate, 0, len(payload.Certs))
+	for _, entry := range payload.Certs {
+		pub, err := ssh.ParsePublicKey(entry.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in state file: %v", err)
+		}
+		cert, err := keyutil.CastSSHPublicKeyToCertificate(pub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in state file: %v", err)
+		}
+		certs = append(certs, &certificate{cert, cert.Marshal(), entry.Comment})
+	}
+	return certs, nil
+}
+
+// save replaces the state file with the certificates.
+func (c *certStore) save(certs map[hashcode]*certificate) error {
+	payload := statePayload{Version: stateVersion, Certs: make([]stateEntry, 0, len(certs))}
+	for _, cert := range certs {
+		payload.Certs = append(payload.Certs, stateEntry{Cert: cert.Blob, Comment: cert.Comment})
+	}
+	// Keep the state file stable regardless of the map iteration order.
+	sort.Slice(payload.Certs, func(i, j int) bool {
+		return string(payload.Certs[i].Cert) < string(payload.Certs[j].Cert)
+	})
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(stateEnvelope{Payload: payloadBytes, MAC: c.mac(payloadBytes)})
+	if err != nil {
+		return err
+	}
+	return writeStateFile(c.path, data)
+}
+
+func (c *certStore) mac(data []byte) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// readStateFile reads the file after checking it is a regular file only accessible by the current user.
+func readStateFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if err := checkStatePermission(fi); err != nil {
+		return nil, fmt.Errorf("insecure permission of %s: %v", path, err)
+	}
+
+	return io.ReadAll(f)
+}
+
+// writeStateFile replaces the file at path with data atomically.
+func writeStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(statePerm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
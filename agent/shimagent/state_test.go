@@ -0,0 +1,288 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import (
+	"crypto/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/nettest"
+)
+
+// newTestCert returns a certificate of a new key, which is valid between validAfter and validBefore.
+func newTestCert(t *testing.T, validAfter, validBefore time.Time) (interface{}, *ssh.Certificate) {
+	t.Helper()
+	priv, _, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:         signer.PublicKey(),
+		KeyId:       "keyid",
+		ValidAfter:  uint64(validAfter.Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return priv, cert
+}
+
+func TestCertStore(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	_, cert := newTestCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+	certs := map[hashcode]*certificate{
+		hash(cert.Marshal()): {cert, cert.Marshal(), "comment"},
+	}
+
+	tests := []struct {
+		name      string
+		tamper    func(t *testing.T, statePath string)
+		wantCerts int
+		wantErr   bool
+	}{
+		{name: "round trip", wantCerts: 1},
+		{
+			name: "tampered state",
+			tamper: func(t *testing.T, statePath string) {
+				data, err := os.ReadFile(statePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)/2] ^= 0x01
+				if err := os.WriteFile(statePath, data, statePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "state accessible by others",
+			tamper: func(t *testing.T, statePath string) {
+				if err := os.Chmod(statePath, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "key accessible by others",
+			tamper: func(t *testing.T, statePath string) {
+				if err := os.Chmod(statePath+stateKeySuffix, 0640); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing key discards state",
+			tamper: func(t *testing.T, statePath string) {
+				if err := os.Remove(statePath + stateKeySuffix); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCerts: 0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			statePath := path.Join(t.TempDir(), "state")
+			store, err := openCertStore(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.save(certs); err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(t, statePath)
+			}
+
+			store, err = openCertStore(statePath)
+			if err == nil {
+				var got []*certificate
+				got, err = store.load()
+				if err == nil && len(got) != tt.wantCerts {
+					t.Errorf("load() got %d certs, want %d", len(got), tt.wantCerts)
+				}
+				if err == nil && len(got) == 1 && got[0].Comment != "comment" {
+					t.Errorf("load() got comment %q, want %q", got[0].Comment, "comment")
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestUpstream serves a keyring as the underlying agent, and returns the keyring with its address.
+// Unlike testServer, it accepts multiple connections.
+func newTestUpstream(t *testing.T) (ag.Agent, string) {
+	t.Helper()
+	keyring := ag.NewKeyring()
+	listener, err := nettest.NewLocalListener("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ag.ServeAgent(keyring, conn)
+		}
+	}()
+	return keyring, listener.Addr().String()
+}
+
+func TestNew_StatePath(t *testing.T) {
+	t.Parallel()
+
+	keyring, address := newTestUpstream(t)
+	statePath := path.Join(t.TempDir(), "state")
+	opt := Option{Address: address, StatePath: statePath}
+
+	now := time.Now()
+	validPriv, validCert := newTestCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expiringPriv, expiringCert := newTestCert(t, now.Add(-time.Hour), now.Add(2*time.Second))
+	orphanPriv, orphanCert := newTestCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+	for _, priv := range []interface{}{validPriv, expiringPriv, orphanPriv} {
+		if err := keyring.Add(ag.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*ssh.Certificate{validCert, expiringCert, orphanCert} {
+		if err := s.AddHardCert(cert, "hard"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the shim agent after the key of orphanCert is removed and expiringCert is expired.
+	if err := keyring.Remove(orphanCert.Key); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(time.Unix(int64(expiringCert.ValidBefore), 0).Add(time.Second)))
+
+	s, err = New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	server := s.(*Server)
+	if len(server.certs) != 1 {
+		t.Fatalf("got %d restored certs, want 1", len(server.certs))
+	}
+	if _, ok := server.certs[hash(validCert.Marshal())]; !ok {
+		t.Fatal("the valid cert is not restored")
+	}
+
+	// The state file is updated on removal.
+	if err := s.Remove(validCert); err != nil {
+		t.Fatal(err)
+	}
+	store, err := openCertStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 0 {
+		t.Errorf("got %d certs in state file, want 0", len(certs))
+	}
+}
+
+func TestNew_CorruptedState(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, statePath string)
+	}{
+		{
+			name: "tampered state",
+			corrupt: func(t *testing.T, statePath string) {
+				if err := os.WriteFile(statePath, []byte(`{"mac":"AAAA","payload":"e30="}`), statePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "invalid key",
+			corrupt: func(t *testing.T, statePath string) {
+				if err := os.WriteFile(statePath+stateKeySuffix, []byte("short"), statePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			keyring, address := newTestUpstream(t)
+			statePath := path.Join(t.TempDir(), "state")
+			opt := Option{Address: address, StatePath: statePath}
+
+			now := time.Now()
+			priv, cert := newTestCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+			if err := keyring.Add(ag.AddedKey{PrivateKey: priv}); err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddHardCert(cert, "hard"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.corrupt(t, statePath)
+
+			// The corrupted state is discarded instead of keeping the shim agent from starting.
+			s, err = New(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if certs := s.(*Server).certs; len(certs) != 0 {
+				t.Fatalf("got %d restored certs, want 0", len(certs))
+			}
+			store, err := openCertStore(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.load(); err != nil {
+				t.Errorf("the corrupted state file is not replaced: %v", err)
+			}
+		})
+	}
+}
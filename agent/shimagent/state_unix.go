@@ -0,0 +1,24 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+//go:build !windows
+// +build !windows
+
+package shimagent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkStatePermission checks the file is owned by the current user, and not accessible by others.
+func checkStatePermission(fi os.FileInfo) error {
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permission %#o is accessible by group or others", perm)
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("owned by uid %d", stat.Uid)
+	}
+	return nil
+}
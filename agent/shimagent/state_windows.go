@@ -0,0 +1,12 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package shimagent
+
+import "os"
+
+// checkStatePermission is a no-op on Windows, where the file permission bits are not meaningful.
+// The state file is expected to be stored in the user's profile directory, which is protected by ACLs.
+func checkStatePermission(_ os.FileInfo) error {
+	return nil
+}
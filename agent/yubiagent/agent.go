@@ -8,6 +8,9 @@ import (
 	"time"
 
 	"github.com/theparanoids/ysshra/agent/shimagent"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
 )
 
 // YubiAgent is an interface that extends the functionality
@@ -27,9 +30,33 @@ type YubiAgent interface {
 	// More details: https://developers.yubico.com/yubico-piv-tool/Attestation.html
 	AttestSlot(slot string) (cert *x509.Certificate, err error)
 
+	// GenerateKey generates a key in the specified slot with the given PIN and touch policies, and returns
+	// the public key together with the certificates required to register the key, so that the key can be
+	// enrolled in one call.
+	GenerateKey(slot string, algo key.PublicKeyAlgo,
+		pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (*SlotKey, error)
+
+	// ListReaders lists the smartcard readers.
+	ListReaders() (readers []string, err error)
+
 	// AddSmartcardKey adds the specified smartcard to the agent.
+	// The key is removed after lifetime if it is not zero, and each use of the key requires a confirmation if confirmBeforeUse is true.
 	AddSmartcardKey(readerId string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error
 
 	// RemoveSmartcardKey removes the specified smartcard from the agent.
 	RemoveSmartcardKey(readerId string, pin []byte) error
 }
+
+// SlotKey is a key generated in a PIV slot.
+type SlotKey struct {
+	// Slot is the slot holding the key.
+	Slot string
+	// PublicKey is the public key of the slot.
+	PublicKey ssh.PublicKey
+	// Cert is the certificate stored in the slot.
+	Cert *x509.Certificate
+	// AttestCert is the attestation certificate of the slot, which is signed by F9Cert.
+	AttestCert *x509.Certificate
+	// F9Cert is the certificate of the attestation key ("f9" slot).
+	F9Cert *x509.Certificate
+}
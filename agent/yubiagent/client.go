@@ -7,11 +7,14 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/theparanoids/ysshra/agent/utils"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -105,6 +108,23 @@ func (c *client) ListSlots() (slots []string, err error) {
 	return msg.Slots, err
 }
 
+// ListReaders sends a list readers request to the agent server.
+func (c *client) ListReaders() (readers []string, err error) {
+	resp, err := c.call([]byte{AgentMessageListReaders})
+	if err != nil {
+		return nil, err
+	}
+
+	var msg agentListReadersResp
+	if err = ssh.Unmarshal(resp, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Err != "" {
+		err = errors.New(msg.Err)
+	}
+	return msg.Readers, err
+}
+
 // ReadSlot sends a read slot request to the agent server.
 func (c *client) ReadSlot(slot string) (cert *x509.Certificate, err error) {
 	req := append([]byte{AgentMessageReadSlot}, []byte(slot)...)
@@ -141,6 +161,42 @@ func (c *client) AttestSlot(slot string) (cert *x509.Certificate, err error) {
 	return utils.ParsePEMCertificate(msg.Cert)
 }
 
+// GenerateKey sends a generate key request to the agent server.
+func (c *client) GenerateKey(slot string, algo key.PublicKeyAlgo,
+	pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (*SlotKey, error) {
+	resp, err := c.call(ssh.Marshal(agentGenerateKeyReq{
+		Slot:        slot,
+		Algorithm:   uint32(algo),
+		PINPolicy:   uint8(pinPolicy),
+		TouchPolicy: uint8(touchPolicy),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var msg agentGenerateKeyResp
+	if err = ssh.Unmarshal(resp, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Err != "" {
+		return nil, errors.New(msg.Err)
+	}
+	slotKey := &SlotKey{Slot: slot}
+	if slotKey.PublicKey, err = ssh.ParsePublicKey(msg.KeyBlob); err != nil {
+		return nil, fmt.Errorf("failed to parse the generated key: %v", err)
+	}
+	if slotKey.Cert, err = utils.ParsePEMCertificate(msg.Cert); err != nil {
+		return nil, fmt.Errorf("failed to parse the slot certificate: %v", err)
+	}
+	if slotKey.AttestCert, err = utils.ParsePEMCertificate(msg.AttestCert); err != nil {
+		return nil, fmt.Errorf("failed to parse the attestation certificate: %v", err)
+	}
+	if slotKey.F9Cert, err = utils.ParsePEMCertificate(msg.F9Cert); err != nil {
+		return nil, fmt.Errorf("failed to parse the f9 certificate: %v", err)
+	}
+	return slotKey, nil
+}
+
 // Wait appends the AgentMessageWait message to the given request, and sends to agent server.
 func (c *client) Wait(agentMsg byte) error {
 	req := append([]byte{AgentMessageWait}, agentMsg)
@@ -158,21 +214,7 @@ func (c *client) Wait(agentMsg byte) error {
 // AddSmartcardKey sends an add smartcard request to the agent server.
 // Ref: https://tools.ietf.org/html/draft-miller-ssh-agent-02#section-4.2.5
 func (c *client) AddSmartcardKey(readerID string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error {
-	var constraints []byte
-	if lifetime != 0 {
-		secs := uint32(lifetime.Seconds())
-		constraints = append(constraints, ssh.Marshal(agentLifetimeConstraint{secs})...)
-	}
-
-	if confirmBeforeUse {
-		constraints = append(constraints, agentConstrainConfirm)
-	}
-
-	req := ssh.Marshal(agentAddSmartcardKeyReq{
-		ID:          readerID,
-		PIN:         pin,
-		Constraints: constraints,
-	})
+	req := marshalAddSmartcardKeyReq(readerID, pin, lifetime, confirmBeforeUse)
 
 	resp, err := c.call(req)
 	if err != nil {
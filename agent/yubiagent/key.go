@@ -0,0 +1,77 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiagent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/theparanoids/crypki/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+// HardKey represents a key pair held by a hardware token behind yubiagent, e.g. a PIV slot or a FIDO security key.
+// The private key never leaves the token, so its certificates are added to yubiagent as hard certs.
+// It implements csr.AgentKey.
+type HardKey struct {
+	agent YubiAgent
+	csrs  []*proto.SSHCertificateSigningRequest
+}
+
+// NewHardKey returns a HardKey adding the certificates through agent.
+func NewHardKey(agent YubiAgent) *HardKey {
+	return &HardKey{agent: agent}
+}
+
+// AddCSR adds the CSR for the key.
+func (k *HardKey) AddCSR(csr *proto.SSHCertificateSigningRequest) {
+	k.csrs = append(k.csrs, csr)
+}
+
+// CSRs returns the CSR list of the key.
+func (k *HardKey) CSRs() []*proto.SSHCertificateSigningRequest {
+	return k.csrs
+}
+
+// Challenge checks the private key of pubKey is accessible through yubiagent by signing a random challenge.
+// It returns the verified signature.
+func (k *HardKey) Challenge(pubKey ssh.PublicKey) (*ssh.Signature, error) {
+	data := make([]byte, 64)
+	if _, err := rand.Read(data); err != nil {
+		return nil, fmt.Errorf("cannot generate random challenge: %v", err)
+	}
+	sig, err := k.agent.Sign(pubKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign the challenge: %v", err)
+	}
+	if err := pubKey.Verify(data, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// ReadPubKey returns the registered public key of logName in pubKeyDir in authorized keys format,
+// from the file named logName with ".pub" suffix, or named logName if it does not exist.
+func ReadPubKey(pubKeyDir string, logName string) ([]byte, error) {
+	pubKeyPath := path.Join(pubKeyDir, logName+".pub")
+	if _, err := os.Stat(pubKeyPath); err != nil {
+		pubKeyPath = path.Join(pubKeyDir, logName)
+	}
+	return os.ReadFile(pubKeyPath)
+}
+
+// AddCertsToAgent adds the certificates of the hardware key into yubiagent.
+func (k *HardKey) AddCertsToAgent(certs []ssh.PublicKey, comments []string) error {
+	if len(certs) != len(comments) {
+		return fmt.Errorf("the number of certificates %d mismatches the number of comments %d", len(certs), len(comments))
+	}
+	for i, cert := range certs {
+		if err := k.agent.AddHardCert(cert, comments[i]); err != nil {
+			return fmt.Errorf("failed to add hard cert: %v", err)
+		}
+	}
+	return nil
+}
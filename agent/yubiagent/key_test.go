@@ -0,0 +1,145 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiagent
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hardCertRecorder records the hard certs added to yubiagent.
+type hardCertRecorder struct {
+	YubiAgent
+	comments []string
+	err      error
+}
+
+func (r *hardCertRecorder) AddHardCert(_ ssh.PublicKey, comment string) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.comments = append(r.comments, comment)
+	return nil
+}
+
+func TestHardKey_AddCertsToAgent(t *testing.T) {
+	t.Parallel()
+	_, cert, err := createSelfSignCert("hard key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		certs        []ssh.PublicKey
+		comments     []string
+		agentErr     error
+		wantComments []string
+		wantErr      bool
+	}{
+		{
+			name:         "happy path",
+			certs:        []ssh.PublicKey{cert, cert},
+			comments:     []string{"touch", "touchless"},
+			wantComments: []string{"touch", "touchless"},
+		},
+		{
+			name:     "mismatched comments",
+			certs:    []ssh.PublicKey{cert},
+			comments: []string{"touch", "touchless"},
+			wantErr:  true,
+		},
+		{
+			name:     "agent failure",
+			certs:    []ssh.PublicKey{cert},
+			comments: []string{"touch"},
+			agentErr: errors.New("agent locked"),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			agent := &hardCertRecorder{err: tt.agentErr}
+			err := NewHardKey(agent).AddCertsToAgent(tt.certs, tt.comments)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddCertsToAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(agent.comments, tt.wantComments) {
+				t.Errorf("AddCertsToAgent() added %v, want %v", agent.comments, tt.wantComments)
+			}
+		})
+	}
+}
+
+// signerAgent signs by the signer.
+type signerAgent struct {
+	YubiAgent
+	signer ssh.Signer
+}
+
+func (a *signerAgent) Sign(_ ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.signer.Sign(rand.Reader, data)
+}
+
+func TestHardKey_Challenge(t *testing.T) {
+	t.Parallel()
+	priv, pub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPub, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &signerAgent{signer: signer}
+	if _, err := NewHardKey(agent).Challenge(pub); err != nil {
+		t.Errorf("Challenge() unexpected error: %v", err)
+	}
+	if _, err := NewHardKey(agent).Challenge(otherPub); err == nil {
+		t.Error("Challenge() expect error for a key not in the agent")
+	}
+}
+
+func TestReadPubKey(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"alice.pub": "alice.pub", "alice": "alice", "bob": "bob"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		logName string
+		want    string
+		wantErr bool
+	}{
+		{logName: "alice", want: "alice.pub"},
+		{logName: "bob", want: "bob"},
+		{logName: "carol", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.logName, func(t *testing.T) {
+			t.Parallel()
+			got, err := ReadPubKey(dir, tt.logName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadPubKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadPubKey() got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
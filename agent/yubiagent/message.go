@@ -7,9 +7,15 @@ package yubiagent
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
 )
 
 // Following messages are the ssh agent protocol number, which are used as the tags of sshtype in a yubiagent request.
@@ -30,6 +36,12 @@ const (
 	// AgentMessageWait extends the SSH agent protocol numbers for the YubiKey's capability to wait
 	// for the specified operation finished.
 	AgentMessageWait = 35
+	// AgentMessageListReaders extends the SSH agent protocol numbers for the capability to list
+	// the smartcard readers.
+	AgentMessageListReaders = 36
+	// AgentMessageGenerateKey extends the SSH agent protocol numbers for the YubiKey's capability to
+	// generate a key in the slot.
+	AgentMessageGenerateKey = 37
 )
 
 // agentAddHardCertReq defines the request to add hard certs.
@@ -54,6 +66,30 @@ type agentAttestSlotResp struct {
 	Err  string
 }
 
+type agentListReadersResp struct {
+	Readers []string
+	Err     string
+}
+
+// agentGenerateKeyReq defines the request to generate a key in a slot.
+// sshtype `37` is AgentMessageGenerateKey.
+type agentGenerateKeyReq struct {
+	Slot        string `sshtype:"37"`
+	Algorithm   uint32
+	PINPolicy   uint8
+	TouchPolicy uint8
+}
+
+// agentGenerateKeyResp defines the response of a generated key.
+// The certificates are in PEM format.
+type agentGenerateKeyResp struct {
+	KeyBlob    []byte
+	Cert       []byte
+	AttestCert []byte
+	F9Cert     []byte
+	Err        string
+}
+
 type agentLifetimeConstraint struct {
 	LifetimeSecs uint32 `sshtype:"1"`
 }
@@ -68,6 +104,9 @@ const (
 	// AgentMessageAddSmartcardKeyConstrained is the SSH agent protocol numbers described in https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent-01#rfc.section.7.1.
 	AgentMessageAddSmartcardKeyConstrained = 26
 
+	// agentConstrainLifetime is the protocol number (sshtype) to identify the lifetime of the key in seconds.
+	// Ref: https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent-01#section-4.2.6.1
+	agentConstrainLifetime = 1
 	// agentConstrainConfirm is the protocol number (sshtype) to identify whether the agent require explicit user confirmation for private key operation when using the key.
 	// Ref: https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent-01#section-4.2.6.2
 	agentConstrainConfirm = 2
@@ -78,13 +117,58 @@ const (
 )
 
 // agentAddSmartcardKeyReq defines the request to add a smartcard key.
-// sshtype `26` is AgentMessageAddSmartcardKeyConstrained.
+// sshtype `20` is AgentMessageAddSmartcardKey, and `26` is AgentMessageAddSmartcardKeyConstrained.
+// The constraints are only present in AgentMessageAddSmartcardKeyConstrained.
 type agentAddSmartcardKeyReq struct {
-	ID          string `sshtype:"26"`
+	ID          string `sshtype:"20|26"`
 	PIN         []byte
 	Constraints []byte `ssh:"rest"`
 }
 
+// marshalAddSmartcardKeyReq marshals the request to add a smartcard key with the constraints.
+func marshalAddSmartcardKeyReq(readerID string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) []byte {
+	var constraints []byte
+	if lifetime > 0 {
+		// Round up the lifetime, because a zero lifetime means no lifetime.
+		secs := uint32(math.MaxUint32)
+		if lifetime < time.Duration(math.MaxUint32)*time.Second {
+			secs = uint32((lifetime + time.Second - 1) / time.Second)
+		}
+		constraints = append(constraints, ssh.Marshal(agentLifetimeConstraint{secs})...)
+	}
+	if confirmBeforeUse {
+		constraints = append(constraints, agentConstrainConfirm)
+	}
+	req := ssh.Marshal(agentAddSmartcardKeyReq{
+		ID:          readerID,
+		PIN:         pin,
+		Constraints: constraints,
+	})
+	// ssh.Marshal takes the first sshtype.
+	req[0] = AgentMessageAddSmartcardKeyConstrained
+	return req
+}
+
+// parseSmartcardConstraints parses the constraints of a request to add a smartcard key.
+func parseSmartcardConstraints(constraints []byte) (lifetime time.Duration, confirmBeforeUse bool, err error) {
+	for len(constraints) != 0 {
+		switch constraints[0] {
+		case agentConstrainLifetime:
+			if len(constraints) < 5 {
+				return 0, false, errors.New("yubiagent: invalid lifetime constraint")
+			}
+			lifetime = time.Duration(binary.BigEndian.Uint32(constraints[1:5])) * time.Second
+			constraints = constraints[5:]
+		case agentConstrainConfirm:
+			confirmBeforeUse = true
+			constraints = constraints[1:]
+		default:
+			return 0, false, fmt.Errorf("yubiagent: unsupported constraint type %d", constraints[0])
+		}
+	}
+	return lifetime, confirmBeforeUse, nil
+}
+
 // agentAddSmartcardKeyReq defines the request to remove a smartcard key.
 // sshtype `21` is AgentMessageRemoveSmartcardKey.
 type agentRemoveSmartcardKeyReq struct {
@@ -121,6 +205,10 @@ const (
 	AgentMessageLock = 22
 	// AgentMessageUnlock is the SSH agent protocol number for agent.Unlock.
 	AgentMessageUnlock = 23
+
+	// AgentMessageExtension is the SSH agent protocol number for agent.Extension.
+	// Ref: https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent-04#section-3.8
+	AgentMessageExtension = 27
 )
 
 type forwarder struct {
@@ -0,0 +1,77 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiagent
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAddSmartcardKeyReq(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name             string
+		lifetime         time.Duration
+		confirmBeforeUse bool
+		// wantLifetime is the lifetime in the request, which is the same as lifetime if it is zero.
+		wantLifetime time.Duration
+	}{
+		{name: "no constraints"},
+		{name: "lifetime", lifetime: 5 * time.Second},
+		{name: "confirm", confirmBeforeUse: true},
+		{name: "lifetime and confirm", lifetime: time.Hour, confirmBeforeUse: true},
+		{name: "sub-second lifetime", lifetime: time.Millisecond, wantLifetime: time.Second},
+		{name: "fractional lifetime", lifetime: 1500 * time.Millisecond, wantLifetime: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := marshalAddSmartcardKeyReq("/path/to/lib", []byte("123"), tt.lifetime, tt.confirmBeforeUse)
+			if req[0] != AgentMessageAddSmartcardKeyConstrained {
+				t.Fatalf("got message type %d, want %d", req[0], AgentMessageAddSmartcardKeyConstrained)
+			}
+			var msg agentAddSmartcardKeyReq
+			if err := ssh.Unmarshal(req, &msg); err != nil {
+				t.Fatal(err)
+			}
+			lifetime, confirmBeforeUse, err := parseSmartcardConstraints(msg.Constraints)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLifetime := tt.wantLifetime
+			if wantLifetime == 0 {
+				wantLifetime = tt.lifetime
+			}
+			if msg.ID != "/path/to/lib" || string(msg.PIN) != "123" || lifetime != wantLifetime || confirmBeforeUse != tt.confirmBeforeUse {
+				t.Errorf("got %+v, lifetime %v, confirm %v", msg, lifetime, confirmBeforeUse)
+			}
+		})
+	}
+}
+
+func TestParseSmartcardConstraints(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		constraints []byte
+		wantErr     bool
+	}{
+		{name: "empty"},
+		{name: "truncated lifetime", constraints: []byte{agentConstrainLifetime, 0, 0, 5}, wantErr: true},
+		{name: "extension", constraints: []byte{255, 0, 0, 0, 0}, wantErr: true},
+		{name: "unknown", constraints: []byte{agentConstrainConfirm, 3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, _, err := parseSmartcardConstraints(tt.constraints); (err != nil) != tt.wantErr {
+				t.Errorf("parseSmartcardConstraints() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
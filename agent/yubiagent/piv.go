@@ -0,0 +1,208 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiagent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/theparanoids/ysshra/agent/utils"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
+)
+
+// PIVBackend performs the PIV operations on a smartcard for the yubiagent server.
+// The slot parameters are the hexadecimal PIV slot IDs, e.g. "9a", "9e" or "f9".
+type PIVBackend interface {
+	// ListSlots lists all the used slots in the smartcard.
+	ListSlots() (slots []string, err error)
+
+	// ReadSlot reads the x509 certificate from the specified slot.
+	ReadSlot(slot string) (cert *x509.Certificate, err error)
+
+	// AttestSlot signs the public key of the specified slot with the private key of "f9" slot and
+	// returns the resulting attestation certificate.
+	AttestSlot(slot string) (cert *x509.Certificate, err error)
+}
+
+// ReaderLister is an optional interface of a PIVBackend, which lists the smartcard readers.
+type ReaderLister interface {
+	// ListReaders lists the smartcard readers.
+	ListReaders() (readers []string, err error)
+}
+
+// SmartcardBackend is an optional interface of a PIVBackend, which manages the smartcard keys of the agent itself.
+// If the backend does not implement it, the smartcard keys are managed by the PKCS#11 provider of the underlying
+// ssh-agent, where the reader ID is the path of the provider library, e.g. libykcs11.so.
+type SmartcardBackend interface {
+	// AddSmartcardKey adds the keys of the smartcard to the agent.
+	// The keys are removed after lifetime if it is not zero, and each use of the keys requires a confirmation if confirmBeforeUse is true.
+	AddSmartcardKey(readerID string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error
+
+	// RemoveSmartcardKey removes the keys of the smartcard from the agent.
+	RemoveSmartcardKey(readerID string, pin []byte) error
+}
+
+// KeyGenerator is an optional interface of a PIVBackend, which generates keys on the smartcard.
+type KeyGenerator interface {
+	// GenerateKey generates a key pair in the specified slot with the given PIN and touch policies,
+	// and stores a certificate of the public key in the slot. Any existing key in the slot is replaced.
+	// The default policies of the smartcard apply if the policies are PINPolicyDefault and TouchPolicyDefault.
+	GenerateKey(slot string, algo key.PublicKeyAlgo,
+		pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (crypto.PublicKey, error)
+}
+
+// PIVToolOption is the option of the PIVBackend operating the YubiKey by yubico-piv-tool.
+type PIVToolOption struct {
+	// ManagementKey is the PIV management key of the YubiKey in hexadecimal, which is required to generate keys.
+	// It is passed to yubico-piv-tool through stdin, so that it is not exposed in the process list.
+	// The default value is empty, which uses the default management key of the YubiKey.
+	ManagementKey string
+}
+
+// pivToolBackend implements PIVBackend by invoking yubico-piv-tool.
+type pivToolBackend struct {
+	path          string
+	managementKey string
+}
+
+// NewPIVToolBackend returns a PIVBackend that operates the YubiKey by yubico-piv-tool.
+// It returns an error if yubico-piv-tool cannot be found.
+func NewPIVToolBackend() (PIVBackend, error) {
+	return NewPIVToolBackendWithOption(PIVToolOption{})
+}
+
+// NewPIVToolBackendWithOption returns a PIVBackend that operates the YubiKey by yubico-piv-tool with opt.
+// It returns an error if yubico-piv-tool cannot be found, or the management key is invalid.
+func NewPIVToolBackendWithOption(opt PIVToolOption) (PIVBackend, error) {
+	if err := validateManagementKey(opt.ManagementKey); err != nil {
+		return nil, err
+	}
+	path, err := getPivToolPath()
+	if err != nil {
+		return nil, err
+	}
+	return &pivToolBackend{path: path, managementKey: opt.ManagementKey}, nil
+}
+
+// validateManagementKey checks the management key is empty, or a 3DES or AES key in hexadecimal.
+func validateManagementKey(mgmKey string) error {
+	if mgmKey == "" {
+		return nil
+	}
+	k, err := hex.DecodeString(mgmKey)
+	if err != nil {
+		return fmt.Errorf("invalid management key: %v", err)
+	}
+	switch len(k) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("invalid management key size %d", len(k))
+	}
+}
+
+// managementKeyCommand returns the command of yubico-piv-tool for an action requiring the management key.
+// The management key is written to stdin before input, if it is not the default one.
+func (p *pivToolBackend) managementKeyCommand(input []byte, args ...string) *exec.Cmd {
+	if p.managementKey != "" {
+		args = append(args, "--key", "--stdin-input")
+		input = append([]byte(p.managementKey+"\n"), input...)
+	}
+	cmd := exec.Command(p.path, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd
+}
+
+// ListSlots lists all the used slots in YubiKey.
+func (p *pivToolBackend) ListSlots() (slots []string, err error) {
+	output, err := exec.Command(p.path, "-a", "status").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		// Expect to find a line like "Slot 9a:"
+		if len(line) >= 6 && line[:4] == "Slot" {
+			slots = append(slots, line[5:7])
+		}
+	}
+	return slots, nil
+}
+
+// ListReaders lists the smartcard readers.
+func (p *pivToolBackend) ListReaders() (readers []string, err error) {
+	output, err := exec.Command(p.path, "-a", "list-readers").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if reader := strings.TrimSpace(line); reader != "" {
+			readers = append(readers, reader)
+		}
+	}
+	return readers, nil
+}
+
+// ReadSlot reads x509 certificate in PEM format from the specified slot.
+func (p *pivToolBackend) ReadSlot(slot string) (cert *x509.Certificate, err error) {
+	output, err := exec.Command(p.path, "-a", "read-certificate", "-s", slot).Output()
+	if err != nil {
+		return nil, err
+	}
+	return utils.ParsePEMCertificate(output)
+}
+
+// AttestSlot signs the public key of the specified slot with the private key of "f9" slot and
+// returns the resulting attestation certificate.
+func (p *pivToolBackend) AttestSlot(slot string) (cert *x509.Certificate, err error) {
+	output, err := exec.Command(p.path, "-a", "attest", "-s", slot).Output()
+	if err != nil {
+		return nil, err
+	}
+	return utils.ParsePEMCertificate(output)
+}
+
+// GenerateKey generates a key pair in the specified slot with the given PIN and touch policies.
+// The management key of the option is used to generate the key.
+// yubico-piv-tool requires the PIN to create a self-signed certificate, so the attestation certificate
+// of the key is imported into the slot instead, which makes the key available to PKCS#11 providers.
+func (p *pivToolBackend) GenerateKey(slot string, algo key.PublicKeyAlgo,
+	pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (crypto.PublicKey, error) {
+	args := []string{"-a", "generate", "-s", slot, "-A", algo.String()}
+	if pinPolicy != yubiattest.PINPolicyDefault {
+		args = append(args, "--pin-policy="+pinPolicy.String())
+	}
+	if touchPolicy != yubiattest.TouchPolicyDefault {
+		args = append(args, "--touch-policy="+touchPolicy.String())
+	}
+	output, err := p.managementKeyCommand(nil, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key in slot %s: %v", slot, err)
+	}
+	block, _ := pem.Decode(output)
+	if block == nil {
+		return nil, errors.New("failed to decode the generated public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the generated public key: %v", err)
+	}
+
+	attestCert, err := exec.Command(p.path, "-a", "attest", "-s", slot).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attest slot %s: %v", slot, err)
+	}
+	if err := p.managementKeyCommand(attestCert, "-a", "import-certificate", "-s", slot).Run(); err != nil {
+		return nil, fmt.Errorf("failed to import certificate into slot %s: %v", slot, err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiagent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
+)
+
+// fakePIVTool writes a script recording the arguments and stdin of each call of yubico-piv-tool into dir.
+func fakePIVTool(t *testing.T, dir string) string {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pub.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+echo "$*" >> "` + dir + `/args"
+cat >> "` + dir + `/stdin"
+case "$*" in
+*generate*) cat "` + dir + `/pub.pem" ;;
+esac
+`
+	path := filepath.Join(dir, "yubico-piv-tool")
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPIVToolBackend_GenerateKey(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake yubico-piv-tool is a shell script")
+	}
+	mgmKey := "0102030405060708010203040506070801020304050607ff"
+	tests := []struct {
+		name          string
+		managementKey string
+		wantArgs      []string
+		wantStdin     string
+	}{
+		{
+			name: "default management key",
+			wantArgs: []string{
+				"-a generate -s 9a -A ECCP256 --touch-policy=always",
+				"-a attest -s 9a",
+				"-a import-certificate -s 9a",
+			},
+		},
+		{
+			name:          "management key",
+			managementKey: mgmKey,
+			wantArgs: []string{
+				"-a generate -s 9a -A ECCP256 --touch-policy=always --key --stdin-input",
+				"-a attest -s 9a",
+				"-a import-certificate -s 9a --key --stdin-input",
+			},
+			wantStdin: mgmKey + "\n" + mgmKey + "\n",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			p := &pivToolBackend{path: fakePIVTool(t, dir), managementKey: tt.managementKey}
+			if _, err := p.GenerateKey("9a", key.ECDSAsecp256r1, yubiattest.PINPolicyDefault, yubiattest.TouchPolicyAlways); err != nil {
+				t.Fatalf("GenerateKey() unexpected error: %v", err)
+			}
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSpace(string(args)), "\n"); strings.Join(got, "|") != strings.Join(tt.wantArgs, "|") {
+				t.Errorf("GenerateKey() invoked %q, want %q", got, tt.wantArgs)
+			}
+			stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stdin) != tt.wantStdin {
+				t.Errorf("GenerateKey() wrote %q to stdin, want %q", stdin, tt.wantStdin)
+			}
+		})
+	}
+}
+
+func TestValidateManagementKey(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		mgmKey  string
+		wantErr bool
+	}{
+		"default":      {mgmKey: ""},
+		"3DES":         {mgmKey: "010203040506070801020304050607080102030405060708"},
+		"AES-128":      {mgmKey: "0102030405060708090a0b0c0d0e0f10"},
+		"invalid hex":  {mgmKey: "not a key", wantErr: true},
+		"invalid size": {mgmKey: "010203", wantErr: true},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if err := validateManagementKey(tt.mgmKey); (err != nil) != tt.wantErr {
+				t.Errorf("validateManagementKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
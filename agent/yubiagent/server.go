@@ -4,25 +4,34 @@
 package yubiagent
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
-	"github.com/rs/zerolog/log"
-	"github.com/theparanoids/ysshra/agent/utils"
+	"fmt"
 	"io"
-	"os/exec"
-	"strings"
 	"time"
 
+	"github.com/rs/zerolog/log"
+
 	"github.com/theparanoids/ysshra/agent/shimagent"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
 	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
 )
 
+// attestationSlot is the slot storing the attestation key and certificate.
+const attestationSlot = "f9"
+
+// errBoundSession is the error of a request refused on a connection bound to an ssh session.
+var errBoundSession = errors.New("yubiagent: request refused on a connection bound to an ssh session")
+
 type server struct {
 	shimagent.ShimAgent
-	pivtoolpath string
-	remote      bool // In remote mode, yubiAgent will behave as a shimAgent.
+	// backend performs the PIV operations. It is nil in remote mode, where yubiAgent will behave as a shimAgent.
+	backend PIVBackend
 }
 
 // NewServer will create a new server that implements yubiagent.YubiAgent interface.
@@ -30,89 +39,188 @@ type server struct {
 // The definition of address depends on OS.
 // For Darwin and Linux, address is a unix socket.
 // For Windows, address is a named pipe.
+// If remote is false, the PIV operations are performed by yubico-piv-tool.
 func NewServer(address string, remote bool) (YubiAgent, error) {
-	var srv *server
-	shimAgent, err := shimagent.New(
-		shimagent.Option{
-			Address:    address,
-			NoUpstream: false,
-		})
-	if err != nil {
-		return nil, err
-	}
-
-	var path string
+	var backend PIVBackend
 	if !remote {
-		path, err = getPivToolPath()
+		var err error
+		backend, err = NewPIVToolBackend()
 		if err != nil {
 			return nil, err
 		}
 	}
-	srv = &server{
-		shimAgent,
-		path,
-		remote,
+	return NewServerWithBackend(address, backend)
+}
+
+// NewServerWithBackend will create a new server that implements yubiagent.YubiAgent interface,
+// and performs the PIV operations by the given backend.
+// If backend is nil, the server runs in remote mode and the PIV operations are not supported.
+func NewServerWithBackend(address string, backend PIVBackend) (YubiAgent, error) {
+	return NewServerWithOption(shimagent.Option{Address: address}, backend)
+}
+
+// NewServerWithOption will create a new server that implements yubiagent.YubiAgent interface,
+// on top of a shim agent created with opt, and performs the PIV operations by the given backend.
+// If backend is nil, the server runs in remote mode and the PIV operations are not supported.
+func NewServerWithOption(opt shimagent.Option, backend PIVBackend) (YubiAgent, error) {
+	shimAgent, err := shimagent.New(opt)
+	if err != nil {
+		return nil, err
 	}
-	return srv, nil
+	return &server{
+		ShimAgent: shimAgent,
+		backend:   backend,
+	}, nil
 }
 
 // ListSlots lists all the used slots in YubiKey.
 func (s *server) ListSlots() (slots []string, err error) {
-	if s.remote {
+	if s.backend == nil {
 		return nil, errors.New("yubiagent: ListSlots is not supported in remote mode")
 	}
-	output, err := exec.Command(s.pivtoolpath, "-a", "status").Output()
-	if err != nil {
-		return nil, err
-	}
-	for _, line := range strings.Split(string(output), "\n") {
-		// Expect to find a line like "Slot 9a:"
-		if len(line) >= 6 && line[:4] == "Slot" {
-			slots = append(slots, line[5:7])
-		}
-	}
-	return slots, nil
+	return s.backend.ListSlots()
 }
 
 // ReadSlot reads x509 certificate in PEM format from the specified slot.
 func (s *server) ReadSlot(slot string) (cert *x509.Certificate, err error) {
-	if s.remote {
+	if s.backend == nil {
 		return nil, errors.New("yubiagent: ReadSlot is not supported in remote mode")
 	}
-	output, err := exec.Command(s.pivtoolpath, "-a", "read-certificate", "-s", slot).Output()
-	if err != nil {
-		return nil, err
-	}
-	return utils.ParsePEMCertificate(output)
+	return s.backend.ReadSlot(slot)
 }
 
 // AttestSlot signs the public key of the specified slot with the private key of "f9" slot and
 // returns the resulting attestation certificate in PEM format, which can be verified later on.
 func (s *server) AttestSlot(slot string) (cert *x509.Certificate, err error) {
-	if s.remote {
+	if s.backend == nil {
 		return nil, errors.New("yubiagent: AttestSlot is not supported in remote mode")
 	}
-	output, err := exec.Command(s.pivtoolpath, "-a", "attest", "-s", slot).Output()
+	return s.backend.AttestSlot(slot)
+}
+
+// GenerateKey generates a key in the specified slot with the given PIN and touch policies by the backend,
+// and returns the public key together with the slot certificate and the attestation certificates.
+// It is refused on a connection bound to an ssh session, e.g. a forwarded agent, because it overwrites the slot key.
+func (s *server) GenerateKey(slot string, algo key.PublicKeyAlgo,
+	pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (*SlotKey, error) {
+	if s.bound() {
+		return nil, errBoundSession
+	}
+	generator, ok := s.backend.(KeyGenerator)
+	if !ok {
+		return nil, errors.New("yubiagent: GenerateKey is not supported by the backend")
+	}
+	pub, err := generator.GenerateKey(slot, algo, pinPolicy, touchPolicy)
 	if err != nil {
 		return nil, err
 	}
-	return utils.ParsePEMCertificate(output)
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("yubiagent: invalid generated key: %v", err)
+	}
+
+	cert, err := s.backend.ReadSlot(slot)
+	if err != nil {
+		return nil, fmt.Errorf("yubiagent: failed to read slot %s: %v", slot, err)
+	}
+	attestCert, err := s.backend.AttestSlot(slot)
+	if err != nil {
+		return nil, fmt.Errorf("yubiagent: failed to attest slot %s: %v", slot, err)
+	}
+	f9Cert, err := s.backend.ReadSlot(attestationSlot)
+	if err != nil {
+		return nil, fmt.Errorf("yubiagent: failed to read attestation slot: %v", err)
+	}
+	// Make sure the attestation certificate is issued for the generated key,
+	// in case the slot is overwritten in the meantime.
+	attestPub, err := ssh.NewPublicKey(attestCert.PublicKey)
+	if err != nil || !bytes.Equal(attestPub.Marshal(), sshPub.Marshal()) {
+		return nil, fmt.Errorf("yubiagent: attestation certificate of slot %s mismatches the generated key", slot)
+	}
+	return &SlotKey{
+		Slot:       slot,
+		PublicKey:  sshPub,
+		Cert:       cert,
+		AttestCert: attestCert,
+		F9Cert:     f9Cert,
+	}, nil
+}
+
+// ListReaders lists the smartcard readers.
+func (s *server) ListReaders() (readers []string, err error) {
+	lister, ok := s.backend.(ReaderLister)
+	if !ok {
+		return nil, errors.New("yubiagent: ListReaders is not supported by the backend")
+	}
+	return lister.ListReaders()
 }
 
 // AddSmartcardKey adds the specified smartcard to the agent.
-// The request should be forwarded (see: ServeAgent), and be handled by the wrapped SSH agent server.
-func (_ *server) AddSmartcardKey(readerId string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error {
-	return errors.New("yubiagent: AddSmartcardKey is not implemented in server")
+// It is done by the backend if the backend implements SmartcardBackend,
+// otherwise by the PKCS#11 provider of the underlying ssh-agent, where readerId is the path of the provider library.
+// Same as ssh-agent, it is refused on a connection bound to an ssh session, e.g. a forwarded agent,
+// because the underlying ssh-agent cannot tell the request is from a remote host.
+func (s *server) AddSmartcardKey(readerId string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error {
+	if s.bound() {
+		return errBoundSession
+	}
+	if backend, ok := s.backend.(SmartcardBackend); ok {
+		return backend.AddSmartcardKey(readerId, pin, lifetime, confirmBeforeUse)
+	}
+	req := marshalAddSmartcardKeyReq(readerId, pin, lifetime, confirmBeforeUse)
+	return s.forwardSmartcardReq(req, "could not add smartcard "+readerId)
 }
 
 // RemoveSmartcardKey removes the specified smartcard from the agent.
-// The request should be forwarded (see: ServeAgent), and be handled by the wrapped SSH agent server.
-func (_ *server) RemoveSmartcardKey(readerId string, pin []byte) error {
-	return errors.New("yubiagent: RemoveSmartcardKey in not implemented in server")
+// Same as AddSmartcardKey, it is done by the backend or by the PKCS#11 provider of the underlying ssh-agent.
+func (s *server) RemoveSmartcardKey(readerId string, pin []byte) error {
+	if backend, ok := s.backend.(SmartcardBackend); ok {
+		return backend.RemoveSmartcardKey(readerId, pin)
+	}
+	req := ssh.Marshal(agentRemoveSmartcardKeyReq{ID: readerId, PIN: pin})
+	return s.forwardSmartcardReq(req, "could not remove smartcard "+readerId)
+}
+
+// bound checks if the connection served by s is bound to an ssh session.
+// A local client, e.g. ssh-add, doesn't bind the connection, while ssh binds the connection it authenticates or forwards by.
+func (s *server) bound() bool {
+	session, ok := s.ShimAgent.(*shimagent.Session)
+	return ok && len(session.Binds()) != 0
+}
+
+// forwardSmartcardReq forwards the smartcard request to the underlying ssh-agent.
+// failureMsg describes the error if the underlying ssh-agent fails the request.
+func (s *server) forwardSmartcardReq(req []byte, failureMsg string) error {
+	resp, err := s.Forward(req)
+	// Wipe the PIN in the request.
+	if _, err := rand.Read(req); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp) < 1 {
+		return errors.New("yubiagent: empty packet")
+	}
+	if resp[0] != agentSuccess {
+		return errors.New("yubiagent: " + failureMsg + ": agent failure")
+	}
+	return nil
 }
 
 // ServeAgent uses an agent (usually a server object) to serve the connection c.
+// If agent is a server object, the session binds of the connection are tracked by a shimagent.Session.
 func ServeAgent(agent YubiAgent, c io.ReadWriter) error {
+	var shimServer *shimagent.Server
+	if yubiServer, ok := agent.(*server); ok {
+		if shimServer, ok = yubiServer.ShimAgent.(*shimagent.Server); ok {
+			agent = &server{
+				ShimAgent: shimServer.NewSession(),
+				backend:   yubiServer.backend,
+			}
+		}
+	}
+
 	for {
 		req, err := read(c)
 		if err == io.EOF {
@@ -122,14 +230,6 @@ func ServeAgent(agent YubiAgent, c io.ReadWriter) error {
 			return err
 		}
 
-		if yubiServer, ok := agent.(*server); ok {
-			if shimServer, ok := yubiServer.ShimAgent.(*shimagent.Server); ok {
-				if err := shimServer.Broadcast(req[0]); err != nil {
-					return err
-				}
-			}
-		}
-
 		switch req[0] {
 		case AgentMessageAddHardCert:
 			var key ssh.PublicKey
@@ -196,6 +296,31 @@ func ServeAgent(agent YubiAgent, c io.ReadWriter) error {
 				return err
 			}
 
+		case AgentMessageListReaders:
+			var msg agentListReadersResp
+			msg.Readers, err = agent.ListReaders()
+			if err != nil {
+				msg.Err = err.Error()
+			}
+			if err = write(c, ssh.Marshal(&msg)); err != nil {
+				return err
+			}
+
+		case AgentMessageGenerateKey:
+			if err = write(c, ssh.Marshal(serveGenerateKey(agent, req))); err != nil {
+				return err
+			}
+
+		case AgentMessageAddSmartcardKey, AgentMessageAddSmartcardKeyConstrained:
+			if err = write(c, smartcardResp(serveAddSmartcardKey(agent, req))); err != nil {
+				return err
+			}
+
+		case AgentMessageRemoveSmartcardKey:
+			if err = write(c, smartcardResp(serveRemoveSmartcardKey(agent, req))); err != nil {
+				return err
+			}
+
 		case AgentMessageWait:
 			var writeErr error
 			if err = agent.Wait(req[1]); err != nil {
@@ -211,7 +336,8 @@ func ServeAgent(agent YubiAgent, c io.ReadWriter) error {
 			AgentMessageLock, AgentMessageUnlock, AgentMessageSignRequest,
 			AgentMessageAddIdentity, AgentMessageAddIDConstrained,
 			AgentMessageRemoveIdentity, AgentMessageRemoveAllIdentities,
-			AgentMessageRequestV1Identities, AgentMessageRequestIdentities:
+			AgentMessageRequestV1Identities, AgentMessageRequestIdentities,
+			AgentMessageExtension:
 
 			forwarder := newForwarder(req, c)
 			err = sshagent.ServeAgent(agent, forwarder)
@@ -230,5 +356,82 @@ func ServeAgent(agent YubiAgent, c io.ReadWriter) error {
 				return err
 			}
 		}
+
+		// The operations of the shim agent notify the subscribers by themselves.
+		if shimServer != nil && !isShimAgentMessage(req[0]) {
+			if err := shimServer.Broadcast(req[0]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// serveGenerateKey parses the request to generate a key, and returns the response with the generated key.
+func serveGenerateKey(agent YubiAgent, req []byte) *agentGenerateKeyResp {
+	var resp agentGenerateKeyResp
+	var msg agentGenerateKeyReq
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		resp.Err = err.Error()
+		return &resp
+	}
+	slotKey, err := agent.GenerateKey(msg.Slot, key.PublicKeyAlgo(msg.Algorithm),
+		yubiattest.PINPolicy(msg.PINPolicy), yubiattest.TouchPolicy(msg.TouchPolicy))
+	if err != nil {
+		resp.Err = err.Error()
+		return &resp
+	}
+	resp.KeyBlob = slotKey.PublicKey.Marshal()
+	resp.Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: slotKey.Cert.Raw})
+	resp.AttestCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: slotKey.AttestCert.Raw})
+	resp.F9Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: slotKey.F9Cert.Raw})
+	return &resp
+}
+
+// serveAddSmartcardKey parses the request to add a smartcard key, and adds the smartcard to the agent.
+func serveAddSmartcardKey(agent YubiAgent, req []byte) error {
+	var msg agentAddSmartcardKeyReq
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return err
+	}
+	if req[0] == AgentMessageAddSmartcardKey && len(msg.Constraints) != 0 {
+		return errors.New("yubiagent: unexpected constraints in unconstrained request")
+	}
+	lifetime, confirmBeforeUse, err := parseSmartcardConstraints(msg.Constraints)
+	if err != nil {
+		return err
+	}
+	return agent.AddSmartcardKey(msg.ID, msg.PIN, lifetime, confirmBeforeUse)
+}
+
+// serveRemoveSmartcardKey parses the request to remove a smartcard key, and removes the smartcard from the agent.
+func serveRemoveSmartcardKey(agent YubiAgent, req []byte) error {
+	var msg agentRemoveSmartcardKeyReq
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return err
+	}
+	return agent.RemoveSmartcardKey(msg.ID, msg.PIN)
+}
+
+// smartcardResp returns the response to a smartcard request with the result err.
+// Same as ssh-agent, the reason of a failure is not sent to the client.
+func smartcardResp(err error) []byte {
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to serve smartcard request")
+		return []byte{agentFailure}
+	}
+	return []byte{agentSuccess}
+}
+
+// isShimAgentMessage checks if the message is handled by the shim agent.
+func isShimAgentMessage(msg byte) bool {
+	switch msg {
+	case
+		AgentMessageAddHardCert,
+		AgentMessageLock, AgentMessageUnlock, AgentMessageSignRequest,
+		AgentMessageAddIdentity, AgentMessageAddIDConstrained,
+		AgentMessageRemoveIdentity, AgentMessageRemoveAllIdentities,
+		AgentMessageRequestIdentities, AgentMessageExtension:
+		return true
 	}
+	return false
 }
@@ -8,12 +8,20 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"errors"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
+	"github.com/theparanoids/ysshra/agent/shimagent"
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/net/nettest"
@@ -32,8 +40,13 @@ func createPublicKey() (*rsa.PrivateKey, ssh.PublicKey, error) {
 	return priv, pub, nil
 }
 
-// testServer creates a yubiagent server for unit tests
+// testServer creates a yubiagent server in remote mode for unit tests.
 func testServer(t *testing.T) YubiAgent {
+	return testServerWithBackend(t, nil)
+}
+
+// testServerWithBackend creates a yubiagent server with the given PIV backend for unit tests.
+func testServerWithBackend(t *testing.T, backend PIVBackend) YubiAgent {
 	ag := agent.NewKeyring()
 
 	listener, err := nettest.NewLocalListener("unix")
@@ -61,8 +74,8 @@ func testServer(t *testing.T) YubiAgent {
 		}
 	}()
 
-	// remote needs to be true because the yubico-piv-tool doesn't exist in the unit test.
-	s, err := NewServer(listener.Addr().String(), true)
+	// The backend is nil (remote mode) by default because the yubico-piv-tool doesn't exist in the unit test.
+	s, err := NewServerWithBackend(listener.Addr().String(), backend)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -316,3 +329,434 @@ func TestServerRemoveSmartcardKey(t *testing.T) {
 		t.Fatal("unexpected error: want non-nil error")
 	}
 }
+
+func TestServerSoftPIV(t *testing.T) {
+	t.Parallel()
+	var _ PIVBackend = (*softpiv.Token)(nil)
+
+	token, err := softpiv.New(softpiv.Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotPub, err := token.GenerateKey("9a", key.ECDSAsecp256r1, yubiattest.PINPolicyOnce, yubiattest.TouchPolicyCached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cleanup := createClient(testServerWithBackend(t, token))
+	defer cleanup()
+
+	slots, err := c.ListSlots()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cmp.Equal(slots, []string{"9a"}) {
+		t.Errorf("unexpected slots: diff(-got,+want):\n%v", cmp.Diff(slots, []string{"9a"}))
+	}
+
+	f9Cert, err := c.ReadSlot(softpiv.AttestationSlot)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	attestCert, err := c.AttestSlot("9a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(token.Root())
+	info, err := yubiattest.NewAttestorWithCAPool(roots).Attest(f9Cert, attestCert)
+	if err != nil {
+		t.Fatalf("failed to attest the slot: %v", err)
+	}
+	if info.Serial != token.Serial() || info.Slot != "9a" {
+		t.Errorf("unexpected attestation info: %+v", info)
+	}
+
+	// The private key of the attested slot is loaded into the agent, as `ssh-add -s` does,
+	// so that a hard cert of the slot key can be added to the yubiagent.
+	slotKey, err := token.Signer("9a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(agent.AddedKey{PrivateKey: slotKey}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pub, err := ssh.NewPublicKey(attestCert.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshSlotPub, err := ssh.NewPublicKey(slotPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Marshal(), sshSlotPub.Marshal()) {
+		t.Fatal("the attested public key mismatches the slot key")
+	}
+	caPriv, _, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:         pub,
+		KeyId:       "hard-cert",
+		CertType:    ssh.UserCert,
+		ValidAfter:  uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddHardCert(cert, "soft-piv"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data := []byte("challenge")
+	sig, err := c.Sign(cert, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pub.Verify(data, sig); err != nil {
+		t.Errorf("failed to verify the signature: %v", err)
+	}
+}
+
+func TestServerGenerateKey(t *testing.T) {
+	t.Parallel()
+	var _ KeyGenerator = (*softpiv.Token)(nil)
+
+	token, err := softpiv.New(softpiv.Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(token.Root())
+
+	tests := []struct {
+		name            string
+		backend         PIVBackend
+		slot            string
+		algo            key.PublicKeyAlgo
+		pinPolicy       yubiattest.PINPolicy
+		touchPolicy     yubiattest.TouchPolicy
+		wantPINPolicy   yubiattest.PINPolicy
+		wantTouchPolicy yubiattest.TouchPolicy
+		wantErr         bool
+	}{
+		{
+			name:            "touch key",
+			backend:         token,
+			slot:            "9a",
+			algo:            key.ECDSAsecp256r1,
+			pinPolicy:       yubiattest.PINPolicyNever,
+			touchPolicy:     yubiattest.TouchPolicyCached,
+			wantPINPolicy:   yubiattest.PINPolicyNever,
+			wantTouchPolicy: yubiattest.TouchPolicyCached,
+		},
+		{
+			name:            "default policies",
+			backend:         token,
+			slot:            "9e",
+			algo:            key.RSA2048,
+			wantPINPolicy:   yubiattest.PINPolicyOnce,
+			wantTouchPolicy: yubiattest.TouchPolicyNever,
+		},
+		{name: "invalid slot", backend: token, slot: "f9", algo: key.ECDSAsecp256r1, wantErr: true},
+		{name: "unsupported algorithm", backend: token, slot: "9c", algo: key.ED25519, wantErr: true},
+		{name: "remote mode", slot: "9a", algo: key.ECDSAsecp256r1, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c, cleanup := createClient(testServerWithBackend(t, tt.backend))
+			defer cleanup()
+
+			slotKey, err := c.GenerateKey(tt.slot, tt.algo, tt.pinPolicy, tt.touchPolicy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if slotKey.Slot != tt.slot {
+				t.Errorf("got slot %q, want %q", slotKey.Slot, tt.slot)
+			}
+			certPub, err := ssh.NewPublicKey(slotKey.Cert.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(certPub.Marshal(), slotKey.PublicKey.Marshal()) {
+				t.Error("the slot certificate mismatches the generated key")
+			}
+			info, err := yubiattest.NewAttestorWithCAPool(roots).Attest(slotKey.F9Cert, slotKey.AttestCert)
+			if err != nil {
+				t.Fatalf("failed to attest the generated key: %v", err)
+			}
+			if info.Serial != token.Serial() || info.Slot != tt.slot ||
+				info.PINPolicy != tt.wantPINPolicy || info.TouchPolicy != tt.wantTouchPolicy {
+				t.Errorf("unexpected attestation info: %+v", info)
+			}
+		})
+	}
+}
+
+// newSessionBind returns the contents of a session-bind@openssh.com extension request signed by a new host key.
+func newSessionBind(t *testing.T, forwarding bool) []byte {
+	hostPriv, _, err := createPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := []byte("session-1")
+	sig, err := hostKey.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.Marshal(struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}{hostKey.PublicKey().Marshal(), sessionID, ssh.Marshal(sig), forwarding})
+}
+
+func TestServerSessionBind(t *testing.T) {
+	t.Parallel()
+
+	bind := newSessionBind(t, false)
+	s := testServer(t)
+	c1, cleanup1 := createClient(s)
+	defer cleanup1()
+	c2, cleanup2 := createClient(s)
+	defer cleanup2()
+
+	// The session bind is handled by the yubiagent, instead of the underlying agent.
+	if _, err := c1.Extension(shimagent.SessionBindExtension, bind); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A connection bound for authentication cannot be bound again, while the other connections are not affected.
+	if _, err := c1.Extension(shimagent.SessionBindExtension, bind); err == nil {
+		t.Error("expect error for binding a connection twice")
+	}
+	if _, err := c2.Extension(shimagent.SessionBindExtension, bind); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestServerGenerateKey_BoundSession(t *testing.T) {
+	t.Parallel()
+
+	token, err := softpiv.New(softpiv.Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testServerWithBackend(t, token)
+
+	for _, forwarding := range []bool{true, false} {
+		c, cleanup := createClient(s)
+		defer cleanup()
+		if _, err := c.Extension(shimagent.SessionBindExtension, newSessionBind(t, forwarding)); err != nil {
+			t.Fatal(err)
+		}
+		// A remote host must not overwrite the slot key through a forwarded agent.
+		if _, err := c.GenerateKey("9a", key.ECDSAsecp256r1, yubiattest.PINPolicyNever, yubiattest.TouchPolicyAlways); err == nil {
+			t.Errorf("expect error to generate a key on a bound session, forwarding %v", forwarding)
+		}
+	}
+	if slots, err := token.ListSlots(); err != nil || len(slots) != 0 {
+		t.Errorf("got slots %v, %v, want no key generated", slots, err)
+	}
+
+	local, cleanup := createClient(s)
+	defer cleanup()
+	if _, err := local.GenerateKey("9a", key.ECDSAsecp256r1, yubiattest.PINPolicyNever, yubiattest.TouchPolicyAlways); err != nil {
+		t.Errorf("GenerateKey() unexpected error on a local session: %v", err)
+	}
+}
+
+// smartcardBackend is a PIVBackend managing the smartcard keys for unit tests.
+type smartcardBackend struct {
+	PIVBackend
+
+	mu       sync.Mutex
+	readers  []string
+	added    map[string]smartcardKey
+	removeOK bool
+}
+
+type smartcardKey struct {
+	pin              string
+	lifetime         time.Duration
+	confirmBeforeUse bool
+}
+
+func (b *smartcardBackend) ListReaders() ([]string, error) {
+	if b.readers == nil {
+		return nil, errors.New("no reader")
+	}
+	return b.readers, nil
+}
+
+func (b *smartcardBackend) AddSmartcardKey(readerID string, pin []byte, lifetime time.Duration, confirmBeforeUse bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if string(pin) != "123456" {
+		return errors.New("wrong PIN")
+	}
+	b.added[readerID] = smartcardKey{string(pin), lifetime, confirmBeforeUse}
+	return nil
+}
+
+func (b *smartcardBackend) RemoveSmartcardKey(readerID string, pin []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.added[readerID]; !ok {
+		return errors.New("not added")
+	}
+	delete(b.added, readerID)
+	return nil
+}
+
+func TestServerSmartcardBackend(t *testing.T) {
+	t.Parallel()
+	backend := &smartcardBackend{
+		readers: []string{"Yubico YubiKey OTP+FIDO+CCID 00 00"},
+		added:   make(map[string]smartcardKey),
+	}
+	c, cleanup := createClient(testServerWithBackend(t, backend))
+	defer cleanup()
+
+	readers, err := c.ListReaders()
+	if err != nil || !reflect.DeepEqual(readers, backend.readers) {
+		t.Errorf("ListReaders() = %v, %v, want %v", readers, err, backend.readers)
+	}
+
+	reader := backend.readers[0]
+	if err := c.AddSmartcardKey(reader, []byte("000000"), 0, false); err == nil {
+		t.Error("expect error for wrong PIN")
+	}
+	if err := c.AddSmartcardKey(reader, []byte("123456"), 5*time.Minute, true); err != nil {
+		t.Fatalf("AddSmartcardKey() unexpected error: %v", err)
+	}
+	want := smartcardKey{"123456", 5 * time.Minute, true}
+	if got := backend.added[reader]; got != want {
+		t.Errorf("the backend got %+v, want %+v", got, want)
+	}
+	if err := c.RemoveSmartcardKey(reader, nil); err != nil {
+		t.Fatalf("RemoveSmartcardKey() unexpected error: %v", err)
+	}
+	if err := c.RemoveSmartcardKey(reader, nil); err == nil {
+		t.Error("expect error to remove a removed smartcard")
+	}
+
+	// The connection is still usable after the failures.
+	if _, err := c.List(); err != nil {
+		t.Errorf("List() unexpected error: %v", err)
+	}
+
+	noReaders, cleanup := createClient(testServerWithBackend(t, &smartcardBackend{}))
+	defer cleanup()
+	if _, err := noReaders.ListReaders(); err == nil || !strings.Contains(err.Error(), "no reader") {
+		t.Errorf("ListReaders() error = %v, want the error from the backend", err)
+	}
+	remote, cleanup := createClient(testServer(t))
+	defer cleanup()
+	if _, err := remote.ListReaders(); err == nil {
+		t.Error("expect error to list readers in remote mode")
+	}
+}
+
+func TestServerSmartcardPKCS11(t *testing.T) {
+	t.Parallel()
+
+	// The underlying ssh-agent loads the PKCS#11 provider at the path /path/to/lib.
+	listener, err := nettest.NewLocalListener("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan []byte, 4)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			req, err := read(conn)
+			if err != nil {
+				return
+			}
+			requests <- req
+			resp := []byte{agentFailure}
+			var add agentAddSmartcardKeyReq
+			var remove agentRemoveSmartcardKeyReq
+			if (ssh.Unmarshal(req, &add) == nil && add.ID == "/path/to/lib") ||
+				(ssh.Unmarshal(req, &remove) == nil && remove.ID == "/path/to/lib") {
+				resp = []byte{agentSuccess}
+			}
+			if err := write(conn, resp); err != nil {
+				return
+			}
+		}
+	}()
+	s, err := NewServerWithBackend(listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cleanup := createClient(s)
+	defer cleanup()
+
+	// A request of unconstrained message type is also accepted by the server.
+	unconstrained := ssh.Marshal(agentRemoveSmartcardKeyReq{ID: "/path/to/lib", PIN: []byte("123")})
+	unconstrained[0] = AgentMessageAddSmartcardKey
+	resp, err := c.Forward(unconstrained)
+	if err != nil || len(resp) != 1 || resp[0] != agentSuccess {
+		t.Fatalf("unconstrained request got %v, %v", resp, err)
+	}
+	var msg agentAddSmartcardKeyReq
+	if err := ssh.Unmarshal(<-requests, &msg); err != nil || msg.ID != "/path/to/lib" || string(msg.PIN) != "123" {
+		t.Errorf("the underlying agent got %+v, %v", msg, err)
+	}
+
+	if err := c.AddSmartcardKey("/path/to/lib", []byte("123"), 5*time.Second, true); err != nil {
+		t.Fatalf("AddSmartcardKey() unexpected error: %v", err)
+	}
+	if err := ssh.Unmarshal(<-requests, &msg); err != nil {
+		t.Fatal(err)
+	}
+	lifetime, confirm, err := parseSmartcardConstraints(msg.Constraints)
+	if err != nil || lifetime != 5*time.Second || !confirm {
+		t.Errorf("the underlying agent got constraints %v, %v, %v", lifetime, confirm, err)
+	}
+
+	if err := c.RemoveSmartcardKey("/path/to/lib", nil); err != nil {
+		t.Fatalf("RemoveSmartcardKey() unexpected error: %v", err)
+	}
+	<-requests
+	if err := c.AddSmartcardKey("/other/lib", nil, 0, false); err == nil {
+		t.Error("expect error for the provider rejected by the underlying agent")
+	}
+	<-requests
+
+	// A remote host must not load a PKCS#11 provider through a forwarded agent.
+	forwarded, cleanup := createClient(s)
+	defer cleanup()
+	if _, err := forwarded.Extension(shimagent.SessionBindExtension, newSessionBind(t, true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwarded.AddSmartcardKey("/path/to/lib", []byte("123"), 0, false); err == nil {
+		t.Error("expect error to add a smartcard on a bound session")
+	}
+	select {
+	case req := <-requests:
+		t.Errorf("the request on a bound session is forwarded to the underlying agent: %v", req[0])
+	default:
+	}
+}
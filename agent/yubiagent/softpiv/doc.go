@@ -0,0 +1,9 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package softpiv implements a software PIV token that mimics a YubiKey.
+// The token holds the slot keys and certificates in memory, and issues attestation certificates
+// with the Yubico extensions from an attestation (f9) key signed by a configurable root.
+// It implements yubiagent.PIVBackend, so the hard-key flow can be tested without a physical device.
+// It must not be used in production.
+package softpiv
@@ -0,0 +1,295 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package softpiv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
+)
+
+const (
+	// AttestationSlot is the slot storing the attestation key and certificate.
+	AttestationSlot = "f9"
+
+	defaultSerial     = 12345678
+	defaultFormFactor = yubiattest.FormFactorUSBAKeychain
+	certValidity      = 20 * 365 * 24 * time.Hour
+)
+
+var defaultFirmware = [3]byte{5, 4, 3}
+
+// keySlots contains the PIV slots which can hold a key.
+// Ref: https://developers.yubico.com/PIV/Introduction/Certificate_slots.html
+var keySlots = map[string]struct{}{
+	"9a": {}, "9c": {}, "9d": {}, "9e": {},
+	"82": {}, "83": {}, "84": {}, "85": {}, "86": {}, "87": {}, "88": {}, "89": {}, "8a": {}, "8b": {},
+	"8c": {}, "8d": {}, "8e": {}, "8f": {}, "90": {}, "91": {}, "92": {}, "93": {}, "94": {}, "95": {},
+}
+
+// Option encapsulates the parameters of New function that create new Token objects.
+type Option struct {
+	// Serial is the serial number of the token. The default value is 12345678.
+	Serial uint32
+	// Firmware is the firmware version (major, minor, patch) of the token. The default value is 5.4.3.
+	Firmware [3]byte
+	// FormFactor is the form factor of the token. The default value is a USB-A keychain.
+	FormFactor yubiattest.FormFactor
+	// RootCert and RootKey are used to sign the attestation (f9) certificate of the token.
+	// If either of them is nil, a self-signed root is generated.
+	RootCert *x509.Certificate
+	RootKey  crypto.Signer
+}
+
+// slot is a key slot in the token.
+type slot struct {
+	key         crypto.Signer
+	cert        *x509.Certificate
+	pinPolicy   yubiattest.PINPolicy
+	touchPolicy yubiattest.TouchPolicy
+}
+
+// Token is a software PIV token. It implements yubiagent.PIVBackend.
+type Token struct {
+	mu sync.RWMutex
+
+	serial     uint32
+	firmware   [3]byte
+	formFactor yubiattest.FormFactor
+
+	rootCert *x509.Certificate
+	f9Key    crypto.Signer
+	f9Cert   *x509.Certificate
+	slots    map[string]*slot
+}
+
+// New returns a new Token with an attestation key signed by the root in opt.
+func New(opt Option) (*Token, error) {
+	if opt.Serial == 0 {
+		opt.Serial = defaultSerial
+	}
+	if opt.Firmware == [3]byte{} {
+		opt.Firmware = defaultFirmware
+	}
+	if opt.FormFactor == yubiattest.FormFactorUnknown {
+		opt.FormFactor = defaultFormFactor
+	}
+	if opt.RootCert == nil || opt.RootKey == nil {
+		var err error
+		opt.RootCert, opt.RootKey, err = NewRoot("Soft PIV Root CA")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The attestation key of a YubiKey is always an RSA 2048 key.
+	f9Key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	f9Cert, err := createCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("Soft PIV Attestation %d", opt.Serial)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, opt.RootCert, f9Key.Public(), opt.RootKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attestation certificate: %v", err)
+	}
+
+	return &Token{
+		serial:     opt.Serial,
+		firmware:   opt.Firmware,
+		formFactor: opt.FormFactor,
+		rootCert:   opt.RootCert,
+		f9Key:      f9Key,
+		f9Cert:     f9Cert,
+		slots:      make(map[string]*slot),
+	}, nil
+}
+
+// NewRoot returns a self-signed root certificate and its private key,
+// which can be used as the attestation root of the tokens.
+func NewRoot(commonName string) (*x509.Certificate, crypto.Signer, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := createCertificate(template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, priv, nil
+}
+
+// Root returns the root certificate which signs the attestation certificate of the token.
+func (t *Token) Root() *x509.Certificate {
+	return t.rootCert
+}
+
+// Serial returns the serial number of the token.
+func (t *Token) Serial() uint32 {
+	return t.serial
+}
+
+// GenerateKey generates a key pair in the specified slot with the given PIN and touch policies,
+// and stores a self-signed certificate of the key in the slot. Any existing key in the slot is replaced.
+// Only RSA2048, ECCP256 and ECCP384 keys are supported, as in a YubiKey.
+func (t *Token) GenerateKey(slotID string, algo key.PublicKeyAlgo,
+	pinPolicy yubiattest.PINPolicy, touchPolicy yubiattest.TouchPolicy) (crypto.PublicKey, error) {
+	if _, ok := keySlots[slotID]; !ok {
+		return nil, fmt.Errorf("softpiv: invalid key slot %q", slotID)
+	}
+	switch algo {
+	case key.RSA2048, key.ECDSAsecp256r1, key.ECDSAsecp384r1:
+	default:
+		return nil, fmt.Errorf("softpiv: unsupported key algorithm %s", algo)
+	}
+	priv, _, err := key.GenerateKeyPair(algo)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("softpiv: generated key is not a signer")
+	}
+
+	// Apply the default policies of a YubiKey.
+	if pinPolicy == yubiattest.PINPolicyDefault {
+		pinPolicy = yubiattest.PINPolicyOnce
+	}
+	if touchPolicy == yubiattest.TouchPolicyDefault {
+		touchPolicy = yubiattest.TouchPolicyNever
+	}
+
+	// yubico-piv-tool stores a self-signed certificate after generating a key.
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "SSH key"},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(certValidity),
+	}
+	cert, err := createCertificate(template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slots[slotID] = &slot{
+		key:         signer,
+		cert:        cert,
+		pinPolicy:   pinPolicy,
+		touchPolicy: touchPolicy,
+	}
+	return signer.Public(), nil
+}
+
+// Signer returns the private key in the specified slot.
+// It can be added to an ssh-agent to emulate a PKCS#11 provider.
+func (t *Token) Signer(slotID string) (crypto.Signer, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.slots[slotID]
+	if !ok {
+		return nil, fmt.Errorf("softpiv: slot %q is empty", slotID)
+	}
+	return s.key, nil
+}
+
+// ListSlots lists all the used slots in the token.
+func (t *Token) ListSlots() (slots []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for id := range t.slots {
+		slots = append(slots, id)
+	}
+	sort.Strings(slots)
+	return slots, nil
+}
+
+// ReadSlot reads the x509 certificate from the specified slot.
+func (t *Token) ReadSlot(slotID string) (cert *x509.Certificate, err error) {
+	if slotID == AttestationSlot {
+		return t.f9Cert, nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.slots[slotID]
+	if !ok {
+		return nil, fmt.Errorf("softpiv: slot %q is empty", slotID)
+	}
+	return s.cert, nil
+}
+
+// AttestSlot signs the public key of the specified slot with the attestation key and
+// returns the resulting attestation certificate.
+func (t *Token) AttestSlot(slotID string) (cert *x509.Certificate, err error) {
+	t.mu.RLock()
+	s, ok := t.slots[slotID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("softpiv: slot %q is empty", slotID)
+	}
+
+	serial, err := asn1.Marshal(int64(t.serial))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: fmt.Sprintf("YubiKey PIV Attestation %s", slotID)},
+		NotBefore: t.f9Cert.NotBefore,
+		NotAfter:  t.f9Cert.NotAfter,
+		ExtraExtensions: []pkix.Extension{
+			{Id: yubiattest.OIDFirmwareVersion, Value: t.firmware[:]},
+			{Id: yubiattest.OIDSerialNumber, Value: serial},
+			{Id: yubiattest.OIDPolicy, Value: []byte{byte(s.pinPolicy), byte(s.touchPolicy)}},
+			{Id: yubiattest.OIDFormFactor, Value: []byte{byte(t.formFactor)}},
+		},
+	}
+	return createCertificate(template, t.f9Cert, s.key.Public(), t.f9Key)
+}
+
+func createCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serialNumber
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package softpiv
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/sshutils/key"
+)
+
+func TestTokenGenerateKey(t *testing.T) {
+	t.Parallel()
+	token, err := New(Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		slot    string
+		algo    key.PublicKeyAlgo
+		wantErr bool
+	}{
+		{name: "ECCP256 in 9a", slot: "9a", algo: key.ECDSAsecp256r1},
+		{name: "ECCP384 in 9e", slot: "9e", algo: key.ECDSAsecp384r1},
+		{name: "RSA2048 in retired slot", slot: "82", algo: key.RSA2048},
+		{name: "attestation slot", slot: AttestationSlot, algo: key.ECDSAsecp256r1, wantErr: true},
+		{name: "invalid slot", slot: "zz", algo: key.ECDSAsecp256r1, wantErr: true},
+		{name: "unsupported algorithm", slot: "9c", algo: key.ED25519, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := token.GenerateKey(tt.slot, tt.algo, yubiattest.PINPolicyDefault, yubiattest.TouchPolicyDefault)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			cert, err := token.ReadSlot(tt.slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := x509.MarshalPKIXPublicKey(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("certificate in slot %s mismatches the generated key", tt.slot)
+			}
+		})
+	}
+
+	slots, err := token.ListSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"82", "9a", "9e"}
+	if len(slots) != len(want) {
+		t.Fatalf("ListSlots() got %v, want %v", slots, want)
+	}
+	for i := range want {
+		if slots[i] != want[i] {
+			t.Errorf("ListSlots() got %v, want %v", slots, want)
+		}
+	}
+}
+
+func TestTokenAttestSlot(t *testing.T) {
+	t.Parallel()
+	rootCert, rootKey, err := NewRoot("Unittest Root CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := New(Option{
+		Serial:     0x010203,
+		Firmware:   [3]byte{4, 3, 5},
+		FormFactor: yubiattest.FormFactorUSBCNano,
+		RootCert:   rootCert,
+		RootKey:    rootKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Root() != rootCert {
+		t.Error("token is not signed by the configured root")
+	}
+	if _, err := token.AttestSlot("9a"); err == nil {
+		t.Error("expected error to attest an empty slot")
+	}
+	if _, err := token.GenerateKey("9a", key.ECDSAsecp256r1, yubiattest.PINPolicyAlways, yubiattest.TouchPolicyCached); err != nil {
+		t.Fatal(err)
+	}
+
+	f9Cert, err := token.ReadSlot(AttestationSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestCert, err := token.AttestSlot("9a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	info, err := yubiattest.NewAttestorWithCAPool(roots).Attest(f9Cert, attestCert)
+	if err != nil {
+		t.Fatalf("failed to attest: %v", err)
+	}
+	wantInfo := &yubiattest.AttestationInfo{
+		Serial:      0x010203,
+		ModHex:      "cccbcdce",
+		Firmware:    yubiattest.FirmwareVersion{Major: 4, Minor: 3, Patch: 5},
+		PINPolicy:   yubiattest.PINPolicyAlways,
+		TouchPolicy: yubiattest.TouchPolicyCached,
+		FormFactor:  yubiattest.FormFactorUSBCNano,
+		Slot:        "9a",
+		Root:        rootCert,
+	}
+	if *info != *wantInfo {
+		t.Errorf("Attest() got %+v, want %+v", info, wantInfo)
+	}
+
+	modhex, err := yubiattest.ModHex(attestCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modhex != "cccbcdce" {
+		t.Errorf("ModHex() got %v, want %v", modhex, "cccbcdce")
+	}
+
+	wantExts := map[string][]byte{
+		yubiattest.OIDFirmwareVersion.String(): {4, 3, 5},
+		yubiattest.OIDPolicy.String():          {byte(yubiattest.PINPolicyAlways), byte(yubiattest.TouchPolicyCached)},
+		yubiattest.OIDFormFactor.String():      {byte(yubiattest.FormFactorUSBCNano)},
+	}
+	for _, ext := range attestCert.Extensions {
+		want, ok := wantExts[ext.Id.String()]
+		if !ok {
+			continue
+		}
+		if !bytes.Equal(ext.Value, want) {
+			t.Errorf("extension %v got %v, want %v", ext.Id, ext.Value, want)
+		}
+		delete(wantExts, ext.Id.String())
+	}
+	if len(wantExts) != 0 {
+		t.Errorf("missing extensions %v", wantExts)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package approval implements the queue of gensign requests which require a second person to approve.
+// A handler returns gensign.NewApprovalRequiredError for such a request, and gensign submits it to the Queue.
+// An approver approves or denies the queued request by ysshra-approve, which signs the decision by a decision key.
+// The request waiting for the decision, or the retried request with the request ID, gets the verified decision,
+// and the approval is consumed before the certificates are added to the agent.
+package approval
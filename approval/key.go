@@ -0,0 +1,86 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// approversOption is the option of a decision key listing the approvers allowed to sign by the key.
+const approversOption = "approvers="
+
+// DecisionKey is a public key trusted to sign the decisions of the approvers.
+type DecisionKey struct {
+	Key ssh.PublicKey
+	// Approvers are the approvers allowed to sign by the key. Any approver is allowed if it is empty.
+	Approvers []string
+}
+
+// allows returns true if the approver is allowed to sign by the key.
+func (k *DecisionKey) allows(approver string) bool {
+	if len(k.Approvers) == 0 {
+		return true
+	}
+	for _, a := range k.Approvers {
+		if a == approver {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadDecisionKeys reads the decision keys from the file at path in the authorized_keys format.
+// The option approvers="alice,bob" of a key restricts the approvers allowed to sign by the key.
+func LoadDecisionKeys(path string) ([]DecisionKey, error) {
+	if path == "" {
+		return nil, errors.New("no decision keys configured")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decision keys: %v", err)
+	}
+	var keys []DecisionKey
+	for len(data) > 0 {
+		var (
+			key     ssh.PublicKey
+			options []string
+		)
+		key, _, options, data, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// No more valid keys in the rest of the file.
+			break
+		}
+		k := DecisionKey{Key: key}
+		for _, option := range options {
+			if !strings.HasPrefix(option, approversOption) {
+				return nil, fmt.Errorf("unsupported option %q of decision key %s", option, ssh.FingerprintSHA256(key))
+			}
+			approvers := strings.Trim(strings.TrimPrefix(option, approversOption), `"`)
+			k.Approvers = append(k.Approvers, strings.Split(approvers, ",")...)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no decision keys in %s", path)
+	}
+	return keys, nil
+}
+
+// LoadSigner reads the private key at path, which signs the decisions of the approver.
+func LoadSigner(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	return signer, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package approval
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadDecisionKeys(t *testing.T) {
+	t.Parallel()
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey())))
+	tests := []struct {
+		name          string
+		keys          string
+		wantApprovers [][]string
+		wantErr       bool
+	}{
+		{name: "any approver", keys: key + " approvers\n", wantApprovers: [][]string{nil}},
+		{
+			name:          "restricted approvers",
+			keys:          "# approvers\n" + key + "\n" + `approvers="bob,carol" ` + key + "\n",
+			wantApprovers: [][]string{nil, {"bob", "carol"}},
+		},
+		{name: "unsupported option", keys: `command="true" ` + key + "\n", wantErr: true},
+		{name: "no key", keys: "# no approvers\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "decision_keys")
+			if err := os.WriteFile(path, []byte(tt.keys), 0644); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadDecisionKeys(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadDecisionKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var approvers [][]string
+			for _, k := range keys {
+				approvers = append(approvers, k.Approvers)
+			}
+			if !reflect.DeepEqual(approvers, tt.wantApprovers) {
+				t.Errorf("LoadDecisionKeys() got approvers %v, want %v", approvers, tt.wantApprovers)
+			}
+		})
+	}
+
+	if _, err := LoadDecisionKeys(""); err == nil {
+		t.Error("expect error for no decision keys configured")
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package approval
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/csr/transid"
+	"github.com/theparanoids/ysshra/internal/flock"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// JustificationExt is the key in message.Attributes.Exts for the requester to justify the request.
+	JustificationExt = "justification"
+	// IDExt is the key in message.Attributes.Exts for the requester to retry the queued request with the ID.
+	IDExt = "approval_id"
+
+	lockFileName = ".lock"
+	requestExt   = ".json"
+	// dirPerm and requestPerm are group-writable, so that the gensign processes of all the users
+	// and the approvers can share the queue, see NewQueue.
+	dirPerm     = 0770
+	requestPerm = 0660
+	// decisionDomain separates the signed decisions from the other data signed by the same keys.
+	decisionDomain = "ysshra-approval-decision-v1\n"
+	// maxJustificationLen is the maximum length of a justification kept in the queue.
+	maxJustificationLen = 1024
+)
+
+// validID matches the IDs of the requests, which are also the names of the request files.
+var validID = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// ErrNotFound is returned if the request is not in the queue.
+var ErrNotFound = errors.New("request not found")
+
+// State is the state of a queued request.
+type State string
+
+const (
+	// StatePending indicates the request is waiting for a decision.
+	StatePending State = "pending"
+	// StateApproved indicates the request is approved.
+	StateApproved State = "approved"
+	// StateDenied indicates the request is denied.
+	StateDenied State = "denied"
+)
+
+// Request is a queued request.
+type Request struct {
+	// ID is the transaction ID of the request submitting it.
+	ID      string `json:"id"`
+	Handler string `json:"handler"`
+	LogName string `json:"logName"`
+	// Fingerprint is the fingerprint of the public key to be certified.
+	Fingerprint string   `json:"fingerprint"`
+	ReqUser     string   `json:"reqUser"`
+	ReqHost     string   `json:"reqHost"`
+	ClientIP    string   `json:"clientIP"`
+	Principals  []string `json:"principals"`
+	// Justification is given by the requester in message.Attributes.Exts.
+	Justification string    `json:"justification,omitempty"`
+	Created       time.Time `json:"created"`
+	// Expires is the time after which the request is removed from the queue, whether it is decided or not.
+	Expires time.Time `json:"expires"`
+
+	State    State     `json:"state"`
+	Approver string    `json:"approver,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Decided  time.Time `json:"decided"`
+	// Signature is the signature of the decision by a decision key of the approver.
+	Signature *ssh.Signature `json:"signature,omitempty"`
+}
+
+// decision returns the signed data of the decision on the request.
+func (r *Request) decision() ([]byte, error) {
+	data, err := json.Marshal(struct {
+		ID          string    `json:"id"`
+		Handler     string    `json:"handler"`
+		LogName     string    `json:"logName"`
+		Principals  []string  `json:"principals"`
+		Fingerprint string    `json:"fingerprint"`
+		Expires     time.Time `json:"expires"`
+		State       State     `json:"state"`
+		Approver    string    `json:"approver"`
+		Reason      string    `json:"reason"`
+		Decided     time.Time `json:"decided"`
+	}{r.ID, r.Handler, r.LogName, r.Principals, r.Fingerprint, r.Expires, r.State, r.Approver, r.Reason, r.Decided})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(decisionDomain), data...), nil
+}
+
+// approval returns the approval status of the request.
+func (r *Request) approval() *csr.Approval {
+	return &csr.Approval{
+		ID:       r.ID,
+		Approver: r.Approver,
+		Approved: r.State == StateApproved,
+		Reason:   r.Reason,
+		Time:     r.Decided,
+	}
+}
+
+// matches returns true if the request is for the same handler, requester, principals and key.
+func (r *Request) matches(handler, logName string, principals []string, fingerprint string) bool {
+	if r.Handler != handler || r.LogName != logName || r.Fingerprint != fingerprint || len(r.Principals) != len(principals) {
+		return false
+	}
+	for i := range principals {
+		if r.Principals[i] != principals[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Queue stores the requests in a directory, one file per request. It implements gensign.ApprovalQueue.
+// The directory is locked while the queue is updated, so that the gensign processes serving concurrent
+// requests and the approvers can share the queue.
+type Queue struct {
+	dir  string
+	ttl  time.Duration
+	keys []DecisionKey
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+// NewQueue returns a Queue storing the requests in dir, where the requests expire after ttl.
+// A decision is trusted only if it is signed by one of the keys.
+//
+// gensign runs as the login user, so the directory is shared by the gensign processes of all the users and the approvers.
+// The directory and the files in it are created group-writable regardless of the umask; set up the directory as
+// the audit log directory, e.g. owned by a dedicated group, setgid, and writable by gensign installed setgid to the group.
+// A requester who can write the directory directly may forge a request file, but not the signature of a decision.
+func NewQueue(dir string, ttl time.Duration, keys []DecisionKey) (*Queue, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid time to live %v", ttl)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no decision keys")
+	}
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create approval queue: %v", err)
+	}
+	return &Queue{dir: dir, ttl: ttl, keys: keys, now: time.Now}, nil
+}
+
+// Submit implements gensign.ApprovalQueue. The request is identified by the ID given by the requester in
+// message.Attributes.Exts, or by the transaction ID of the request. The queued request with the ID must be
+// for the same handler, requester, principals and key.
+func (q *Queue) Submit(params *csr.ReqParam, handler string, principals []string, fingerprint string) (*csr.Approval, error) {
+	id, retried := requestID(params)
+	var approval *csr.Approval
+	err := q.update(func(requests []*Request) error {
+		for _, r := range requests {
+			if r.ID != id {
+				continue
+			}
+			if !r.matches(handler, params.LogName, principals, fingerprint) {
+				return fmt.Errorf("request %s is not for the same key and principals", id)
+			}
+			if r.State == StatePending {
+				approval = r.approval()
+				return nil
+			}
+			if err := q.verify(r); err != nil {
+				return err
+			}
+			approval = r.approval()
+			if r.State == StateDenied {
+				// The denial is returned only once.
+				return q.remove(r.ID)
+			}
+			// The approval is removed by Consume once the certificates are issued.
+			return nil
+		}
+		if retried {
+			return fmt.Errorf("request %s: %w", id, ErrNotFound)
+		}
+
+		now := q.now()
+		r := &Request{
+			ID:            id,
+			Handler:       handler,
+			LogName:       params.LogName,
+			Fingerprint:   fingerprint,
+			ReqUser:       params.ReqUser,
+			ReqHost:       params.ReqHost,
+			ClientIP:      params.ClientIP,
+			Principals:    principals,
+			Justification: justification(params),
+			Created:       now,
+			Expires:       now.Add(q.ttl),
+			State:         StatePending,
+		}
+		approval = r.approval()
+		return q.store(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// Consume implements gensign.ApprovalQueue.
+// It returns ErrNotFound if the approved request is not in the queue, e.g. it is consumed by a concurrent request.
+func (q *Queue) Consume(id string) error {
+	return q.update(func(requests []*Request) error {
+		for _, r := range requests {
+			if r.ID == id && r.State == StateApproved {
+				return q.remove(id)
+			}
+		}
+		return fmt.Errorf("approved request %s: %w", id, ErrNotFound)
+	})
+}
+
+// requestID returns the ID of the request given by the requester, or the transaction ID of the request if it is not given.
+// retried is true if the ID is given by the requester.
+func requestID(params *csr.ReqParam) (id string, retried bool) {
+	if params.Attrs != nil {
+		if id, _ := params.Attrs.Exts[IDExt].(string); validID.MatchString(id) {
+			return id, true
+		}
+	}
+	if validID.MatchString(params.TransID) {
+		return params.TransID, false
+	}
+	return transid.Generate(), false
+}
+
+// verify checks the decision on the request is signed by a decision key of the approver.
+func (q *Queue) verify(r *Request) error {
+	if r.Signature == nil {
+		return fmt.Errorf("decision on request %s is not signed", r.ID)
+	}
+	data, err := r.decision()
+	if err != nil {
+		return err
+	}
+	for i := range q.keys {
+		if q.keys[i].allows(r.Approver) && q.keys[i].Key.Verify(data, r.Signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("decision on request %s is not signed by a decision key of %s", r.ID, r.Approver)
+}
+
+// List returns the requests in the queue, sorted by the creation time.
+func (q *Queue) List() ([]*Request, error) {
+	var list []*Request
+	err := q.update(func(requests []*Request) error {
+		list = requests
+		return nil
+	})
+	return list, err
+}
+
+// Approve approves the pending request with the id by the approver, who signs the decision by the signer.
+func (q *Queue) Approve(id, approver, reason string, signer ssh.Signer) (*Request, error) {
+	return q.decide(id, approver, reason, signer, StateApproved)
+}
+
+// Deny denies the pending request with the id by the approver, who signs the decision by the signer.
+func (q *Queue) Deny(id, approver, reason string, signer ssh.Signer) (*Request, error) {
+	return q.decide(id, approver, reason, signer, StateDenied)
+}
+
+func (q *Queue) decide(id, approver, reason string, signer ssh.Signer, state State) (*Request, error) {
+	if approver == "" {
+		return nil, errors.New("empty approver")
+	}
+	var decided *Request
+	err := q.update(func(requests []*Request) error {
+		for _, r := range requests {
+			if r.ID != id {
+				continue
+			}
+			if r.State != StatePending {
+				return fmt.Errorf("request %s is already %s by %s", id, r.State, r.Approver)
+			}
+			if r.LogName == approver {
+				return fmt.Errorf("request %s cannot be decided by the requester %s", id, approver)
+			}
+			r.State, r.Approver, r.Reason, r.Decided = state, approver, reason, q.now()
+			data, err := r.decision()
+			if err != nil {
+				return err
+			}
+			if r.Signature, err = signer.Sign(rand.Reader, data); err != nil {
+				return fmt.Errorf("failed to sign decision: %v", err)
+			}
+			// Fail early if gensign would not trust the decision.
+			if err := q.verify(r); err != nil {
+				return err
+			}
+			decided = r
+			return q.store(r)
+		}
+		return ErrNotFound
+	})
+	return decided, err
+}
+
+// update locks the queue, removes the expired requests, and calls fn with the other requests.
+func (q *Queue) update(fn func(requests []*Request) error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	lock, err := openLockFile(filepath.Join(q.dir, lockFileName))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := flock.Lock(lock); err != nil {
+		return fmt.Errorf("failed to lock approval queue: %v", err)
+	}
+	defer flock.Unlock(lock)
+
+	requests, err := q.load()
+	if err != nil {
+		return err
+	}
+	return fn(requests)
+}
+
+// openLockFile opens the lock file at path, and creates it if it does not exist.
+func openLockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, requestPerm)
+	switch {
+	case err == nil:
+		// The umask of the user may have removed the group write permission.
+		if err := f.Chmod(requestPerm); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to set permission of approval queue lock: %v", err)
+		}
+		return f, nil
+	case errors.Is(err, os.ErrExist):
+		if f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+			return nil, fmt.Errorf("failed to open approval queue lock: %v", err)
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("failed to create approval queue lock: %v", err)
+	}
+}
+
+// load reads the requests in the queue, and removes the expired ones.
+func (q *Queue) load() ([]*Request, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval queue: %v", err)
+	}
+	now := q.now()
+	var requests []*Request
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), requestExt)
+		if !entry.Type().IsRegular() || id == entry.Name() || !validID.MatchString(id) {
+			continue
+		}
+		// The queue directory is writable by every user, so an unreadable request must not fail the queue.
+		data, err := os.ReadFile(filepath.Join(q.dir, entry.Name()))
+		if err != nil {
+			log.Warn().Err(err).Str("request", id).Msg("failed to read request, skip it")
+			continue
+		}
+		r := new(Request)
+		if err := json.Unmarshal(data, r); err != nil || r.ID != id {
+			log.Warn().Err(err).Str("request", id).Msg("corrupted request, skip it")
+			continue
+		}
+		if !now.Before(r.Expires) {
+			if err := q.remove(id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Created.Before(requests[j].Created)
+	})
+	return requests, nil
+}
+
+// store writes the request to its file atomically.
+func (q *Queue) store(r *Request) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(q.dir, ".tmp-"+r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to write request %s: %v", r.ID, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write request %s: %v", r.ID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write request %s: %v", r.ID, err)
+	}
+	if err := os.Chmod(tmp.Name(), requestPerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(q.dir, r.ID+requestExt))
+}
+
+// remove removes the request from the queue.
+func (q *Queue) remove(id string) error {
+	if err := os.Remove(filepath.Join(q.dir, id+requestExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove request %s: %v", id, err)
+	}
+	return nil
+}
+
+// justification returns the justification given by the requester.
+func justification(params *csr.ReqParam) string {
+	if params.Attrs == nil {
+		return ""
+	}
+	s, _ := params.Attrs.Exts[JustificationExt].(string)
+	if len(s) > maxJustificationLen {
+		s = s[:maxJustificationLen]
+	}
+	return s
+}
@@ -0,0 +1,344 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package approval
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/message"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testHandler     = "paranoids.hardkey"
+	testFingerprint = "SHA256:key"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestQueue(t *testing.T, now *time.Time, keys ...DecisionKey) *Queue {
+	t.Helper()
+	q, err := NewQueue(t.TempDir(), time.Hour, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.now = func() time.Time { return *now }
+	return q
+}
+
+// newTestParams returns the params of a request with the transID, retrying the queued request with the id if it is not empty.
+func newTestParams(transID, id string) *csr.ReqParam {
+	exts := map[string]interface{}{JustificationExt: "INC-1234"}
+	if id != "" {
+		exts[IDExt] = id
+	}
+	return &csr.ReqParam{
+		TransID:  transID,
+		LogName:  "alice",
+		ReqUser:  "alice",
+		ReqHost:  "laptop",
+		ClientIP: "10.0.0.1",
+		Attrs:    &message.Attributes{Exts: exts},
+	}
+}
+
+func TestNewQueue(t *testing.T) {
+	t.Parallel()
+	if _, err := NewQueue(t.TempDir(), time.Hour, nil); err == nil {
+		t.Error("expect error for no decision keys")
+	}
+	now := time.Unix(1700000000, 0)
+	q := newTestQueue(t, &now, DecisionKey{Key: newTestSigner(t).PublicKey()})
+	if _, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	// The files are shared by the gensign processes of all the users.
+	for _, name := range []string{lockFileName, "0a1b2c3d4e" + requestExt} {
+		info, err := os.Stat(filepath.Join(q.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != requestPerm {
+			t.Errorf("%s created with %v, want %v", name, info.Mode().Perm(), os.FileMode(requestPerm))
+		}
+	}
+}
+
+func TestQueue_Approve(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner(t)
+	q := newTestQueue(t, &now, DecisionKey{Key: signer.PublicKey()})
+	principals := []string{"alice"}
+
+	a, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, principals, testFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Pending() || a.ID != "0a1b2c3d4e" {
+		t.Fatalf("got approval %+v, want pending request 0a1b2c3d4e", a)
+	}
+	if err := q.Consume("0a1b2c3d4e"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v to consume a pending request, want ErrNotFound", err)
+	}
+	// The retried request gets the status of the queued request.
+	if a, err = q.Submit(newTestParams("5f6a7b8c9d", "0a1b2c3d4e"), testHandler, principals, testFingerprint); err != nil || a.ID != "0a1b2c3d4e" || !a.Pending() {
+		t.Fatalf("got approval %+v, err %v, want pending request 0a1b2c3d4e", a, err)
+	}
+
+	requests, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Justification != "INC-1234" || requests[0].ReqHost != "laptop" ||
+		requests[0].Fingerprint != testFingerprint {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+
+	if _, err := q.Approve("0a1b2c3d4e", "alice", "", signer); err == nil {
+		t.Error("the requester approves the own request")
+	}
+	if _, err := q.Approve("ffffffffff", "bob", "", signer); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, want ErrNotFound", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := q.Approve("0a1b2c3d4e", "bob", "on call", signer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Deny("0a1b2c3d4e", "carol", "too late", signer); err == nil {
+		t.Error("a decided request is decided again")
+	}
+
+	// The approval is bound to the key.
+	if _, err := q.Submit(newTestParams("5f6a7b8c9d", "0a1b2c3d4e"), testHandler, principals, "SHA256:other"); err == nil {
+		t.Error("the approval is used for another key")
+	}
+	// The approval is bound to the request ID.
+	if a, err = q.Submit(newTestParams("5f6a7b8c9d", ""), testHandler, principals, testFingerprint); err != nil || !a.Pending() || a.ID != "5f6a7b8c9d" {
+		t.Fatalf("got approval %+v, err %v, want new pending request 5f6a7b8c9d", a, err)
+	}
+	for i := 0; i < 2; i++ {
+		a, err = q.Submit(newTestParams("6a7b8c9d0e", "0a1b2c3d4e"), testHandler, principals, testFingerprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.Approved || a.Approver != "bob" || a.Reason != "on call" || !a.Time.Equal(now) {
+			t.Fatalf("got approval %+v, want approved by bob", a)
+		}
+	}
+	// The approval is used only once.
+	if err := q.Consume("0a1b2c3d4e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Consume("0a1b2c3d4e"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v to consume the approval again, want ErrNotFound", err)
+	}
+	if _, err = q.Submit(newTestParams("6a7b8c9d0e", "0a1b2c3d4e"), testHandler, principals, testFingerprint); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestQueue_Deny(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner(t)
+	q := newTestQueue(t, &now, DecisionKey{Key: signer.PublicKey()})
+
+	if _, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Deny("0a1b2c3d4e", "bob", "no incident", signer); err != nil {
+		t.Fatal(err)
+	}
+	a, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Pending() || a.Approved || a.Approver != "bob" || a.Reason != "no incident" {
+		t.Fatalf("got approval %+v, want denied by bob", a)
+	}
+	// The denial is returned only once.
+	if _, err = q.Submit(newTestParams("5f6a7b8c9d", "0a1b2c3d4e"), testHandler, []string{"alice"}, testFingerprint); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestQueue_Expire(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner(t)
+	q := newTestQueue(t, &now, DecisionKey{Key: signer.PublicKey()})
+
+	if _, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Approve("0a1b2c3d4e", "bob", "", signer); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	requests, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("got requests %+v, want none", requests)
+	}
+	if _, err := q.Submit(newTestParams("5f6a7b8c9d", "0a1b2c3d4e"), testHandler, []string{"alice"}, testFingerprint); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestQueue_CorruptedRequest(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner(t)
+	q := newTestQueue(t, &now, DecisionKey{Key: signer.PublicKey()})
+
+	if _, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	// Any user can write the queue directory, e.g. a garbage request or a request with another ID.
+	files := map[string]string{
+		"ffffffffff": "garbage",
+		"eeeeeeeeee": `{"id":"0a1b2c3d4e"}`,
+	}
+	for id, data := range files {
+		if err := os.WriteFile(filepath.Join(q.dir, id+requestExt), []byte(data), requestPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The corrupted requests are skipped instead of failing the queue.
+	requests, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].ID != "0a1b2c3d4e" {
+		t.Fatalf("got requests %+v, want 0a1b2c3d4e only", requests)
+	}
+	if _, err := q.Approve("0a1b2c3d4e", "bob", "", signer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit(newTestParams("5f6a7b8c9d", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Approve("ffffffffff", "bob", "", signer); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestQueue_VerifyDecision(t *testing.T) {
+	t.Parallel()
+	signer, other := newTestSigner(t), newTestSigner(t)
+	tests := []struct {
+		name   string
+		keys   []DecisionKey
+		signer ssh.Signer
+		// forge edits the decided request file.
+		forge       func(r *Request)
+		wantErr     string
+		wantSignErr bool
+	}{
+		{name: "signed", keys: []DecisionKey{{Key: signer.PublicKey()}}, signer: signer},
+		{name: "allowed approver", keys: []DecisionKey{{Key: signer.PublicKey(), Approvers: []string{"bob"}}}, signer: signer},
+		{
+			name:        "untrusted key",
+			keys:        []DecisionKey{{Key: signer.PublicKey()}},
+			signer:      other,
+			wantSignErr: true,
+		},
+		{
+			name:        "other approver",
+			keys:        []DecisionKey{{Key: signer.PublicKey(), Approvers: []string{"carol"}}},
+			signer:      signer,
+			wantSignErr: true,
+		},
+		{
+			name:    "forged approval",
+			keys:    []DecisionKey{{Key: signer.PublicKey()}},
+			signer:  signer,
+			forge:   func(r *Request) { r.Signature = nil },
+			wantErr: "not signed",
+		},
+		{
+			name:    "denial turned into approval",
+			keys:    []DecisionKey{{Key: signer.PublicKey()}},
+			signer:  signer,
+			forge:   func(r *Request) { r.State = StateApproved },
+			wantErr: "not signed by a decision key",
+		},
+		{
+			name:    "forged approver",
+			keys:    []DecisionKey{{Key: signer.PublicKey()}},
+			signer:  signer,
+			forge:   func(r *Request) { r.Approver = "carol" },
+			wantErr: "not signed by a decision key",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			now := time.Unix(1700000000, 0)
+			q := newTestQueue(t, &now, tt.keys...)
+			if _, err := q.Submit(newTestParams("0a1b2c3d4e", ""), testHandler, []string{"alice"}, testFingerprint); err != nil {
+				t.Fatal(err)
+			}
+			decide := q.Approve
+			if tt.name == "denial turned into approval" {
+				decide = q.Deny
+			}
+			_, err := decide("0a1b2c3d4e", "bob", "reason", tt.signer)
+			if (err != nil) != tt.wantSignErr {
+				t.Fatalf("decide error = %v, wantSignErr %v", err, tt.wantSignErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.forge != nil {
+				path := filepath.Join(q.dir, "0a1b2c3d4e"+requestExt)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := new(Request)
+				if err := json.Unmarshal(data, r); err != nil {
+					t.Fatal(err)
+				}
+				tt.forge(r)
+				if err := q.store(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a, err := q.Submit(newTestParams("5f6a7b8c9d", "0a1b2c3d4e"), testHandler, []string{"alice"}, testFingerprint)
+			if tt.wantErr == "" {
+				if err != nil || !a.Approved {
+					t.Errorf("got approval %+v, err %v, want approved", a, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
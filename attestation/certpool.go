@@ -0,0 +1,76 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package attestation
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/theparanoids/ysshra/agent/utils"
+)
+
+// LoadCertPool returns a certificate pool containing all the certificates in paths.
+// Each path can be a PEM file containing one or more certificates, or a directory of such files.
+// It returns nil if paths is empty.
+func LoadCertPool(paths []string) (*x509.CertPool, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		certs, err := LoadCertificates(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+	return pool, nil
+}
+
+// LoadCertificates reads the PEM encoded certificates in the file,
+// or in all the files of the directory if path is a directory.
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := utils.ParsePEMCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("%s: no certificate found", path)
+		}
+		return certs, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		c, err := LoadCertificates(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c...)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+	return certs, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package attestation
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writePEM(t *testing.T, path string, certs ...*x509.Certificate) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0400); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	bundlePath := filepath.Join(dir, "bundle.pem")
+	writePEM(t, bundlePath, newTestCA(t, "Root CA"), newTestCA(t, "Another Root CA"))
+	rootDir := filepath.Join(dir, "roots")
+	if err := os.Mkdir(rootDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(rootDir, "a.pem"), newTestCA(t, "Root CA A"))
+	writePEM(t, filepath.Join(rootDir, "b.pem"), newTestCA(t, "Root CA B"))
+	emptyDir := filepath.Join(dir, "empty")
+	if err := os.Mkdir(emptyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	invalidPath := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidPath, []byte("not a certificate"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "bundle", paths: []string{bundlePath}},
+		{name: "directory", paths: []string{rootDir}},
+		{name: "bundle and directory", paths: []string{bundlePath, rootDir}},
+		{name: "directory with invalid file", paths: []string{dir}, wantErr: true},
+		{name: "no paths", wantNil: true},
+		{name: "missing file", paths: []string{filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "empty directory", paths: []string{emptyDir}, wantErr: true},
+		{name: "invalid file", paths: []string{invalidPath}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pool, err := LoadCertPool(tt.paths)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadCertPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (pool == nil) != tt.wantNil {
+				t.Errorf("LoadCertPool() got pool %v, wantNil %v", pool, tt.wantNil)
+			}
+		})
+	}
+}
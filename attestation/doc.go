@@ -1,5 +1,6 @@
 // Copyright 2022 Yahoo Inc.
 // Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
 
-// Package attestation contains subpackages for smartcard attestation.
+// Package attestation contains subpackages for smartcard and security key attestation,
+// and the helpers shared by them.
 package attestation
@@ -0,0 +1,105 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Versions of the attestation file written by ssh-keygen.
+const (
+	// AttestationV00 is written by OpenSSH 8.2 and 8.3, which does not contain the authenticator data.
+	AttestationV00 = "ssh-sk-attest-v00"
+	// AttestationV01 is written by OpenSSH 8.4 and later.
+	AttestationV01 = "ssh-sk-attest-v01"
+)
+
+// Attestation is the attestation of a security key, written by `ssh-keygen -O write-attestation`.
+type Attestation struct {
+	// Version is the version of the attestation file.
+	Version string
+	// Certificate is the attestation certificate of the security key.
+	Certificate *x509.Certificate
+	// Signature is the enrollment signature over the authenticator data and the client data hash.
+	Signature []byte
+	// AuthData is the raw authenticator data. It is nil in AttestationV00.
+	AuthData []byte
+}
+
+// ParseAttestation parses an attestation file written by `ssh-keygen -O write-attestation`.
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.u2f
+func ParseAttestation(blob []byte) (*Attestation, error) {
+	var magic struct {
+		Version string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(blob, &magic); err != nil {
+		return nil, fmt.Errorf("invalid attestation: %v", err)
+	}
+
+	var (
+		att      = &Attestation{Version: magic.Version}
+		certData []byte
+	)
+	switch magic.Version {
+	case AttestationV00:
+		var w struct {
+			Certificate   []byte
+			Signature     []byte
+			ReservedFlags uint32
+			Reserved      []byte
+		}
+		if err := ssh.Unmarshal(magic.Rest, &w); err != nil {
+			return nil, fmt.Errorf("invalid attestation %s: %v", magic.Version, err)
+		}
+		certData, att.Signature = w.Certificate, w.Signature
+	case AttestationV01:
+		var w struct {
+			Certificate   []byte
+			Signature     []byte
+			AuthData      []byte
+			ReservedFlags uint32
+			Reserved      []byte
+		}
+		if err := ssh.Unmarshal(magic.Rest, &w); err != nil {
+			return nil, fmt.Errorf("invalid attestation %s: %v", magic.Version, err)
+		}
+		authData, err := unwrapAuthData(w.AuthData)
+		if err != nil {
+			return nil, err
+		}
+		certData, att.Signature, att.AuthData = w.Certificate, w.Signature, authData
+	default:
+		return nil, fmt.Errorf("unsupported attestation version %q", magic.Version)
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation certificate: %v", err)
+	}
+	att.Certificate = cert
+	return att, nil
+}
+
+// unwrapAuthData returns the raw authenticator data.
+// libfido2 returns the authenticator data wrapped in a CBOR byte string, which is written to the file as is.
+func unwrapAuthData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty authenticator data")
+	}
+	if data[0]>>5 != cborBytes {
+		return data, nil
+	}
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authenticator data: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid authenticator data: %d trailing bytes", len(rest))
+	}
+	return item.([]byte), nil
+}
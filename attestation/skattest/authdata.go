@@ -0,0 +1,134 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Flags of the authenticator data.
+// Ref: https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+const (
+	// FlagUserPresent indicates the user touched the security key.
+	FlagUserPresent byte = 0x01
+	// FlagUserVerified indicates the user was verified by the security key, e.g. by PIN.
+	FlagUserVerified byte = 0x04
+	// FlagAttestedCredentialData indicates the authenticator data contains the attested credential.
+	FlagAttestedCredentialData byte = 0x40
+	// FlagExtensionData indicates the authenticator data contains extensions.
+	FlagExtensionData byte = 0x80
+)
+
+// COSE key parameters and values used by security keys.
+// Ref: https://www.rfc-editor.org/rfc/rfc8152.html#section-13
+const (
+	coseKeyType  = 1
+	coseKeyCurve = -1
+	coseKeyX     = -2
+	coseKeyY     = -3
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// AuthenticatorData is the authenticator data generated by the security key during the enrollment.
+type AuthenticatorData struct {
+	// RPIDHash is the SHA-256 hash of the relying party ID, i.e. the application of the SSH key.
+	RPIDHash [32]byte
+	// Flags is the bit field of the flags, e.g. FlagUserPresent.
+	Flags byte
+	// Counter is the signature counter of the security key.
+	Counter uint32
+	// AAGUID identifies the model of the security key.
+	AAGUID [16]byte
+	// CredentialID is the credential ID, i.e. the key handle of the SSH key.
+	CredentialID []byte
+	// PublicKey is the credential public key, either *ecdsa.PublicKey or ed25519.PublicKey.
+	PublicKey crypto.PublicKey
+}
+
+// ParseAuthenticatorData parses the raw authenticator data containing an attested credential.
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	const headerLen = 32 + 1 + 4
+	if len(data) < headerLen {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &AuthenticatorData{}
+	copy(ad.RPIDHash[:], data[:32])
+	ad.Flags = data[32]
+	ad.Counter = binary.BigEndian.Uint32(data[33:37])
+	data = data[headerLen:]
+
+	if ad.Flags&FlagAttestedCredentialData == 0 {
+		return nil, errors.New("authenticator data contains no attested credential")
+	}
+	if len(data) < 16+2 {
+		return nil, errors.New("attested credential data too short")
+	}
+	copy(ad.AAGUID[:], data[:16])
+	idLen := int(binary.BigEndian.Uint16(data[16:18]))
+	data = data[18:]
+	if len(data) < idLen {
+		return nil, errors.New("credential ID too short")
+	}
+	ad.CredentialID = data[:idLen]
+	data = data[idLen:]
+
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	if ad.PublicKey, err = parseCOSEKey(item); err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	if len(rest) != 0 && ad.Flags&FlagExtensionData == 0 {
+		return nil, fmt.Errorf("authenticator data has %d trailing bytes", len(rest))
+	}
+	return ad, nil
+}
+
+// parseCOSEKey converts a decoded COSE key to a P-256 ECDSA or an ED25519 public key.
+func parseCOSEKey(item interface{}) (crypto.PublicKey, error) {
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+	kty, _ := m[int64(coseKeyType)].(int64)
+	crv, _ := m[int64(coseKeyCurve)].(int64)
+	x, _ := m[int64(coseKeyX)].([]byte)
+
+	switch {
+	case kty == coseKeyTypeEC2 && crv == coseCurveP256:
+		y, _ := m[int64(coseKeyY)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 coordinates")
+		}
+		point := append(append([]byte{0x04}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case kty == coseKeyTypeOKP && crv == coseCurveEd25519:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ED25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %d with curve %d", kty, crv)
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR major types.
+// Ref: https://www.rfc-editor.org/rfc/rfc8949.html#section-3.1
+const (
+	cborUnsigned byte = iota
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// maxCBORDepth limits the nesting of the decoded items.
+const maxCBORDepth = 8
+
+// decodeCBOR decodes the first CBOR data item in data, and returns the rest of data.
+// It only supports the subset of CBOR used by the FIDO authenticator data:
+// integers are decoded to int64, byte strings to []byte, text strings to string,
+// arrays to []interface{}, maps to map[interface{}]interface{} and booleans to bool.
+// Indefinite length items and floating point numbers are not supported.
+func decodeCBOR(data []byte) (item interface{}, rest []byte, err error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	major, arg, rest, err := decodeCBORHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), rest, nil
+	case cborNegative:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), rest, nil
+	case cborBytes, cborText:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		if major == cborText {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+		return rest[:arg], rest[arg:], nil
+	case cborArray:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case cborMap:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case cborTag:
+		// The tag is ignored, and the tagged item is returned.
+		return decodeCBORItem(rest, depth+1)
+	default:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+	}
+}
+
+// decodeCBORHead decodes the initial byte and the argument of a CBOR data item.
+func decodeCBORHead(data []byte) (major byte, arg uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errors.New("cbor: unexpected end of data")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return 0, 0, nil, errors.New("cbor: unexpected end of data")
+		}
+		for _, b := range data[:n] {
+			arg = arg<<8 | uint64(b)
+		}
+		if major == cborSimple && info != 24 {
+			return 0, 0, nil, errors.New("cbor: floating point numbers are not supported")
+		}
+		return major, arg, data[n:], nil
+	case info == 31:
+		return 0, 0, nil, errors.New("cbor: indefinite length items are not supported")
+	default:
+		return 0, 0, nil, fmt.Errorf("cbor: invalid additional information %d", info)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		data     []byte
+		want     interface{}
+		wantRest []byte
+		wantErr  bool
+	}{
+		{name: "small uint", data: []byte{0x17}, want: int64(23)},
+		{name: "uint8", data: []byte{0x18, 0xff}, want: int64(255)},
+		{name: "uint32", data: []byte{0x1a, 0x00, 0x01, 0x00, 0x00}, want: int64(65536)},
+		{name: "negative", data: []byte{0x27}, want: int64(-8)},
+		{name: "bytes", data: []byte{0x43, 1, 2, 3, 0xff}, want: []byte{1, 2, 3}, wantRest: []byte{0xff}},
+		{name: "text", data: []byte{0x63, 'f', 'o', 'o'}, want: "foo"},
+		{name: "array", data: []byte{0x82, 0x01, 0x20}, want: []interface{}{int64(1), int64(-1)}},
+		{
+			name: "map",
+			data: []byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf5},
+			want: map[interface{}]interface{}{int64(1): int64(2), "k": true},
+		},
+		{name: "tag", data: []byte{0xc2, 0x41, 0x01}, want: []byte{0x01}},
+		{name: "empty", data: []byte{}, wantErr: true},
+		{name: "truncated bytes", data: []byte{0x43, 1, 2}, wantErr: true},
+		{name: "truncated head", data: []byte{0x19, 0x01}, wantErr: true},
+		{name: "uint64 overflow", data: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "indefinite length", data: []byte{0x5f, 0x41, 0x01, 0xff}, wantErr: true},
+		{name: "float", data: []byte{0xf9, 0x3c, 0x00}, wantErr: true},
+		{name: "unsupported map key", data: []byte{0xa1, 0x41, 0x01, 0x01}, wantErr: true},
+		{name: "too deep", data: []byte{0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x01}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, rest, err := decodeCBOR(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeCBOR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("decodeCBOR() mismatch (-want +got):\n%s", diff)
+			}
+			if len(rest) != len(tt.wantRest) {
+				t.Errorf("decodeCBOR() rest = %x, want %x", rest, tt.wantRest)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package skattest contains the functions to verify the attestation of FIDO security key (sk-*) SSH keys.
+// The attestation is the file written by `ssh-keygen -O write-attestation` during the key enrollment,
+// which carries a packed format FIDO attestation.
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.u2f
+package skattest
@@ -0,0 +1,7 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package softsk implements a software FIDO security key holding an sk-ssh-ed25519 key.
+// It signs and attests the key in the same formats as OpenSSH with a hardware security key,
+// and is intended for tests and development environments without a security key.
+package softsk
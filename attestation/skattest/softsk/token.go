@@ -0,0 +1,283 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package softsk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	defaultApplication = "ssh:"
+	certValidity       = 20 * 365 * 24 * time.Hour
+
+	// attestationVersion is the version of the attestation file written by ssh-keygen.
+	attestationVersion = "ssh-sk-attest-v01"
+	// flagAttestedCredentialData indicates the authenticator data contains the attested credential.
+	flagAttestedCredentialData byte = 0x40
+)
+
+// oidAAGUID is the object identifier of the FIDO extension carrying the AAGUID in an attestation certificate.
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// errNotSupported is returned by the agent operations not supported by a security key.
+var errNotSupported = errors.New("softsk: operation not supported")
+
+// Option encapsulates the parameters of New function that create new Token objects.
+type Option struct {
+	// Application is the FIDO application of the key. The default value is "ssh:".
+	Application string
+	// AAGUID identifies the model of the token.
+	AAGUID [16]byte
+	// NoTouch makes the token sign without user presence, as a key enrolled with `-O no-touch-required`.
+	NoTouch bool
+	// Verify makes the token sign with user verification, as a key enrolled with `-O verify-required`.
+	Verify bool
+	// RootCert and RootKey are used to sign the attestation certificate of the token.
+	// If either of them is nil, a self-signed root is generated.
+	RootCert *x509.Certificate
+	RootKey  crypto.Signer
+}
+
+// Token is a software security key holding a single sk-ssh-ed25519 key.
+type Token struct {
+	mu      sync.Mutex
+	counter uint32
+
+	app          string
+	aaguid       [16]byte
+	flags        byte
+	priv         ed25519.PrivateKey
+	pub          ssh.PublicKey
+	credentialID []byte
+
+	rootCert   *x509.Certificate
+	attestKey  *ecdsa.PrivateKey
+	attestCert *x509.Certificate
+}
+
+// New returns a new Token with an attestation certificate signed by the root in opt.
+func New(opt Option) (*Token, error) {
+	if opt.Application == "" {
+		opt.Application = defaultApplication
+	}
+	if opt.RootCert == nil || opt.RootKey == nil {
+		var err error
+		opt.RootCert, opt.RootKey, err = softpiv.NewRoot("Soft FIDO Root CA")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, opt.Application}))
+	if err != nil {
+		return nil, err
+	}
+	credentialID := make([]byte, 32)
+	if _, err := rand.Read(credentialID); err != nil {
+		return nil, err
+	}
+
+	attestKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aaguid, err := asn1.Marshal(opt.AAGUID[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Soft FIDO Attestation"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidAAGUID, Value: aaguid}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, opt.RootCert, attestKey.Public(), opt.RootKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attestation certificate: %v", err)
+	}
+	attestCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := key.SKFlagUserPresence
+	if opt.NoTouch {
+		flags = 0
+	}
+	if opt.Verify {
+		flags |= key.SKFlagUserVerification
+	}
+	return &Token{
+		app:          opt.Application,
+		aaguid:       opt.AAGUID,
+		flags:        flags,
+		priv:         priv,
+		pub:          sshPub,
+		credentialID: credentialID,
+		rootCert:     opt.RootCert,
+		attestKey:    attestKey,
+		attestCert:   attestCert,
+	}, nil
+}
+
+// PublicKey returns the sk-ssh-ed25519 public key of the token.
+func (t *Token) PublicKey() ssh.PublicKey {
+	return t.pub
+}
+
+// Root returns the root certificate which signs the attestation certificate of the token.
+func (t *Token) Root() *x509.Certificate {
+	return t.rootCert
+}
+
+// Attest returns the attestation of the key enrolled with the challenge,
+// in the format written by `ssh-keygen -O write-attestation`.
+func (t *Token) Attest(challenge []byte) ([]byte, error) {
+	authData := t.authData()
+	clientDataHash := sha256.Sum256(challenge)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, t.attestKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(struct {
+		Version       string
+		Certificate   []byte
+		Signature     []byte
+		AuthData      []byte
+		ReservedFlags uint32
+		Reserved      []byte
+	}{
+		Version:     attestationVersion,
+		Certificate: t.attestCert.Raw,
+		Signature:   sig,
+		AuthData:    cborBytes(authData),
+	}), nil
+}
+
+// authData returns the authenticator data of the enrollment.
+func (t *Token) authData() []byte {
+	rpIDHash := sha256.Sum256([]byte(t.app))
+	var buf bytes.Buffer
+	buf.Write(rpIDHash[:])
+	buf.WriteByte(t.flags | flagAttestedCredentialData)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(0))
+	buf.Write(t.aaguid[:])
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(t.credentialID)))
+	buf.Write(t.credentialID)
+	// COSE key {1 (kty): 1 (OKP), 3 (alg): -8 (EdDSA), -1 (crv): 6 (Ed25519), -2 (x): public key}.
+	buf.Write([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21})
+	buf.Write(cborBytes(t.priv.Public().(ed25519.PublicKey)))
+	return buf.Bytes()
+}
+
+// Sign signs the data in the security key signature format.
+func (t *Token) Sign(data []byte) (*ssh.Signature, error) {
+	t.mu.Lock()
+	t.counter++
+	counter := t.counter
+	t.mu.Unlock()
+
+	appHash := sha256.Sum256([]byte(t.app))
+	dataHash := sha256.Sum256(data)
+	var blob bytes.Buffer
+	blob.Write(appHash[:])
+	blob.WriteByte(t.flags)
+	_ = binary.Write(&blob, binary.BigEndian, counter)
+	blob.Write(dataHash[:])
+
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(t.priv, blob.Bytes()),
+		Rest: ssh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{t.flags, counter}),
+	}, nil
+}
+
+// Agent returns an ssh agent holding the key of the token.
+// Like ssh-agent with a security key, it only supports listing and signing.
+func (t *Token) Agent() agent.Agent {
+	return &tokenAgent{token: t}
+}
+
+// cborBytes encodes data as a CBOR byte string.
+func cborBytes(data []byte) []byte {
+	const major = 2 << 5
+	var head []byte
+	switch n := len(data); {
+	case n < 24:
+		head = []byte{major | byte(n)}
+	case n <= 0xff:
+		head = []byte{major | 24, byte(n)}
+	default:
+		head = []byte{major | 25, byte(n >> 8), byte(n)}
+	}
+	return append(head, data...)
+}
+
+// tokenAgent implements agent.Agent with a Token.
+type tokenAgent struct {
+	token *Token
+}
+
+func (a *tokenAgent) List() ([]*agent.Key, error) {
+	pub := a.token.PublicKey()
+	return []*agent.Key{{Format: pub.Type(), Blob: pub.Marshal(), Comment: "softsk"}}, nil
+}
+
+func (a *tokenAgent) Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if !bytes.Equal(pub.Marshal(), a.token.PublicKey().Marshal()) {
+		return nil, errors.New("softsk: key not found")
+	}
+	return a.token.Sign(data)
+}
+
+func (a *tokenAgent) Add(agent.AddedKey) error { return errNotSupported }
+
+func (a *tokenAgent) Remove(ssh.PublicKey) error { return errNotSupported }
+
+func (a *tokenAgent) RemoveAll() error { return errNotSupported }
+
+func (a *tokenAgent) Lock([]byte) error { return errNotSupported }
+
+func (a *tokenAgent) Unlock([]byte) error { return errNotSupported }
+
+func (a *tokenAgent) Signers() ([]ssh.Signer, error) { return nil, errNotSupported }
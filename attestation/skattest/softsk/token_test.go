@@ -0,0 +1,60 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package softsk
+
+import (
+	"testing"
+
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTokenSign(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		opt       Option
+		wantFlags byte
+	}{
+		{name: "default", opt: Option{}, wantFlags: key.SKFlagUserPresence},
+		{name: "no touch", opt: Option{NoTouch: true}, wantFlags: 0},
+		{name: "verify", opt: Option{Verify: true}, wantFlags: key.SKFlagUserPresence | key.SKFlagUserVerification},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			token, err := New(tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ag := token.Agent()
+			keys, err := ag.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || keys[0].Type() != ssh.KeyAlgoSKED25519 {
+				t.Fatalf("List() got %v, want a single %s key", keys, ssh.KeyAlgoSKED25519)
+			}
+
+			data := []byte("data")
+			for wantCounter := uint32(1); wantCounter <= 2; wantCounter++ {
+				sig, err := ag.Sign(token.PublicKey(), data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := token.PublicKey().Verify(data, sig); err != nil {
+					t.Fatalf("Verify() unexpected error: %v", err)
+				}
+				flags, counter, err := key.SecurityKeySignatureFlags(sig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if flags != tt.wantFlags || counter != wantCounter {
+					t.Errorf("got flags %#x, counter %d, want flags %#x, counter %d", flags, counter, tt.wantFlags, wantCounter)
+				}
+			}
+		})
+	}
+}
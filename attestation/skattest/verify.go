@@ -0,0 +1,162 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/theparanoids/ysshra/attestation"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// OIDAAGUID is the object identifier of the FIDO extension carrying the AAGUID in an attestation certificate.
+// Ref: https://www.w3.org/TR/webauthn-2/#sctn-packed-attestation-cert-requirements
+var OIDAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Result contains the facts about a security key obtained from a verified attestation.
+type Result struct {
+	// AuthData is the authenticator data of the enrollment.
+	AuthData *AuthenticatorData
+	// Certificate is the attestation certificate of the security key.
+	Certificate *x509.Certificate
+	// Root is the trusted root certificate anchoring the attestation certificate.
+	Root *x509.Certificate
+}
+
+// Verifier verifies the attestation of security keys.
+type Verifier struct {
+	// roots is a certificate pool of the trusted FIDO attestation root CAs, e.g. Yubico U2F Root CA.
+	roots *x509.CertPool
+}
+
+// NewVerifier returns a new Verifier trusting the root CA certificates in roots.
+func NewVerifier(roots *x509.CertPool) *Verifier {
+	return &Verifier{roots: roots}
+}
+
+// NewVerifierFromFiles returns a new Verifier trusting the root CA certificates in rootPaths.
+// Each path can be a PEM file containing one or more certificates, or a directory of such files.
+func NewVerifierFromFiles(rootPaths []string) (*Verifier, error) {
+	roots, err := attestation.LoadCertPool(rootPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA certificates, %v", err)
+	}
+	if roots == nil {
+		return nil, errors.New("cannot add root CA certificates")
+	}
+	return NewVerifier(roots), nil
+}
+
+// Verify verifies the attestation of the security key pub, enrolled with the challenge.
+// The challenge is the one passed to `ssh-keygen -O challenge=path`.
+// It checks the attestation certificate is issued by a trusted root,
+// the attested credential is the key pub for the same application,
+// and the enrollment signature is signed by the attestation certificate.
+func (v *Verifier) Verify(att *Attestation, pub ssh.PublicKey, challenge []byte) (*Result, error) {
+	if att.AuthData == nil {
+		return nil, fmt.Errorf("attestation %s does not contain the authenticator data", att.Version)
+	}
+	authData, err := ParseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := key.SecurityKeyApplication(pub)
+	if err != nil {
+		return nil, err
+	}
+	if rpIDHash := sha256.Sum256([]byte(app)); authData.RPIDHash != rpIDHash {
+		return nil, fmt.Errorf("the attested credential is not for application %q", app)
+	}
+	cryptoPub, err := key.SecurityKeyCryptoPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	equaler, ok := authData.PublicKey.(interface{ Equal(x crypto.PublicKey) bool })
+	if !ok || !equaler.Equal(cryptoPub) {
+		return nil, errors.New("the attested credential mismatches the public key")
+	}
+
+	cert := att.Certificate
+	if cert.IsCA {
+		return nil, errors.New("the attestation certificate must not be a CA certificate")
+	}
+	if err := checkAAGUID(cert, authData.AAGUID); err != nil {
+		return nil, err
+	}
+	if err := checkSignature(cert, att.AuthData, att.Signature, challenge); err != nil {
+		return nil, fmt.Errorf("failed to verify the enrollment signature: %v", err)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     v.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		AuthData:    authData,
+		Certificate: cert,
+		Root:        chains[0][len(chains[0])-1],
+	}, nil
+}
+
+// checkAAGUID checks the AAGUID extension, if present, matches the AAGUID in the authenticator data.
+func checkAAGUID(cert *x509.Certificate, aaguid [16]byte) error {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDAAGUID) {
+			continue
+		}
+		var value []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &value); err != nil || len(rest) != 0 {
+			return fmt.Errorf("invalid AAGUID extension: %x", ext.Value)
+		}
+		if !bytes.Equal(value, aaguid[:]) {
+			return fmt.Errorf("the AAGUID %x in authenticator data mismatches the attestation certificate", aaguid)
+		}
+	}
+	return nil
+}
+
+// checkSignature verifies the packed attestation signature over the authenticator data and the client data hash.
+// ssh-keygen uses the SHA-256 hash of the challenge as the client data hash.
+// Old versions of libfido2 take a 32-byte challenge as the client data hash directly, which is also accepted.
+func checkSignature(cert *x509.Certificate, authData, sig, challenge []byte) error {
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported attestation key type %T", cert.PublicKey)
+	}
+
+	clientDataHash := sha256.Sum256(challenge)
+	candidates := [][]byte{clientDataHash[:]}
+	if len(challenge) == sha256.Size {
+		candidates = append(candidates, challenge)
+	}
+	var err error
+	for _, cdh := range candidates {
+		signed := append(append([]byte{}, authData...), cdh...)
+		if err = cert.CheckSignature(algo, signed, sig); err == nil {
+			return nil
+		}
+	}
+	return err
+}
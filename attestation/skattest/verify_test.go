@@ -0,0 +1,165 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package skattest
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/attestation/skattest/softsk"
+	"golang.org/x/crypto/ssh"
+)
+
+func newToken(t *testing.T, opt softsk.Option) *softsk.Token {
+	t.Helper()
+	token, err := softsk.New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseAttestation(t *testing.T) {
+	t.Parallel()
+	token := newToken(t, softsk.Option{})
+	blob, err := token.Attest([]byte("challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v00 := ssh.Marshal(struct {
+		Version       string
+		Certificate   []byte
+		Signature     []byte
+		ReservedFlags uint32
+		Reserved      []byte
+	}{AttestationV00, token.Root().Raw, []byte("sig"), 0, nil})
+
+	tests := []struct {
+		name        string
+		blob        []byte
+		wantVersion string
+		wantErr     bool
+	}{
+		{name: "v01", blob: blob, wantVersion: AttestationV01},
+		{name: "v00", blob: v00, wantVersion: AttestationV00},
+		{name: "unknown version", blob: ssh.Marshal(struct{ Version string }{"ssh-sk-attest-v99"}), wantErr: true},
+		{name: "truncated", blob: blob[:len(blob)-8], wantErr: true},
+		{name: "empty", blob: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			att, err := ParseAttestation(tt.blob)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAttestation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if att.Version != tt.wantVersion {
+				t.Errorf("ParseAttestation() version = %q, want %q", att.Version, tt.wantVersion)
+			}
+			if tt.wantVersion == AttestationV01 && len(att.AuthData) == 0 {
+				t.Error("ParseAttestation() got no authenticator data")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	rootCert, rootKey, err := softpiv.NewRoot("test root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aaguid := [16]byte{0xcb, 0x69, 0x48, 0x1e}
+	token := newToken(t, softsk.Option{RootCert: rootCert, RootKey: rootKey, AAGUID: aaguid, Verify: true})
+	otherToken := newToken(t, softsk.Option{RootCert: rootCert, RootKey: rootKey})
+	untrustedToken := newToken(t, softsk.Option{})
+
+	challenge := []byte("enrollment challenge")
+	attest := func(token *softsk.Token) *Attestation {
+		blob, err := token.Attest(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		att, err := ParseAttestation(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return att
+	}
+	tampered := attest(token)
+	tampered.AuthData = append([]byte{}, tampered.AuthData...)
+	tampered.AuthData[33] ^= 0xff
+	v00 := attest(token)
+	v00.Version, v00.AuthData = AttestationV00, nil
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	verifier := NewVerifier(roots)
+
+	tests := []struct {
+		name      string
+		att       *Attestation
+		pub       ssh.PublicKey
+		challenge []byte
+		wantErr   bool
+	}{
+		{name: "valid", att: attest(token), pub: token.PublicKey(), challenge: challenge},
+		{name: "wrong challenge", att: attest(token), pub: token.PublicKey(), challenge: []byte("other"), wantErr: true},
+		{name: "another key", att: attest(token), pub: otherToken.PublicKey(), challenge: challenge, wantErr: true},
+		{name: "untrusted root", att: attest(untrustedToken), pub: untrustedToken.PublicKey(), challenge: challenge, wantErr: true},
+		{name: "tampered authenticator data", att: tampered, pub: token.PublicKey(), challenge: challenge, wantErr: true},
+		{name: "v00", att: v00, pub: token.PublicKey(), challenge: challenge, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := verifier.Verify(tt.att, tt.pub, tt.challenge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !got.Root.Equal(rootCert) {
+				t.Errorf("Verify() root = %v, want %v", got.Root.Subject, rootCert.Subject)
+			}
+			if got.AuthData.AAGUID != aaguid {
+				t.Errorf("Verify() AAGUID = %x, want %x", got.AuthData.AAGUID, aaguid)
+			}
+			if got.AuthData.Flags&FlagUserVerified == 0 {
+				t.Errorf("Verify() flags = %#x, want user verified", got.AuthData.Flags)
+			}
+		})
+	}
+}
+
+func TestNewVerifierFromFiles(t *testing.T) {
+	t.Parallel()
+	rootCert, _, err := softpiv.NewRoot("test root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPath := path.Join(t.TempDir(), "root.pem")
+	if err := os.WriteFile(rootPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw}), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifierFromFiles([]string{rootPath}); err != nil {
+		t.Errorf("NewVerifierFromFiles() unexpected error: %v", err)
+	}
+	if _, err := NewVerifierFromFiles(nil); err == nil {
+		t.Error("NewVerifierFromFiles() expected error for no roots")
+	}
+	if _, err := NewVerifierFromFiles([]string{"/nonexistent"}); err == nil {
+		t.Error("NewVerifierFromFiles() expected error for missing file")
+	}
+}
@@ -17,6 +17,8 @@ const (
 type Attestor struct {
 	// roots is a certificate pool, which should include YubicoPIVRootCA and YubicoU2FRootCA.
 	roots *x509.CertPool
+	// intermediates is a certificate pool of the intermediate CAs between the roots and f9 certificates.
+	intermediates *x509.CertPool
 }
 
 // NewAttestor returns a new Attestor struct.
@@ -44,8 +46,16 @@ func NewAttestor(pivRootCAPath string, u2fRootCAPath string) (*Attestor, error)
 
 // NewAttestorWithCAPool returns a new Attestor struct.
 func NewAttestorWithCAPool(roots *x509.CertPool) *Attestor {
+	return NewAttestorWithCAPools(roots, nil)
+}
+
+// NewAttestorWithCAPools returns a new Attestor trusting the root CA certificates in roots.
+// intermediates are the intermediate CA certificates which may be absent from the attestation chain,
+// and can be nil.
+func NewAttestorWithCAPools(roots *x509.CertPool, intermediates *x509.CertPool) *Attestor {
 	return &Attestor{
-		roots: roots,
+		roots:         roots,
+		intermediates: intermediates,
 	}
 }
 
@@ -54,12 +64,51 @@ func NewAttestorWithCAPool(roots *x509.CertPool) *Attestor {
 // attestation key slot. Attestation verifies such a certificate chain: YubicoPIVCA
 // or YubicoU2FCA signs a f9 (attestation slot) cert, then the f9 cert signs attestCert.
 // Note: the private key of an attestCert is backed in 9a or 9e key slot.
+// On success, it returns the facts decoded from the Yubico extensions of attestCert.
 // Ref: https://developers.yubico.com/PIV/Introduction/Certificate_slots.html
-func (a *Attestor) Attest(f9Cert *x509.Certificate, attestCert *x509.Certificate) error {
-	// Check whether f9 certificate is signed by YubiKey root certificate.
-	if _, err := f9Cert.Verify(x509.VerifyOptions{Roots: a.roots}); err != nil {
-		return err
+func (a *Attestor) Attest(f9Cert *x509.Certificate, attestCert *x509.Certificate) (*AttestationInfo, error) {
+	return a.AttestChain(attestCert, f9Cert)
+}
+
+// AttestChain performs attestation on an arbitrary attestation chain.
+// The chain starts with the attestation certificate, followed by the f9 certificate,
+// and then any intermediate CA certificates (in any order) between the f9 certificate and a trusted root.
+// The intermediates configured in the Attestor are also used to build the path.
+// On success, it returns the facts decoded from the attestation certificate,
+// together with the root certificate anchoring the chain.
+func (a *Attestor) AttestChain(chain ...*x509.Certificate) (*AttestationInfo, error) {
+	if len(chain) < 2 {
+		return nil, fmt.Errorf("attestation chain too short, want at least 2 certificates, got %d", len(chain))
+	}
+	attestCert, f9Cert := chain[0], chain[1]
+
+	intermediates := x509.NewCertPool()
+	if a.intermediates != nil {
+		intermediates = a.intermediates.Clone()
+	}
+	for _, cert := range chain[2:] {
+		intermediates.AddCert(cert)
+	}
+
+	// Check whether f9 certificate is issued by a trusted root, possibly through intermediates.
+	chains, err := f9Cert.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
 	}
 	// Check whether attestation certificate is signed by F9 certificate.
-	return checkSignature(attestCert.SignatureAlgorithm, attestCert.RawTBSCertificate, attestCert.Signature, f9Cert.PublicKey)
+	// The attestation certificates issued by old firmware cannot be verified by the standard library.
+	if err := checkSignature(attestCert.SignatureAlgorithm, attestCert.RawTBSCertificate, attestCert.Signature, f9Cert.PublicKey); err != nil {
+		return nil, err
+	}
+
+	info, err := ParseAttestationInfo(attestCert)
+	if err != nil {
+		return nil, err
+	}
+	info.Root = chains[0][len(chains[0])-1]
+	return info, nil
 }
@@ -4,8 +4,17 @@
 package yubiattest
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
 	"testing"
+	"time"
 )
 
 const fakeYubicoPIVRootCA = "./testdata/Unittest_Root_CA.crt"
@@ -34,7 +43,7 @@ func TestInvalidAttest(t *testing.T) {
 			t.Errorf("unexpected error, %v", err2)
 			continue
 		}
-		err2 = attester.Attest(f9Cert, attestCert)
+		_, err2 = attester.Attest(f9Cert, attestCert)
 		if err2 != rsa.ErrVerification {
 			t.Errorf("expected %v, got %v", rsa.ErrVerification, err2)
 		}
@@ -49,7 +58,7 @@ func TestInvalidAttest(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := attester.Attest(f9Cert, attestCert); err == nil {
+	if _, err := attester.Attest(f9Cert, attestCert); err == nil {
 		t.Error("expected error for certificate signed by unknown authority")
 	}
 }
@@ -76,8 +85,147 @@ func TestAttest(t *testing.T) {
 			t.Errorf("unexpected error, %v", err)
 			continue
 		}
-		if err = attester.Attest(f9Cert, attestCert); err != nil {
+		if _, err = attester.Attest(f9Cert, attestCert); err != nil {
 			t.Error(err)
 		}
 	}
 }
+
+// testCA is a certificate and its private key for unit tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// newTestCert creates a certificate signed by parent. A nil parent creates a self-signed certificate.
+// The key of a CA is an ECDSA key, the key of a non-CA (i.e. f9) is an RSA key as in a YubiKey.
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCA, exts ...pkix.Extension) *testCA {
+	t.Helper()
+	var (
+		priv crypto.Signer
+		err  error
+	)
+	if isCA {
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		ExtraExtensions:       exts,
+	}
+	parentCert, parentKey := template, priv
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, priv.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: priv}
+}
+
+func TestAttestChain(t *testing.T) {
+	t.Parallel()
+	rootA := newTestCert(t, "Root CA A", true, nil)
+	rootB := newTestCert(t, "Root CA B", true, nil)
+	intermediate := newTestCert(t, "Intermediate CA", true, rootB)
+	f9 := newTestCert(t, "Attestation f9", false, intermediate)
+	f9FromRootA := newTestCert(t, "Attestation f9 A", false, rootA)
+	serial, err := asn1.Marshal(int64(0x010203))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := newTestCert(t, "YubiKey PIV Attestation 9a", false, f9, pkix.Extension{Id: OIDSerialNumber, Value: serial})
+	leafFromRootA := newTestCert(t, "YubiKey PIV Attestation 9c", false, f9FromRootA)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootA.cert)
+	roots.AddCert(rootB.cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate.cert)
+
+	withoutIntermediates := NewAttestorWithCAPool(roots)
+	withIntermediates := NewAttestorWithCAPools(roots, intermediates)
+
+	tests := []struct {
+		name     string
+		attestor *Attestor
+		chain    []*x509.Certificate
+		wantRoot *x509.Certificate
+		wantSlot string
+		wantErr  bool
+	}{
+		{
+			name:     "intermediate in chain",
+			attestor: withoutIntermediates,
+			chain:    []*x509.Certificate{leaf.cert, f9.cert, intermediate.cert},
+			wantRoot: rootB.cert,
+			wantSlot: "9a",
+		},
+		{
+			name:     "intermediate in attestor",
+			attestor: withIntermediates,
+			chain:    []*x509.Certificate{leaf.cert, f9.cert},
+			wantRoot: rootB.cert,
+			wantSlot: "9a",
+		},
+		{
+			name:     "anchored by another root",
+			attestor: withIntermediates,
+			chain:    []*x509.Certificate{leafFromRootA.cert, f9FromRootA.cert},
+			wantRoot: rootA.cert,
+			wantSlot: "9c",
+		},
+		{
+			name:     "missing intermediate",
+			attestor: withoutIntermediates,
+			chain:    []*x509.Certificate{leaf.cert, f9.cert},
+			wantErr:  true,
+		},
+		{
+			name:     "attestation certificate not signed by f9",
+			attestor: withIntermediates,
+			chain:    []*x509.Certificate{leafFromRootA.cert, f9.cert},
+			wantErr:  true,
+		},
+		{
+			name:     "chain too short",
+			attestor: withIntermediates,
+			chain:    []*x509.Certificate{leaf.cert},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			info, err := tt.attestor.AttestChain(tt.chain...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AttestChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !info.Root.Equal(tt.wantRoot) {
+				t.Errorf("AttestChain() anchored by %q, want %q", info.Root.Subject, tt.wantRoot.Subject)
+			}
+			if info.Slot != tt.wantSlot {
+				t.Errorf("AttestChain() got slot %q, want %q", info.Slot, tt.wantSlot)
+			}
+		})
+	}
+}
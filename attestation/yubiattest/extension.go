@@ -0,0 +1,142 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiattest
+
+import (
+	"encoding/asn1"
+	"fmt"
+)
+
+// Yubico specific X.509 extensions in a PIV attestation certificate.
+// Ref: https://developers.yubico.com/PIV/Introduction/PIV_attestation.html
+var (
+	// OIDFirmwareVersion is the extension holding the firmware version of the YubiKey,
+	// encoded as three raw bytes (major, minor, patch).
+	OIDFirmwareVersion = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}
+	// OIDSerialNumber is the extension holding the serial number of the YubiKey, encoded as a DER integer.
+	OIDSerialNumber = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	// OIDPolicy is the extension holding the PIN policy and the touch policy of the attested slot,
+	// encoded as two raw bytes.
+	OIDPolicy = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+	// OIDFormFactor is the extension holding the form factor of the YubiKey, encoded as one raw byte.
+	OIDFormFactor = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 9}
+)
+
+// PINPolicy is the PIN policy of a key slot, as recorded in the attestation certificate.
+type PINPolicy byte
+
+const (
+	// PINPolicyDefault indicates the PIN policy is unknown or not specified.
+	PINPolicyDefault PINPolicy = iota
+	// PINPolicyNever indicates the PIN is never required for operations.
+	PINPolicyNever
+	// PINPolicyOnce indicates the PIN is required once per session.
+	PINPolicyOnce
+	// PINPolicyAlways indicates the PIN is required for every operation.
+	PINPolicyAlways
+)
+
+// TouchPolicy is the touch policy of a key slot, as recorded in the attestation certificate.
+type TouchPolicy byte
+
+const (
+	// TouchPolicyDefault indicates the touch policy is unknown or not specified.
+	TouchPolicyDefault TouchPolicy = iota
+	// TouchPolicyNever indicates the touch is never required for operations.
+	TouchPolicyNever
+	// TouchPolicyAlways indicates the touch is always required for operations.
+	TouchPolicyAlways
+	// TouchPolicyCached indicates the touch is cached for 15s after use.
+	TouchPolicyCached
+)
+
+// FormFactor is the form factor of a YubiKey, as recorded in the attestation certificate.
+// The two most significant bits are flags (see FormFactorFIPS and FormFactorCSPN),
+// the rest identify the physical form of the device.
+type FormFactor byte
+
+const (
+	// FormFactorUnknown indicates the form factor is unknown.
+	FormFactorUnknown FormFactor = 0x00
+	// FormFactorUSBAKeychain is a USB-A keychain device.
+	FormFactorUSBAKeychain FormFactor = 0x01
+	// FormFactorUSBANano is a USB-A nano device.
+	FormFactorUSBANano FormFactor = 0x02
+	// FormFactorUSBCKeychain is a USB-C keychain device.
+	FormFactorUSBCKeychain FormFactor = 0x03
+	// FormFactorUSBCNano is a USB-C nano device.
+	FormFactorUSBCNano FormFactor = 0x04
+	// FormFactorUSBCLightning is a device with both USB-C and Lightning connectors.
+	FormFactorUSBCLightning FormFactor = 0x05
+
+	// FormFactorFIPS is the flag set on FIPS certified devices.
+	FormFactorFIPS FormFactor = 0x80
+	// FormFactorCSPN is the flag set on CSPN certified devices.
+	FormFactorCSPN FormFactor = 0x40
+)
+
+// String returns the name of the PIN policy.
+func (p PINPolicy) String() string {
+	switch p {
+	case PINPolicyDefault:
+		return "default"
+	case PINPolicyNever:
+		return "never"
+	case PINPolicyOnce:
+		return "once"
+	case PINPolicyAlways:
+		return "always"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// String returns the name of the touch policy.
+func (p TouchPolicy) String() string {
+	switch p {
+	case TouchPolicyDefault:
+		return "default"
+	case TouchPolicyNever:
+		return "never"
+	case TouchPolicyAlways:
+		return "always"
+	case TouchPolicyCached:
+		return "cached"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// Model returns the form factor without the certification flags.
+func (f FormFactor) Model() FormFactor {
+	return f &^ (FormFactorFIPS | FormFactorCSPN)
+}
+
+// String returns the name of the form factor, followed by the certification flags if any.
+func (f FormFactor) String() string {
+	var name string
+	switch f.Model() {
+	case FormFactorUnknown:
+		name = "unknown"
+	case FormFactorUSBAKeychain:
+		name = "usb-a-keychain"
+	case FormFactorUSBANano:
+		name = "usb-a-nano"
+	case FormFactorUSBCKeychain:
+		name = "usb-c-keychain"
+	case FormFactorUSBCNano:
+		name = "usb-c-nano"
+	case FormFactorUSBCLightning:
+		name = "usb-c-lightning"
+	default:
+		name = fmt.Sprintf("unknown(%d)", byte(f.Model()))
+	}
+	if f&FormFactorFIPS != 0 {
+		name += "+fips"
+	}
+	if f&FormFactorCSPN != 0 {
+		name += "+cspn"
+	}
+	return name
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiattest
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+
+	"github.com/theparanoids/ysshra/keyid"
+)
+
+// attestationSubjectPrefix is the prefix of the common name of an attestation certificate,
+// which is followed by the attested slot, e.g. "YubiKey PIV Attestation 9a".
+const attestationSubjectPrefix = "YubiKey PIV Attestation "
+
+// FirmwareVersion is the firmware version of a YubiKey.
+type FirmwareVersion struct {
+	Major, Minor, Patch uint8
+}
+
+// String returns the version in "major.minor.patch" format.
+func (v FirmwareVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// LessThan checks if this version is released earlier than the other version.
+func (v FirmwareVersion) LessThan(other FirmwareVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// AttestationInfo contains the facts about the attested key and the YubiKey holding it,
+// decoded from the Yubico extensions of a verified attestation certificate.
+// An extension absent in the certificate (e.g. issued by an old firmware) leaves its field in zero value.
+type AttestationInfo struct {
+	// Serial is the serial number of the YubiKey.
+	Serial uint32
+	// ModHex is the serial number in ModHex format.
+	ModHex string
+	// Firmware is the firmware version of the YubiKey.
+	Firmware FirmwareVersion
+	// PINPolicy is the PIN policy of the attested slot.
+	PINPolicy PINPolicy
+	// TouchPolicy is the touch policy of the attested slot.
+	TouchPolicy TouchPolicy
+	// FormFactor is the form factor of the YubiKey.
+	FormFactor FormFactor
+	// Slot is the attested slot, e.g. "9a".
+	Slot string
+	// Root is the trusted root certificate anchoring the attestation chain.
+	// It is nil if the info is not obtained from a verified chain.
+	Root *x509.Certificate
+}
+
+// ParseAttestationInfo decodes the Yubico extensions of an attestation certificate.
+// It does not verify the certificate; use Attestor.Attest to obtain the info of a verified certificate.
+// Ref: https://developers.yubico.com/PIV/Introduction/PIV_attestation.html
+func ParseAttestationInfo(cert *x509.Certificate) (*AttestationInfo, error) {
+	info := &AttestationInfo{}
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(OIDFirmwareVersion):
+			if len(ext.Value) != 3 {
+				return nil, fmt.Errorf("invalid firmware version length: %v", len(ext.Value))
+			}
+			info.Firmware = FirmwareVersion{Major: ext.Value[0], Minor: ext.Value[1], Patch: ext.Value[2]}
+		case ext.Id.Equal(OIDSerialNumber):
+			var serial int64
+			if rest, err := asn1.Unmarshal(ext.Value, &serial); err != nil || len(rest) != 0 || serial < 0 || serial > 0xffffffff {
+				return nil, fmt.Errorf("invalid serial number: %x", ext.Value)
+			}
+			info.Serial = uint32(serial)
+			modhex, err := ModHex(cert)
+			if err != nil {
+				return nil, err
+			}
+			info.ModHex = modhex
+		case ext.Id.Equal(OIDPolicy):
+			if len(ext.Value) != 2 {
+				return nil, fmt.Errorf("invalid policy length: %v", len(ext.Value))
+			}
+			info.PINPolicy = PINPolicy(ext.Value[0])
+			info.TouchPolicy = TouchPolicy(ext.Value[1])
+		case ext.Id.Equal(OIDFormFactor):
+			if len(ext.Value) != 1 {
+				return nil, fmt.Errorf("invalid form factor length: %v", len(ext.Value))
+			}
+			info.FormFactor = FormFactor(ext.Value[0])
+		}
+	}
+	if strings.HasPrefix(cert.Subject.CommonName, attestationSubjectPrefix) {
+		info.Slot = strings.ToLower(strings.TrimPrefix(cert.Subject.CommonName, attestationSubjectPrefix))
+	}
+	return info, nil
+}
+
+// KeyIDTouchPolicy converts the touch policy of the attested slot to the touch policy in KeyID.
+// An unknown touch policy is regarded as never touch, since the touch cannot be guaranteed by the hardware.
+func (p TouchPolicy) KeyIDTouchPolicy() keyid.TouchPolicy {
+	switch p {
+	case TouchPolicyAlways:
+		return keyid.AlwaysTouch
+	case TouchPolicyCached:
+		return keyid.CachedTouch
+	default:
+		return keyid.NeverTouch
+	}
+}
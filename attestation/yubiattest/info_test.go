@@ -0,0 +1,162 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiattest
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/theparanoids/ysshra/keyid"
+)
+
+func TestParseAttestationInfo(t *testing.T) {
+	t.Parallel()
+	fakeCert, err := getCertificateFromFile("./testdata/fake_yubico_piv_attestation.rsa.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyCert, err := getCertificateFromFile("./testdata/Unittest_Authentication_9a_attest.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    *AttestationInfo
+		wantErr bool
+	}{
+		{
+			name: "firmware and serial only",
+			cert: fakeCert,
+			want: &AttestationInfo{
+				Serial:   0x04030201,
+				ModHex:   "cfcecdcb",
+				Firmware: FirmwareVersion{Major: 4, Minor: 3, Patch: 5},
+			},
+		},
+		{
+			name: "no yubico extensions",
+			cert: legacyCert,
+			want: &AttestationInfo{},
+		},
+		{
+			name: "all extensions",
+			cert: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "YubiKey PIV Attestation 9E"},
+				Extensions: []pkix.Extension{
+					{Id: OIDFirmwareVersion, Value: []byte{5, 4, 3}},
+					{Id: OIDSerialNumber, Value: []byte{0x02, 0x03, 0x01, 0x02, 0x03}},
+					{Id: OIDPolicy, Value: []byte{byte(PINPolicyNever), byte(TouchPolicyAlways)}},
+					{Id: OIDFormFactor, Value: []byte{byte(FormFactorUSBCKeychain | FormFactorFIPS)}},
+				},
+			},
+			want: &AttestationInfo{
+				Serial:      0x010203,
+				ModHex:      "cccbcdce",
+				Firmware:    FirmwareVersion{Major: 5, Minor: 4, Patch: 3},
+				PINPolicy:   PINPolicyNever,
+				TouchPolicy: TouchPolicyAlways,
+				FormFactor:  FormFactorUSBCKeychain | FormFactorFIPS,
+				Slot:        "9e",
+			},
+		},
+		{
+			name: "invalid firmware",
+			cert: &x509.Certificate{
+				Extensions: []pkix.Extension{{Id: OIDFirmwareVersion, Value: []byte{5, 4}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid serial",
+			cert: &x509.Certificate{
+				Extensions: []pkix.Extension{{Id: OIDSerialNumber, Value: []byte{0x04, 0x01, 0x05}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid policy",
+			cert: &x509.Certificate{
+				Extensions: []pkix.Extension{{Id: OIDPolicy, Value: []byte{1}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid form factor",
+			cert: &x509.Certificate{
+				Extensions: []pkix.Extension{{Id: OIDFormFactor, Value: []byte{}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseAttestationInfo(tt.cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAttestationInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if *got != *tt.want {
+				t.Errorf("ParseAttestationInfo() got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirmwareVersionLessThan(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		v, other FirmwareVersion
+		want     bool
+	}{
+		{v: FirmwareVersion{4, 3, 5}, other: FirmwareVersion{5, 0, 0}, want: true},
+		{v: FirmwareVersion{5, 2, 7}, other: FirmwareVersion{5, 4, 0}, want: true},
+		{v: FirmwareVersion{5, 4, 2}, other: FirmwareVersion{5, 4, 3}, want: true},
+		{v: FirmwareVersion{5, 4, 3}, other: FirmwareVersion{5, 4, 3}, want: false},
+		{v: FirmwareVersion{5, 7, 1}, other: FirmwareVersion{5, 4, 3}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.v.LessThan(tt.other); got != tt.want {
+			t.Errorf("%v.LessThan(%v) got %v, want %v", tt.v, tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestTouchPolicyKeyIDTouchPolicy(t *testing.T) {
+	t.Parallel()
+	tests := map[TouchPolicy]keyid.TouchPolicy{
+		TouchPolicyDefault: keyid.NeverTouch,
+		TouchPolicyNever:   keyid.NeverTouch,
+		TouchPolicyAlways:  keyid.AlwaysTouch,
+		TouchPolicyCached:  keyid.CachedTouch,
+		TouchPolicy(0x10):  keyid.NeverTouch,
+	}
+	for p, want := range tests {
+		if got := p.KeyIDTouchPolicy(); got != want {
+			t.Errorf("%v.KeyIDTouchPolicy() got %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestFormFactorString(t *testing.T) {
+	t.Parallel()
+	tests := map[FormFactor]string{
+		FormFactorUnknown:                        "unknown",
+		FormFactorUSBANano:                       "usb-a-nano",
+		FormFactorUSBCKeychain | FormFactorFIPS:  "usb-c-keychain+fips",
+		FormFactorUSBCLightning | FormFactorCSPN: "usb-c-lightning+cspn",
+		FormFactor(0x0f):                         "unknown(15)",
+	}
+	for f, want := range tests {
+		if got := f.String(); got != want {
+			t.Errorf("String() got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiattest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PolicyConfig specifies which attested devices are acceptable.
+// An empty field imposes no restriction.
+type PolicyConfig struct {
+	// MinFirmware is the minimum firmware version in "major.minor.patch" format, e.g. "5.2.3".
+	MinFirmware string `mapstructure:"min_firmware"`
+	// TouchPolicies are the allowed touch policies of the slot, i.e. "never", "always" or "cached".
+	TouchPolicies []string `mapstructure:"touch_policies"`
+	// PINPolicies are the allowed PIN policies of the slot, i.e. "never", "once" or "always".
+	PINPolicies []string `mapstructure:"pin_policies"`
+	// FormFactors are the allowed form factors of the device, e.g. "usb-a-keychain" or "usb-c-nano".
+	// The certification flags (FIPS or CSPN) of the device are ignored.
+	FormFactors []string `mapstructure:"form_factors"`
+	// SerialAllowlist lists the serial numbers of the allowed devices.
+	SerialAllowlist []uint32 `mapstructure:"serial_allowlist"`
+	// SerialDenylist lists the serial numbers of the denied devices, e.g. lost or stolen ones.
+	SerialDenylist []uint32 `mapstructure:"serial_denylist"`
+	// SerialBindingFile is the path of the file binding users to their registered devices.
+	// Each line contains a user name followed by the serial numbers of the user's devices,
+	// separated by whitespaces, e.g. "alice 12345678 23456789". Lines starting with "#" are ignored.
+	SerialBindingFile string `mapstructure:"serial_binding_file"`
+}
+
+// PolicyRule identifies the rule of a Policy.
+type PolicyRule int
+
+const (
+	// RuleFirmware requires the minimum firmware version.
+	RuleFirmware PolicyRule = iota + 1
+	// RuleTouchPolicy requires the touch policy of the slot.
+	RuleTouchPolicy
+	// RulePINPolicy requires the PIN policy of the slot.
+	RulePINPolicy
+	// RuleFormFactor requires the form factor of the device.
+	RuleFormFactor
+	// RuleSerialDenied rejects the denied devices, or the devices not in the allowlist.
+	RuleSerialDenied
+	// RuleSerialBinding requires the device to be registered to the user.
+	RuleSerialBinding
+)
+
+// PolicyViolation is the error returned when an attested device violates a rule of the Policy.
+type PolicyViolation struct {
+	Rule PolicyRule
+	msg  string
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.msg
+}
+
+func violation(rule PolicyRule, format string, a ...interface{}) *PolicyViolation {
+	return &PolicyViolation{Rule: rule, msg: fmt.Sprintf(format, a...)}
+}
+
+// Policy checks the attestation info against the configured rules.
+type Policy struct {
+	minFirmware   *FirmwareVersion
+	touchPolicies map[TouchPolicy]bool
+	pinPolicies   map[PINPolicy]bool
+	formFactors   map[FormFactor]bool
+	allowlist     map[uint32]bool
+	denylist      map[uint32]bool
+	bindingFile   string
+}
+
+// NewPolicy returns a Policy with the rules in the config.
+func NewPolicy(conf PolicyConfig) (*Policy, error) {
+	p := &Policy{
+		bindingFile: conf.SerialBindingFile,
+	}
+	if conf.MinFirmware != "" {
+		v, err := ParseFirmwareVersion(conf.MinFirmware)
+		if err != nil {
+			return nil, err
+		}
+		p.minFirmware = &v
+	}
+	if len(conf.TouchPolicies) != 0 {
+		p.touchPolicies = make(map[TouchPolicy]bool)
+		for _, name := range conf.TouchPolicies {
+			tp, ok := parseTouchPolicy(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid touch policy %q", name)
+			}
+			p.touchPolicies[tp] = true
+		}
+	}
+	if len(conf.PINPolicies) != 0 {
+		p.pinPolicies = make(map[PINPolicy]bool)
+		for _, name := range conf.PINPolicies {
+			pp, ok := parsePINPolicy(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid PIN policy %q", name)
+			}
+			p.pinPolicies[pp] = true
+		}
+	}
+	if len(conf.FormFactors) != 0 {
+		p.formFactors = make(map[FormFactor]bool)
+		for _, name := range conf.FormFactors {
+			ff, ok := parseFormFactor(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid form factor %q", name)
+			}
+			p.formFactors[ff] = true
+		}
+	}
+	if len(conf.SerialAllowlist) != 0 {
+		p.allowlist = make(map[uint32]bool)
+		for _, serial := range conf.SerialAllowlist {
+			p.allowlist[serial] = true
+		}
+	}
+	p.denylist = make(map[uint32]bool)
+	for _, serial := range conf.SerialDenylist {
+		p.denylist[serial] = true
+	}
+	return p, nil
+}
+
+func parseTouchPolicy(name string) (TouchPolicy, bool) {
+	for _, tp := range []TouchPolicy{TouchPolicyNever, TouchPolicyAlways, TouchPolicyCached} {
+		if strings.EqualFold(tp.String(), name) {
+			return tp, true
+		}
+	}
+	return TouchPolicyDefault, false
+}
+
+func parsePINPolicy(name string) (PINPolicy, bool) {
+	for _, pp := range []PINPolicy{PINPolicyNever, PINPolicyOnce, PINPolicyAlways} {
+		if strings.EqualFold(pp.String(), name) {
+			return pp, true
+		}
+	}
+	return PINPolicyDefault, false
+}
+
+func parseFormFactor(name string) (FormFactor, bool) {
+	for ff := FormFactorUSBAKeychain; ff <= FormFactorUSBCLightning; ff++ {
+		if strings.EqualFold(ff.String(), name) {
+			return ff, true
+		}
+	}
+	return FormFactorUnknown, false
+}
+
+// ParseFirmwareVersion parses the firmware version in "major.minor.patch" format.
+func ParseFirmwareVersion(s string) (FirmwareVersion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return FirmwareVersion{}, fmt.Errorf("invalid firmware version %q", s)
+	}
+	var nums [3]uint8
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return FirmwareVersion{}, fmt.Errorf("invalid firmware version %q: %v", s, err)
+		}
+		nums[i] = uint8(n)
+	}
+	return FirmwareVersion{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// Check returns a *PolicyViolation if the attested device is not acceptable for the user.
+// Other errors indicate the policy cannot be evaluated, e.g. the serial binding file is unreadable.
+// A nil Policy accepts any device.
+func (p *Policy) Check(info *AttestationInfo, user string) error {
+	if p == nil {
+		return nil
+	}
+	if p.minFirmware != nil && info.Firmware.LessThan(*p.minFirmware) {
+		return violation(RuleFirmware, "firmware %s is older than %s", info.Firmware, p.minFirmware)
+	}
+	if p.touchPolicies != nil && !p.touchPolicies[info.TouchPolicy] {
+		return violation(RuleTouchPolicy, "touch policy %s is not allowed", info.TouchPolicy)
+	}
+	if p.pinPolicies != nil && !p.pinPolicies[info.PINPolicy] {
+		return violation(RulePINPolicy, "PIN policy %s is not allowed", info.PINPolicy)
+	}
+	if p.formFactors != nil && !p.formFactors[info.FormFactor.Model()] {
+		return violation(RuleFormFactor, "form factor %s is not allowed", info.FormFactor)
+	}
+	if p.denylist[info.Serial] {
+		return violation(RuleSerialDenied, "YubiKey %d is denied", info.Serial)
+	}
+	if p.allowlist != nil && !p.allowlist[info.Serial] {
+		return violation(RuleSerialDenied, "YubiKey %d is not in the allowlist", info.Serial)
+	}
+	if p.bindingFile != "" {
+		serials, err := readSerialBinding(p.bindingFile, user)
+		if err != nil {
+			return err
+		}
+		if !serials[info.Serial] {
+			return violation(RuleSerialBinding, "YubiKey %d is not registered to user %s", info.Serial, user)
+		}
+	}
+	return nil
+}
+
+// readSerialBinding returns the serial numbers registered to the user in the binding file.
+func readSerialBinding(path string, user string) (map[uint32]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial binding file: %v", err)
+	}
+	defer file.Close()
+
+	serials := make(map[uint32]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] != user {
+			continue
+		}
+		for _, field := range fields[1:] {
+			serial, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid serial number %q in %s:%d", field, path, lineNum)
+			}
+			serials[uint32(serial)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read serial binding file: %v", err)
+	}
+	return serials, nil
+}
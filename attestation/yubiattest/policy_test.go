@@ -0,0 +1,128 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package yubiattest
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNewPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		conf    PolicyConfig
+		wantErr bool
+	}{
+		{name: "empty", conf: PolicyConfig{}},
+		{
+			name: "all rules",
+			conf: PolicyConfig{
+				MinFirmware:     "5.2.3",
+				TouchPolicies:   []string{"always", "Cached"},
+				PINPolicies:     []string{"once"},
+				FormFactors:     []string{"usb-a-nano", "usb-c-nano"},
+				SerialAllowlist: []uint32{1},
+				SerialDenylist:  []uint32{2},
+			},
+		},
+		{name: "invalid firmware", conf: PolicyConfig{MinFirmware: "5.2"}, wantErr: true},
+		{name: "firmware out of range", conf: PolicyConfig{MinFirmware: "5.2.256"}, wantErr: true},
+		{name: "invalid touch policy", conf: PolicyConfig{TouchPolicies: []string{"default"}}, wantErr: true},
+		{name: "invalid PIN policy", conf: PolicyConfig{PINPolicies: []string{"sometimes"}}, wantErr: true},
+		{name: "invalid form factor", conf: PolicyConfig{FormFactors: []string{"usb-c-nano+fips"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := NewPolicy(tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("NewPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	t.Parallel()
+	bindingFile := path.Join(t.TempDir(), "binding")
+	content := "# user serials\nalice 100 200\n\nbob 300\n"
+	if err := os.WriteFile(bindingFile, []byte(content), 0400); err != nil {
+		t.Fatal(err)
+	}
+	invalidBindingFile := path.Join(t.TempDir(), "binding")
+	if err := os.WriteFile(invalidBindingFile, []byte("alice abc\n"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	info := AttestationInfo{
+		Serial:      100,
+		Firmware:    FirmwareVersion{Major: 5, Minor: 4, Patch: 3},
+		PINPolicy:   PINPolicyOnce,
+		TouchPolicy: TouchPolicyCached,
+		FormFactor:  FormFactorUSBCNano | FormFactorFIPS,
+	}
+	tests := []struct {
+		name      string
+		conf      PolicyConfig
+		user      string
+		wantRule  PolicyRule
+		wantOther bool
+	}{
+		{name: "no rules", conf: PolicyConfig{}, user: "alice"},
+		{
+			name: "all rules satisfied",
+			conf: PolicyConfig{
+				MinFirmware:       "5.4.3",
+				TouchPolicies:     []string{"always", "cached"},
+				PINPolicies:       []string{"once", "always"},
+				FormFactors:       []string{"usb-c-nano"},
+				SerialAllowlist:   []uint32{100, 300},
+				SerialDenylist:    []uint32{400},
+				SerialBindingFile: bindingFile,
+			},
+			user: "alice",
+		},
+		{name: "old firmware", conf: PolicyConfig{MinFirmware: "5.7.0"}, wantRule: RuleFirmware},
+		{name: "touch policy", conf: PolicyConfig{TouchPolicies: []string{"always"}}, wantRule: RuleTouchPolicy},
+		{name: "PIN policy", conf: PolicyConfig{PINPolicies: []string{"always"}}, wantRule: RulePINPolicy},
+		{name: "form factor", conf: PolicyConfig{FormFactors: []string{"usb-a-keychain"}}, wantRule: RuleFormFactor},
+		{name: "denylist", conf: PolicyConfig{SerialDenylist: []uint32{100}}, wantRule: RuleSerialDenied},
+		{name: "not in allowlist", conf: PolicyConfig{SerialAllowlist: []uint32{300}}, wantRule: RuleSerialDenied},
+		{name: "bound to another user", conf: PolicyConfig{SerialBindingFile: bindingFile}, user: "bob", wantRule: RuleSerialBinding},
+		{name: "unknown user", conf: PolicyConfig{SerialBindingFile: bindingFile}, user: "carol", wantRule: RuleSerialBinding},
+		{name: "missing binding file", conf: PolicyConfig{SerialBindingFile: "/nonexistent"}, user: "alice", wantOther: true},
+		{name: "invalid binding file", conf: PolicyConfig{SerialBindingFile: invalidBindingFile}, user: "alice", wantOther: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p, err := NewPolicy(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Check(&info, tt.user)
+			v, isViolation := err.(*PolicyViolation)
+			switch {
+			case tt.wantOther:
+				if err == nil || isViolation {
+					t.Errorf("Check() got %v, want non-violation error", err)
+				}
+			case tt.wantRule == 0:
+				if err != nil {
+					t.Errorf("Check() unexpected error: %v", err)
+				}
+			case !isViolation || v.Rule != tt.wantRule:
+				t.Errorf("Check() got %v, want violation of rule %v", err, tt.wantRule)
+			}
+		})
+	}
+
+	var nilPolicy *Policy
+	if err := nilPolicy.Check(&info, "alice"); err != nil {
+		t.Errorf("nil policy should accept any device, got %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package audit implements a tamper-evident audit log of gensign.
+// The log contains one JSON record per line for each issued certificate and each denied request.
+// Every record includes the hash of the previous record and its own hash, so that a modified,
+// inserted or deleted record breaks the chain and is detected by Verify.
+// Truncating the tail of the log is detected by comparing the last record with a previously saved anchor.
+package audit
@@ -0,0 +1,206 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/internal/flock"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// logPerm is the permission of a new log file. It is group-writable, so that the gensign processes of
+	// the other users can append to the log created by the first one, see NewLogger.
+	logPerm = 0660
+	// tailChunkSize is the size of the chunks read backwards to find the last record.
+	tailChunkSize = 4096
+)
+
+// Logger appends the records to an audit log file. It implements gensign.Auditor.
+// The log file is locked while a record is appended,
+// so that the gensign processes serving concurrent requests can share the log file.
+type Logger struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+// NewLogger returns a Logger appending the records to the log file at path.
+//
+// gensign runs as the login user, so every user requesting certificates appends to the same log file.
+// The log file is created group-writable regardless of the umask if it does not exist, and its group is
+// inherited from the directory if the directory is setgid. Either all the users are in the group of the directory,
+// or gensign is installed setgid to the group, which keeps the users from writing the log outside gensign.
+// It returns an error if the log file exists but is not writable by the current user.
+func NewLogger(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, logPerm)
+	switch {
+	case err == nil:
+		// The umask of the user may have removed the group write permission.
+		if err := f.Chmod(logPerm); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to set permission of audit log: %v", err)
+		}
+	case errors.Is(err, os.ErrExist):
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0); err != nil {
+			return nil, fmt.Errorf("audit log %s is not writable by uid %d: %v", path, os.Getuid(), err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to create audit log: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &Logger{path: path, now: time.Now}, nil
+}
+
+// Issued records a certificate issued for the request by the handler.
+// keyIdentifier is the identifier of the CA key requested to sign the certificate.
+func (l *Logger) Issued(params *csr.ReqParam, handler string, keyIdentifier string, cert *ssh.Certificate) error {
+	record := newRecord(EventIssued, params, handler)
+	record.Principals = cert.ValidPrincipals
+	record.KeyID = cert.KeyId
+	record.CAKeyID = keyIdentifier
+	if cert.SignatureKey != nil {
+		record.CAFingerprint = ssh.FingerprintSHA256(cert.SignatureKey)
+	}
+	record.Serial = cert.Serial
+	record.Fingerprint = ssh.FingerprintSHA256(cert)
+	record.ValidAfter = cert.ValidAfter
+	record.ValidBefore = cert.ValidBefore
+	return l.append(record)
+}
+
+// Denied records a request which fails without any certificate issued.
+func (l *Logger) Denied(params *csr.ReqParam, handler string, reason error) error {
+	record := newRecord(EventDenied, params, handler)
+	if reason != nil {
+		record.Error = reason.Error()
+	}
+	return l.append(record)
+}
+
+// Decided records the decision of an approver on a request waiting for approval.
+func (l *Logger) Decided(request *approval.Request) error {
+	event := EventRejected
+	if request.State == approval.StateApproved {
+		event = EventApproved
+	}
+	return l.append(&Record{
+		Event:      event,
+		TransID:    request.ID,
+		Handler:    request.Handler,
+		ReqUser:    request.ReqUser,
+		ReqHost:    request.ReqHost,
+		LogName:    request.LogName,
+		ClientIP:   request.ClientIP,
+		Principals: request.Principals,
+		ApprovalID: request.ID,
+		Approver:   request.Approver,
+		Reason:     request.Reason,
+	})
+}
+
+// newRecord returns a record of the event for the request.
+func newRecord(event Event, params *csr.ReqParam, handler string) *Record {
+	record := &Record{
+		Event:    event,
+		TransID:  params.TransID,
+		Handler:  handler,
+		ReqUser:  params.ReqUser,
+		ReqHost:  params.ReqHost,
+		LogName:  params.LogName,
+		ClientIP: params.ClientIP,
+	}
+	if params.Approval != nil {
+		record.ApprovalID = params.Approval.ID
+		record.Approver = params.Approval.Approver
+	}
+	return record
+}
+
+// append chains the record to the last record in the log file, and appends it to the file.
+func (l *Logger) append(record *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, logPerm)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	if err := flock.Lock(f); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer flock.Unlock(f)
+
+	last, err := lastRecord(f)
+	if err != nil {
+		return err
+	}
+	record.Time = l.now().UTC()
+	if err := record.chain(last); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return f.Sync()
+}
+
+// lastRecord reads the last record in the log file f. It returns nil if the file is empty.
+func lastRecord(f *os.File) (*Record, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	// Read the file backwards until the line break before the last record is found.
+	var tail []byte
+	for offset := size; offset > 0; {
+		n := int64(tailChunkSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+		if tail[len(tail)-1] != '\n' {
+			return nil, errors.New("audit log is corrupted: incomplete last record")
+		}
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 {
+			tail = tail[i+1:]
+			break
+		}
+		if len(tail) > maxRecordSize {
+			return nil, errors.New("audit log is corrupted: last record too large")
+		}
+	}
+	record, err := parseRecord(tail)
+	if err != nil {
+		return nil, fmt.Errorf("audit log is corrupted: %v", err)
+	}
+	return record, nil
+}
@@ -0,0 +1,378 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/csr"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestCert(t *testing.T) *ssh.Certificate {
+	t.Helper()
+	signers := make([]ssh.Signer, 2)
+	for i := range signers {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signers[i], err = ssh.NewSignerFromKey(priv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert := &ssh.Certificate{
+		Key:             signers[0].PublicKey(),
+		Serial:          42,
+		KeyId:           `{"prins":["alice"],"transID":"a7af667d"}`,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      1000,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, signers[1]); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+var testParams = &csr.ReqParam{
+	TransID:  "a7af667d",
+	ReqUser:  "alice",
+	ReqHost:  "laptop",
+	LogName:  "alice",
+	ClientIP: "10.0.0.1",
+}
+
+// writeTestLog writes n records, alternating between issued and denied, to a new log file.
+func writeTestLog(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCert(t)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			err = l.Issued(testParams, "paranoids.regular", "ssh-user-key", cert)
+		} else {
+			err = l.Denied(testParams, "", errors.New("all authentications failed"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestNewLogger(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	if _, err := NewLogger(path); err != nil {
+		t.Fatalf("NewLogger() unexpected error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != logPerm {
+		t.Errorf("NewLogger() created the log with %v, want %v", info.Mode().Perm(), os.FileMode(logPerm))
+	}
+	// Open the existing log again.
+	if _, err := NewLogger(path); err != nil {
+		t.Errorf("NewLogger() unexpected error for existing log: %v", err)
+	}
+
+	if os.Getuid() == 0 {
+		t.Skip("root can write any log")
+	}
+	readOnly := filepath.Join(dir, "readonly.log")
+	if err := os.WriteFile(readOnly, nil, 0440); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLogger(readOnly); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("NewLogger() error = %v, want not writable error", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+	cert := newTestCert(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Loggers sharing the same file emulate the concurrent gensign processes.
+	const loggers, records = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < loggers; i++ {
+		l, err := NewLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				if err := l.Issued(testParams, "paranoids.regular", "ssh-user-key", cert); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	count, last, err := Verify(f)
+	if err != nil {
+		t.Fatalf("Verify() unexpected error: %v", err)
+	}
+	if count != loggers*records || last.Seq != loggers*records {
+		t.Fatalf("got %d records with last seq %d, want %d", count, last.Seq, loggers*records)
+	}
+	if last.Event != EventIssued || last.TransID != testParams.TransID || last.Handler != "paranoids.regular" ||
+		last.LogName != "alice" || last.ClientIP != "10.0.0.1" || last.Serial != 42 || last.KeyID != cert.KeyId ||
+		last.Fingerprint != ssh.FingerprintSHA256(cert) || last.CAKeyID != "ssh-user-key" ||
+		last.CAFingerprint != ssh.FingerprintSHA256(cert.SignatureKey) ||
+		last.ValidAfter != 1000 || last.ValidBefore != ssh.CertTimeInfinity || len(last.Principals) != 1 {
+		t.Errorf("unexpected record %+v", last)
+	}
+	if time.Since(last.Time) > time.Minute {
+		t.Errorf("unexpected record time %v", last.Time)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		tamper    func(lines [][]byte) [][]byte
+		wantCount int
+		wantLine  int
+	}{
+		{name: "intact", tamper: func(lines [][]byte) [][]byte { return lines }, wantCount: 5},
+		{
+			name: "edited record",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[2] = bytes.Replace(lines[2], []byte(`"alice"`), []byte(`"mallory"`), 1)
+				return lines
+			},
+			wantCount: 2,
+			wantLine:  3,
+		},
+		{
+			name: "deleted record",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			wantCount: 1,
+			wantLine:  2,
+		},
+		{
+			name: "reordered records",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1], lines[3] = lines[3], lines[1]
+				return lines
+			},
+			wantCount: 1,
+			wantLine:  2,
+		},
+		{
+			name: "rehashed record",
+			tamper: func(lines [][]byte) [][]byte {
+				record, err := parseRecord(lines[4])
+				if err != nil {
+					t.Fatal(err)
+				}
+				record.LogName = "mallory"
+				record.Hash, _ = record.computeHash()
+				// The record is consistent by itself, but the chain is not.
+				lines[3] = bytes.Replace(lines[3], []byte(`"alice"`), []byte(`"mallory"`), 1)
+				return lines
+			},
+			wantCount: 3,
+			wantLine:  4,
+		},
+		{
+			name: "unknown field",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[0] = append([]byte(`{"extra":1,`), lines[0][1:]...)
+				return lines
+			},
+			wantLine: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			data, err := os.ReadFile(writeTestLog(t, 5))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			lines = tt.tamper(lines[:len(lines)-1])
+
+			count, _, err := Verify(bytes.NewReader(bytes.Join(lines, nil)))
+			if count != tt.wantCount {
+				t.Errorf("Verify() got %d valid records, want %d", count, tt.wantCount)
+			}
+			var verifyErr *VerifyError
+			if tt.wantLine == 0 {
+				if err != nil {
+					t.Errorf("Verify() unexpected error: %v", err)
+				}
+			} else if !errors.As(err, &verifyErr) || verifyErr.Line != tt.wantLine {
+				t.Errorf("Verify() error = %v, want error at line %d", err, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestLogger_CorruptedLog(t *testing.T) {
+	t.Parallel()
+	path := writeTestLog(t, 2)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Emulate a partial write.
+	if err := os.WriteFile(path, data[:len(data)-10], logPerm); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Denied(testParams, "", errors.New("denied"))
+	if err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("got error %v, want corrupted log error", err)
+	}
+}
+
+func TestVerifyWithAnchor(t *testing.T) {
+	t.Parallel()
+	data, err := os.ReadFile(writeTestLog(t, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, last, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	truncated := bytes.Join(lines[:2], nil)
+
+	tests := []struct {
+		name    string
+		log     []byte
+		anchor  string
+		wantErr bool
+	}{
+		{name: "last record", log: data, anchor: Anchor{Seq: last.Seq, Hash: last.Hash}.String()},
+		{name: "appended after anchor", log: data, anchor: Anchor{Seq: 2, Hash: mustParse(t, lines[1]).Hash}.String()},
+		{name: "truncated", log: truncated, anchor: Anchor{Seq: last.Seq, Hash: last.Hash}.String(), wantErr: true},
+		{name: "empty", log: nil, anchor: Anchor{Seq: last.Seq, Hash: last.Hash}.String(), wantErr: true},
+		{name: "rewritten", log: data, anchor: Anchor{Seq: last.Seq, Hash: "0123"}.String(), wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			anchor, err := ParseAnchor(tt.anchor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = VerifyWithAnchor(bytes.NewReader(tt.log), anchor)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyWithAnchor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAnchor(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		anchor  string
+		want    Anchor
+		wantErr bool
+	}{
+		{anchor: "12:abcd", want: Anchor{Seq: 12, Hash: "abcd"}},
+		{anchor: "abcd", wantErr: true},
+		{anchor: "0:abcd", wantErr: true},
+		{anchor: "x:abcd", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.anchor, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseAnchor(tt.anchor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAnchor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAnchor() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParse(t *testing.T, line []byte) *Record {
+	t.Helper()
+	record, err := parseRecord(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestLogger_Decided(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &approval.Request{
+		ID:         "0a1b2c3d4e",
+		Handler:    "paranoids.hardkey",
+		LogName:    "alice",
+		Principals: []string{"alice"},
+		State:      approval.StateDenied,
+		Approver:   "bob",
+		Reason:     "no incident",
+	}
+	if err := l.Decided(request); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, last, err := Verify(f)
+	if err != nil {
+		t.Fatalf("Verify() unexpected error: %v", err)
+	}
+	if last.Event != EventRejected || last.ApprovalID != request.ID || last.Approver != "bob" ||
+		last.Reason != "no incident" || last.LogName != "alice" {
+		t.Errorf("unexpected record %+v", last)
+	}
+}
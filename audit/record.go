@@ -0,0 +1,224 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRecordSize is the maximum size of a record in the log.
+const maxRecordSize = 1 << 20
+
+// Event is the type of a record.
+type Event string
+
+const (
+	// EventIssued records an issued certificate.
+	EventIssued Event = "issued"
+	// EventDenied records a request which fails without any certificate issued.
+	EventDenied Event = "denied"
+	// EventApproved records an approval of a request waiting for approval.
+	EventApproved Event = "approved"
+	// EventRejected records a rejection of a request waiting for approval.
+	EventRejected Event = "rejected"
+)
+
+// Record is a record in the audit log.
+type Record struct {
+	// Seq is the sequence number of the record, starting from 1.
+	Seq uint64 `json:"seq"`
+	// Time is the time when the record is written.
+	Time  time.Time `json:"time"`
+	Event Event     `json:"event"`
+
+	TransID  string `json:"transID"`
+	Handler  string `json:"handler,omitempty"`
+	ReqUser  string `json:"reqUser"`
+	ReqHost  string `json:"reqHost"`
+	LogName  string `json:"logName"`
+	ClientIP string `json:"clientIP"`
+
+	// The following fields describe the issued certificate.
+	Principals []string `json:"principals,omitempty"`
+	KeyID      string   `json:"keyID,omitempty"`
+	// CAKeyID is the identifier of the CA key requested to sign the certificate, e.g. the Crypki key identifier.
+	CAKeyID string `json:"caKeyID,omitempty"`
+	// CAFingerprint is the SHA256 fingerprint of the CA key signing the certificate.
+	CAFingerprint string `json:"caFingerprint,omitempty"`
+	Serial        uint64 `json:"serial,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of the certificate.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// ValidAfter and ValidBefore are the validity window of the certificate in unix time.
+	ValidAfter  uint64 `json:"validAfter,omitempty"`
+	ValidBefore uint64 `json:"validBefore,omitempty"`
+
+	// ApprovalID and Approver identify the approval of the request, if the handler requires one.
+	ApprovalID string `json:"approvalID,omitempty"`
+	Approver   string `json:"approver,omitempty"`
+	// Reason is the reason given by the approver.
+	Reason string `json:"reason,omitempty"`
+
+	// Error is the reason why the request is denied.
+	Error string `json:"error,omitempty"`
+
+	// PrevHash is the hash of the previous record. It is empty for the first record.
+	PrevHash string `json:"prevHash"`
+	// Hash is the hex encoded SHA256 hash of the record with an empty Hash.
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of the record.
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// chain links the record to the previous record prev, which is nil for the first record,
+// and sets the hash of the record.
+func (r *Record) chain(prev *Record) error {
+	r.Seq, r.PrevHash = 1, ""
+	if prev != nil {
+		r.Seq, r.PrevHash = prev.Seq+1, prev.Hash
+	}
+	hash, err := r.computeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	return nil
+}
+
+// parseRecord parses a line of the log.
+func parseRecord(line []byte) (*Record, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	record := new(Record)
+	if err := decoder.Decode(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// VerifyError is returned by Verify if the chain of the log is broken.
+type VerifyError struct {
+	// Line is the line number of the first invalid record.
+	Line int
+	Err  error
+}
+
+// Error returns the string representation of the VerifyError.
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTruncated is returned by VerifyWithAnchor if the log ends before the anchor.
+var ErrTruncated = errors.New("audit log is truncated before the anchor")
+
+// Anchor identifies a record of the log. It is saved out of the log,
+// e.g. the last record reported by Verify, to detect the truncation of the log later on.
+type Anchor struct {
+	Seq  uint64
+	Hash string
+}
+
+// ParseAnchor parses an anchor in the format "<seq>:<hash>".
+func ParseAnchor(s string) (Anchor, error) {
+	seq, hash, ok := strings.Cut(s, ":")
+	if !ok {
+		return Anchor{}, fmt.Errorf("invalid anchor %q, want <seq>:<hash>", s)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n == 0 {
+		return Anchor{}, fmt.Errorf("invalid sequence number in anchor %q", s)
+	}
+	return Anchor{Seq: n, Hash: hash}, nil
+}
+
+// String returns the anchor in the format accepted by ParseAnchor.
+func (a Anchor) String() string {
+	return fmt.Sprintf("%d:%s", a.Seq, a.Hash)
+}
+
+// Verify verifies the hash chain of the log read from r.
+// It returns the number of records and the last record, which can be saved as an anchor to
+// detect the truncation of the log later on.
+func Verify(r io.Reader) (count int, last *Record, err error) {
+	return verify(r, nil)
+}
+
+// VerifyWithAnchor verifies the hash chain of the log read from r as Verify does,
+// and also verifies that the log contains the record identified by the anchor.
+func VerifyWithAnchor(r io.Reader, anchor Anchor) (count int, last *Record, err error) {
+	return verify(r, &anchor)
+}
+
+func verify(r io.Reader, anchor *Anchor) (count int, last *Record, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		record, err := parseRecord(scanner.Bytes())
+		if err != nil {
+			return count, last, &VerifyError{Line: line, Err: fmt.Errorf("malformed record: %v", err)}
+		}
+		if err := verifyLink(record, last); err != nil {
+			return count, last, &VerifyError{Line: line, Err: err}
+		}
+		if anchor != nil && record.Seq == anchor.Seq && record.Hash != anchor.Hash {
+			return count, last, &VerifyError{Line: line, Err: errors.New("hash mismatches the anchor")}
+		}
+		count++
+		last = record
+	}
+	if err := scanner.Err(); err != nil {
+		return count, last, &VerifyError{Line: line + 1, Err: err}
+	}
+	if anchor != nil && (last == nil || last.Seq < anchor.Seq) {
+		return count, last, ErrTruncated
+	}
+	return count, last, nil
+}
+
+// verifyLink verifies the record and its link to the previous record prev.
+func verifyLink(record, prev *Record) error {
+	wantSeq, wantPrevHash := uint64(1), ""
+	if prev != nil {
+		wantSeq, wantPrevHash = prev.Seq+1, prev.Hash
+	}
+	if record.Seq != wantSeq {
+		return fmt.Errorf("got sequence number %d, want %d", record.Seq, wantSeq)
+	}
+	if record.PrevHash != wantPrevHash {
+		return errors.New("previous hash mismatches")
+	}
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	if record.Hash != hash {
+		return errors.New("hash mismatches")
+	}
+	return nil
+}
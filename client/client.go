@@ -0,0 +1,256 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/message"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// interfaceVersion is the version of the gensign attributes sent by the client.
+	interfaceVersion = 7
+	defaultTimeout   = 30 * time.Second
+)
+
+// Option encapsulates the parameters of New function that create new Client objects.
+type Option struct {
+	// Address is the address of the RA in "host:port" format. Required.
+	Address string
+	// HostKeyCallback verifies the host key of the RA. Required.
+	HostKeyCallback ssh.HostKeyCallback
+	// Agent authenticates the user to the RA, and is forwarded to the RA to receive the certificates. Required.
+	Agent agent.Agent
+	// User is the user to log in the RA. The default value is Username.
+	User string
+	// Username is the requester in the attributes. The default value is the current user.
+	Username string
+	// Hostname is the host of the requester in the attributes. The default value is the current host name.
+	Hostname string
+	// SSHClientVersion is the version of the OpenSSH client in "major.minor" format.
+	// It is detected from the local ssh command if empty.
+	SSHClientVersion string
+	// Timeout is the timeout to connect the RA. The default value is 30 seconds.
+	Timeout time.Duration
+	// Output receives the output of the RA as it arrives, e.g. the prompts to touch the YubiKey. Optional.
+	Output io.Writer
+}
+
+// Request specifies the certificates that the client requests for.
+type Request struct {
+	// HardKey indicates whether the certificates are for the keys backed in a smartcard.
+	HardKey bool
+	// Touch2SSH indicates whether the certificate requires a touch during SSH login challenge.
+	Touch2SSH bool
+	// TouchlessSudo requests a touchless sudo certificate if it is not nil.
+	TouchlessSudo *message.TouchlessSudo
+	// CAPubKeyAlgo is the public key algorithm of the CA that signs the certificates.
+	// The default CA of the RA is used if it is x509.UnknownPublicKeyAlgorithm.
+	CAPubKeyAlgo x509.PublicKeyAlgorithm
+	// Exts contains the extended attributes for specific handlers.
+	Exts map[string]interface{}
+}
+
+// Result is the result of a request.
+type Result struct {
+	// Certificates are the certificates added to the agent during the request.
+	Certificates []*ssh.Certificate
+	// Output is the output of the RA, which is usually the messages to the user.
+	Output []byte
+}
+
+// Client requests certificates from the RA.
+type Client struct {
+	opt Option
+}
+
+// New returns a new Client. The missing fields in opt are filled with the default values.
+func New(opt Option) (*Client, error) {
+	if opt.Address == "" {
+		return nil, errors.New("RA address cannot be empty")
+	}
+	if opt.HostKeyCallback == nil {
+		return nil, errors.New("host key callback cannot be nil")
+	}
+	if opt.Agent == nil {
+		return nil, errors.New("agent cannot be nil")
+	}
+	if opt.Username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current user: %v", err)
+		}
+		opt.Username = u.Username
+	}
+	if opt.User == "" {
+		opt.User = opt.Username
+	}
+	if opt.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get host name: %v", err)
+		}
+		opt.Hostname = hostname
+	}
+	if opt.SSHClientVersion == "" {
+		version, err := DetectSSHClientVersion()
+		if err != nil {
+			return nil, err
+		}
+		opt.SSHClientVersion = version
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultTimeout
+	}
+	return &Client{opt: opt}, nil
+}
+
+// Attributes returns the gensign attributes of the request.
+func (c *Client) Attributes(req Request) *message.Attributes {
+	return &message.Attributes{
+		IfVer:            interfaceVersion,
+		Username:         c.opt.Username,
+		Hostname:         c.opt.Hostname,
+		SSHClientVersion: c.opt.SSHClientVersion,
+		CAPubKeyAlgo:     req.CAPubKeyAlgo,
+		HardKey:          req.HardKey,
+		Touch2SSH:        req.Touch2SSH,
+		TouchlessSudo:    req.TouchlessSudo,
+		Exts:             req.Exts,
+	}
+}
+
+// Run sends the request to the RA with the agent forwarded, and waits for the RA to finish.
+// It returns the certificates that the RA added to the agent.
+func (c *Client) Run(ctx context.Context, req Request) (*Result, error) {
+	cmd, err := c.Attributes(req).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	before, err := c.certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	if err := agent.ForwardToAgent(client, c.opt.Agent); err != nil {
+		return nil, fmt.Errorf("failed to forward agent: %v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return nil, fmt.Errorf("failed to request agent forwarding: %v", err)
+	}
+
+	var output bytes.Buffer
+	w := &syncWriter{w: &output}
+	if c.opt.Output != nil {
+		w.w = io.MultiWriter(&output, c.opt.Output)
+	}
+	session.Stdout = w
+	session.Stderr = w
+	if err := session.Run(cmd); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("request failed: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	after, err := c.certificates()
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Output: output.Bytes()}
+	for blob, cert := range after {
+		if _, ok := before[blob]; !ok {
+			result.Certificates = append(result.Certificates, cert)
+		}
+	}
+	return result, nil
+}
+
+// dial connects to the RA, and authenticates with the keys in the agent.
+func (c *Client) dial(ctx context.Context) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User:            c.opt.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(c.opt.Agent.Signers)},
+		HostKeyCallback: c.opt.HostKeyCallback,
+		Timeout:         c.opt.Timeout,
+	}
+
+	dialer := net.Dialer{Timeout: c.opt.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.opt.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", c.opt.Address, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.opt.Address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to establish ssh connection to %s: %v", c.opt.Address, err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// certificates returns the certificates in the agent, indexed by their wire format.
+func (c *Client) certificates() (map[string]*ssh.Certificate, error) {
+	keys, err := c.opt.Agent.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in agent: %v", err)
+	}
+	certs := make(map[string]*ssh.Certificate)
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			continue
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			certs[string(key.Blob)] = cert
+		}
+	}
+	return certs, nil
+}
+
+// syncWriter serializes the writes of the stdout and the stderr of a session.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes p to the underlying writer.
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,307 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/message"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// raHandler handles a request in the test RA. It returns the output to the user and the exit status.
+type raHandler func(attrs *message.Attributes, ag agent.Agent) (string, uint32)
+
+// newSigner returns a new ed25519 signer with its private key.
+func newSigner(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, signer
+}
+
+// newCert returns a certificate of a new key signed by ca, together with the private key.
+func newCert(t *testing.T, ca ssh.Signer, keyID string) (ed25519.PrivateKey, *ssh.Certificate) {
+	t.Helper()
+	priv, signer := newSigner(t)
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		KeyId:           keyID,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return priv, cert
+}
+
+// newTestRA starts an SSH server standing in for the RA, which runs handle with the forwarded agent
+// for each command. It returns the address and the host key of the server.
+func newTestRA(t *testing.T, userKey ssh.PublicKey, handle raHandler) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostKey := newSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userKey.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestRA(conn, config, handle)
+		}
+	}()
+	return listener.Addr().String(), hostKey.PublicKey()
+}
+
+func serveTestRA(conn net.Conn, config *ssh.ServerConfig, handle raHandler) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			forwarded := false
+			for req := range requests {
+				switch req.Type {
+				case "auth-agent-req@openssh.com":
+					forwarded = true
+					_ = req.Reply(true, nil)
+				case "exec":
+					var msg struct{ Command string }
+					if err := ssh.Unmarshal(req.Payload, &msg); err != nil || !forwarded {
+						_ = req.Reply(false, nil)
+						continue
+					}
+					_ = req.Reply(true, nil)
+					status := runTestRA(sshConn, channel, msg.Command, handle)
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					return
+				default:
+					_ = req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// runTestRA parses the command as gensign does, and runs handle with the forwarded agent.
+func runTestRA(sshConn ssh.Conn, channel ssh.Channel, cmd string, handle raHandler) uint32 {
+	attrs, err := message.Unmarshal(cmd)
+	if err != nil {
+		_, _ = channel.Stderr().Write([]byte(err.Error()))
+		return 1
+	}
+	agentChannel, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		_, _ = channel.Stderr().Write([]byte(err.Error()))
+		return 1
+	}
+	defer agentChannel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	output, status := handle(attrs, agent.NewClient(agentChannel))
+	_, _ = channel.Stderr().Write([]byte(output))
+	return status
+}
+
+func TestClient_Run(t *testing.T) {
+	t.Parallel()
+	_, ca := newSigner(t)
+	userPriv, userSigner := newSigner(t)
+
+	tests := []struct {
+		name       string
+		req        Request
+		handle     raHandler
+		hostKey    ssh.PublicKey
+		wantKeyIDs []string
+		wantOutput string
+		wantErr    string
+	}{
+		{
+			name: "hard key with touchless sudo",
+			req: Request{
+				HardKey:       true,
+				Touch2SSH:     true,
+				TouchlessSudo: &message.TouchlessSudo{Hosts: "host1,host2", Time: 30},
+				CAPubKeyAlgo:  x509.ECDSA,
+			},
+			handle: func(attrs *message.Attributes, ag agent.Agent) (string, uint32) {
+				if attrs.IfVer != 7 || attrs.Username != "alice" || attrs.Hostname != "laptop" ||
+					attrs.SSHClientVersion != "8.9" || !attrs.HardKey || !attrs.Touch2SSH ||
+					attrs.TouchlessSudo.Hosts != "host1,host2" || attrs.TouchlessSudo.Time != 30 ||
+					attrs.CAPubKeyAlgo != x509.ECDSA {
+					return "unexpected attributes", 1
+				}
+				for _, keyID := range []string{"touch", "touchless"} {
+					priv, cert := newCert(t, ca, keyID)
+					if err := ag.Add(agent.AddedKey{PrivateKey: priv, Certificate: cert}); err != nil {
+						return err.Error(), 1
+					}
+				}
+				return "certificates issued", 0
+			},
+			wantKeyIDs: []string{"touch", "touchless"},
+			wantOutput: "certificates issued",
+		},
+		{
+			name: "no certificate",
+			handle: func(attrs *message.Attributes, ag agent.Agent) (string, uint32) {
+				return "", 0
+			},
+		},
+		{
+			name: "request rejected",
+			handle: func(attrs *message.Attributes, ag agent.Agent) (string, uint32) {
+				return "permission denied", 1
+			},
+			wantErr: "permission denied",
+		},
+		{
+			name: "unknown host key",
+			handle: func(attrs *message.Attributes, ag agent.Agent) (string, uint32) {
+				return "", 0
+			},
+			hostKey: userSigner.PublicKey(),
+			wantErr: "failed to establish ssh connection",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			address, hostKey := newTestRA(t, userSigner.PublicKey(), tt.handle)
+			if tt.hostKey != nil {
+				hostKey = tt.hostKey
+			}
+
+			keyring := agent.NewKeyring()
+			if err := keyring.Add(agent.AddedKey{PrivateKey: userPriv}); err != nil {
+				t.Fatal(err)
+			}
+			// The existing certificate should not be reported.
+			existingPriv, existingCert := newCert(t, ca, "existing")
+			if err := keyring.Add(agent.AddedKey{PrivateKey: existingPriv, Certificate: existingCert}); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := New(Option{
+				Address:          address,
+				HostKeyCallback:  ssh.FixedHostKey(hostKey),
+				Agent:            keyring,
+				Username:         "alice",
+				Hostname:         "laptop",
+				SSHClientVersion: "8.9",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			result, err := c.Run(ctx, tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+
+			if string(result.Output) != tt.wantOutput {
+				t.Errorf("got output %q, want %q", result.Output, tt.wantOutput)
+			}
+			keyIDs := make(map[string]bool)
+			for _, cert := range result.Certificates {
+				keyIDs[cert.KeyId] = true
+			}
+			if len(keyIDs) != len(tt.wantKeyIDs) {
+				t.Errorf("got certificates %v, want %v", keyIDs, tt.wantKeyIDs)
+			}
+			for _, keyID := range tt.wantKeyIDs {
+				if !keyIDs[keyID] {
+					t.Errorf("certificate %q is not reported", keyID)
+				}
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		opt     Option
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			opt: Option{Address: "ra:22", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Agent: agent.NewKeyring(),
+				Username: "alice", Hostname: "laptop", SSHClientVersion: "8.9"},
+		},
+		{name: "no address", opt: Option{HostKeyCallback: ssh.InsecureIgnoreHostKey(), Agent: agent.NewKeyring()}, wantErr: true},
+		{name: "no host key callback", opt: Option{Address: "ra:22", Agent: agent.NewKeyring()}, wantErr: true},
+		{name: "no agent", opt: Option{Address: "ra:22", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := New(tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (c.opt.User != "alice" || c.opt.Timeout != defaultTimeout) {
+				t.Errorf("unexpected default option %+v", c.opt)
+			}
+		})
+	}
+}
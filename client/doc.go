@@ -0,0 +1,7 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package client implements a client of gensign. It connects to the RA over SSH with the agent forwarded,
+// sends the requested certificate attributes in the SSH command, and reports the certificates
+// that the RA adds to the agent.
+package client
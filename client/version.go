@@ -0,0 +1,34 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package client
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// opensshVersionRE matches the version printed by `ssh -V`,
+// e.g. "OpenSSH_8.9p1 Ubuntu-3, OpenSSL 3.0.2 15 Mar 2022" or "OpenSSH_for_Windows_8.1p1, LibreSSL 3.0.2".
+var opensshVersionRE = regexp.MustCompile(`OpenSSH_(?:for_Windows_)?(\d+\.\d+)`)
+
+// DetectSSHClientVersion returns the version of the local OpenSSH client in "major.minor" format, e.g. "8.9".
+func DetectSSHClientVersion() (string, error) {
+	// ssh prints the version to stderr.
+	output, err := exec.Command("ssh", "-V").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get ssh client version: %v", err)
+	}
+	return parseSSHClientVersion(string(output))
+}
+
+// parseSSHClientVersion parses the output of `ssh -V`.
+func parseSSHClientVersion(output string) (string, error) {
+	match := opensshVersionRE.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("unrecognized ssh client version %q", strings.TrimSpace(output))
+	}
+	return match[1], nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package client
+
+import "testing"
+
+func TestParseSSHClientVersion(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{name: "linux", output: "OpenSSH_8.9p1 Ubuntu-3ubuntu0.6, OpenSSL 3.0.2 15 Mar 2022\n", want: "8.9"},
+		{name: "darwin", output: "OpenSSH_9.0p1, LibreSSL 3.3.6\n", want: "9.0"},
+		{name: "windows", output: "OpenSSH_for_Windows_8.1p1, LibreSSL 3.0.2\r\n", want: "8.1"},
+		{name: "not openssh", output: "dropbear v2022.83\n", wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseSSHClientVersion(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSSHClientVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSSHClientVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
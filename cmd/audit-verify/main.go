@@ -0,0 +1,74 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// audit-verify verifies the hash chain of the gensign audit log.
+// It prints the anchor of the last record, which can be saved and passed to the next run
+// to detect the truncation of the log.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/theparanoids/ysshra/audit"
+	"github.com/theparanoids/ysshra/config"
+)
+
+var (
+	cfg     string
+	logPath string
+	anchor  string
+)
+
+func parseFlags() {
+	flag.StringVar(&cfg, "config", "/opt/ysshra/config.json", "gensign configuration file, used if -log is not specified")
+	flag.StringVar(&logPath, "log", "", "audit log file")
+	flag.StringVar(&anchor, "anchor", "", "anchor printed by a previous run, in the format <seq>:<hash>")
+	flag.Parse()
+	log.SetFlags(0)
+}
+
+func main() {
+	parseFlags()
+
+	if logPath == "" {
+		conf, err := config.NewGensignConfig(cfg)
+		if err != nil {
+			log.Fatalf("failed to load configuration: %v", err)
+		}
+		if conf.AuditLogPath == "" {
+			log.Fatal("no audit log configured")
+		}
+		logPath = conf.AuditLogPath
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var (
+		count int
+		last  *audit.Record
+	)
+	if anchor == "" {
+		count, last, err = audit.Verify(f)
+	} else {
+		a, perr := audit.ParseAnchor(anchor)
+		if perr != nil {
+			log.Fatal(perr)
+		}
+		count, last, err = audit.VerifyWithAnchor(f, a)
+	}
+	if err != nil {
+		log.Fatalf("%s: verification failed after %d valid records: %v", logPath, count, err)
+	}
+
+	fmt.Printf("%s: %d records verified\n", logPath, count)
+	if last != nil {
+		fmt.Printf("anchor: %s\n", audit.Anchor{Seq: last.Seq, Hash: last.Hash})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/ysshra/agent/readonly"
+	"github.com/theparanoids/ysshra/agent/ssh"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// envFlag collects the environment variables in the format of KEY=VALUE.
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	pairs := make([]string, 0, len(e))
+	for k, v := range e {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (e envFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not in the format of KEY=VALUE", value)
+	}
+	e[k] = v
+	return nil
+}
+
+// getenv returns the value of the environment variable key, which is overridden by the flags.
+func (e envFlag) getenv(key string) string {
+	if v, ok := e[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// dryRun simulates a request with the environment variables set by OpenSSH, e.g. SSH_ORIGINAL_COMMAND,
+// SSH_CONNECTION and LOGNAME, and prints the generated CSRs. It neither contacts Crypki nor modifies the agent.
+// The handlers read the keys from the agent at SSH_AUTH_SOCK to authenticate the request.
+func dryRun(args []string) int {
+	env := envFlag{}
+	fs := flag.NewFlagSet("dry-run", flag.ExitOnError)
+	confPath := fs.String("config", defaultConfPath, "gensign configuration file")
+	fs.Var(env, "env", "environment variable of the request in the format of KEY=VALUE, which can be repeated")
+	_ = fs.Parse(args)
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.WarnLevel)
+
+	conf, err := config.NewGensignConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		return 1
+	}
+	reqParam, err := csr.NewReqParam(env.getenv, func() []string {
+		return append([]string{os.Args[0]}, fs.Args()...)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create request parameter: %v\n", err)
+		return 1
+	}
+	upstream, err := ssh.AgentConn()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize the connection for ssh agent: %v\n", err)
+		return 1
+	}
+	defer upstream.Close()
+	// The handlers add the keys to the agent in Generate, so they are given a read-only connection.
+	conn := readonly.NewConn(upstream)
+	defer conn.Close()
+
+	handlers := gensign.NewHandlers(conf, handlerCreators, conn)
+	handlerName, csrs, err := gensign.DryRun(reqParam, handlers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dry run failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("handler: %s\n", handlerName)
+	for i, req := range csrs {
+		fmt.Printf("CSR %d:\n", i+1)
+		fmt.Printf("  key identifier: %s\n", req.GetKeyMeta().GetIdentifier())
+		fmt.Printf("  key ID: %s\n", req.GetKeyId())
+		fmt.Printf("  principals: %s\n", strings.Join(req.GetPrincipals(), ","))
+		fmt.Printf("  validity: %v\n", time.Duration(req.GetValidity())*time.Second)
+		if pub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(req.GetPublicKey())); err == nil {
+			fmt.Printf("  public key: %s %s\n", pub.Type(), gossh.FingerprintSHA256(pub))
+		}
+		fmt.Printf("  critical options: %s\n", formatOptions(req.GetCriticalOptions()))
+		fmt.Printf("  extensions: %s\n", formatOptions(req.GetExtensions()))
+	}
+	return 0
+}
+
+// formatOptions formats the certificate options in the order of the names.
+func formatOptions(options map[string]string) string {
+	if len(options) == 0 {
+		return "(none)"
+	}
+	pairs := make([]string, 0, len(options))
+	for k, v := range options {
+		if v == "" {
+			pairs = append(pairs, k)
+		} else {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -1,10 +1,22 @@
 // Copyright 2022 Yahoo Inc.
 // Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
 
+// gensign issues SSH certificates for the requests from SSH connections. It is invoked by OpenSSH ForceCommand:
+//
+//	gensign $NAMESPACE_POLICY $HANDLER_KEYWORD
+//
+// The subcommands help to operate gensign:
+//
+//	gensign run [-config path] [-log path] $NAMESPACE_POLICY $HANDLER_KEYWORD
+//	gensign validate-config [-config path]
+//	gensign dry-run [-config path] [-env KEY=VALUE]... $NAMESPACE_POLICY $HANDLER_KEYWORD
+//	gensign version
 package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"io"
 	golog "log"
 	"os"
@@ -13,27 +25,73 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/theparanoids/crypki/otellib"
 	"github.com/theparanoids/ysshra/agent/ssh"
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/audit"
 	"github.com/theparanoids/ysshra/config"
 	"github.com/theparanoids/ysshra/crypki"
 	"github.com/theparanoids/ysshra/csr"
 	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/gensign/hardkey"
 	"github.com/theparanoids/ysshra/gensign/regular"
+	"github.com/theparanoids/ysshra/gensign/securitykey"
 	"github.com/theparanoids/ysshra/internal/logkey"
+	"github.com/theparanoids/ysshra/internal/tracing"
+	"github.com/theparanoids/ysshra/notify"
+	"github.com/theparanoids/ysshra/ratelimit"
 	"github.com/theparanoids/ysshra/tlsutils"
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 const (
-	confPath = "/opt/ysshra/config.json"
-	logFile  = "/var/log/ysshra/gensign.log"
+	defaultConfPath = "/opt/ysshra/config.json"
+	defaultLogFile  = "/var/log/ysshra/gensign.log"
 )
 
 var handlerCreators = map[string]gensign.CreateHandler{
-	regular.HandlerName: regular.NewHandler,
+	regular.HandlerName:     regular.NewHandler,
+	hardkey.HandlerName:     hardkey.NewHandler,
+	securitykey.HandlerName: securitykey.NewHandler,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %[1]s $NAMESPACE_POLICY $HANDLER_KEYWORD
+  %[1]s run [-config path] [-log path] $NAMESPACE_POLICY $HANDLER_KEYWORD
+  %[1]s validate-config [-config path]
+  %[1]s dry-run [-config path] [-env KEY=VALUE]... $NAMESPACE_POLICY $HANDLER_KEYWORD
+  %[1]s version
+`, os.Args[0])
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			fs := flag.NewFlagSet("run", flag.ExitOnError)
+			confPath := fs.String("config", defaultConfPath, "gensign configuration file")
+			logFile := fs.String("log", defaultLogFile, "gensign log file")
+			_ = fs.Parse(os.Args[2:])
+			run(*confPath, *logFile, append([]string{os.Args[0]}, fs.Args()...))
+			return
+		case "validate-config":
+			os.Exit(validateConfig(os.Args[2:]))
+		case "dry-run":
+			os.Exit(dryRun(os.Args[2:]))
+		case "version":
+			printVersion()
+			return
+		case "help", "-h", "-help", "--help":
+			usage()
+			os.Exit(2)
+		}
+	}
+	// Invoked by OpenSSH ForceCommand, the arguments end with the namespace policy and the handler keyword.
+	run(defaultConfPath, defaultLogFile, os.Args)
+}
+
+// run serves the request from the SSH connection, with the arguments args of the force command.
+func run(confPath, logFile string, args []string) {
 	log.Logger = log.Logger.With().Caller().Str("app", "gensign").Logger()
 	zerolog.MessageFieldName = logkey.MsgField
 	zerolog.ErrorFieldName = logkey.ErrField
@@ -55,7 +113,7 @@ func main() {
 	}
 
 	reqParam, err := csr.NewReqParam(os.Getenv, func() []string {
-		return os.Args
+		return args
 	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create request parameter")
@@ -68,22 +126,7 @@ func main() {
 	}
 	defer conn.Close()
 
-	var handlers []gensign.Handler
-	// Create Handler by the configuration.
-	for hName := range conf.HandlerConfig {
-		// Lookup creator by the handler mapping.
-		create, ok := handlerCreators[hName]
-		if !ok {
-			log.Warn().Msgf("cannot find creator for handler %s", hName)
-			continue
-		}
-		handler, err := create(conf, conn)
-		if err != nil {
-			log.Warn().Err(err).Msgf("cannot create handler %s", hName)
-			continue
-		}
-		handlers = append(handlers, handler)
-	}
+	handlers := gensign.NewHandlers(conf, handlerCreators, conn)
 
 	signer, err := crypki.NewSignerWithGensignConf(*conf)
 	if err != nil {
@@ -111,12 +154,64 @@ func main() {
 				fileLogger.Warn().Err(err).Msg("failed to shut down oTel provider")
 			}
 		}()
+
+		if conf.OTel.TracingEnabled {
+			shutdownTracerProvider, err := tracing.InitTracerProvider(context.Background(),
+				conf.OTel.OTELCollectorEndpoint, otelTLSConf, otelResource)
+			if err != nil {
+				fileLogger.Warn().Err(err).Msg("failed to create oTel tracer provider")
+			} else {
+				defer func() {
+					if err := shutdownTracerProvider(context.Background()); err != nil {
+						fileLogger.Warn().Err(err).Msg("failed to shut down oTel tracer provider")
+					}
+				}()
+			}
+		}
+	}
+
+	var opt gensign.RunOption
+	if conf.AuditLogPath != "" {
+		// A misconfigured audit log, e.g. owned by another user, must not break the logins of all the users.
+		if auditor, err := audit.NewLogger(conf.AuditLogPath); err != nil {
+			fileLogger.Error().Err(err).Msg("failed to create audit logger, issuing certificates without audit records")
+		} else {
+			opt.Auditor = auditor
+		}
+	}
+	if conf.RateLimitStatePath != "" {
+		limiter, err := ratelimit.NewLimiter(conf)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create rate limiter")
+		}
+		opt.RateLimiter = limiter
+	}
+	if conf.Approval.QueueDir != "" {
+		keys, err := approval.LoadDecisionKeys(conf.Approval.DecisionKeysPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load approval decision keys")
+		}
+		queue, err := approval.NewQueue(conf.Approval.QueueDir, conf.Approval.TTL, keys)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create approval queue")
+		}
+		opt.ApprovalQueue = queue
+		opt.ApprovalWait = conf.Approval.Wait
+	}
+	if len(conf.Notifiers) != 0 {
+		notifier, err := notify.NewDispatcher(conf.Notifiers)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create notifiers")
+		}
+		// Wait for the notifications in background before gensign exits.
+		defer notifier.Wait()
+		opt.Notifier = notifier
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), conf.RequestTimeout)
 	defer cancel()
 
-	err = gensign.Run(ctx, reqParam, handlers, signer)
+	err = gensign.RunWithOption(ctx, reqParam, handlers, signer, opt)
 	if err != nil {
 		if gensign.IsErrorOfType(err, gensign.Panic) {
 			// gensign will return debug stack in err when panic.
@@ -0,0 +1,86 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/crypki"
+	"github.com/theparanoids/ysshra/notify"
+	"github.com/theparanoids/ysshra/tlsutils"
+)
+
+// validateConfig loads the configuration, and creates the handlers, the signer and the notifiers by it
+// without serving any request. It reports the problems found and returns the exit code.
+func validateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	confPath := fs.String("config", defaultConfPath, "gensign configuration file")
+	_ = fs.Parse(args)
+
+	conf, err := config.NewGensignConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if len(conf.HandlerConfig) == 0 {
+		report("no handler configured")
+	}
+	// The handlers are created with a connection which is never used, since no request is served.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	names := make([]string, 0, len(conf.HandlerConfig))
+	for name := range conf.HandlerConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		create, ok := handlerCreators[name]
+		if !ok {
+			report("handler %s: unknown handler", name)
+			continue
+		}
+		if _, err := create(conf, conn); err != nil {
+			report("handler %s: %v", name, err)
+			continue
+		}
+		if _, err := conf.ExtractHandlerRateLimit(name); err != nil {
+			report("handler %s: invalid rate limits: %v", name, err)
+		}
+	}
+
+	// The signer loads the TLS files, but it does not connect to Crypki until a CSR is signed.
+	if _, err := crypki.NewSignerWithGensignConf(*conf); err != nil {
+		report("signer: %v", err)
+	}
+	if conf.OTel.Enabled {
+		if _, err := tlsutils.TLSClientConfiguration(conf.OTel.ClientCertPath, conf.OTel.ClientKeyPath,
+			[]string{conf.OTel.CACertPath}); err != nil {
+			report("otel: %v", err)
+		}
+	}
+	if _, err := notify.NewDispatcher(conf.Notifiers); err != nil {
+		report("notifiers: %v", err)
+	}
+
+	if len(problems) != 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *confPath, p)
+		}
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", *confPath)
+	return 0
+}
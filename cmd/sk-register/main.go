@@ -0,0 +1,69 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// sk-register registers a FIDO security key of a user for the security key handler of gensign.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/gensign/securitykey"
+)
+
+var (
+	cfg             string
+	user            string
+	pubKeyPath      string
+	attestationPath string
+	challengePath   string
+)
+
+func parseFlags() {
+	flag.StringVar(&cfg, "config", "/opt/ysshra/config.json", "gensign configuration file")
+	flag.StringVar(&user, "user", "", "logname of the user owning the security key")
+	flag.StringVar(&pubKeyPath, "pub", "", "public key file of the security key")
+	flag.StringVar(&attestationPath, "attestation", "", "attestation file written by `ssh-keygen -O write-attestation`")
+	flag.StringVar(&challengePath, "challenge", "", "challenge file passed to `ssh-keygen -O challenge`")
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if user == "" {
+		log.Fatal("no user specified")
+	}
+	if pubKeyPath == "" {
+		log.Fatal("no public key file specified")
+	}
+	if (attestationPath == "") != (challengePath == "") {
+		log.Fatal("the attestation and the challenge must be specified together")
+	}
+}
+
+func main() {
+	parseFlags()
+
+	conf, err := config.NewGensignConfig(cfg)
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+	pubKey, err := os.ReadFile(pubKeyPath)
+	if err != nil {
+		log.Fatalf("failed to read public key: %v", err)
+	}
+	var attestation, challenge []byte
+	if attestationPath != "" {
+		if attestation, err = os.ReadFile(attestationPath); err != nil {
+			log.Fatalf("failed to read attestation: %v", err)
+		}
+		if challenge, err = os.ReadFile(challengePath); err != nil {
+			log.Fatalf("failed to read challenge: %v", err)
+		}
+	}
+
+	if err := securitykey.Register(conf, user, pubKey, attestation, challenge); err != nil {
+		log.Fatalf("failed to register security key: %v", err)
+	}
+	log.Printf("security key of %s registered", user)
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// ysshra-approve lists, approves and denies the gensign requests which require a second person to approve.
+//
+//	ysshra-approve [-config path] list
+//	ysshra-approve [-config path] approve [-key path] [-reason text] <id>
+//	ysshra-approve [-config path] deny [-key path] -reason text <id>
+//
+// The approver is the user running the command, or the user invoking sudo if it runs by sudo.
+// The decision is signed by the private key at -key, or at approval.signing_key_path of the config by default.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/audit"
+	"github.com/theparanoids/ysshra/config"
+)
+
+var cfg string
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config path] list | approve [-key path] [-reason text] <id> | deny [-key path] -reason text <id>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// approver returns the identity of the approver running the command.
+func approver() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); u.Uid == "0" && sudoUser != "" {
+		return sudoUser, nil
+	}
+	return u.Username, nil
+}
+
+func list(queue *approval.Queue) {
+	requests, err := queue.List()
+	if err != nil {
+		log.Fatalf("failed to list requests: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tHANDLER\tLOGNAME\tHOST\tPRINCIPALS\tKEY\tCREATED\tJUSTIFICATION")
+	for _, r := range requests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%q\n", r.ID, r.State, r.Handler, r.LogName, r.ReqHost,
+			strings.Join(r.Principals, ","), r.Fingerprint, r.Created.Local().Format(time.RFC3339), r.Justification)
+	}
+	_ = w.Flush()
+}
+
+func decide(queue *approval.Queue, conf *config.GensignConfig, approve bool, args []string) {
+	name := "deny"
+	if approve {
+		name = "approve"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	reason := fs.String("reason", "", "reason of the decision")
+	key := fs.String("key", conf.Approval.SigningKeyPath, "private key signing the decision")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("%s requires exactly one request ID", name)
+	}
+	if !approve && *reason == "" {
+		log.Fatal("deny requires a reason")
+	}
+	id := fs.Arg(0)
+
+	who, err := approver()
+	if err != nil {
+		log.Fatalf("failed to identify the approver: %v", err)
+	}
+	signer, err := approval.LoadSigner(*key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var request *approval.Request
+	if approve {
+		request, err = queue.Approve(id, who, *reason, signer)
+	} else {
+		request, err = queue.Deny(id, who, *reason, signer)
+	}
+	if err != nil {
+		log.Fatalf("failed to %s request %s: %v", name, id, err)
+	}
+
+	if conf.AuditLogPath != "" {
+		logger, err := audit.NewLogger(conf.AuditLogPath)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+		if err := logger.Decided(request); err != nil {
+			log.Fatalf("failed to audit the decision: %v", err)
+		}
+	}
+	fmt.Printf("request %s of %s for %s is %s by %s\n", request.ID, request.LogName,
+		strings.Join(request.Principals, ","), request.State, request.Approver)
+}
+
+func main() {
+	flag.StringVar(&cfg, "config", "/opt/ysshra/config.json", "gensign configuration file")
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(0)
+
+	conf, err := config.NewGensignConfig(cfg)
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+	if conf.Approval.QueueDir == "" {
+		log.Fatal("no approval queue configured")
+	}
+	keys, err := approval.LoadDecisionKeys(conf.Approval.DecisionKeysPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	queue, err := approval.NewQueue(conf.Approval.QueueDir, conf.Approval.TTL, keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		list(queue)
+	case "approve":
+		decide(queue, conf, true, flag.Args()[1:])
+	case "deny":
+		decide(queue, conf, false, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
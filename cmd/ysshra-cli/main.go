@@ -0,0 +1,139 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// ysshra-cli requests SSH certificates from the RA. The certificates are added to the ssh-agent of the user.
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	agentssh "github.com/theparanoids/ysshra/agent/ssh"
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/client"
+	"github.com/theparanoids/ysshra/message"
+	certutil "github.com/theparanoids/ysshra/sshutils/cert"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultPort = "22"
+
+// caAlgos maps the -ca-algo flag to the CA public key algorithms.
+var caAlgos = map[string]x509.PublicKeyAlgorithm{
+	"":        x509.UnknownPublicKeyAlgorithm,
+	"rsa":     x509.RSA,
+	"ecdsa":   x509.ECDSA,
+	"ed25519": x509.Ed25519,
+}
+
+var (
+	address            string
+	user               string
+	knownHostsPath     string
+	hardKey            bool
+	touch2SSH          bool
+	touchlessSudoHosts string
+	touchlessSudoTime  int64
+	firefighter        bool
+	justification      string
+	approvalID         string
+	caAlgo             string
+	timeout            time.Duration
+)
+
+func parseFlags() {
+	home, _ := os.UserHomeDir()
+	flag.StringVar(&address, "ra", "", "address of the RA in host[:port] format")
+	flag.StringVar(&user, "user", "", "user to log in the RA (default current user)")
+	flag.StringVar(&knownHostsPath, "known-hosts", filepath.Join(home, ".ssh", "known_hosts"), "known hosts file to verify the RA")
+	flag.BoolVar(&hardKey, "hardkey", false, "request certificates for the keys in the YubiKey")
+	flag.BoolVar(&touch2SSH, "touch2ssh", false, "request a certificate which requires a touch to SSH")
+	flag.StringVar(&touchlessSudoHosts, "touchless-sudo-hosts", "", "comma separated hosts accepting the touchless sudo certificate")
+	flag.Int64Var(&touchlessSudoTime, "touchless-sudo-time", 0, "valid time of the touchless sudo certificate in minutes")
+	flag.BoolVar(&firefighter, "firefighter", false, "request a firefighter certificate")
+	flag.StringVar(&justification, "justification", "", "justification for the approver if the request requires approval")
+	flag.StringVar(&approvalID, "approval-id", "", "ID of the queued request to retry after it is approved")
+	flag.StringVar(&caAlgo, "ca-algo", "", "public key algorithm of the CA: rsa, ecdsa or ed25519 (default decided by the RA)")
+	flag.DurationVar(&timeout, "timeout", 5*time.Minute, "timeout of the request")
+	flag.Parse()
+	log.SetFlags(0)
+
+	if address == "" {
+		log.Fatal("no RA address specified")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, defaultPort)
+	}
+	if _, ok := caAlgos[strings.ToLower(caAlgo)]; !ok {
+		log.Fatalf("unsupported CA algorithm %q", caAlgo)
+	}
+}
+
+func main() {
+	parseFlags()
+
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		log.Fatalf("failed to load known hosts: %v", err)
+	}
+	agent, conn, err := agentssh.Agent()
+	if err != nil {
+		log.Fatalf("failed to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	c, err := client.New(client.Option{
+		Address:         address,
+		HostKeyCallback: hostKeyCallback,
+		Agent:           agent,
+		User:            user,
+		Output:          os.Stderr,
+	})
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	req := client.Request{
+		HardKey:      hardKey,
+		Touch2SSH:    touch2SSH,
+		CAPubKeyAlgo: caAlgos[strings.ToLower(caAlgo)],
+	}
+	if firefighter || touchlessSudoHosts != "" || touchlessSudoTime != 0 {
+		req.TouchlessSudo = &message.TouchlessSudo{
+			IsFirefighter: firefighter,
+			Hosts:         touchlessSudoHosts,
+			Time:          touchlessSudoTime,
+		}
+	}
+	if justification != "" || approvalID != "" {
+		req.Exts = make(map[string]interface{})
+		if justification != "" {
+			req.Exts[approval.JustificationExt] = justification
+		}
+		if approvalID != "" {
+			req.Exts[approval.IDExt] = approvalID
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result, err := c.Run(ctx, req)
+	if err != nil {
+		log.Fatalf("failed to request certificates: %v", err)
+	}
+	if len(result.Certificates) == 0 {
+		log.Fatal("no certificate was added to the ssh-agent")
+	}
+	for _, cert := range result.Certificates {
+		fmt.Printf("%s certificate for %s, valid until %s\n", certutil.GetType(cert),
+			strings.Join(cert.ValidPrincipals, ","), time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+}
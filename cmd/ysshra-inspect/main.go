@@ -0,0 +1,162 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// ysshra-inspect decodes the SSH certificates issued by ysshra and checks them against the requirements
+// of their KeyID version. It reads the certificates from the files, the standard input, or an ssh-agent:
+//
+//	ysshra-inspect ~/.ssh/id_ecdsa-cert.pub
+//	ssh-add -L | ysshra-inspect
+//	ysshra-inspect -agent $SSH_AUTH_SOCK -json
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/theparanoids/ysshra/agent/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	agentSock  string
+	jsonOutput bool
+)
+
+func parseFlags() {
+	flag.StringVar(&agentSock, "agent", "", "ssh-agent socket to read the certificates from, instead of the files")
+	flag.BoolVar(&jsonOutput, "json", false, "print the reports in JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-json] [-agent socket | file ...]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The certificates are read from the standard input if no file is specified, or the file is \"-\".")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+}
+
+// source is a certificate with where it is read from.
+type source struct {
+	name    string
+	comment string
+	cert    *gossh.Certificate
+}
+
+func main() {
+	parseFlags()
+
+	var (
+		sources []source
+		err     error
+	)
+	if agentSock != "" {
+		if flag.NArg() != 0 {
+			log.Fatal("files cannot be specified with -agent")
+		}
+		sources, err = readAgent(agentSock)
+		if err != nil {
+			log.Fatalf("failed to read certificates from agent: %v", err)
+		}
+	} else {
+		files := flag.Args()
+		if len(files) == 0 {
+			files = []string{"-"}
+		}
+		for _, file := range files {
+			certs, err := readFile(file)
+			if err != nil {
+				log.Fatalf("failed to read certificates from %s: %v", file, err)
+			}
+			sources = append(sources, certs...)
+		}
+	}
+	if len(sources) == 0 {
+		log.Fatal("no certificate found")
+	}
+
+	now := time.Now()
+	reports := make([]*report, 0, len(sources))
+	for _, s := range sources {
+		reports = append(reports, newReport(s, now))
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatalf("failed to encode reports: %v", err)
+		}
+		return
+	}
+	for i, r := range reports {
+		if i != 0 {
+			fmt.Println()
+		}
+		r.print(os.Stdout)
+	}
+}
+
+// readFile reads the certificates in the authorized_keys format from the file, or the standard input if file is "-".
+// The public keys which are not certificates are skipped.
+func readFile(file string) ([]source, error) {
+	var (
+		in  []byte
+		err error
+	)
+	if file == "-" {
+		in, err = io.ReadAll(os.Stdin)
+		file = "stdin"
+	} else {
+		in, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []source
+	for len(bytes.TrimSpace(in)) != 0 {
+		pub, comment, _, rest, err := gossh.ParseAuthorizedKey(in)
+		if err != nil {
+			// ParseAuthorizedKey only fails if there is no valid key in the rest of the input.
+			if len(sources) == 0 {
+				return nil, err
+			}
+			break
+		}
+		if cert, ok := pub.(*gossh.Certificate); ok {
+			sources = append(sources, source{name: file, comment: comment, cert: cert})
+		}
+		in = rest
+	}
+	return sources, nil
+}
+
+// readAgent reads the certificates in the ssh-agent listening on the socket.
+func readAgent(socket string) ([]source, error) {
+	ag, conn, err := ssh.AgentBySocket(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err := ag.List()
+	if err != nil {
+		return nil, err
+	}
+	var sources []source
+	for _, key := range keys {
+		pub, err := gossh.ParsePublicKey(key.Blob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %q: %v", key.Comment, err)
+		}
+		if cert, ok := pub.(*gossh.Certificate); ok {
+			sources = append(sources, source{name: "agent", comment: key.Comment, cert: cert})
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theparanoids/ysshra/keyid"
+	"github.com/theparanoids/ysshra/sshutils/cert"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	validityValid       = "valid"
+	validityExpired     = "expired"
+	validityNotYetValid = "not yet valid"
+)
+
+// report is the decoded content of a certificate.
+type report struct {
+	Source            string            `json:"source"`
+	Comment           string            `json:"comment,omitempty"`
+	Type              string            `json:"type"`
+	Label             string            `json:"label,omitempty"`
+	KeyID             *keyid.KeyID      `json:"keyID,omitempty"`
+	RawKeyID          string            `json:"rawKeyID"`
+	Serial            uint64            `json:"serial"`
+	CertType          string            `json:"certType"`
+	Principals        []string          `json:"principals"`
+	LabeledPrincipals []string          `json:"labeledPrincipals,omitempty"`
+	CriticalOptions   map[string]string `json:"criticalOptions,omitempty"`
+	Extensions        map[string]string `json:"extensions,omitempty"`
+	ValidAfter        string            `json:"validAfter"`
+	ValidBefore       string            `json:"validBefore"`
+	Validity          string            `json:"validity"`
+	KeyFingerprint    string            `json:"keyFingerprint"`
+	CAFingerprint     string            `json:"caFingerprint"`
+	Violations        []string          `json:"violations,omitempty"`
+}
+
+// newReport decodes the certificate in s, and checks its validity at now.
+func newReport(s source, now time.Time) *report {
+	c := s.cert
+	certType := cert.GetType(c)
+	r := &report{
+		Source:          s.name,
+		Comment:         s.comment,
+		Type:            certType.String(),
+		RawKeyID:        c.KeyId,
+		Serial:          c.Serial,
+		CertType:        "user",
+		Principals:      c.ValidPrincipals,
+		CriticalOptions: c.CriticalOptions,
+		Extensions:      c.Extensions,
+		ValidAfter:      formatCertTime(c.ValidAfter),
+		ValidBefore:     formatCertTime(c.ValidBefore),
+		Validity:        validityValid,
+		KeyFingerprint:  gossh.FingerprintSHA256(c.Key),
+		CAFingerprint:   gossh.FingerprintSHA256(c.SignatureKey),
+	}
+	if r.Type == "" {
+		r.Type = "Unknown"
+	}
+	if c.CertType == gossh.HostCert {
+		r.CertType = "host"
+	}
+	if label, err := cert.Label(c); err == nil {
+		r.Label = label
+	}
+	if !cert.ValidateSSHCertTime(c, now) {
+		r.Validity = validityExpired
+		if c.ValidAfter <= math.MaxInt64 && int64(c.ValidAfter) > now.Unix() {
+			r.Validity = validityNotYetValid
+		}
+	}
+
+	kid, violations := keyid.Inspect(c.KeyId)
+	r.KeyID = kid
+	if kid != nil {
+		r.LabeledPrincipals = cert.GetPrincipals(kid.Principals, certType)
+	}
+	for _, v := range violations {
+		r.Violations = append(r.Violations, v.Error())
+	}
+	return r
+}
+
+// formatCertTime formats the timestamp of the certificate in RFC 3339.
+func formatCertTime(t uint64) string {
+	if t == gossh.CertTimeInfinity {
+		return "forever"
+	}
+	if t > math.MaxInt64 {
+		return fmt.Sprintf("%d", t)
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// print prints the report in a human-readable format.
+func (r *report) print(w io.Writer) {
+	fmt.Fprintf(w, "Source:             %s\n", r.Source)
+	if r.Comment != "" {
+		fmt.Fprintf(w, "Comment:            %s\n", r.Comment)
+	}
+	fmt.Fprintf(w, "Type:               %s\n", r.Type)
+	if r.Label != "" {
+		fmt.Fprintf(w, "Label:              %s\n", r.Label)
+	}
+	fmt.Fprintf(w, "Certificate type:   %s\n", r.CertType)
+	fmt.Fprintf(w, "Serial:             %d\n", r.Serial)
+	fmt.Fprintf(w, "Key ID:             %s\n", r.RawKeyID)
+	if r.KeyID != nil {
+		k := r.KeyID
+		fmt.Fprintf(w, "  Version:          %d\n", k.Version)
+		fmt.Fprintf(w, "  Principals:       %s\n", strings.Join(k.Principals, ", "))
+		fmt.Fprintf(w, "  Transaction ID:   %s\n", k.TransID)
+		fmt.Fprintf(w, "  Request user:     %s\n", k.ReqUser)
+		fmt.Fprintf(w, "  Request IP:       %s\n", k.ReqIP)
+		fmt.Fprintf(w, "  Request host:     %s\n", k.ReqHost)
+		fmt.Fprintf(w, "  Firefighter:      %t\n", k.IsFirefighter)
+		fmt.Fprintf(w, "  Hardware key:     %t\n", k.IsHWKey)
+		fmt.Fprintf(w, "  Headless:         %t\n", k.IsHeadless)
+		fmt.Fprintf(w, "  Nonce:            %t\n", k.IsNonce)
+		fmt.Fprintf(w, "  Usage:            %d\n", k.Usage)
+		fmt.Fprintf(w, "  Touch policy:     %d\n", k.TouchPolicy)
+	}
+	fmt.Fprintf(w, "Principals:         %s\n", strings.Join(r.Principals, ", "))
+	fmt.Fprintf(w, "Labeled principals: %s\n", strings.Join(r.LabeledPrincipals, ", "))
+	printMap(w, "Critical options:", r.CriticalOptions)
+	printMap(w, "Extensions:", r.Extensions)
+	fmt.Fprintf(w, "Valid:              from %s to %s (%s)\n", r.ValidAfter, r.ValidBefore, r.Validity)
+	fmt.Fprintf(w, "Key fingerprint:    %s\n", r.KeyFingerprint)
+	fmt.Fprintf(w, "CA fingerprint:     %s\n", r.CAFingerprint)
+	if len(r.Violations) == 0 {
+		fmt.Fprintln(w, "Violations:         none")
+		return
+	}
+	fmt.Fprintln(w, "Violations:")
+	for _, v := range r.Violations {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+}
+
+// printMap prints the options of the certificate in sorted order.
+func printMap(w io.Writer, title string, m map[string]string) {
+	if len(m) == 0 {
+		fmt.Fprintf(w, "%-19s none\n", title)
+		return
+	}
+	fmt.Fprintln(w, title)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if m[k] == "" {
+			fmt.Fprintf(w, "  %s\n", k)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s\n", k, m[k])
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// ysshra-server serves gensign requests over SSH by itself, without OpenSSH ForceCommand.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/crypki/otellib"
+	"github.com/theparanoids/ysshra/approval"
+	"github.com/theparanoids/ysshra/audit"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/crypki"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/gensign/hardkey"
+	"github.com/theparanoids/ysshra/gensign/regular"
+	"github.com/theparanoids/ysshra/gensign/securitykey"
+	"github.com/theparanoids/ysshra/internal/logkey"
+	"github.com/theparanoids/ysshra/internal/tracing"
+	"github.com/theparanoids/ysshra/notify"
+	"github.com/theparanoids/ysshra/ratelimit"
+	"github.com/theparanoids/ysshra/server"
+	"github.com/theparanoids/ysshra/tlsutils"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"golang.org/x/crypto/ssh"
+)
+
+var handlerCreators = map[string]gensign.CreateHandler{
+	regular.HandlerName:     regular.NewHandler,
+	hardkey.HandlerName:     hardkey.NewHandler,
+	securitykey.HandlerName: securitykey.NewHandler,
+}
+
+var (
+	cfg             string
+	address         string
+	hostKeyPaths    string
+	authorizedKeys  string
+	namespacePolicy string
+	handlerKeyword  string
+	maxConcurrency  int
+)
+
+func parseFlags() {
+	flag.StringVar(&cfg, "config", "/opt/ysshra/config.json", "gensign configuration file")
+	flag.StringVar(&address, "listen", ":222", "address to listen on")
+	flag.StringVar(&hostKeyPaths, "host-keys", "/etc/ssh/ssh_host_ed25519_key", "comma separated host private key files")
+	flag.StringVar(&authorizedKeys, "authorized-keys", "/home/%u/.ssh/authorized_keys", "authorized keys file of the users, where %u is the user name")
+	flag.StringVar(&namespacePolicy, "namespace-policy", string(common.NoNamespace), "namespace policy of the requests, NONS or NSOK")
+	flag.StringVar(&handlerKeyword, "handler", "ALL_MODULES", "handler keyword of the requests")
+	flag.IntVar(&maxConcurrency, "max-concurrency", 32, "maximum number of the requests running at the same time")
+	flag.Parse()
+}
+
+func loadHostKeys(paths string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range strings.Split(paths, ",") {
+		data, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func main() {
+	parseFlags()
+	log.Logger = log.Logger.With().Caller().Str("app", "ysshra-server").Logger()
+	zerolog.MessageFieldName = logkey.MsgField
+	zerolog.ErrorFieldName = logkey.ErrField
+
+	conf, err := config.NewGensignConfig(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load configuration")
+	}
+	hostKeys, err := loadHostKeys(hostKeyPaths)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load host keys")
+	}
+	// The signer keeps the connections to the CA, and is shared by all the requests.
+	signer, err := crypki.NewSignerWithGensignConf(*conf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create signer")
+	}
+
+	if conf.OTel.Enabled {
+		otelResource, err := resource.Merge(
+			resource.Default(),
+			resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("ysshra-server")),
+		)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create oTel resource")
+		}
+		otelTLSConf, err := tlsutils.TLSClientConfiguration(conf.OTel.ClientCertPath, conf.OTel.ClientKeyPath,
+			[]string{conf.OTel.CACertPath})
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create oTel TLS config")
+		}
+		shutdownProvider := otellib.InitOTelSDK(context.Background(),
+			conf.OTel.OTELCollectorEndpoint, otelTLSConf, otelResource)
+
+		defer func() {
+			if err := shutdownProvider(context.Background()); err != nil {
+				log.Warn().Err(err).Msg("failed to shut down oTel provider")
+			}
+		}()
+
+		if conf.OTel.TracingEnabled {
+			shutdownTracerProvider, err := tracing.InitTracerProvider(context.Background(),
+				conf.OTel.OTELCollectorEndpoint, otelTLSConf, otelResource)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to create oTel tracer provider")
+			} else {
+				defer func() {
+					if err := shutdownTracerProvider(context.Background()); err != nil {
+						log.Warn().Err(err).Msg("failed to shut down oTel tracer provider")
+					}
+				}()
+			}
+		}
+	}
+
+	opt := server.Option{
+		HostKeys:          hostKeys,
+		PublicKeyCallback: server.AuthorizedKeysCallback(authorizedKeys),
+		Config:            conf,
+		HandlerCreators:   handlerCreators,
+		Signer:            signer,
+		NamespacePolicy:   common.NamespacePolicy(namespacePolicy),
+		HandlerKeyword:    handlerKeyword,
+		MaxConcurrency:    maxConcurrency,
+	}
+	if conf.AuditLogPath != "" {
+		auditor, err := audit.NewLogger(conf.AuditLogPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create audit logger")
+		}
+		opt.Auditor = auditor
+	}
+	if conf.RateLimitStatePath != "" {
+		limiter, err := ratelimit.NewLimiter(conf)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create rate limiter")
+		}
+		opt.RateLimiter = limiter
+	}
+	if conf.Approval.QueueDir != "" {
+		keys, err := approval.LoadDecisionKeys(conf.Approval.DecisionKeysPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load approval decision keys")
+		}
+		queue, err := approval.NewQueue(conf.Approval.QueueDir, conf.Approval.TTL, keys)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create approval queue")
+		}
+		opt.ApprovalQueue = queue
+		opt.ApprovalWait = conf.Approval.Wait
+	}
+	var notifier *notify.Dispatcher
+	if len(conf.Notifiers) != 0 {
+		notifier, err = notify.NewDispatcher(conf.Notifiers)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create notifiers")
+		}
+		opt.Notifier = notifier
+	}
+	s, err := server.New(opt)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create server")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to listen")
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Info().Msg("shutting down")
+		s.Close()
+	}()
+
+	log.Info().Msgf("serving gensign on %s", listener.Addr())
+	if err := s.Serve(listener); !errors.Is(err, server.ErrServerClosed) {
+		log.Error().Err(err).Msg("failed to serve")
+	}
+	if notifier != nil {
+		notifier.Wait()
+	}
+}
@@ -4,7 +4,6 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"time"
@@ -13,12 +12,21 @@ import (
 )
 
 const (
-	// 60 * time.Second
-	requestTimeoutDefault = 60
+	requestTimeoutDefault = 60 * time.Second
+	approvalTTLDefault    = time.Hour
 )
 
 type handlerConfMap map[string]interface{}
 
+// handlerEnableKey is the key documented in the format of HandlerConfig, which is not decoded by any handler.
+const handlerEnableKey = "enable"
+
+// reservedHandlerKeys are the keys in the config of every handler which are not decoded by the handler itself.
+var reservedHandlerKeys = map[string]bool{
+	handlerEnableKey: true,
+	rateLimitKey:     true,
+}
+
 // GensignConfig stores the configuration for gensign command.
 type GensignConfig struct {
 	// KeyIDVersion specifies the version of KeyID.
@@ -43,10 +51,19 @@ type GensignConfig struct {
 	HandlerConfig map[string]handlerConfMap `json:"handlers"`
 	// SignerConfig is the mapping for signer configuration.
 	SignerConfig map[string]interface{} `json:"signer"`
-	// Timeout for gensign (in second).
+	// Timeout for gensign, in seconds or a duration string, e.g. "90s".
 	RequestTimeout time.Duration `json:"request_timeout"`
 	// OTel is the configuration for connecting to OpenTelemetry collector.
 	OTel OTelConfig `json:"otel"`
+	// AuditLogPath is the path of the tamper-evident audit log. The audit log is disabled if it is empty.
+	AuditLogPath string `json:"audit_log_path"`
+	// RateLimitStatePath is the path of the state file shared by the gensign processes to enforce
+	// the rate limits configured in the handler config. The rate limits are disabled if it is empty.
+	RateLimitStatePath string `json:"rate_limit_state_path"`
+	// Approval is the configuration of the queue of the requests which require a second person to approve.
+	Approval ApprovalConfig `json:"approval"`
+	// Notifiers are the configuration of the notifiers of the issued certificates and the failed requests.
+	Notifiers []NotifierConfig `json:"notifiers"`
 }
 
 // OTelConfig stores the configuration for connecting to OpenTelemetry collector.
@@ -61,38 +78,66 @@ type OTelConfig struct {
 	ClientKeyPath string `json:"client_key_path"`
 	// CACertPath is the path to the CA certificate.
 	CACertPath string `json:"ca_cert_path"`
+	// TracingEnabled indicates whether to export the traces of the requests in addition to the metrics.
+	TracingEnabled bool `json:"tracing_enabled"`
+}
+
+// ApprovalConfig stores the configuration of the queue of the requests which require a second person to approve.
+type ApprovalConfig struct {
+	// QueueDir is the directory storing the queued requests.
+	// The requests requiring approval are rejected if it is empty.
+	QueueDir string `json:"queue_dir"`
+	// TTL is the time period after which a queued request expires, whether it is decided or not,
+	// in seconds or a duration string, e.g. "1h".
+	TTL time.Duration `json:"ttl"`
+	// Wait is the time period for a request to wait for the decision, in seconds or a duration string.
+	// If it is zero, the requester retries the request after the approval.
+	Wait time.Duration `json:"wait"`
+	// DecisionKeysPath is the path of the public keys, in the authorized_keys format, trusted to sign the decisions.
+	// It is required if QueueDir is set.
+	DecisionKeysPath string `json:"decision_keys_path"`
+	// SigningKeyPath is the path of the private key for ysshra-approve to sign the decisions.
+	// It must be readable only by the approvers.
+	SigningKeyPath string `json:"signing_key_path"`
 }
 
 func (g *GensignConfig) populate() {
 	if g.RequestTimeout <= 0 {
 		g.RequestTimeout = requestTimeoutDefault
 	}
-	g.RequestTimeout = g.RequestTimeout * time.Second
+	if g.Approval.TTL <= 0 {
+		g.Approval.TTL = approvalTTLDefault
+	}
+	for i := range g.Notifiers {
+		g.Notifiers[i].populate()
+	}
 }
 
 // NewGensignConfig returns the gensign configuration loaded from the provided path.
+// The file is in JSON, or in YAML if its extension is ".yaml" or ".yml". The unknown keys are rejected.
+// The fragments in the directory set by "include" are merged into the configuration in the order of
+// their file names, and the secrets paths are overridden by the environment variables, e.g.
+// YSSHRA_SIGNER_TLS_CLIENT_KEY_FILE for "signer.tls_client_key_file".
 func NewGensignConfig(path string) (*GensignConfig, error) {
-	conf := new(GensignConfig)
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	if err := json.Unmarshal(data, conf); err != nil {
-		return nil, err
-	}
-	conf.populate()
-	return conf, nil
+	return loadGensignConfig(path, os.LookupEnv)
 }
 
 // ExtractHandlerConf extracts handler config from GensignConfig by the given name.
+// It returns an error if the handler config has a key unknown to handlerConf, except the keys
+// reserved for all the handlers, e.g. "enable" and "rate_limit".
 func (g *GensignConfig) ExtractHandlerConf(name string, handlerConf interface{}) error {
 	hConfMap, ok := g.HandlerConfig[name]
 	if !ok {
 		return fmt.Errorf("failed to find config for handler %q", name)
 	}
+	return decodeHandlerConf(name, hConfMap, handlerConf)
+}
+
+// decodeHandlerConf decodes hConfMap, which is the config or a part of the config of the handler, to handlerConf.
+func decodeHandlerConf(name string, hConfMap handlerConfMap, handlerConf interface{}) error {
 	config := &mapstructure.DecoderConfig{
-		DecodeHook: StringToX509PublicKeyAlgo(),
-		Metadata:   nil,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(StringToX509PublicKeyAlgo(), SecondsOrStringToDuration()),
+		Metadata:   new(mapstructure.Metadata),
 		Result:     handlerConf,
 	}
 
@@ -104,5 +149,8 @@ func (g *GensignConfig) ExtractHandlerConf(name string, handlerConf interface{})
 	if err != nil {
 		return fmt.Errorf("failed to decode handler conf for %q, err:%v", name, err)
 	}
+	if err := unknownKeysErr(config.Metadata.Unused, reservedHandlerKeys); err != nil {
+		return fmt.Errorf("failed to decode handler conf for %q, err:%v", name, err)
+	}
 	return nil
 }
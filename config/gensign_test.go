@@ -74,6 +74,7 @@ func TestNewGensignConfig(t *testing.T) {
 					ClientKeyPath:         "path_to_client_key.pem",
 					CACertPath:            "path_to_ca_cert.pem",
 				},
+				Approval: ApprovalConfig{TTL: time.Hour},
 			},
 		},
 		{
@@ -94,7 +95,17 @@ func TestNewGensignConfig(t *testing.T) {
 							"tls_client_key_file": "path_to_tls_client.key",
 							"tls_client_cert_file": "path_to_tls_client.crt"
 						},
-						"request_timeout": 30
+						"request_timeout": 30,
+						"approval": {
+							"queue_dir": "/var/lib/ysshra/approval",
+							"ttl": 600,
+							"wait": 20,
+							"decision_keys_path": "/etc/ysshra/approval_keys"
+						},
+						"notifiers": [
+							{"type": "webhook", "url": "https://example.com/hook", "cert_types": ["FireFighterSudo"], "retries": 3},
+							{"type": "syslog", "mandatory": true, "timeout": 2}
+						]
 					}`
 				configPath := path.Join(t.TempDir(), "config.json")
 				if err := os.WriteFile(configPath, []byte(configStr), 0644); err != nil {
@@ -117,6 +128,22 @@ func TestNewGensignConfig(t *testing.T) {
 					"tls_client_cert_file": "path_to_tls_client.crt",
 				},
 				RequestTimeout: 30 * time.Second,
+				Approval: ApprovalConfig{
+					QueueDir:         "/var/lib/ysshra/approval",
+					TTL:              10 * time.Minute,
+					Wait:             20 * time.Second,
+					DecisionKeysPath: "/etc/ysshra/approval_keys",
+				},
+				Notifiers: []NotifierConfig{
+					{
+						Type:      NotifierWebhook,
+						URL:       "https://example.com/hook",
+						CertTypes: []string{"FireFighterSudo"},
+						Retries:   3,
+						Timeout:   10 * time.Second,
+					},
+					{Type: NotifierSyslog, Mandatory: true, Timeout: 2 * time.Second},
+				},
 			},
 		},
 	}
@@ -168,6 +195,40 @@ func TestGensignConfig_ExtractHandlerConf(t *testing.T) {
 				Number:     10,
 			},
 		},
+		{
+			name:        "reserved keys",
+			handlerName: "ExampleHandler",
+			gensignConf: &GensignConfig{
+				HandlerConfig: map[string]handlerConfMap{
+					"ExampleHandler": {
+						"enable":       true,
+						"pub_key_path": "/etc/ssh/pub_key",
+						"rate_limit":   map[string]interface{}{"global": map[string]interface{}{"burst": 10}},
+					},
+				},
+			},
+			wantHandlerConf: &exampleHandlerConf{
+				PubKeyPath: "/etc/ssh/pub_key",
+			},
+		},
+		{
+			name:        "unknown keys",
+			handlerName: "ExampleHandler",
+			gensignConf: &GensignConfig{
+				HandlerConfig: map[string]handlerConfMap{
+					"ExampleHandler": {
+						"pub_key_pth": "/etc/ssh/pub_key",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:        "handler not found",
+			handlerName: "ExampleHandler",
+			gensignConf: &GensignConfig{},
+			wantErr:     true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
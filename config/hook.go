@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 )
@@ -51,3 +52,30 @@ func StringToX509PublicKeyAlgo() mapstructure.DecodeHookFunc {
 		return x509.PublicKeyAlgorithm(u), nil
 	}
 }
+
+// SecondsOrStringToDuration returns a DecodeHookFunc that converts a number of seconds, or
+// a duration string parsed by time.ParseDuration, e.g. "90s" or "1h30m", to time.Duration.
+func SecondsOrStringToDuration() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if t != reflect.TypeOf(time.Duration(0)) {
+			return data, nil
+		}
+
+		v := reflect.ValueOf(data)
+		switch f.Kind() {
+		case reflect.String:
+			return time.ParseDuration(v.String())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return time.Duration(v.Int()) * time.Second, nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return time.Duration(v.Uint()) * time.Second, nil
+		case reflect.Float32, reflect.Float64:
+			return time.Duration(v.Float() * float64(time.Second)), nil
+		default:
+			return data, nil
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 )
@@ -40,3 +41,36 @@ func TestStringToX509PublicKeyAlgo(t *testing.T) {
 		}
 	}
 }
+
+func TestSecondsOrStringToDuration(t *testing.T) {
+	f := SecondsOrStringToDuration()
+
+	durationValue := reflect.ValueOf(time.Duration(0))
+	strValue := reflect.ValueOf("")
+	cases := []struct {
+		f, t   reflect.Value
+		result interface{}
+		err    bool
+	}{
+		{reflect.ValueOf("90s"), durationValue, 90 * time.Second, false},
+		{reflect.ValueOf("1h30m"), durationValue, 90 * time.Minute, false},
+		{reflect.ValueOf(60), durationValue, time.Minute, false},
+		{reflect.ValueOf(uint(60)), durationValue, time.Minute, false},
+		{reflect.ValueOf(1.5), durationValue, 1500 * time.Millisecond, false},
+		{reflect.ValueOf("90"), durationValue, nil, true},
+		{reflect.ValueOf("invalid"), durationValue, nil, true},
+		{reflect.ValueOf("90s"), strValue, "90s", false},
+	}
+
+	for i, tc := range cases {
+		actual, err := mapstructure.DecodeHookExec(f, tc.f, tc.t)
+		if tc.err != (err != nil) {
+			t.Fatalf("case %d: expected err %#v", i, tc.err)
+		}
+		if !tc.err && !reflect.DeepEqual(actual, tc.result) {
+			t.Fatalf(
+				"case %d: expected %#v, got %#v",
+				i, tc.result, actual)
+		}
+	}
+}
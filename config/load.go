@@ -0,0 +1,328 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// includeKey is the key of the directory containing the drop-in config fragments.
+	includeKey = "include"
+	// envOverridePrefix is the prefix of the environment variables overriding the secrets paths.
+	envOverridePrefix = "YSSHRA_"
+)
+
+// secretsPathKeys are the keys of the secrets paths which can be overridden by the environment variables,
+// e.g. YSSHRA_SIGNER_TLS_CLIENT_KEY_FILE for "signer.tls_client_key_file".
+// "*" matches each element of a list, e.g. YSSHRA_NOTIFIERS_0_SECRET_PATH for the first notifier.
+// The values of the list keys are separated by the os.PathListSeparator.
+var secretsPathKeys = []string{
+	"signer.tls_client_key_file",
+	"signer.tls_client_cert_file",
+	"signer.tls_ca_cert_files",
+	"otel.client_cert_path",
+	"otel.client_key_path",
+	"otel.ca_cert_path",
+	"notifiers.*.secret_path",
+}
+
+// listKeys are the secrets paths keys whose values are lists.
+var listKeys = map[string]bool{
+	"signer.tls_ca_cert_files": true,
+}
+
+// loadGensignConfig loads the config file in path and the fragments in its include directory, and
+// overrides the secrets paths by the environment variables looked up by lookupEnv.
+func loadGensignConfig(path string, lookupEnv func(string) (string, bool)) (*GensignConfig, error) {
+	raw, include, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if include != "" {
+		fragments, err := readFragments(include)
+		if err != nil {
+			return nil, err
+		}
+		for _, fragment := range fragments {
+			mergeConfig(raw, fragment)
+		}
+	}
+	overridden := overrideSecretsPaths(raw, lookupEnv)
+
+	conf := new(GensignConfig)
+	if err := decodeGensignConfig(raw, conf); err != nil {
+		if len(overridden) == 0 {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		// The files are decoded successfully, so the error is likely caused by the environment variables.
+		return nil, fmt.Errorf("%s with environment variables %s: %v", path, strings.Join(overridden, ", "), err)
+	}
+	conf.populate()
+	return conf, nil
+}
+
+// readConfigFile reads the config file in JSON, or in YAML if its extension is ".yaml" or ".yml".
+// It returns the config, decoded by GensignConfig to report the errors in the file, and its include directory.
+func readConfigFile(path string) (raw map[string]interface{}, include string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", path, err)
+		}
+	default:
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", jsonErrorPos(path, data, err), err)
+		}
+	}
+	if raw == nil {
+		// An empty YAML file, or a JSON null.
+		raw = make(map[string]interface{})
+	}
+
+	if include, err = includeDir(path, raw); err != nil {
+		return nil, "", err
+	}
+	if err := decodeGensignConfig(raw, new(GensignConfig)); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+	return raw, include, nil
+}
+
+// jsonErrorPos returns the position of the JSON syntax or type error in the format of "path:line:column".
+func jsonErrorPos(path string, data []byte, err error) string {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return path
+	}
+	// The offset is after the byte causing the error.
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Sprintf("%s:%d:%d", path, line, column)
+}
+
+// includeDir removes the include directory from the config of the file in path, and returns it.
+// A relative directory is relative to the directory of the file.
+func includeDir(path string, raw map[string]interface{}) (string, error) {
+	include, ok := raw[includeKey]
+	if !ok {
+		return "", nil
+	}
+	delete(raw, includeKey)
+	dir, ok := include.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: %s: expected a directory, got %v", path, includeKey, include)
+	}
+	if dir == "" || filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	return filepath.Join(filepath.Dir(path), dir), nil
+}
+
+// readFragments reads the config fragments in dir, in the lexical order of their file names.
+// The files other than JSON and YAML are skipped, e.g. the backups of the package manager.
+func readFragments(dir string) ([]map[string]interface{}, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yaml", ".yml":
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+
+	fragments := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fragment, include, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if include != "" {
+			return nil, fmt.Errorf("%s: %s is not allowed in a config fragment", path, includeKey)
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// mergeConfig merges src into dst. The objects are merged recursively, e.g. the handlers configured
+// in different files; any other value in src replaces the one in dst.
+func mergeConfig(dst, src map[string]interface{}) {
+	for key, srcVal := range src {
+		srcMap, ok := srcVal.(map[string]interface{})
+		if !ok {
+			dst[key] = srcVal
+			continue
+		}
+		dstMap, ok := dst[key].(map[string]interface{})
+		if !ok {
+			dst[key] = srcMap
+			continue
+		}
+		mergeConfig(dstMap, srcMap)
+	}
+}
+
+// overrideSecretsPaths sets the secrets paths in raw by the environment variables,
+// and returns the names of the environment variables applied.
+func overrideSecretsPaths(raw map[string]interface{}, lookupEnv func(string) (string, bool)) []string {
+	var overridden []string
+	for _, key := range secretsPathKeys {
+		for _, path := range expandKey(raw, strings.Split(key, ".")) {
+			name := envOverridePrefix + strings.ToUpper(strings.Join(path, "_"))
+			value, ok := lookupEnv(name)
+			if !ok {
+				continue
+			}
+			var v interface{} = value
+			if listKeys[key] {
+				var paths []interface{}
+				for _, p := range filepath.SplitList(value) {
+					paths = append(paths, p)
+				}
+				v = paths
+			}
+			setKey(raw, path, v)
+			overridden = append(overridden, name)
+		}
+	}
+	return overridden
+}
+
+// expandKey expands "*" in the key to the indexes of the list in raw.
+func expandKey(raw map[string]interface{}, key []string) [][]string {
+	for i, k := range key {
+		if k != "*" {
+			continue
+		}
+		list, _ := getKey(raw, key[:i]).([]interface{})
+		var paths [][]string
+		for j := range list {
+			prefix := append(append([]string{}, key[:i]...), strconv.Itoa(j))
+			paths = append(paths, expandKey(raw, append(prefix, key[i+1:]...))...)
+		}
+		return paths
+	}
+	return [][]string{key}
+}
+
+// getKey returns the value of the key in raw, or nil if the key does not exist.
+func getKey(raw interface{}, key []string) interface{} {
+	for _, k := range key {
+		switch v := raw.(type) {
+		case map[string]interface{}:
+			raw = v[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			raw = v[i]
+		default:
+			return nil
+		}
+	}
+	return raw
+}
+
+// setKey sets the value of the key in raw. The missing objects in the key are created.
+func setKey(raw map[string]interface{}, key []string, value interface{}) {
+	var parent interface{} = raw
+	for i, k := range key {
+		child := value
+		if i != len(key)-1 {
+			child = getKey(parent, []string{k})
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				parent = child
+				continue
+			default:
+				child = make(map[string]interface{})
+			}
+		}
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[k] = child
+		case []interface{}:
+			// The indexes are expanded from the lists by expandKey.
+			j, _ := strconv.Atoi(k)
+			p[j] = child
+		}
+		parent = child
+	}
+}
+
+// decodeGensignConfig decodes raw into conf. It returns an error with the paths of
+// the unknown keys, or of the keys whose values cannot be decoded.
+func decodeGensignConfig(raw map[string]interface{}, conf *GensignConfig) error {
+	md := new(mapstructure.Metadata)
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: SecondsOrStringToDuration(),
+		Metadata:   md,
+		Result:     conf,
+		TagName:    "json",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize decoder %v", err)
+	}
+	if err := decoder.Decode(raw); err != nil {
+		var decodeErr *mapstructure.Error
+		if errors.As(err, &decodeErr) {
+			sort.Strings(decodeErr.Errors)
+			return errors.New(strings.Join(decodeErr.Errors, "; "))
+		}
+		return err
+	}
+	return unknownKeysErr(md.Unused, nil)
+}
+
+// unknownKeysErr returns an error listing the unused keys reported by mapstructure, except the keys in allowed.
+func unknownKeysErr(unused []string, allowed map[string]bool) error {
+	var unknown []string
+	for _, key := range unused {
+		if !allowed[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadGensignConfig(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		// files are the contents of the files in a temporary directory, by their relative paths.
+		files map[string]string
+		// path is the relative path of the config file.
+		path string
+		env  map[string]string
+		want *GensignConfig
+		// wantErr is a substring of the expected error.
+		wantErr string
+	}{
+		{
+			name: "duration strings",
+			files: map[string]string{
+				"config.json": `{
+					"request_timeout": "90s",
+					"approval": {"ttl": "30m", "wait": 20},
+					"notifiers": [{"type": "syslog", "timeout": "1.5s"}]
+				}`,
+			},
+			path: "config.json",
+			want: &GensignConfig{
+				RequestTimeout: 90 * time.Second,
+				Approval:       ApprovalConfig{TTL: 30 * time.Minute, Wait: 20 * time.Second},
+				Notifiers:      []NotifierConfig{{Type: NotifierSyslog, Timeout: 1500 * time.Millisecond}},
+			},
+		},
+		{
+			name: "yaml",
+			files: map[string]string{
+				"config.yaml": `
+keyid_version: 1
+handlers:
+  paranoids.regular:
+    pub_key_dir: /etc/ssh/pubkeys
+    cert_validity_sec: 3600
+signer:
+  tls_ca_cert_files: [/opt/ca.crt]
+request_timeout: 1m
+`,
+			},
+			path: "config.yaml",
+			want: &GensignConfig{
+				KeyIDVersion: 1,
+				HandlerConfig: map[string]handlerConfMap{
+					"paranoids.regular": {"pub_key_dir": "/etc/ssh/pubkeys", "cert_validity_sec": 3600},
+				},
+				SignerConfig:   map[string]interface{}{"tls_ca_cert_files": []interface{}{"/opt/ca.crt"}},
+				RequestTimeout: time.Minute,
+				Approval:       ApprovalConfig{TTL: time.Hour},
+			},
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"config.json": `{
+					"include": "conf.d",
+					"audit_log_path": "/var/log/ysshra/audit.log",
+					"handlers": {"paranoids.regular": {"pub_key_dir": "/etc/ssh/pubkeys"}}
+				}`,
+				"conf.d/10-hardkey.yaml": `
+handlers:
+  paranoids.hardkey:
+    slot: "9a"
+`,
+				"conf.d/20-regular.json":    `{"handlers": {"paranoids.regular": {"cert_validity_sec": 3600}}}`,
+				"conf.d/30-audit.json":      `{"audit_log_path": "/var/log/audit.log"}`,
+				"conf.d/README":             `not a config fragment`,
+				"conf.d/40-old.json.bak":    `{"audit_log_path": "/tmp/audit.log"}`,
+				"conf.d/50-empty.yaml":      ``,
+				"conf.d/60-dir.json/x.json": `{"audit_log_path": "/tmp/audit.log"}`,
+			},
+			path: "config.json",
+			want: &GensignConfig{
+				HandlerConfig: map[string]handlerConfMap{
+					"paranoids.regular": {"pub_key_dir": "/etc/ssh/pubkeys", "cert_validity_sec": float64(3600)},
+					"paranoids.hardkey": {"slot": "9a"},
+				},
+				AuditLogPath:   "/var/log/audit.log",
+				RequestTimeout: requestTimeoutDefault,
+				Approval:       ApprovalConfig{TTL: approvalTTLDefault},
+			},
+		},
+		{
+			name: "environment variables",
+			files: map[string]string{
+				"config.json": `{
+					"signer": {"tls_client_key_file": "/opt/client.key", "crypki_port": 4443},
+					"notifiers": [{"type": "syslog"}, {"type": "webhook", "secret_path": "/opt/secret"}]
+				}`,
+			},
+			path: "config.json",
+			env: map[string]string{
+				"YSSHRA_SIGNER_TLS_CLIENT_KEY_FILE": "/run/secrets/client.key",
+				"YSSHRA_SIGNER_TLS_CA_CERT_FILES":   "/run/secrets/ca1.crt" + string(os.PathListSeparator) + "/run/secrets/ca2.crt",
+				"YSSHRA_OTEL_CLIENT_KEY_PATH":       "/run/secrets/otel.key",
+				"YSSHRA_NOTIFIERS_1_SECRET_PATH":    "/run/secrets/webhook",
+				"YSSHRA_NOTIFIERS_2_SECRET_PATH":    "/run/secrets/unused",
+				"YSSHRA_AUDIT_LOG_PATH":             "/tmp/audit.log",
+			},
+			want: &GensignConfig{
+				SignerConfig: map[string]interface{}{
+					"tls_client_key_file": "/run/secrets/client.key",
+					"tls_ca_cert_files":   []interface{}{"/run/secrets/ca1.crt", "/run/secrets/ca2.crt"},
+					"crypki_port":         float64(4443),
+				},
+				RequestTimeout: requestTimeoutDefault,
+				OTel:           OTelConfig{ClientKeyPath: "/run/secrets/otel.key"},
+				Approval:       ApprovalConfig{TTL: approvalTTLDefault},
+				Notifiers: []NotifierConfig{
+					{Type: NotifierSyslog, Timeout: notifierTimeoutDefault},
+					{Type: NotifierWebhook, SecretPath: "/run/secrets/webhook", Timeout: notifierTimeoutDefault},
+				},
+			},
+		},
+		{
+			name:    "unknown keys",
+			files:   map[string]string{"config.json": `{"request_timout": 30, "otel": {"enabled": true, "client_key_pth": "/opt/key"}}`},
+			path:    "config.json",
+			wantErr: "config.json: unknown keys: otel.client_key_pth, request_timout",
+		},
+		{
+			name:    "unknown keys in list",
+			files:   map[string]string{"config.yaml": "notifiers:\n  - type: syslog\n    tg: ysshra\n"},
+			path:    "config.yaml",
+			wantErr: "config.yaml: unknown keys: notifiers[0].tg",
+		},
+		{
+			name:    "invalid duration",
+			files:   map[string]string{"config.json": `{"approval": {"ttl": "1 hour"}}`},
+			path:    "config.json",
+			wantErr: "config.json: error decoding 'approval.ttl'",
+		},
+		{
+			name:    "invalid type",
+			files:   map[string]string{"config.json": `{"keyid_version": "one"}`},
+			path:    "config.json",
+			wantErr: "config.json: 'keyid_version' expected type 'uint16'",
+		},
+		{
+			name:    "json syntax error",
+			files:   map[string]string{"config.json": "{\n  \"keyid_version\": 1,\n  \"handlers\": {,\n}"},
+			path:    "config.json",
+			wantErr: "config.json:3:16: invalid character ','",
+		},
+		{
+			name:    "yaml syntax error",
+			files:   map[string]string{"config.yml": "keyid_version: 1\nhandlers: [\n"},
+			path:    "config.yml",
+			wantErr: "config.yml: yaml: line 2",
+		},
+		{
+			name: "unknown keys in fragment",
+			files: map[string]string{
+				"config.json":         `{"include": "conf.d"}`,
+				"conf.d/otel.json":    `{"otel": {"enabled": true}}`,
+				"conf.d/signer.yaml":  "signr:\n  crypki_port: 4443\n",
+				"conf.d/z-audit.json": `{"audit_log_path": "/var/log/audit.log"}`,
+			},
+			path:    "config.json",
+			wantErr: filepath.Join("conf.d", "signer.yaml") + ": unknown keys: signr",
+		},
+		{
+			name: "include in fragment",
+			files: map[string]string{
+				"config.json":      `{"include": "conf.d"}`,
+				"conf.d/more.json": `{"include": "more.d"}`,
+			},
+			path:    "config.json",
+			wantErr: "include is not allowed in a config fragment",
+		},
+		{
+			name:    "missing include directory",
+			files:   map[string]string{"config.json": `{"include": "conf.d"}`},
+			path:    "config.json",
+			wantErr: "failed to read include directory",
+		},
+		{
+			name:  "empty environment variable",
+			files: map[string]string{"config.json": `{"notifiers": [{"type": "webhook"}]}`},
+			path:  "config.json",
+			env:   map[string]string{"YSSHRA_NOTIFIERS_0_SECRET_PATH": ""},
+			want: &GensignConfig{
+				RequestTimeout: requestTimeoutDefault,
+				Approval:       ApprovalConfig{TTL: approvalTTLDefault},
+				Notifiers:      []NotifierConfig{{Type: NotifierWebhook, Timeout: notifierTimeoutDefault}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lookupEnv := func(key string) (string, bool) {
+				v, ok := tt.env[key]
+				return v, ok
+			}
+
+			got, err := loadGensignConfig(filepath.Join(dir, tt.path), lookupEnv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadGensignConfig() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadGensignConfig() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadGensignConfig() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package config
+
+import "time"
+
+const (
+	notifierTimeoutDefault = 10 * time.Second
+)
+
+// Types of the notifiers.
+const (
+	NotifierWebhook = "webhook"
+	NotifierSyslog  = "syslog"
+	NotifierExec    = "exec"
+)
+
+// NotifierConfig stores the configuration of a notifier, which notifies the outcome of the requests to an external system.
+type NotifierConfig struct {
+	// Type is the type of the notifier, one of "webhook", "syslog" and "exec".
+	Type string `json:"type"`
+	// Handlers are the names of the handlers whose requests are notified.
+	// The requests to all the handlers are notified if it is empty.
+	Handlers []string `json:"handlers"`
+	// CertTypes are the labels of the certificate types notified, e.g. "FireFighterSudo" or "TouchlessSudo".
+	// All the certificates are notified if it is empty. Otherwise, the failed requests are not notified.
+	CertTypes []string `json:"cert_types"`
+	// Mandatory indicates the notifier is notified of the certificates before they are added to the agent,
+	// and the request fails without adding them if the notifier fails.
+	// Otherwise, the notifier runs in background once the certificates are added and its failures are only logged.
+	Mandatory bool `json:"mandatory"`
+	// Timeout is the time limit of a notification, including the retries, in seconds or a duration string.
+	Timeout time.Duration `json:"timeout"`
+
+	// URL is the endpoint of the webhook, which receives the events in JSON by POST requests.
+	URL string `json:"url"`
+	// SecretPath is the path of the key signing the webhook requests by HMAC-SHA256.
+	// The requests are not signed if it is empty.
+	SecretPath string `json:"secret_path"`
+	// Retries is the number of the retries after a webhook request fails.
+	Retries uint `json:"retries"`
+
+	// Network and Address specify the syslog server, e.g. "udp" and "syslog.example.com:514".
+	// The local syslog server is used if they are empty.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// Tag is the tag of the syslog messages. The name of the process is used if it is empty.
+	Tag string `json:"tag"`
+
+	// Command is the path and the arguments of the exec hook, which receives the event in JSON from stdin.
+	Command []string `json:"command"`
+}
+
+func (n *NotifierConfig) populate() {
+	if n.Timeout <= 0 {
+		n.Timeout = notifierTimeoutDefault
+	}
+}
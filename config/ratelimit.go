@@ -0,0 +1,75 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package config
+
+import "fmt"
+
+// rateLimitKey is the key of the rate limits in the handler config.
+const rateLimitKey = "rate_limit"
+
+// RateLimit is the token bucket limit of the requests.
+type RateLimit struct {
+	// PerHour is the number of the tokens refilled per hour.
+	PerHour float64 `mapstructure:"per_hour"`
+	// Burst is the capacity of the bucket. The limit is disabled if it is zero.
+	Burst int `mapstructure:"burst"`
+}
+
+// Enabled returns true if the limit applies to the requests.
+func (r RateLimit) Enabled() bool {
+	return r.Burst > 0
+}
+
+// validate checks the bucket of an enabled limit is refilled.
+func (r RateLimit) validate() error {
+	if r.Burst < 0 {
+		return fmt.Errorf("burst must not be negative, got %d", r.Burst)
+	}
+	if r.Enabled() && r.PerHour <= 0 {
+		return fmt.Errorf("per_hour must be positive if burst is set, got %v", r.PerHour)
+	}
+	return nil
+}
+
+// HandlerRateLimit is the rate limits of a handler, configured in "rate_limit" of the handler config, e.g.
+//
+//	"rate_limit": {
+//	  "per_user": {"per_hour": 60, "burst": 10},
+//	  "per_source": {"per_hour": 120, "burst": 20},
+//	  "global": {"per_hour": 3600, "burst": 200}
+//	}
+type HandlerRateLimit struct {
+	// PerUser limits the requests of each LogName.
+	PerUser RateLimit `mapstructure:"per_user"`
+	// PerSource limits the requests from each client IP.
+	PerSource RateLimit `mapstructure:"per_source"`
+	// Global limits all the requests to the handler.
+	Global RateLimit `mapstructure:"global"`
+}
+
+// ExtractHandlerRateLimit extracts the rate limits of the handler from GensignConfig by the given name.
+func (g *GensignConfig) ExtractHandlerRateLimit(name string) (HandlerRateLimit, error) {
+	hConfMap, ok := g.HandlerConfig[name]
+	if !ok {
+		return HandlerRateLimit{}, fmt.Errorf("failed to find config for handler %q", name)
+	}
+	conf := struct {
+		RateLimit HandlerRateLimit `mapstructure:"rate_limit"`
+	}{}
+	// Only the rate limits are decoded, the other keys are decoded by the handler.
+	if err := decodeHandlerConf(name, handlerConfMap{rateLimitKey: hConfMap[rateLimitKey]}, &conf); err != nil {
+		return HandlerRateLimit{}, err
+	}
+	limits := map[string]RateLimit{
+		"per_user":   conf.RateLimit.PerUser,
+		"per_source": conf.RateLimit.PerSource,
+		"global":     conf.RateLimit.Global,
+	}
+	for key, limit := range limits {
+		if err := limit.validate(); err != nil {
+			return HandlerRateLimit{}, fmt.Errorf("invalid %s.%s of handler %q: %v", rateLimitKey, key, name, err)
+		}
+	}
+	return conf.RateLimit, nil
+}
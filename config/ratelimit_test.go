@@ -0,0 +1,87 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGensignConfig_ExtractHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		handlerMap handlerConfMap
+		want       HandlerRateLimit
+		wantErr    bool
+	}{
+		{
+			name: "happy path",
+			handlerMap: handlerConfMap{
+				"pub_key_dir": "/etc/ssh/pubkeys",
+				"rate_limit": map[string]interface{}{
+					"per_user": map[string]interface{}{"per_hour": 60, "burst": 10},
+					"global":   map[string]interface{}{"per_hour": 3600.0, "burst": 200},
+				},
+			},
+			want: HandlerRateLimit{
+				PerUser: RateLimit{PerHour: 60, Burst: 10},
+				Global:  RateLimit{PerHour: 3600, Burst: 200},
+			},
+		},
+		{
+			name:       "no rate limits",
+			handlerMap: handlerConfMap{"pub_key_dir": "/etc/ssh/pubkeys"},
+		},
+		{
+			name: "unknown keys",
+			handlerMap: handlerConfMap{
+				"rate_limit": map[string]interface{}{
+					"per_user": map[string]interface{}{"per_hr": 60, "burst": 10},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "never refilled",
+			handlerMap: handlerConfMap{
+				"rate_limit": map[string]interface{}{
+					"per_source": map[string]interface{}{"burst": 10},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative burst",
+			handlerMap: handlerConfMap{
+				"rate_limit": map[string]interface{}{
+					"global": map[string]interface{}{"per_hour": 60, "burst": -1},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "disabled without refill",
+			handlerMap: handlerConfMap{
+				"rate_limit": map[string]interface{}{
+					"global": map[string]interface{}{"per_hour": 0, "burst": 0},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			conf := &GensignConfig{HandlerConfig: map[string]handlerConfMap{"example": tt.handlerMap}}
+			got, err := conf.ExtractHandlerRateLimit("example")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractHandlerRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractHandlerRateLimit() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
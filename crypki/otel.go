@@ -0,0 +1,45 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package crypki
+
+import (
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+const (
+	scopeName                = "github.com/theparanoids/ysshra/crypki"
+	ysshraCrypkiSignDuration = "ysshra.crypki.sign.duration"
+)
+
+// Span and metric attributes of the signing requests.
+const (
+	// endpointKey is the attribute of the Crypki endpoint.
+	endpointKey = attribute.Key("crypki.endpoint")
+	// keyIdentifierKey is the attribute of the identifier of the signing key in Crypki.
+	keyIdentifierKey = attribute.Key("crypki.key_identifier")
+	// successKey is the attribute indicating whether the signing request succeeds.
+	successKey = attribute.Key("crypki.success")
+)
+
+// signDuration records the latency of the signing requests to each endpoint.
+// It is created once by the global meter provider, which forwards it to the provider set up later by the commands.
+var signDuration metric.Float64Histogram
+
+func init() {
+	var err error
+	signDuration, err = otel.GetMeterProvider().Meter(scopeName).Float64Histogram(
+		ysshraCrypkiSignDuration,
+		metric.WithUnit("s"),
+		metric.WithDescription("The latency of the signing requests to each Crypki endpoint"),
+	)
+	if err != nil {
+		log.Printf("Error creating metric for signing duration: %v\n", err)
+		signDuration, _ = noop.Meter{}.Float64Histogram(ysshraCrypkiSignDuration)
+	}
+}
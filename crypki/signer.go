@@ -6,6 +6,7 @@ package crypki
 import (
 	"context"
 	"fmt"
+	"time"
 
 	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	"github.com/rs/zerolog/log"
@@ -16,9 +17,16 @@ import (
 	"github.com/theparanoids/ysshra/sshutils/key"
 	"github.com/theparanoids/ysshra/tlsutils"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 )
 
@@ -26,6 +34,10 @@ import (
 type Signer struct {
 	endpoints   []string
 	dialOptions []grpc.DialOption
+	// tracerProvider creates the spans of the signing requests. The global provider is used if it is nil.
+	tracerProvider trace.TracerProvider
+	// signDuration records the latency of the signing requests. The default instrument is used if it is nil.
+	signDuration metric.Float64Histogram
 }
 
 // NewSignerWithGensignConf creates a Signer by GensignConfig.
@@ -68,7 +80,7 @@ func NewSigner(conf SignerConfig) (*Signer, error) {
 			grpc_retry.WithPerRetryTimeout(conf.PerTryTimeout),
 			grpc_retry.WithBackoff(backoff.DefaultConfig.Backoff)),
 		),
-		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithStatsHandler(newClientStatsHandler()),
 	}
 
 	signer := &Signer{
@@ -78,10 +90,16 @@ func NewSigner(conf SignerConfig) (*Signer, error) {
 	return signer, nil
 }
 
+// newClientStatsHandler returns the gRPC stats handler propagating the trace context to Crypki,
+// so that the signing is traced as part of the gensign request.
+func newClientStatsHandler() stats.Handler {
+	return otelgrpc.NewClientHandler(otelgrpc.WithPropagators(propagation.TraceContext{}))
+}
+
 // Sign makes a signing request against Crypki Server.
 func (s *Signer) Sign(ctx context.Context, request *pb.SSHCertificateSigningRequest) (certs []ssh.PublicKey, comments []string, err error) {
 	for _, endpoint := range s.endpoints {
-		certs, comments, err = s.postUserSSHCertificate(ctx, request, endpoint)
+		certs, comments, err = s.sign(ctx, request, endpoint)
 		if err == nil {
 			return
 		}
@@ -90,6 +108,33 @@ func (s *Signer) Sign(ctx context.Context, request *pb.SSHCertificateSigningRequ
 	return
 }
 
+// sign sends the signing request to the endpoint in a span, and records the latency of the request.
+func (s *Signer) sign(ctx context.Context, request *pb.SSHCertificateSigningRequest, endpoint string) ([]ssh.PublicKey, []string, error) {
+	tp := s.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	attrs := []attribute.KeyValue{endpointKey.String(endpoint), keyIdentifierKey.String(request.GetKeyMeta().GetIdentifier())}
+	ctx, span := tp.Tracer(scopeName).Start(ctx, "crypki.Sign", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	start := time.Now()
+	certs, comments, err := s.postUserSSHCertificate(ctx, request, endpoint)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to sign")
+	}
+
+	histogram := s.signDuration
+	if histogram == nil {
+		histogram = signDuration
+	}
+	histogram.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributes(append(attrs, successKey.Bool(err == nil))...))
+	return certs, comments, err
+}
+
 // postUserSSHCertificate establishes the gRPC connection to the Crypki Server, and sends the signing request.
 func (s *Signer) postUserSSHCertificate(ctx context.Context, csr *pb.SSHCertificateSigningRequest, endpoint string) (certs []ssh.PublicKey, comments []string, err error) {
 	const apiName = "postUserSSHCertificate"
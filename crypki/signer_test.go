@@ -20,10 +20,16 @@ import (
 	mockhelper "github.com/theparanoids/ysshra/crypki/mock"
 	"github.com/theparanoids/ysshra/internal/backoff"
 	"github.com/theparanoids/ysshra/sshutils/key"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
@@ -283,3 +289,77 @@ func TestNewSigner(t *testing.T) {
 		})
 	}
 }
+
+func TestSignerSignTracing(t *testing.T) {
+	// Disable parallel to prevent race condition with other test cases relying on the mock grpc server.
+	// t.Parallel()
+	csr := &proto.SSHCertificateSigningRequest{
+		KeyMeta:    &proto.KeyMeta{Identifier: "key-identifier"},
+		Principals: []string{"testuser"},
+	}
+	validCert, _ := testSSHCertificate(t, "testuser")
+
+	mockServer, dialOpts := testMockGRPCServer(t)
+	var traceparent []string
+	mockServer.
+		EXPECT().
+		PostUserSSHCertificate(gomock.Any(), mockhelper.String(csr)).
+		DoAndReturn(func(ctx context.Context, _ *proto.SSHCertificateSigningRequest) (*proto.SSHKey, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			traceparent = md.Get("traceparent")
+			return &proto.SSHKey{Key: string(ssh.MarshalAuthorizedKey(validCert))}, nil
+		})
+
+	recorder := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	histogram, err := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter(scopeName).
+		Float64Histogram(ysshraCrypkiSignDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Signer{
+		endpoints:      []string{"127.0.0.1"},
+		dialOptions:    append(dialOpts, grpc.WithStatsHandler(newClientStatsHandler())),
+		tracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		signDuration:   histogram,
+	}
+	if _, _, err = s.Sign(context.Background(), csr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	for _, want := range []attribute.KeyValue{endpointKey.String("127.0.0.1"), keyIdentifierKey.String("key-identifier")} {
+		found := false
+		for _, attr := range span.Attributes() {
+			found = found || attr == want
+		}
+		if !found {
+			t.Errorf("span has no attribute %v: %v", want, span.Attributes())
+		}
+	}
+	if len(traceparent) != 1 || !strings.Contains(traceparent[0], span.SpanContext().TraceID().String()) {
+		t.Errorf("got traceparent %v, want trace ID %s", traceparent, span.SpanContext().TraceID())
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	if len(rm.ScopeMetrics) != 1 || len(rm.ScopeMetrics[0].Metrics) != 1 {
+		t.Fatalf("unexpected metrics %+v", rm.ScopeMetrics)
+	}
+	points := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64]).DataPoints
+	if len(points) != 1 || points[0].Count != 1 {
+		t.Fatalf("unexpected signing duration %+v", points)
+	}
+	if v, _ := points[0].Attributes.Value(endpointKey); v.AsString() != "127.0.0.1" {
+		t.Errorf("got endpoint %q, want 127.0.0.1", v.AsString())
+	}
+	if v, _ := points[0].Attributes.Value(successKey); !v.AsBool() {
+		t.Errorf("got unsuccessful signing duration")
+	}
+}
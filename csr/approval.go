@@ -0,0 +1,25 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package csr
+
+import "time"
+
+// Approval is the status of a request which requires a second person to approve.
+type Approval struct {
+	// ID identifies the request waiting for approval.
+	ID string
+	// Approver is the person who approves or denies the request. It is empty if the request is pending.
+	Approver string
+	// Approved indicates whether the request is approved.
+	Approved bool
+	// Reason is the reason given by the approver.
+	Reason string
+	// Time is the time when the approver makes the decision.
+	Time time.Time
+}
+
+// Pending returns true if no decision has been made on the request.
+func (a *Approval) Pending() bool {
+	return a.Approver == ""
+}
@@ -47,6 +47,8 @@ type ReqParam struct {
 	SignatureAlgo x509.SignatureAlgorithm
 	// Attrs stores information that client passes to RA, containing attributes of SSH certificate that the client requests for.
 	Attrs *message.Attributes
+	// Approval is the approval of the request, set by gensign if the handler requires one.
+	Approval *Approval
 }
 
 // NewReqParam initializes a ReqParam properly.
@@ -0,0 +1,97 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/theparanoids/ysshra/csr"
+)
+
+// approvalPollInterval is the interval to check the approval queue while waiting for a decision.
+const approvalPollInterval = time.Second
+
+// ApprovalQueue stores the requests which require a second person to approve.
+type ApprovalQueue interface {
+	// Submit queues the request to the handler for the principals and the key with the fingerprint,
+	// unless the request is already in the queue. It returns the approval status of the queued request,
+	// where a decision is returned only if it is verified to be made by an approver.
+	// A denied request is removed from the queue once its decision is returned.
+	Submit(params *csr.ReqParam, handler string, principals []string, fingerprint string) (*csr.Approval, error)
+	// Consume removes the approved request with the id from the queue before the certificates are added to the agent,
+	// so that an approval is used for only one request. It fails if the approval is already consumed.
+	Consume(id string) error
+}
+
+// ApprovalRequiredError is the error of an ApprovalRequired Error returned by a handler,
+// which describes the request to be approved.
+type ApprovalRequiredError struct {
+	// Principals are the principals requested in the certificate.
+	Principals []string
+	// Fingerprint is the fingerprint of the public key to be certified.
+	Fingerprint string
+	// id is the ID of the queued request.
+	id string
+}
+
+// Error returns the ApprovalRequiredError's string representation.
+func (e *ApprovalRequiredError) Error() string {
+	if e.id == "" {
+		return fmt.Sprintf("no approval queue for principals %s", strings.Join(e.Principals, ","))
+	}
+	return fmt.Sprintf("request %s for principals %s is waiting for approval", e.id, strings.Join(e.Principals, ","))
+}
+
+// NewApprovalRequiredError returns the error of a handler which requires a second person to approve the request
+// for the principals and the public key with the fingerprint. gensign queues the request, and calls the handler
+// again with the approval in csr.ReqParam.
+func NewApprovalRequiredError(handlerName string, principals []string, fingerprint string) *Error {
+	return NewError(ApprovalRequired, handlerName, &ApprovalRequiredError{Principals: principals, Fingerprint: fingerprint})
+}
+
+// approvalRequired returns the request to be approved if err is an ApprovalRequired Error.
+func approvalRequired(err error) (*ApprovalRequiredError, bool) {
+	e, ok := IsError(err)
+	if !ok || e.Type() != ApprovalRequired {
+		return nil, false
+	}
+	var approvalErr *ApprovalRequiredError
+	if !errors.As(e.err, &approvalErr) {
+		return nil, false
+	}
+	return approvalErr, true
+}
+
+// waitApproval submits the request to the queue, and waits for the decision until wait elapses or ctx is done.
+// It returns the approval if the request is approved.
+func waitApproval(ctx context.Context, queue ApprovalQueue, wait time.Duration, params *csr.ReqParam,
+	handlerName string, request *ApprovalRequiredError) (*csr.Approval, error) {
+	principals := request.Principals
+	deadline := time.Now().Add(wait)
+	for {
+		approval, err := queue.Submit(params, handlerName, principals, request.Fingerprint)
+		if err != nil {
+			return nil, NewError(ApprovalRequired, handlerName, fmt.Errorf("failed to submit request: %v", err))
+		}
+		if !approval.Pending() {
+			if !approval.Approved {
+				return nil, NewError(ApprovalDenied, handlerName,
+					fmt.Errorf("request %s is denied by %s: %s", approval.ID, approval.Approver, approval.Reason))
+			}
+			return approval, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, NewError(ApprovalRequired, handlerName, &ApprovalRequiredError{Principals: principals, id: approval.ID})
+		}
+		select {
+		case <-ctx.Done():
+			return nil, NewError(ApprovalRequired, handlerName, &ApprovalRequiredError{Principals: principals, id: approval.ID})
+		case <-time.After(approvalPollInterval):
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"github.com/theparanoids/ysshra/csr"
+	"golang.org/x/crypto/ssh"
+)
+
+// Auditor records the outcome of the requests.
+type Auditor interface {
+	// Issued records a certificate issued for the request by the handler.
+	// keyIdentifier is the identifier of the CA key requested to sign the certificate.
+	Issued(params *csr.ReqParam, handler string, keyIdentifier string, cert *ssh.Certificate) error
+	// Denied records a request which fails without any certificate issued.
+	// handler is empty if no handler authenticates the request.
+	Denied(params *csr.ReqParam, handler string, reason error) error
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/csr"
+)
+
+// DryRun authenticates the request and generates the CSRs by the first handler authenticating it, as Run does,
+// but it neither signs the CSRs nor adds any certificate to the agent.
+// It returns the name of the handler and the generated CSRs.
+// If all the authentications fail, the returned error contains the failure of each handler.
+func DryRun(params *csr.ReqParam, handlers []Handler) (handlerName string, csrs []*proto.SSHCertificateSigningRequest, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewError(Panic, handlerName, fmt.Errorf(`unexpected crash: %q`, string(debug.Stack())))
+		}
+	}()
+
+	var (
+		handler  Handler
+		failures []string
+	)
+	for _, h := range handlers {
+		handlerName = h.Name()
+		if err := h.Authenticate(params); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", h.Name(), err))
+			continue
+		}
+		handler = h
+		break
+	}
+	if handler == nil {
+		if len(failures) == 0 {
+			return "", nil, NewErrWithMsg(AllAuthFailed, "no handler configured")
+		}
+		return "", nil, NewErrWithMsg(AllAuthFailed, strings.Join(failures, "; "))
+	}
+
+	agentKeys, err := handler.Generate(params)
+	if err != nil {
+		return handlerName, nil, err
+	}
+	for _, agentKey := range agentKeys {
+		csrs = append(csrs, agentKey.CSRs()...)
+	}
+	if len(csrs) == 0 {
+		return handlerName, nil, NewErrWithMsg(HandlerGenCSRErr, "no csr generated")
+	}
+	return handlerName, csrs, nil
+}
@@ -6,7 +6,9 @@ package gensign
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"time"
 )
 
 // Error defines the format of an error coming from gensign handlers.
@@ -91,6 +93,30 @@ const (
 	AgentOpCertErr
 	// Panic indicates a panic raised from the handler.
 	Panic
+	// FirmwareNotAllowed indicates the firmware of the attested device is older than required.
+	FirmwareNotAllowed
+	// TouchPolicyNotAllowed indicates the touch policy of the attested key is not allowed.
+	TouchPolicyNotAllowed
+	// PINPolicyNotAllowed indicates the PIN policy of the attested key is not allowed.
+	PINPolicyNotAllowed
+	// FormFactorNotAllowed indicates the form factor of the attested device is not allowed.
+	FormFactorNotAllowed
+	// DeviceDenied indicates the attested device is in the denylist, or not in the allowlist.
+	DeviceDenied
+	// DeviceNotBound indicates the attested device is not registered to the user.
+	DeviceNotBound
+	// AuditErr indicates the auditor fails to record the issued certificate.
+	AuditErr
+	// RateLimited indicates the request exceeds the rate limits of the handler.
+	RateLimited
+	// ApprovalRequired indicates the request is waiting for a second person to approve.
+	ApprovalRequired
+	// ApprovalDenied indicates the request is denied by the approver.
+	ApprovalDenied
+	// NotifyErr indicates a mandatory notifier fails to notify the certificates before they are added to the agent.
+	NotifyErr
+	// RateLimiterErr indicates the rate limiter fails to check the request, e.g. its state cannot be read.
+	RateLimiterErr
 )
 
 // String returns the ErrorType's string representation.
@@ -114,11 +140,79 @@ func (t ErrorType) String() string {
 		return "agent fails to operate certificate"
 	case Panic:
 		return "panic"
+	case FirmwareNotAllowed:
+		return "device firmware is not allowed"
+	case TouchPolicyNotAllowed:
+		return "touch policy is not allowed"
+	case PINPolicyNotAllowed:
+		return "PIN policy is not allowed"
+	case FormFactorNotAllowed:
+		return "device form factor is not allowed"
+	case DeviceDenied:
+		return "device is denied"
+	case DeviceNotBound:
+		return "device is not registered to the user"
+	case AuditErr:
+		return "auditor fails to record certificate"
+	case RateLimited:
+		return "too many requests"
+	case ApprovalRequired:
+		return "approval is required"
+	case ApprovalDenied:
+		return "approval is denied"
+	case NotifyErr:
+		return "notifier fails to notify certificate"
+	case RateLimiterErr:
+		return "rate limiter fails to check request"
 	default:
 		return "unknown error type"
 	}
 }
 
+// RetryAfterError is the error of a RateLimited Error, which indicates when the request can be retried.
+type RetryAfterError struct {
+	RetryAfter time.Duration
+}
+
+// Error returns the RetryAfterError's string representation.
+func (e *RetryAfterError) Error() string {
+	retryAfter := e.RetryAfter
+	// Round up to avoid a retry before the tokens are refilled, unless it overflows.
+	if retryAfter <= math.MaxInt64-time.Second {
+		retryAfter = (retryAfter + time.Second - 1).Truncate(time.Second)
+	}
+	return fmt.Sprintf("retry after %v", retryAfter)
+}
+
+// RetryAfter returns the duration after which the request can be retried, if err is a RateLimited Error.
+func RetryAfter(err error) (time.Duration, bool) {
+	e, ok := IsError(err)
+	if !ok || e.Type() != RateLimited {
+		return 0, false
+	}
+	var retryErr *RetryAfterError
+	if !errors.As(e.err, &retryErr) {
+		return 0, false
+	}
+	return retryErr.RetryAfter, true
+}
+
+// isRejection returns true if the error is raised by a handler which identifies the key but rejects it,
+// either by the device policy or by a failure in the policy configuration.
+func isRejection(err error) bool {
+	e, ok := IsError(err)
+	if !ok {
+		return false
+	}
+	switch e.Type() {
+	case FirmwareNotAllowed, TouchPolicyNotAllowed, PINPolicyNotAllowed, FormFactorNotAllowed, DeviceDenied, DeviceNotBound,
+		HandlerConfErr:
+		return true
+	default:
+		return false
+	}
+}
+
 // IsErrorOfType returns true if the error matches to the given error type.
 func IsErrorOfType(err interface{}, typ ErrorType) bool {
 	e, ok := IsError(err)
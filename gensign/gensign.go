@@ -12,36 +12,127 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/theparanoids/ysshra/csr"
 	"github.com/theparanoids/ysshra/internal/logkey"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
+// RunOption contains the optional parameters of RunWithOption.
+type RunOption struct {
+	// Auditor records the issued certificates and the denied requests if it is not nil.
+	// A certificate is not added to the agent unless it is recorded.
+	Auditor Auditor
+	// TracerProvider creates the spans of each phase of the request.
+	// The global provider is used if it is nil.
+	TracerProvider trace.TracerProvider
+	// MeterProvider creates the instruments recording the latency, the issued certificates and
+	// the authentication failures. The instruments created once by the global provider are used if it is nil.
+	MeterProvider metric.MeterProvider
+	// RateLimiter limits the requests to the authenticated handler if it is not nil.
+	// The request fails if the rate limiter fails, otherwise a broken state would disable the limits.
+	RateLimiter RateLimiter
+	// ApprovalQueue stores the requests which the handlers require a second person to approve.
+	// If it is nil, such requests fail.
+	ApprovalQueue ApprovalQueue
+	// ApprovalWait is the duration to wait for the decision on a queued request.
+	// If it is zero, the requester retries the request after the approval.
+	ApprovalWait time.Duration
+	// Notifier notifies the issued certificates and the failed requests if it is not nil.
+	// A certificate is not added to the agent if a mandatory notifier fails to notify it.
+	Notifier Notifier
+}
+
 // Run is the main function of gensign.
 // We assume the user has been authenticated via SSH (OpenSSH Server) before entering this function.
-func Run(ctx context.Context, params *csr.ReqParam, handlers []Handler, signer csr.Signer) (err error) {
+func Run(ctx context.Context, params *csr.ReqParam, handlers []Handler, signer csr.Signer) error {
+	return RunWithOption(ctx, params, handlers, signer, RunOption{})
+}
+
+// RunWithOption is the same as Run, but with the optional parameters in opt.
+func RunWithOption(ctx context.Context, params *csr.ReqParam, handlers []Handler, signer csr.Signer, opt RunOption) (err error) {
+	var (
+		handler Handler
+		issued  int
+	)
+	start := time.Now()
+	m := metricsOf(opt.MeterProvider)
+	tracer := newTracer(opt.TracerProvider)
+	ctx, span := tracer.Start(ctx, spanRun, trace.WithAttributes(transIDKey.String(params.TransID)))
+	defer func() {
+		m.recordRun(ctx, nameOf(handler), time.Since(start), err)
+		endSpan(span, err)
+	}()
+
+	// Record the denied request after the panic is recovered.
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The certificates are audited once they are signed, even if they are not added to the agent.
+		if opt.Auditor != nil && issued == 0 {
+			if auditErr := opt.Auditor.Denied(params, nameOf(handler), err); auditErr != nil {
+				log.Warn().Err(auditErr).Str(logkey.TransIDField, params.TransID).Msg("failed to audit denied request")
+			}
+		}
+		if opt.Notifier != nil {
+			event := &Event{Params: params, Handler: nameOf(handler), Err: err}
+			if notifyErr := opt.Notifier.NotifyMandatory(ctx, event); notifyErr != nil {
+				log.Warn().Err(notifyErr).Str(logkey.TransIDField, params.TransID).Msg("failed to notify failed request")
+			}
+			opt.Notifier.Notify(ctx, event)
+		}
+	}()
 	// Prepare for panic logs
 	defer func() {
 		if r := recover(); r != nil {
-			ExportPanicMetric(ctx, params, fmt.Sprintf("%v", r))
+			m.recordPanic(ctx, fmt.Sprintf("%v", r))
 			err = NewError(Panic, "", fmt.Errorf(`unexpected crash: %q`, string(debug.Stack())))
 		}
 	}()
 
-	start := time.Now()
-
-	var handler Handler
+	// rejected is the first error of a handler which identifies the key but rejects it.
+	var rejected error
 	for _, h := range handlers {
+		_, authSpan := tracer.Start(ctx, spanAuthenticate, trace.WithAttributes(handlerKey.String(h.Name())))
 		err := h.Authenticate(params)
+		endSpan(authSpan, err)
 		if err == nil {
 			handler = h
 			break
 		}
+		if rejected == nil && isRejection(err) {
+			rejected = err
+		}
+		m.recordAuthFailure(ctx, h.Name(), err)
 		log.Info().Err(err).Str("handler", h.Name()).Msgf("authentication failed")
 	}
 	if handler == nil {
+		if rejected != nil {
+			// Surface the rejection, e.g. a policy violation, which tells why the key is refused.
+			return rejected
+		}
 		return NewErrWithMsg(AllAuthFailed, "all authentications failed")
 	}
+	span.SetAttributes(handlerKey.String(handler.Name()))
 
-	csrAgentKeys, err := handler.Generate(params)
+	if opt.RateLimiter != nil {
+		retryAfter, err := opt.RateLimiter.Allow(params, handler.Name())
+		if err != nil {
+			// Fail closed, otherwise a broken state file disables the limits.
+			return NewError(RateLimiterErr, handler.Name(), err)
+		} else if retryAfter > 0 {
+			return NewError(RateLimited, handler.Name(), &RetryAfterError{RetryAfter: retryAfter})
+		}
+	}
+
+	csrAgentKeys, err := generate(ctx, tracer, handler, params)
+	if request, ok := approvalRequired(err); ok && opt.ApprovalQueue != nil {
+		params.Approval, err = waitApproval(ctx, opt.ApprovalQueue, opt.ApprovalWait, params, handler.Name(), request)
+		if err != nil {
+			return err
+		}
+		csrAgentKeys, err = generate(ctx, tracer, handler, params)
+	}
 	if err != nil {
 		return err
 	}
@@ -50,23 +141,68 @@ func Run(ctx context.Context, params *csr.ReqParam, handlers []Handler, signer c
 		return NewErrWithMsg(HandlerGenCSRErr, "no csr generated")
 	}
 
+	var (
+		signed []*signedCerts
+		// certs are the certificates signed for all the agent keys.
+		certs []ssh.PublicKey
+	)
 	for _, agentKey := range csrAgentKeys {
-		var (
-			certs    []ssh.PublicKey
-			comments []string
-		)
+		s := &signedCerts{agentKey: agentKey}
 		for _, csr := range agentKey.CSRs() {
-			cert, comment, err := signer.Sign(ctx, csr)
+			signCtx, signSpan := tracer.Start(ctx, spanSign,
+				trace.WithAttributes(keyIdentifierKey.String(csr.GetKeyMeta().GetIdentifier())))
+			cert, comment, err := signer.Sign(signCtx, csr)
+			endSpan(signSpan, err)
 			if err != nil {
 				return NewErr(SignerSignErr, fmt.Errorf("failed to sign CSR: %v", err))
 			}
-			certs = append(certs, cert...)
-			comments = append(comments, comment...)
+			s.certs = append(s.certs, cert...)
+			s.comments = append(s.comments, comment...)
+			for range cert {
+				s.keyIdentifiers = append(s.keyIdentifiers, csr.GetKeyMeta().GetIdentifier())
+			}
+		}
+		if opt.Auditor != nil {
+			if err := audit(opt.Auditor, params, handler.Name(), s.certs, s.keyIdentifiers); err != nil {
+				return err
+			}
+		}
+		issued += len(s.certs)
+		signed = append(signed, s)
+		certs = append(certs, s.certs...)
+	}
+
+	// The certificates are usable once they are in the agent, so a mandatory notifier must succeed before.
+	if opt.Notifier != nil {
+		if err := opt.Notifier.NotifyMandatory(ctx, issuedEvent(params, handler.Name(), certs)); err != nil {
+			return NewErr(NotifyErr, err)
+		}
+	}
+
+	// Consume the approval before the certificates are usable, so that it is not used by another request.
+	if params.Approval != nil && opt.ApprovalQueue != nil {
+		if err := opt.ApprovalQueue.Consume(params.Approval.ID); err != nil {
+			return NewError(ApprovalRequired, handler.Name(), fmt.Errorf("failed to consume approval: %v", err))
 		}
-		err = agentKey.AddCertsToAgent(certs, comments)
+	}
+
+	// added are the certificates added to the agent.
+	var added []ssh.PublicKey
+	for _, s := range signed {
+		_, addSpan := tracer.Start(ctx, spanAddCertsToAgent, trace.WithAttributes(certCountKey.Int(len(s.certs))))
+		err = s.agentKey.AddCertsToAgent(s.certs, s.comments)
+		endSpan(addSpan, err)
 		if err != nil {
 			return NewErr(AgentOpCertErr, fmt.Errorf("failed to add certificates into the agent: %v", err))
 		}
+		for i, cert := range s.certs {
+			m.recordIssued(ctx, handler.Name(), s.keyIdentifiers[i], cert)
+		}
+		added = append(added, s.certs...)
+	}
+	// Notify the other notifiers of the certificates in the agent; a failure to add them is notified as a failed request.
+	if opt.Notifier != nil {
+		opt.Notifier.Notify(ctx, issuedEvent(params, handler.Name(), added))
 	}
 	log.Info().Stringer(logkey.TimeElapseField, time.Since(start)).
 		Str(logkey.TransIDField, params.TransID).
@@ -74,3 +210,42 @@ func Run(ctx context.Context, params *csr.ReqParam, handlers []Handler, signer c
 		Msgf("gensign success")
 	return nil
 }
+
+// signedCerts are the certificates signed for the CSRs of an agent key.
+type signedCerts struct {
+	agentKey csr.AgentKey
+	certs    []ssh.PublicKey
+	comments []string
+	// keyIdentifiers are the identifiers of the CA keys signing the certs.
+	keyIdentifiers []string
+}
+
+// generate generates the CSRs by the handler in a span.
+func generate(ctx context.Context, tracer trace.Tracer, handler Handler, params *csr.ReqParam) ([]csr.AgentKey, error) {
+	_, span := tracer.Start(ctx, spanGenerate)
+	csrAgentKeys, err := handler.Generate(params)
+	endSpan(span, err)
+	return csrAgentKeys, err
+}
+
+// nameOf returns the name of the handler, or an empty string if the handler is nil.
+func nameOf(handler Handler) string {
+	if handler == nil {
+		return ""
+	}
+	return handler.Name()
+}
+
+// audit records the issued certificates by the auditor, where keyIdentifiers are the identifiers of the CA keys signing the certs.
+func audit(auditor Auditor, params *csr.ReqParam, handlerName string, certs []ssh.PublicKey, keyIdentifiers []string) error {
+	for i, pub := range certs {
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return NewErr(AuditErr, fmt.Errorf("signer returns a non-certificate key %s", pub.Type()))
+		}
+		if err := auditor.Issued(params, handlerName, keyIdentifiers[i], cert); err != nil {
+			return NewErr(AuditErr, err)
+		}
+	}
+	return nil
+}
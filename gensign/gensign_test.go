@@ -0,0 +1,700 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/keyid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/ssh"
+)
+
+type testHandler struct {
+	name    string
+	authErr error
+	addErr  error
+	added   int
+}
+
+func (h *testHandler) Name() string { return h.name }
+
+func (h *testHandler) Authenticate(*csr.ReqParam) error { return h.authErr }
+
+func (h *testHandler) Generate(*csr.ReqParam) ([]csr.AgentKey, error) {
+	return []csr.AgentKey{h}, nil
+}
+
+func (h *testHandler) CSRs() []*proto.SSHCertificateSigningRequest {
+	return []*proto.SSHCertificateSigningRequest{{KeyMeta: &proto.KeyMeta{Identifier: "ssh-user-key"}}}
+}
+
+func (h *testHandler) AddCertsToAgent(certs []ssh.PublicKey, _ []string) error {
+	if h.addErr != nil {
+		return h.addErr
+	}
+	h.added += len(certs)
+	return nil
+}
+
+type testSigner struct {
+	pub ssh.PublicKey
+	err error
+}
+
+func (s testSigner) Sign(context.Context, *proto.SSHCertificateSigningRequest) ([]ssh.PublicKey, []string, error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	return []ssh.PublicKey{s.pub}, []string{"comment"}, nil
+}
+
+type testAuditor struct {
+	err            error
+	issued         []*ssh.Certificate
+	keyIdentifiers []string
+	denied         []error
+	handler        string
+}
+
+func (a *testAuditor) Issued(_ *csr.ReqParam, handler string, keyIdentifier string, cert *ssh.Certificate) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.handler = handler
+	a.issued = append(a.issued, cert)
+	a.keyIdentifiers = append(a.keyIdentifiers, keyIdentifier)
+	return nil
+}
+
+func (a *testAuditor) Denied(_ *csr.ReqParam, handler string, reason error) error {
+	a.handler = handler
+	a.denied = append(a.denied, reason)
+	return nil
+}
+
+func newTestPubKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRunWithOption_Auditor(t *testing.T) {
+	t.Parallel()
+	cert := &ssh.Certificate{Key: newTestPubKey(t), Serial: 1}
+	tests := []struct {
+		name        string
+		authErr     error
+		auditErr    error
+		signed      ssh.PublicKey
+		wantErrType ErrorType
+		wantIssued  int
+		wantDenied  int
+		wantAdded   int
+		wantHandler string
+	}{
+		{
+			name:        "issued",
+			signed:      cert,
+			wantIssued:  1,
+			wantAdded:   1,
+			wantHandler: "test",
+		},
+		{
+			name:        "all authentications failed",
+			authErr:     errors.New("bad request"),
+			signed:      cert,
+			wantErrType: AllAuthFailed,
+			wantDenied:  1,
+		},
+		{
+			name:        "key rejected by policy",
+			authErr:     NewErrorWithMsg(DeviceDenied, "test", "lost device"),
+			signed:      cert,
+			wantErrType: DeviceDenied,
+			wantDenied:  1,
+		},
+		{
+			name:        "audit failure",
+			auditErr:    errors.New("disk full"),
+			signed:      cert,
+			wantErrType: AuditErr,
+			wantDenied:  1,
+			wantHandler: "test",
+		},
+		{
+			name:        "non-certificate key",
+			signed:      newTestPubKey(t),
+			wantErrType: AuditErr,
+			wantDenied:  1,
+			wantHandler: "test",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := &testHandler{name: "test", authErr: tt.authErr}
+			auditor := &testAuditor{err: tt.auditErr}
+			params := &csr.ReqParam{TransID: "a7af667d"}
+
+			err := RunWithOption(context.Background(), params, []Handler{handler}, testSigner{pub: tt.signed},
+				RunOption{Auditor: auditor})
+			if tt.wantErrType == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !IsErrorOfType(err, tt.wantErrType) {
+				t.Fatalf("got error %v, want error of type %v", err, tt.wantErrType)
+			}
+			if len(auditor.issued) != tt.wantIssued || len(auditor.denied) != tt.wantDenied {
+				t.Errorf("got %d issued and %d denied records, want %d and %d",
+					len(auditor.issued), len(auditor.denied), tt.wantIssued, tt.wantDenied)
+			}
+			if auditor.handler != tt.wantHandler {
+				t.Errorf("got handler %q, want %q", auditor.handler, tt.wantHandler)
+			}
+			// The records identify the CA key requested by the CSR.
+			for _, keyIdentifier := range auditor.keyIdentifiers {
+				if keyIdentifier != "ssh-user-key" {
+					t.Errorf("got key identifier %q, want %q", keyIdentifier, "ssh-user-key")
+				}
+			}
+			if handler.added != tt.wantAdded {
+				t.Errorf("got %d certificates added to the agent, want %d", handler.added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestRunWithOption_Spans(t *testing.T) {
+	t.Parallel()
+	cert := &ssh.Certificate{Key: newTestPubKey(t), Serial: 1}
+	tests := []struct {
+		name       string
+		handlers   []Handler
+		wantSpans  []string
+		wantErrors []bool
+	}{
+		{
+			name:     "success",
+			handlers: []Handler{&testHandler{name: "fail", authErr: errors.New("bad request")}, &testHandler{name: "test"}},
+			wantSpans: []string{spanAuthenticate, spanAuthenticate, spanGenerate, spanSign,
+				spanAddCertsToAgent, spanRun},
+			wantErrors: []bool{true, false, false, false, false, false},
+		},
+		{
+			name:       "all authentications failed",
+			handlers:   []Handler{&testHandler{name: "fail", authErr: errors.New("bad request")}},
+			wantSpans:  []string{spanAuthenticate, spanRun},
+			wantErrors: []bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			params := &csr.ReqParam{TransID: "a7af667d"}
+
+			_ = RunWithOption(context.Background(), params, tt.handlers, testSigner{pub: cert},
+				RunOption{TracerProvider: tp})
+
+			spans := recorder.Ended()
+			if len(spans) != len(tt.wantSpans) {
+				t.Fatalf("got %d spans, want %d", len(spans), len(tt.wantSpans))
+			}
+			root := spans[len(spans)-1]
+			for i, span := range spans {
+				if span.Name() != tt.wantSpans[i] {
+					t.Errorf("got span %q, want %q", span.Name(), tt.wantSpans[i])
+				}
+				if span != root && span.Parent().SpanID() != root.SpanContext().SpanID() {
+					t.Errorf("span %q is not a child of the run span", span.Name())
+				}
+				if gotErr := span.Status().Code == codes.Error; gotErr != tt.wantErrors[i] {
+					t.Errorf("span %q got error status %v, want %v", span.Name(), gotErr, tt.wantErrors[i])
+				}
+			}
+			if !hasAttribute(root, transIDKey.String(params.TransID)) {
+				t.Errorf("run span has no transID attribute: %v", root.Attributes())
+			}
+		})
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, want attribute.KeyValue) bool {
+	for _, attr := range span.Attributes() {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRunWithOption_Metrics(t *testing.T) {
+	t.Parallel()
+	kid := &keyid.KeyID{
+		Principals:  []string{"alice"},
+		TransID:     "a7af667d",
+		ReqUser:     "alice",
+		TouchPolicy: keyid.NeverTouch,
+		Version:     keyid.DefaultVersion,
+	}
+	kidStr, err := kid.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{Key: newTestPubKey(t), KeyId: kidStr}
+
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	handlers := []Handler{&testHandler{name: "fail", authErr: NewErrWithMsg(HandlerAuthN, "bad request")}, &testHandler{name: "test"}}
+	if err := RunWithOption(context.Background(), &csr.ReqParam{TransID: "a7af667d"}, handlers, testSigner{pub: cert},
+		RunOption{MeterProvider: mp}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+
+	issued, ok := got[ysshraGensignIssued].(metricdata.Sum[int64])
+	if !ok || len(issued.DataPoints) != 1 || issued.DataPoints[0].Value != 1 {
+		t.Fatalf("unexpected issued metric %+v", got[ysshraGensignIssued])
+	}
+	for _, want := range []attribute.KeyValue{
+		handlerKey.String("test"), keyIdentifierKey.String("ssh-user-key"), certTypeKey.String("Touchless"),
+	} {
+		if v, ok := issued.DataPoints[0].Attributes.Value(want.Key); !ok || v != want.Value {
+			t.Errorf("issued metric got attribute %s=%v, want %v", want.Key, v.Emit(), want.Value.Emit())
+		}
+	}
+
+	authFailure, ok := got[ysshraGensignAuthFailure].(metricdata.Sum[int64])
+	if !ok || len(authFailure.DataPoints) != 1 || authFailure.DataPoints[0].Value != 1 {
+		t.Fatalf("unexpected auth failure metric %+v", got[ysshraGensignAuthFailure])
+	}
+	if v, _ := authFailure.DataPoints[0].Attributes.Value(reasonKey); v.AsString() != HandlerAuthN.String() {
+		t.Errorf("auth failure metric got reason %q, want %q", v.AsString(), HandlerAuthN.String())
+	}
+
+	duration, ok := got[ysshraGensignDuration].(metricdata.Histogram[float64])
+	if !ok || len(duration.DataPoints) != 1 || duration.DataPoints[0].Count != 1 {
+		t.Fatalf("unexpected duration metric %+v", got[ysshraGensignDuration])
+	}
+}
+
+type panicHandler struct {
+	testHandler
+}
+
+func (h *panicHandler) Authenticate(*csr.ReqParam) error { panic("unexpected nil pointer") }
+
+func TestRunWithOption_PanicMetric(t *testing.T) {
+	t.Parallel()
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	err := RunWithOption(context.Background(), &csr.ReqParam{TransID: "a7af667d"},
+		[]Handler{&panicHandler{testHandler{name: "panic"}}}, testSigner{}, RunOption{MeterProvider: mp})
+	if !IsErrorOfType(err, Panic) {
+		t.Fatalf("got error %v, want panic error", err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != ysshraPanic {
+				continue
+			}
+			sum := m.Data.(metricdata.Sum[int64])
+			// The panic message must not be an attribute of the metric.
+			if len(sum.DataPoints) != 1 || sum.DataPoints[0].Value != 1 || sum.DataPoints[0].Attributes.Len() != 0 {
+				t.Errorf("unexpected panic metric %+v", sum)
+			}
+			return
+		}
+	}
+	t.Errorf("no panic metric recorded")
+}
+
+type testRateLimiter struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (l testRateLimiter) Allow(*csr.ReqParam, string) (time.Duration, error) {
+	return l.retryAfter, l.err
+}
+
+func TestRunWithOption_RateLimiter(t *testing.T) {
+	t.Parallel()
+	cert := &ssh.Certificate{Key: newTestPubKey(t), Serial: 1}
+	tests := []struct {
+		name           string
+		limiter        testRateLimiter
+		wantRetryAfter time.Duration
+		wantMsg        string
+		wantAdded      int
+	}{
+		{name: "allowed", wantAdded: 1},
+		{
+			name:           "rate limited",
+			limiter:        testRateLimiter{retryAfter: 89500 * time.Millisecond},
+			wantRetryAfter: 89500 * time.Millisecond,
+			wantMsg:        "test too many requests, retry after 1m30s",
+		},
+		{
+			name:    "rate limiter failure",
+			limiter: testRateLimiter{err: errors.New("disk full")},
+			wantMsg: "test rate limiter fails to check request, disk full",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := &testHandler{name: "test"}
+			err := RunWithOption(context.Background(), &csr.ReqParam{TransID: "a7af667d"}, []Handler{handler},
+				testSigner{pub: cert}, RunOption{RateLimiter: tt.limiter})
+			retryAfter, ok := RetryAfter(err)
+			if tt.wantRetryAfter == 0 {
+				if (err == nil && tt.wantMsg != "") || (err != nil && err.Error() != tt.wantMsg) {
+					t.Fatalf("got error %v, want %q", err, tt.wantMsg)
+				}
+				// A failure of the rate limiter is not reported as rate limited.
+				if tt.limiter.err != nil && (ok || !IsErrorOfType(err, RateLimiterErr)) {
+					t.Errorf("got error %v, want error of type %v", err, RateLimiterErr)
+				}
+			} else if !ok || retryAfter != tt.wantRetryAfter || err.Error() != tt.wantMsg {
+				t.Errorf("got error %q with retry after %v, want %q with %v", err, retryAfter, tt.wantMsg, tt.wantRetryAfter)
+			}
+			if handler.added != tt.wantAdded {
+				t.Errorf("got %d certificates added to the agent, want %d", handler.added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+// approvalHandler requires approval for all the requests.
+type approvalHandler struct {
+	testHandler
+	approval *csr.Approval
+}
+
+func (h *approvalHandler) Generate(params *csr.ReqParam) ([]csr.AgentKey, error) {
+	if params.Approval == nil || !params.Approval.Approved {
+		return nil, NewApprovalRequiredError(h.name, []string{"alice"}, "SHA256:key")
+	}
+	h.approval = params.Approval
+	return h.testHandler.Generate(params)
+}
+
+// testApprovalQueue returns the approvals in order, and repeats the last one.
+// It fails to consume the approvals if consumeErr is not nil.
+type testApprovalQueue struct {
+	approvals  []*csr.Approval
+	submitted  int
+	consumed   []string
+	consumeErr error
+}
+
+func (q *testApprovalQueue) Submit(_ *csr.ReqParam, handler string, principals []string, fingerprint string) (*csr.Approval, error) {
+	if handler != "test" || len(principals) != 1 || principals[0] != "alice" || fingerprint != "SHA256:key" {
+		return nil, fmt.Errorf("unexpected request of %s for %v and %s", handler, principals, fingerprint)
+	}
+	i := q.submitted
+	if i >= len(q.approvals) {
+		i = len(q.approvals) - 1
+	}
+	q.submitted++
+	return q.approvals[i], nil
+}
+
+func (q *testApprovalQueue) Consume(id string) error {
+	if q.consumeErr != nil {
+		return q.consumeErr
+	}
+	q.consumed = append(q.consumed, id)
+	return nil
+}
+
+func TestRunWithOption_Approval(t *testing.T) {
+	t.Parallel()
+	cert := &ssh.Certificate{Key: newTestPubKey(t), Serial: 1}
+	pending := &csr.Approval{ID: "0a1b2c3d4e"}
+	approved := &csr.Approval{ID: "0a1b2c3d4e", Approver: "bob", Approved: true}
+	denied := &csr.Approval{ID: "0a1b2c3d4e", Approver: "bob", Reason: "no incident"}
+	tests := []struct {
+		name        string
+		queue       *testApprovalQueue
+		wait        time.Duration
+		signErr     error
+		wantErrType ErrorType
+		wantMsg     string
+		wantAdded   int
+		// wantConsumed indicates whether the approval is consumed.
+		wantConsumed bool
+	}{
+		{
+			name:        "no queue",
+			wantErrType: ApprovalRequired,
+			wantMsg:     "test approval is required, no approval queue for principals alice",
+		},
+		{
+			name:        "pending",
+			queue:       &testApprovalQueue{approvals: []*csr.Approval{pending}},
+			wantErrType: ApprovalRequired,
+			wantMsg:     "test approval is required, request 0a1b2c3d4e for principals alice is waiting for approval",
+		},
+		{
+			name:         "approved",
+			queue:        &testApprovalQueue{approvals: []*csr.Approval{approved}},
+			wantAdded:    1,
+			wantConsumed: true,
+		},
+		{
+			name:        "approval consumed by another request",
+			queue:       &testApprovalQueue{approvals: []*csr.Approval{approved}, consumeErr: errors.New("request not found")},
+			wantErrType: ApprovalRequired,
+			wantMsg:     "test approval is required, failed to consume approval: request not found",
+		},
+		{
+			name:        "approved but not signed",
+			queue:       &testApprovalQueue{approvals: []*csr.Approval{approved}},
+			signErr:     errors.New("signer is down"),
+			wantErrType: SignerSignErr,
+			wantMsg:     "signer fails to sign certificate, failed to sign CSR: signer is down",
+		},
+		{
+			name:        "denied",
+			queue:       &testApprovalQueue{approvals: []*csr.Approval{denied}},
+			wantErrType: ApprovalDenied,
+			wantMsg:     "test approval is denied, request 0a1b2c3d4e is denied by bob: no incident",
+		},
+		{
+			name:         "approved while waiting",
+			queue:        &testApprovalQueue{approvals: []*csr.Approval{pending, approved}},
+			wait:         time.Minute,
+			wantAdded:    1,
+			wantConsumed: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := &approvalHandler{testHandler: testHandler{name: "test"}}
+			opt := RunOption{ApprovalWait: tt.wait}
+			if tt.queue != nil {
+				opt.ApprovalQueue = tt.queue
+			}
+			err := RunWithOption(context.Background(), &csr.ReqParam{TransID: "a7af667d"}, []Handler{handler},
+				testSigner{pub: cert, err: tt.signErr}, opt)
+			if tt.wantErrType == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if handler.approval != approved {
+					t.Errorf("got approval %+v, want %+v", handler.approval, approved)
+				}
+			} else if !IsErrorOfType(err, tt.wantErrType) || err.Error() != tt.wantMsg {
+				t.Errorf("got error %q, want %q", err, tt.wantMsg)
+			}
+			if handler.added != tt.wantAdded {
+				t.Errorf("got %d certificates added to the agent, want %d", handler.added, tt.wantAdded)
+			}
+			if consumed := tt.queue != nil && len(tt.queue.consumed) != 0; consumed != tt.wantConsumed {
+				t.Errorf("got approval consumed %v, want %v", consumed, tt.wantConsumed)
+			}
+		})
+	}
+}
+
+// testNotifier records the events, and fails the mandatory notifications if err is not nil.
+type testNotifier struct {
+	mandatory []*Event
+	events    []*Event
+	err       error
+}
+
+func (n *testNotifier) NotifyMandatory(_ context.Context, event *Event) error {
+	n.mandatory = append(n.mandatory, event)
+	return n.err
+}
+
+func (n *testNotifier) Notify(_ context.Context, event *Event) {
+	n.events = append(n.events, event)
+}
+
+func TestRunWithOption_Notifier(t *testing.T) {
+	t.Parallel()
+	cert := &ssh.Certificate{Key: newTestPubKey(t), Serial: 1}
+	tests := []struct {
+		name        string
+		authErr     error
+		addErr      error
+		notifyErr   error
+		wantErrType ErrorType
+		// wantMandatory is the number of the events notified to the mandatory notifiers.
+		wantMandatory int
+		wantFailed    bool
+		wantAdded     int
+	}{
+		{name: "issued", wantMandatory: 1, wantAdded: 1},
+		{
+			name:          "failed",
+			authErr:       errors.New("bad request"),
+			wantErrType:   AllAuthFailed,
+			wantMandatory: 1,
+			wantFailed:    true,
+		},
+		{
+			name:        "notify failure",
+			notifyErr:   errors.New("webhook responds 503 Service Unavailable"),
+			wantErrType: NotifyErr,
+			// The certificates are notified to the mandatory notifiers before they are added to the agent,
+			// and the failure of the request is notified as well.
+			wantMandatory: 2,
+			wantFailed:    true,
+		},
+		{
+			name:        "add failure",
+			addErr:      errors.New("agent refused operation"),
+			wantErrType: AgentOpCertErr,
+			// Only the failure is notified to the other notifiers.
+			wantMandatory: 2,
+			wantFailed:    true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := &testHandler{name: "test", authErr: tt.authErr, addErr: tt.addErr}
+			notifier := &testNotifier{err: tt.notifyErr}
+			params := &csr.ReqParam{TransID: "a7af667d"}
+
+			err := RunWithOption(context.Background(), params, []Handler{handler}, testSigner{pub: cert},
+				RunOption{Notifier: notifier})
+			if tt.wantErrType == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !IsErrorOfType(err, tt.wantErrType) {
+				t.Fatalf("got error %v, want error of type %v", err, tt.wantErrType)
+			}
+			if len(notifier.mandatory) != tt.wantMandatory {
+				t.Fatalf("got %d mandatory events, want %d", len(notifier.mandatory), tt.wantMandatory)
+			}
+			if len(notifier.events) != 1 {
+				t.Fatalf("got %d events, want 1", len(notifier.events))
+			}
+			last := notifier.events[0]
+			if last.Params != params || (last.Err != nil) != tt.wantFailed {
+				t.Errorf("unexpected event %+v", last)
+			}
+			if !tt.wantFailed && (len(last.Certs) != 1 || last.Certs[0] != cert || last.Handler != "test") {
+				t.Errorf("unexpected event %+v", last)
+			}
+			if handler.added != tt.wantAdded {
+				t.Errorf("got %d certificates added to the agent, want %d", handler.added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		handlers    []Handler
+		wantHandler string
+		wantCSRs    int
+		wantErrType ErrorType
+		wantMsg     string
+	}{
+		{
+			name:        "generated",
+			handlers:    []Handler{&testHandler{name: "first", authErr: errors.New("bad key")}, &testHandler{name: "second"}},
+			wantHandler: "second",
+			wantCSRs:    1,
+		},
+		{
+			name: "all authentications failed",
+			handlers: []Handler{
+				&testHandler{name: "first", authErr: errors.New("bad key")},
+				&testHandler{name: "second", authErr: errors.New("no attestation")},
+			},
+			wantErrType: AllAuthFailed,
+			wantMsg:     "all authentications failed, first: bad key; second: no attestation",
+		},
+		{
+			name:        "no handler",
+			wantErrType: AllAuthFailed,
+			wantMsg:     "all authentications failed, no handler configured",
+		},
+		{
+			name:        "panic",
+			handlers:    []Handler{&panicHandler{testHandler: testHandler{name: "panic"}}},
+			wantErrType: Panic,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handlerName, csrs, err := DryRun(&csr.ReqParam{TransID: "a7af667d"}, tt.handlers)
+			if tt.wantErrType == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if handlerName != tt.wantHandler {
+					t.Errorf("got handler %q, want %q", handlerName, tt.wantHandler)
+				}
+			} else if !IsErrorOfType(err, tt.wantErrType) || (tt.wantMsg != "" && err.Error() != tt.wantMsg) {
+				t.Fatalf("got error %q, want error of type %v %q", err, tt.wantErrType, tt.wantMsg)
+			}
+			if len(csrs) != tt.wantCSRs {
+				t.Errorf("got %d CSRs, want %d", len(csrs), tt.wantCSRs)
+			}
+			for _, h := range tt.handlers {
+				if th, ok := h.(*testHandler); ok && th.added != 0 {
+					t.Errorf("got %d certificates added to the agent by %s, want none", th.added, th.name)
+				}
+			}
+		})
+	}
+}
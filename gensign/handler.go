@@ -6,6 +6,7 @@ package gensign
 import (
 	"net"
 
+	"github.com/rs/zerolog/log"
 	"github.com/theparanoids/ysshra/config"
 	"github.com/theparanoids/ysshra/csr"
 )
@@ -20,3 +21,25 @@ type Handler interface {
 	Name() string
 	Authenticate(params *csr.ReqParam) error
 }
+
+// NewHandlers creates the handlers configured in gensignConf by the creators, with the agent connection conn.
+// The handlers without creators or failed to be created are skipped.
+func NewHandlers(gensignConf *config.GensignConfig, creators map[string]CreateHandler, conn net.Conn) []Handler {
+	var handlers []Handler
+	// Create Handler by the configuration.
+	for hName := range gensignConf.HandlerConfig {
+		// Lookup creator by the handler mapping.
+		create, ok := creators[hName]
+		if !ok {
+			log.Warn().Msgf("cannot find creator for handler %s", hName)
+			continue
+		}
+		handler, err := create(gensignConf, conn)
+		if err != nil {
+			log.Warn().Err(err).Msgf("cannot create handler %s", hName)
+			continue
+		}
+		handlers = append(handlers, handler)
+	}
+	return handlers
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package hardkey
+
+import (
+	"crypto/x509"
+
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+)
+
+const (
+	defaultPubKeyDir       = "/etc/ssh/authorized_public_keys"
+	defaultPIVRootCAPath   = "/opt/ysshra/yubico_piv_root_ca.pem"
+	defaultU2FRootCAPath   = "/opt/ysshra/yubico_u2f_root_ca.pem"
+	defaultSlot            = "9a"
+	defaultCertValiditySec = 12 * 3600 // 12 hours
+)
+
+type conf struct {
+	// PubKeyDir specifies the folder path which stores users' public keys.
+	PubKeyDir string `mapstructure:"pub_key_dir"`
+	// PIVRootCAPath is the path of Yubico PIV root CA certificate.
+	PIVRootCAPath string `mapstructure:"piv_root_ca_path"`
+	// U2FRootCAPath is the path of Yubico U2F root CA certificate.
+	U2FRootCAPath string `mapstructure:"u2f_root_ca_path"`
+	// RootCAPaths are the PEM files or directories of the trusted attestation root CA certificates.
+	// If specified, PIVRootCAPath and U2FRootCAPath are ignored.
+	RootCAPaths []string `mapstructure:"root_ca_paths"`
+	// IntermediateCAPaths are the PEM files or directories of the intermediate CA certificates
+	// between the roots and the f9 certificates, which are not stored in YubiKeys.
+	IntermediateCAPaths []string `mapstructure:"intermediate_ca_paths"`
+	// Slot is the PIV slot which holds the user's hard key.
+	Slot string `mapstructure:"slot"`
+	// KeyIdentifiers is the mapping from CA public key algorithm to the key identifier configured in signer.
+	KeyIdentifiers map[x509.PublicKeyAlgorithm]string `mapstructure:"key_identifiers"`
+	// CertValiditySec is the time length of cert validity.
+	CertValiditySec uint64 `mapstructure:"cert_validity_sec"`
+	// FirefighterCertValiditySec is the time length of firefighter cert validity.
+	// Firefighter certs are issued only after the approval of a second person.
+	// The requests for firefighter certs are rejected if it is zero.
+	FirefighterCertValiditySec uint64 `mapstructure:"firefighter_cert_validity_sec"`
+	// AttestationPolicy specifies which attested devices are acceptable.
+	AttestationPolicy yubiattest.PolicyConfig `mapstructure:"attestation_policy"`
+}
+
+func newDefaultConf() *conf {
+	return &conf{
+		PubKeyDir:       defaultPubKeyDir,
+		PIVRootCAPath:   defaultPIVRootCAPath,
+		U2FRootCAPath:   defaultU2FRootCAPath,
+		Slot:            defaultSlot,
+		CertValiditySec: defaultCertValiditySec,
+	}
+}
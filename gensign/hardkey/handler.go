@@ -0,0 +1,276 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package hardkey
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/agent/yubiagent"
+	"github.com/theparanoids/ysshra/attestation"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/crypki"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/internal/logkey"
+	"github.com/theparanoids/ysshra/keyid"
+	"github.com/theparanoids/ysshra/sshutils/cert"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HandlerName is a unique name to identify a handler.
+	// It is also appended to the cert label.
+	HandlerName = "paranoids.hardkey"
+	// IsForHumanUser indicates whether this handler should be used for a human user.
+	IsForHumanUser = true
+
+	attestationSlot = "f9"
+)
+
+// Handler implements gensign.Handler.
+// It issues certificates for the key in a YubiKey PIV slot, after verifying the attestation of the slot.
+// The touch policy in the certificate is taken from the attestation instead of the Touch2SSH attribute of the request.
+type Handler struct {
+	agent    yubiagent.YubiAgent
+	attestor *yubiattest.Attestor
+	policy   *yubiattest.Policy
+	conf     *conf
+
+	// pubKey and info are the attested public key and the attestation info of the slot,
+	// set by a successful Authenticate.
+	pubKey ssh.PublicKey
+	info   *yubiattest.AttestationInfo
+}
+
+// NewHandler creates a yubiagent client from the ssh connection,
+// and constructs a gensign.Handler containing the options loaded from conf.
+func NewHandler(gensignConf *config.GensignConfig, conn net.Conn) (gensign.Handler, error) {
+	c := newDefaultConf()
+	if err := gensignConf.ExtractHandlerConf(HandlerName, c); err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+	}
+
+	rootPaths := c.RootCAPaths
+	if len(rootPaths) == 0 {
+		rootPaths = []string{c.PIVRootCAPath, c.U2FRootCAPath}
+	}
+	roots, err := attestation.LoadCertPool(rootPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, failed to load root CA certificates: %v", HandlerName, err)
+	}
+	if roots == nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, no root CA certificates configured", HandlerName)
+	}
+	intermediates, err := attestation.LoadCertPool(c.IntermediateCAPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, failed to load intermediate CA certificates: %v", HandlerName, err)
+	}
+	attestor := yubiattest.NewAttestorWithCAPools(roots, intermediates)
+
+	policy, err := yubiattest.NewPolicy(c.AttestationPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+	}
+
+	agent, err := yubiagent.NewClientFromConn(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+	}
+
+	return &Handler{
+		agent:    agent,
+		attestor: attestor,
+		policy:   policy,
+		conf:     c,
+	}, nil
+}
+
+// Name returns the name of the handler.
+func (h *Handler) Name() string {
+	return HandlerName
+}
+
+// Authenticate succeeds if the key in the configured slot is attested by a trusted YubiKey allowed by the
+// attestation policy, matches the public key on server side's directory, and can sign a challenge.
+func (h *Handler) Authenticate(param *csr.ReqParam) error {
+	err := param.Validate()
+	if err != nil {
+		return gensign.NewError(gensign.InvalidParams, HandlerName, err)
+	}
+
+	if param.NamespacePolicy != common.NoNamespace {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, fmt.Sprintf("want namespace policy %s, but got %s", common.NoNamespace, param.NamespacePolicy))
+	}
+	if !param.Attrs.HardKey {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, "only support hard key validation")
+	}
+
+	pubKey, info, err := h.attestSlot()
+	if err != nil {
+		return gensign.NewError(gensign.HandlerAuthN, HandlerName, err)
+	}
+	if err := h.policy.Check(info, param.LogName); err != nil {
+		return policyError(err)
+	}
+	if err := h.challengePubKey(param, pubKey); err != nil {
+		return gensign.NewError(gensign.HandlerAuthN, HandlerName, err)
+	}
+
+	h.pubKey, h.info = pubKey, info
+	return nil
+}
+
+// Generate implements csr.Generator.
+func (h *Handler) Generate(param *csr.ReqParam) ([]csr.AgentKey, error) {
+	err := param.Validate()
+	if err != nil {
+		return nil, gensign.NewError(gensign.InvalidParams, HandlerName, err)
+	}
+	if h.pubKey == nil || h.info == nil {
+		return nil, gensign.NewErrorWithMsg(gensign.HandlerGenCSRErr, HandlerName, "the hard key has not been authenticated")
+	}
+
+	kid := &keyid.KeyID{
+		Principals:    []string{param.LogName},
+		TransID:       param.TransID,
+		ReqUser:       param.ReqUser,
+		ReqIP:         param.ClientIP,
+		ReqHost:       param.ReqHost,
+		Version:       keyid.DefaultVersion,
+		IsFirefighter: false,
+		IsHWKey:       true,
+		IsHeadless:    false,
+		IsNonce:       false,
+		Usage:         keyid.AllUsage,
+		TouchPolicy:   h.info.TouchPolicy.KeyIDTouchPolicy(),
+	}
+
+	certType := cert.TouchlessCert
+	if kid.TouchPolicy != keyid.NeverTouch {
+		certType = cert.TouchSudoCert
+	}
+	validity := h.conf.CertValiditySec
+
+	if param.Attrs.TouchlessSudo != nil && param.Attrs.TouchlessSudo.IsFirefighter {
+		if h.conf.FirefighterCertValiditySec == 0 {
+			return nil, gensign.NewErrorWithMsg(gensign.InvalidParams, HandlerName, "firefighter certificates are not enabled")
+		}
+		if param.Approval == nil || !param.Approval.Approved {
+			return nil, gensign.NewApprovalRequiredError(HandlerName, kid.Principals, ssh.FingerprintSHA256(h.pubKey))
+		}
+		kid.IsFirefighter = true
+		certType = cert.FirefighterCert
+		validity = h.conf.FirefighterCertValiditySec
+	}
+
+	keyIdentifier, ok := h.conf.KeyIdentifiers[param.Attrs.CAPubKeyAlgo]
+	if !ok {
+		err := fmt.Errorf("unsupported CA public key algorithm %q", param.Attrs.CAPubKeyAlgo)
+		return nil, gensign.NewError(gensign.HandlerConfErr, HandlerName, err)
+	}
+
+	request := &proto.SSHCertificateSigningRequest{
+		KeyMeta:    &proto.KeyMeta{Identifier: keyIdentifier},
+		Extensions: crypki.GetDefaultExtension(),
+		Validity:   validity,
+		Principals: cert.GetPrincipals(kid.Principals, certType),
+		PublicKey:  string(ssh.MarshalAuthorizedKey(h.pubKey)),
+	}
+
+	request.KeyId, err = kid.Marshal()
+	if err != nil {
+		return nil, gensign.NewError(gensign.HandlerGenCSRErr, HandlerName, err)
+	}
+
+	agentKey := yubiagent.NewHardKey(h.agent)
+	agentKey.AddCSR(request)
+
+	log.Info().Str(logkey.TransIDField, param.TransID).
+		Str(logkey.HandlerField, HandlerName).
+		Strs(logkey.PrinsField, request.Principals).
+		Str(logkey.KeyidField, request.KeyId).
+		Msgf("CSRs successfully generated for YubiKey %s (serial %d, firmware %s, touch policy %s, attested by %q)",
+			h.info.ModHex, h.info.Serial, h.info.Firmware, h.info.TouchPolicy, h.info.Root.Subject)
+
+	return []csr.AgentKey{agentKey}, nil
+}
+
+// policyError converts the error from yubiattest.Policy to a gensign error.
+func policyError(err error) error {
+	v, ok := err.(*yubiattest.PolicyViolation)
+	if !ok {
+		return gensign.NewError(gensign.HandlerConfErr, HandlerName, err)
+	}
+	var t gensign.ErrorType
+	switch v.Rule {
+	case yubiattest.RuleFirmware:
+		t = gensign.FirmwareNotAllowed
+	case yubiattest.RuleTouchPolicy:
+		t = gensign.TouchPolicyNotAllowed
+	case yubiattest.RulePINPolicy:
+		t = gensign.PINPolicyNotAllowed
+	case yubiattest.RuleFormFactor:
+		t = gensign.FormFactorNotAllowed
+	case yubiattest.RuleSerialDenied:
+		t = gensign.DeviceDenied
+	case yubiattest.RuleSerialBinding:
+		t = gensign.DeviceNotBound
+	default:
+		t = gensign.Unknown
+	}
+	return gensign.NewError(t, HandlerName, err)
+}
+
+// attestSlot verifies the attestation of the configured slot, and returns the attested public key
+// together with the decoded attestation info.
+func (h *Handler) attestSlot() (ssh.PublicKey, *yubiattest.AttestationInfo, error) {
+	f9Cert, err := h.agent.ReadSlot(attestationSlot)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attestation certificate: %v", err)
+	}
+	attestCert, err := h.agent.AttestSlot(h.conf.Slot)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to attest slot %s: %v", h.conf.Slot, err)
+	}
+	info, err := h.attestor.Attest(f9Cert, attestCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to verify attestation of slot %s: %v", h.conf.Slot, err)
+	}
+	// The agent may return the attestation of another slot, e.g. a slot without a touch policy.
+	if !strings.EqualFold(info.Slot, h.conf.Slot) {
+		return nil, nil, fmt.Errorf("the attestation is for slot %q, want slot %s", info.Slot, h.conf.Slot)
+	}
+	pubKey, err := ssh.NewPublicKey(attestCert.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid attested public key: %v", err)
+	}
+	return pubKey, info, nil
+}
+
+// challengePubKey checks the attested public key is the registered key of the user,
+// and the private key is accessible through the agent.
+func (h *Handler) challengePubKey(param *csr.ReqParam, pubKey ssh.PublicKey) error {
+	pubKeyBytes, err := yubiagent.ReadPubKey(h.conf.PubKeyDir, param.LogName)
+	if err != nil {
+		return fmt.Errorf("failed to read pubkey: %v", err)
+	}
+
+	registeredKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse pubkey: %v, pubkey: %q", err, string(pubKeyBytes))
+	}
+	if !bytes.Equal(registeredKey.Marshal(), pubKey.Marshal()) {
+		return fmt.Errorf("the attested key in slot %s mismatches the registered pubkey", h.conf.Slot)
+	}
+
+	_, err = yubiagent.NewHardKey(h.agent).Challenge(pubKey)
+	return err
+}
@@ -0,0 +1,519 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package hardkey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/agent/yubiagent"
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/attestation/yubiattest"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/csr/transid"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/keyid"
+	"github.com/theparanoids/ysshra/message"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"github.com/theparanoids/ysshra/sshutils/version"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/nettest"
+)
+
+// newYubiAgent creates a yubiagent server backed by the token, and returns a client connected to it.
+func newYubiAgent(t *testing.T, token *softpiv.Token) yubiagent.YubiAgent {
+	t.Helper()
+
+	listener, err := nettest.NewLocalListener("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	server, err := yubiagent.NewServerWithBackend(listener.Addr().String(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go yubiagent.ServeAgent(server, c1)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+		server.Close()
+	})
+	client, err := yubiagent.NewClientFromConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newToken creates a soft PIV token with a key in slot 9a, and loads the key into the returned yubiagent.
+func newToken(t *testing.T, touchPolicy yubiattest.TouchPolicy) (*softpiv.Token, ssh.PublicKey, yubiagent.YubiAgent) {
+	t.Helper()
+
+	token, err := softpiv.New(softpiv.Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := token.GenerateKey(defaultSlot, key.ECDSAsecp256r1, yubiattest.PINPolicyOnce, touchPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := token.Signer(defaultSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag := newYubiAgent(t, token)
+	if err := ag.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	return token, sshPub, ag
+}
+
+// slotAgent attests the slot regardless of the requested slot.
+type slotAgent struct {
+	yubiagent.YubiAgent
+	slot string
+}
+
+func (a *slotAgent) AttestSlot(string) (*x509.Certificate, error) {
+	return a.YubiAgent.AttestSlot(a.slot)
+}
+
+func writePubKeyFile(t *testing.T, logName string, pubBytes []byte) string {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(path.Join(tmpDir, logName), pubBytes, 0400); err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir
+}
+
+func newAttestor(roots ...*x509.Certificate) *yubiattest.Attestor {
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	return yubiattest.NewAttestorWithCAPool(pool)
+}
+
+func newParam(hardKey bool) *csr.ReqParam {
+	return &csr.ReqParam{
+		NamespacePolicy:  common.NoNamespace,
+		HandlerName:      HandlerName,
+		ClientIP:         "1.2.3.4",
+		LogName:          "dummy",
+		ReqUser:          "dummy",
+		ReqHost:          "dummy.com",
+		TransID:          transid.Generate(),
+		SSHClientVersion: version.New(8, 1),
+		Attrs: &message.Attributes{
+			Username:         "dummy",
+			Hostname:         "dummy.com",
+			SSHClientVersion: "8.1",
+			CAPubKeyAlgo:     x509.ECDSA,
+			HardKey:          hardKey,
+		},
+	}
+}
+
+func TestHandler_Authenticate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		params     *csr.ReqParam
+		GetHandler func(t *testing.T) *Handler
+		wantErr    bool
+	}{
+		"happy path": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token, pub, ag := newToken(t, yubiattest.TouchPolicyNever)
+				return &Handler{
+					agent:    ag,
+					attestor: newAttestor(token.Root()),
+					conf:     &conf{PubKeyDir: writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)), Slot: defaultSlot},
+				}
+			},
+		},
+		"nil param": {
+			GetHandler: func(t *testing.T) *Handler {
+				return &Handler{conf: newDefaultConf()}
+			},
+			wantErr: true,
+		},
+		"not a hard key": {
+			params: newParam(false),
+			GetHandler: func(t *testing.T) *Handler {
+				return &Handler{conf: newDefaultConf()}
+			},
+			wantErr: true,
+		},
+		"untrusted attestation root": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				_, pub, ag := newToken(t, yubiattest.TouchPolicyNever)
+				root, _, err := softpiv.NewRoot("Untrusted Root CA")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &Handler{
+					agent:    ag,
+					attestor: newAttestor(root),
+					conf:     &conf{PubKeyDir: writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)), Slot: defaultSlot},
+				}
+			},
+			wantErr: true,
+		},
+		"empty slot": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token, pub, ag := newToken(t, yubiattest.TouchPolicyNever)
+				return &Handler{
+					agent:    ag,
+					attestor: newAttestor(token.Root()),
+					conf:     &conf{PubKeyDir: writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)), Slot: "9c"},
+				}
+			},
+			wantErr: true,
+		},
+		"attestation of another slot": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token, pub, ag := newToken(t, yubiattest.TouchPolicyNever)
+				return &Handler{
+					agent:    &slotAgent{YubiAgent: ag, slot: defaultSlot},
+					attestor: newAttestor(token.Root()),
+					conf:     &conf{PubKeyDir: writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)), Slot: "9c"},
+				}
+			},
+			wantErr: true,
+		},
+		"attested key mismatches registered pubkey": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token, _, ag := newToken(t, yubiattest.TouchPolicyNever)
+				_, otherPub, _ := newToken(t, yubiattest.TouchPolicyNever)
+				return &Handler{
+					agent:    ag,
+					attestor: newAttestor(token.Root()),
+					conf:     &conf{PubKeyDir: writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(otherPub)), Slot: defaultSlot},
+				}
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		name, test := name, test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			h := test.GetHandler(t)
+			if err := h.Authenticate(test.params); (err != nil) != test.wantErr {
+				t.Errorf("Authenticate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// testSigner implements csr.Signer by signing the CSR with an in-memory CA key.
+type testSigner struct {
+	ca ssh.Signer
+}
+
+func (s *testSigner) Sign(_ context.Context, request *proto.SSHCertificateSigningRequest) ([]ssh.PublicKey, []string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		KeyId:           request.KeyId,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: request.Principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Duration(request.Validity) * time.Second).Unix()),
+		Permissions:     ssh.Permissions{Extensions: request.Extensions},
+	}
+	if err := cert.SignCert(rand.Reader, s.ca); err != nil {
+		return nil, nil, err
+	}
+	return []ssh.PublicKey{cert}, []string{HandlerName}, nil
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	caPriv, _, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		touchPolicy    yubiattest.TouchPolicy
+		touch2SSH      bool
+		wantPolicy     keyid.TouchPolicy
+		wantPrincipals []string
+	}{
+		{
+			name:           "cached touch",
+			touchPolicy:    yubiattest.TouchPolicyCached,
+			wantPolicy:     keyid.CachedTouch,
+			wantPrincipals: []string{"dummy:touch"},
+		},
+		{
+			name:           "never touch ignores Touch2SSH attribute",
+			touchPolicy:    yubiattest.TouchPolicyNever,
+			touch2SSH:      true,
+			wantPolicy:     keyid.NeverTouch,
+			wantPrincipals: []string{"dummy:notouch"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			token, pub, ag := newToken(t, tt.touchPolicy)
+			h := &Handler{
+				agent:    ag,
+				attestor: newAttestor(token.Root()),
+				conf: &conf{
+					PubKeyDir:       writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)),
+					Slot:            defaultSlot,
+					KeyIdentifiers:  map[x509.PublicKeyAlgorithm]string{x509.ECDSA: "ecdsa-key"},
+					CertValiditySec: defaultCertValiditySec,
+				},
+			}
+			param := newParam(true)
+			param.Attrs.Touch2SSH = tt.touch2SSH
+			if err := gensign.Run(context.Background(), param, []gensign.Handler{h}, &testSigner{ca: ca}); err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+
+			keys, err := ag.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *ssh.Certificate
+			for _, k := range keys {
+				pk, err := ssh.ParsePublicKey(k.Blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c, ok := pk.(*ssh.Certificate); ok {
+					got = c
+				}
+			}
+			if got == nil {
+				t.Fatal("cannot find the hard cert in the agent")
+			}
+			if !cmp.Equal(got.ValidPrincipals, tt.wantPrincipals) {
+				t.Errorf("unexpected principals: diff(-got,+want):\n%v", cmp.Diff(got.ValidPrincipals, tt.wantPrincipals))
+			}
+			kid, err := keyid.Unmarshal(got.KeyId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !kid.IsHWKey || kid.TouchPolicy != tt.wantPolicy {
+				t.Errorf("unexpected keyid: %+v", kid)
+			}
+		})
+	}
+}
+
+func TestRun_AttestationPolicy(t *testing.T) {
+	t.Parallel()
+
+	caPriv, _, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindingFile := path.Join(t.TempDir(), "binding")
+	if err := os.WriteFile(bindingFile, []byte("dummy 87654321\n"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	// The soft PIV token has serial 12345678, firmware 5.4.3 and USB-A keychain form factor.
+	tests := []struct {
+		name     string
+		policy   yubiattest.PolicyConfig
+		wantType gensign.ErrorType
+	}{
+		{
+			name: "satisfied",
+			policy: yubiattest.PolicyConfig{
+				MinFirmware:     "5.2.3",
+				TouchPolicies:   []string{"cached"},
+				PINPolicies:     []string{"once"},
+				FormFactors:     []string{"usb-a-keychain"},
+				SerialAllowlist: []uint32{12345678},
+			},
+		},
+		{name: "old firmware", policy: yubiattest.PolicyConfig{MinFirmware: "5.7.0"}, wantType: gensign.FirmwareNotAllowed},
+		{name: "touch policy", policy: yubiattest.PolicyConfig{TouchPolicies: []string{"always"}}, wantType: gensign.TouchPolicyNotAllowed},
+		{name: "PIN policy", policy: yubiattest.PolicyConfig{PINPolicies: []string{"always"}}, wantType: gensign.PINPolicyNotAllowed},
+		{name: "form factor", policy: yubiattest.PolicyConfig{FormFactors: []string{"usb-c-nano"}}, wantType: gensign.FormFactorNotAllowed},
+		{name: "denied serial", policy: yubiattest.PolicyConfig{SerialDenylist: []uint32{12345678}}, wantType: gensign.DeviceDenied},
+		{name: "unregistered serial", policy: yubiattest.PolicyConfig{SerialBindingFile: bindingFile}, wantType: gensign.DeviceNotBound},
+		{name: "missing binding file", policy: yubiattest.PolicyConfig{SerialBindingFile: "/nonexistent"}, wantType: gensign.HandlerConfErr},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			policy, err := yubiattest.NewPolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, pub, ag := newToken(t, yubiattest.TouchPolicyCached)
+			h := &Handler{
+				agent:    ag,
+				attestor: newAttestor(token.Root()),
+				policy:   policy,
+				conf: &conf{
+					PubKeyDir:       writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)),
+					Slot:            defaultSlot,
+					KeyIdentifiers:  map[x509.PublicKeyAlgorithm]string{x509.ECDSA: "ecdsa-key"},
+					CertValiditySec: defaultCertValiditySec,
+				},
+			}
+			err = gensign.Run(context.Background(), newParam(true), []gensign.Handler{h}, &testSigner{ca: ca})
+			if tt.wantType == 0 {
+				if err != nil {
+					t.Errorf("Run() unexpected error: %v", err)
+				}
+				return
+			}
+			if !gensign.IsErrorOfType(err, tt.wantType) {
+				t.Errorf("Run() got error %v, want error type %q", err, tt.wantType)
+			}
+			// The disallowed key is rejected by Authenticate, before any CSR is generated.
+			if err := h.Authenticate(newParam(true)); !gensign.IsErrorOfType(err, tt.wantType) {
+				t.Errorf("Authenticate() got error %v, want error type %q", err, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestRun_Firefighter(t *testing.T) {
+	t.Parallel()
+
+	caPriv, _, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		validity    uint64
+		approval    *csr.Approval
+		wantErrType gensign.ErrorType
+	}{
+		{name: "not enabled", approval: &csr.Approval{Approver: "bob", Approved: true}, wantErrType: gensign.InvalidParams},
+		{name: "not approved", validity: 86400, wantErrType: gensign.ApprovalRequired},
+		{name: "pending", validity: 86400, approval: &csr.Approval{ID: "0a1b"}, wantErrType: gensign.ApprovalRequired},
+		{name: "approved", validity: 86400, approval: &csr.Approval{ID: "0a1b", Approver: "bob", Approved: true}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			token, pub, ag := newToken(t, yubiattest.TouchPolicyCached)
+			h := &Handler{
+				agent:    ag,
+				attestor: newAttestor(token.Root()),
+				conf: &conf{
+					PubKeyDir:                  writePubKeyFile(t, "dummy", ssh.MarshalAuthorizedKey(pub)),
+					Slot:                       defaultSlot,
+					KeyIdentifiers:             map[x509.PublicKeyAlgorithm]string{x509.ECDSA: "ecdsa-key"},
+					CertValiditySec:            defaultCertValiditySec,
+					FirefighterCertValiditySec: tt.validity,
+				},
+			}
+			param := newParam(true)
+			param.Attrs.TouchlessSudo = &message.TouchlessSudo{IsFirefighter: true}
+			param.Approval = tt.approval
+			err := gensign.Run(context.Background(), param, []gensign.Handler{h}, &testSigner{ca: ca})
+			if tt.wantErrType != 0 {
+				if !gensign.IsErrorOfType(err, tt.wantErrType) {
+					t.Errorf("Run() got error %v, want error type %q", err, tt.wantErrType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+
+			keys, err := ag.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *ssh.Certificate
+			for _, k := range keys {
+				pk, err := ssh.ParsePublicKey(k.Blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c, ok := pk.(*ssh.Certificate); ok {
+					got = c
+				}
+			}
+			if got == nil {
+				t.Fatal("cannot find the firefighter cert in the agent")
+			}
+			kid, err := keyid.Unmarshal(got.KeyId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !kid.IsFirefighter || !kid.IsHWKey {
+				t.Errorf("unexpected keyid: %+v", kid)
+			}
+			if validity := got.ValidBefore - uint64(time.Now().Unix()); validity < tt.validity-60 || validity > tt.validity {
+				t.Errorf("got validity %ds, want %ds", validity, tt.validity)
+			}
+		})
+	}
+}
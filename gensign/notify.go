@@ -0,0 +1,46 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"context"
+
+	"github.com/theparanoids/ysshra/csr"
+	"golang.org/x/crypto/ssh"
+)
+
+// Event is the outcome of a request notified to a Notifier.
+type Event struct {
+	// Params is the parameters of the request.
+	Params *csr.ReqParam
+	// Handler is the name of the handler authenticating the request.
+	// It is empty if no handler authenticates the request.
+	Handler string
+	// Certs are the certificates issued for the request.
+	Certs []*ssh.Certificate
+	// Err is the error failing the request. It is nil if the certificates are issued.
+	Err error
+}
+
+// Notifier notifies the outcome of the requests to external systems.
+// The certificates issued for a request are notified to the mandatory notifiers before they are added to the agent,
+// and to the other notifiers once they are added. The failure of a request is notified to all the notifiers.
+type Notifier interface {
+	// NotifyMandatory notifies the event to the mandatory notifiers, and returns the first failure.
+	// The request fails without adding the certificates to the agent if it fails to notify the certificates.
+	NotifyMandatory(ctx context.Context, event *Event) error
+	// Notify notifies the event to the other notifiers. Their failures don't fail the request.
+	Notify(ctx context.Context, event *Event)
+}
+
+// issuedEvent returns the event of the certificates issued for the request by the handler.
+func issuedEvent(params *csr.ReqParam, handlerName string, certs []ssh.PublicKey) *Event {
+	event := &Event{Params: params, Handler: handlerName}
+	for _, pub := range certs {
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			event.Certs = append(event.Certs, cert)
+		}
+	}
+	return event
+}
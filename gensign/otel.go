@@ -6,62 +6,207 @@ package gensign
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/sshutils/cert"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	scopeName     = "github.com/theparanoids/ysshra/gensign"
 	ysshraPanic   = "ysshra.panic"
 	ysshraGensign = "ysshra.gensign.run"
+	// ysshraGensignDuration and the following metrics are recorded by RunWithOption.
+	ysshraGensignDuration    = "ysshra.gensign.duration"
+	ysshraGensignIssued      = "ysshra.gensign.issued"
+	ysshraGensignAuthFailure = "ysshra.gensign.auth.failure"
 )
 
-var meter metric.Meter
+// Span names of the phases of gensign.
+const (
+	spanRun             = "gensign.Run"
+	spanAuthenticate    = "gensign.Authenticate"
+	spanGenerate        = "gensign.Generate"
+	spanSign            = "gensign.Sign"
+	spanAddCertsToAgent = "gensign.AddCertsToAgent"
+)
+
+// Span and metric attributes of gensign.
+// The metric attributes must have bounded values, so that the cardinality of the metrics is bounded.
+const (
+	transIDKey       = attribute.Key("ysshra.trans_id")
+	handlerKey       = attribute.Key("ysshra.handler")
+	keyIdentifierKey = attribute.Key("crypki.key_identifier")
+	certCountKey     = attribute.Key("ysshra.cert.count")
+	certTypeKey      = attribute.Key("ysshra.cert.type")
+	errorTypeKey     = attribute.Key("gensign.error.type")
+	reasonKey        = attribute.Key("gensign.error.reason")
+	panicMessageKey  = attribute.Key("panic.message")
+)
+
+// metrics contains the instruments of gensign.
+type metrics struct {
+	panicCounter       metric.Int64Counter
+	runCounter         metric.Int64Counter
+	runDuration        metric.Float64Histogram
+	issuedCounter      metric.Int64Counter
+	authFailureCounter metric.Int64Counter
+}
+
+// defaultMetrics contains the instruments created by the global meter provider.
+// The global meter provider forwards the instruments to the provider set up later by the commands.
+var defaultMetrics *metrics
 
-// init ensures the oTel meter for ysshra is initialized.
+// init ensures the oTel instruments for ysshra are initialized once.
 func init() {
-	meter = otel.GetMeterProvider().Meter(scopeName)
+	defaultMetrics = newMetrics(otel.GetMeterProvider())
 }
 
-// ExportPanicMetric exports a panic metric to the oTel meter.
-func ExportPanicMetric(ctx context.Context, _ *csr.ReqParam, msg string) {
+// newMetrics creates the instruments of gensign by the provider mp.
+// An instrument failed to be created is replaced by a no-op one.
+func newMetrics(mp metric.MeterProvider) *metrics {
+	meter := mp.Meter(scopeName)
+	fallback := noop.Meter{}
+	m := new(metrics)
 	var err error
-	panicCounter, err := meter.Int64Counter(
+	if m.panicCounter, err = meter.Int64Counter(
 		ysshraPanic,
 		metric.WithUnit("1"),
-		metric.WithDescription("Count the number of HTTP handler panic"),
-	)
-	if err != nil {
+		metric.WithDescription("Count the number of gensign panic"),
+	); err != nil {
 		log.Printf("Error creating metric for panic: %v\n", err)
+		m.panicCounter, _ = fallback.Int64Counter(ysshraPanic)
 	}
-	// TODO: add transID to traces instead of metrics to avoid high cardinality.
-	panicCounter.Add(ctx, 1, metric.WithAttributes(
-		attribute.String("panic.message", msg),
-	))
-}
-
-// ExportGensignRunMetric exports a gensign run metric to the oTel meter.
-func ExportGensignRunMetric(ctx context.Context, runErr error) {
-	var err error
-	gensignRunCounter, err := meter.Int64Counter(
+	if m.runCounter, err = meter.Int64Counter(
 		ysshraGensign,
 		metric.WithUnit("1"),
 		metric.WithDescription("Count the number of gensign runs"),
-	)
-	if err != nil {
+	); err != nil {
 		log.Printf("Error creating metric for gensign run: %v\n", err)
+		m.runCounter, _ = fallback.Int64Counter(ysshraGensign)
+	}
+	if m.runDuration, err = meter.Float64Histogram(
+		ysshraGensignDuration,
+		metric.WithUnit("s"),
+		metric.WithDescription("The end-to-end latency of gensign runs"),
+	); err != nil {
+		log.Printf("Error creating metric for gensign duration: %v\n", err)
+		m.runDuration, _ = fallback.Float64Histogram(ysshraGensignDuration)
+	}
+	if m.issuedCounter, err = meter.Int64Counter(
+		ysshraGensignIssued,
+		metric.WithUnit("1"),
+		metric.WithDescription("Count the number of issued certificates"),
+	); err != nil {
+		log.Printf("Error creating metric for issued certificates: %v\n", err)
+		m.issuedCounter, _ = fallback.Int64Counter(ysshraGensignIssued)
+	}
+	if m.authFailureCounter, err = meter.Int64Counter(
+		ysshraGensignAuthFailure,
+		metric.WithUnit("1"),
+		metric.WithDescription("Count the number of handler authentication failures"),
+	); err != nil {
+		log.Printf("Error creating metric for authentication failures: %v\n", err)
+		m.authFailureCounter, _ = fallback.Int64Counter(ysshraGensignAuthFailure)
+	}
+	return m
+}
+
+// metricsOf returns the instruments created by the provider mp, or the default instruments if mp is nil.
+func metricsOf(mp metric.MeterProvider) *metrics {
+	if mp == nil {
+		return defaultMetrics
+	}
+	return newMetrics(mp)
+}
+
+// errorType returns the gensign error type of err as a metric attribute.
+func errorType(err error) attribute.KeyValue {
+	if gensignErr, ok := IsError(err); ok {
+		return errorTypeKey.Int(int(gensignErr.Type()))
+	}
+	return errorTypeKey.Int(int(Unknown))
+}
+
+// reason returns the bounded reason of err as a metric attribute.
+func reason(err error) attribute.KeyValue {
+	if gensignErr, ok := IsError(err); ok {
+		return reasonKey.String(gensignErr.Type().String())
+	}
+	return reasonKey.String(Unknown.String())
+}
+
+// newTracer returns the tracer of gensign from the provider tp, or from the global provider if tp is nil.
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
 	}
+	return tp.Tracer(scopeName)
+}
+
+// endSpan ends the span, and records err in the span if it is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ExportPanicMetric exports a panic metric to the oTel meter.
+// The panic message is added to the span in ctx instead of the metric, to keep the cardinality of the metric bounded.
+func ExportPanicMetric(ctx context.Context, _ *csr.ReqParam, msg string) {
+	defaultMetrics.recordPanic(ctx, msg)
+}
+
+func (m *metrics) recordPanic(ctx context.Context, msg string) {
+	trace.SpanFromContext(ctx).AddEvent("panic", trace.WithAttributes(panicMessageKey.String(msg)))
+	m.panicCounter.Add(ctx, 1)
+}
+
+// ExportGensignRunMetric exports a gensign run metric to the oTel meter.
+func ExportGensignRunMetric(ctx context.Context, runErr error) {
 	var attributes []attribute.KeyValue
 	if runErr != nil {
-		gensignErr, ok := IsError(runErr)
-		if ok {
-			attributes = append(attributes, attribute.Int("gensign.error.type", int(gensignErr.Type())))
-		} else {
-			attributes = append(attributes, attribute.Int("gensign.error.type", int(Unknown)))
-		}
+		attributes = append(attributes, errorType(runErr))
+	}
+	defaultMetrics.runCounter.Add(ctx, 1, metric.WithAttributes(attributes...))
+}
+
+// recordRun records the latency of a gensign run.
+func (m *metrics) recordRun(ctx context.Context, handlerName string, elapsed time.Duration, runErr error) {
+	attributes := []attribute.KeyValue{handlerKey.String(handlerName)}
+	if runErr != nil {
+		attributes = append(attributes, errorType(runErr))
 	}
-	gensignRunCounter.Add(ctx, 1, metric.WithAttributes(attributes...))
+	m.runDuration.Record(ctx, elapsed.Seconds(), metric.WithAttributes(attributes...))
+}
+
+// recordIssued records a certificate issued by the handler and signed by the CA key with the identifier.
+func (m *metrics) recordIssued(ctx context.Context, handlerName string, keyIdentifier string, pub ssh.PublicKey) {
+	certType := cert.UnknownCertType
+	if c, ok := pub.(*ssh.Certificate); ok {
+		certType = cert.GetType(c)
+	}
+	label := certType.String()
+	if label == "" {
+		label = "Unknown"
+	}
+	m.issuedCounter.Add(ctx, 1, metric.WithAttributes(
+		handlerKey.String(handlerName),
+		keyIdentifierKey.String(keyIdentifier),
+		certTypeKey.String(label),
+	))
+}
+
+// recordAuthFailure records an authentication failure of the handler.
+func (m *metrics) recordAuthFailure(ctx context.Context, handlerName string, authErr error) {
+	m.authFailureCounter.Add(ctx, 1, metric.WithAttributes(handlerKey.String(handlerName), reason(authErr)))
 }
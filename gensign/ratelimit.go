@@ -0,0 +1,17 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package gensign
+
+import (
+	"time"
+
+	"github.com/theparanoids/ysshra/csr"
+)
+
+// RateLimiter limits the requests to each handler.
+type RateLimiter interface {
+	// Allow returns zero if the request to the handler is allowed,
+	// or the duration after which the request can be retried.
+	Allow(params *csr.ReqParam, handler string) (retryAfter time.Duration, err error)
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package securitykey
+
+import (
+	"crypto/x509"
+)
+
+const (
+	defaultPubKeyDir       = "/etc/ssh/authorized_public_keys"
+	defaultAttestationDir  = "/etc/ssh/sk_attestations"
+	defaultU2FRootCAPath   = "/opt/ysshra/yubico_u2f_root_ca.pem"
+	defaultCertValiditySec = 12 * 3600 // 12 hours
+)
+
+type conf struct {
+	// PubKeyDir specifies the folder path which stores users' public keys.
+	// The public key of a security key may carry the options "no-touch-required" and "verify-required".
+	PubKeyDir string `mapstructure:"pub_key_dir"`
+	// AttestationDir specifies the folder path which stores the attestations of users' security keys,
+	// together with the challenges used in the enrollment.
+	AttestationDir string `mapstructure:"attestation_dir"`
+	// RootCAPaths are the PEM files or directories of the trusted FIDO attestation root CA certificates.
+	// If not specified, the Yubico U2F root CA certificate at the default path is trusted.
+	RootCAPaths []string `mapstructure:"root_ca_paths"`
+	// RequireAttestation indicates whether the attestation of a security key is verified before issuing certificates.
+	RequireAttestation bool `mapstructure:"require_attestation"`
+	// KeyIdentifiers is the mapping from CA public key algorithm to the key identifier configured in signer.
+	KeyIdentifiers map[x509.PublicKeyAlgorithm]string `mapstructure:"key_identifiers"`
+	// CertValiditySec is the time length of cert validity.
+	CertValiditySec uint64 `mapstructure:"cert_validity_sec"`
+}
+
+func newDefaultConf() *conf {
+	return &conf{
+		PubKeyDir:          defaultPubKeyDir,
+		AttestationDir:     defaultAttestationDir,
+		RequireAttestation: true,
+		CertValiditySec:    defaultCertValiditySec,
+	}
+}
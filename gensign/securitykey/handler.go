@@ -0,0 +1,224 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package securitykey
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/agent/yubiagent"
+	"github.com/theparanoids/ysshra/attestation/skattest"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/crypki"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/internal/logkey"
+	"github.com/theparanoids/ysshra/keyid"
+	"github.com/theparanoids/ysshra/sshutils/cert"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HandlerName is a unique name to identify a handler.
+	// It is also appended to the cert label.
+	HandlerName = "paranoids.securitykey"
+	// IsForHumanUser indicates whether this handler should be used for a human user.
+	IsForHumanUser = true
+)
+
+// Handler implements gensign.Handler.
+// It issues certificates for the FIDO security key (sk-*) registered for the user,
+// after verifying the attestation of the key and a signature from the key.
+// The touch policy in the certificate is derived from the no-touch-required option of the registered key.
+type Handler struct {
+	agent    yubiagent.YubiAgent
+	verifier *skattest.Verifier
+	conf     *conf
+
+	// pubKey and touchPolicy are the authenticated security key and its touch policy,
+	// set by a successful Authenticate.
+	pubKey      ssh.PublicKey
+	touchPolicy keyid.TouchPolicy
+}
+
+// NewHandler creates a yubiagent client from the ssh connection,
+// and constructs a gensign.Handler containing the options loaded from conf.
+func NewHandler(gensignConf *config.GensignConfig, conn net.Conn) (gensign.Handler, error) {
+	c := newDefaultConf()
+	if err := gensignConf.ExtractHandlerConf(HandlerName, c); err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+	}
+
+	var verifier *skattest.Verifier
+	if c.RequireAttestation {
+		var err error
+		if verifier, err = newVerifier(c); err != nil {
+			return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+		}
+	}
+
+	agent, err := yubiagent.NewClientFromConn(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initiialize handler %q, err: %v", HandlerName, err)
+	}
+
+	return &Handler{
+		agent:    agent,
+		verifier: verifier,
+		conf:     c,
+	}, nil
+}
+
+// newVerifier returns the attestation verifier trusting the root CAs in c.
+func newVerifier(c *conf) (*skattest.Verifier, error) {
+	rootPaths := c.RootCAPaths
+	if len(rootPaths) == 0 {
+		rootPaths = []string{defaultU2FRootCAPath}
+	}
+	return skattest.NewVerifierFromFiles(rootPaths)
+}
+
+// Name returns the name of the handler.
+func (h *Handler) Name() string {
+	return HandlerName
+}
+
+// Authenticate succeeds if the security key registered on server side's directory is attested by a trusted vendor,
+// and signs a challenge with the user presence and verification required by the registered options.
+func (h *Handler) Authenticate(param *csr.ReqParam) error {
+	err := param.Validate()
+	if err != nil {
+		return gensign.NewError(gensign.InvalidParams, HandlerName, err)
+	}
+
+	if param.NamespacePolicy != common.NoNamespace {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, fmt.Sprintf("want namespace policy %s, but got %s", common.NoNamespace, param.NamespacePolicy))
+	}
+	if !param.Attrs.HardKey {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, "only support hard key validation")
+	}
+
+	reg, err := readRegistration(h.conf.PubKeyDir, param.LogName)
+	if err != nil {
+		return gensign.NewError(gensign.HandlerAuthN, HandlerName, err)
+	}
+	if h.verifier != nil {
+		if err := h.verifyAttestation(param, reg.pubKey); err != nil {
+			return gensign.NewError(gensign.HandlerAuthN, HandlerName, err)
+		}
+	}
+	flags, err := h.challengePubKey(reg.pubKey)
+	if err != nil {
+		return gensign.NewError(gensign.HandlerAuthN, HandlerName, err)
+	}
+
+	// The touch policy is what the registered key enforces on every signature, not whether this challenge was touched;
+	// a key registered with no-touch-required can sign without touch later even if the user touched it now.
+	touchPolicy := keyid.AlwaysTouch
+	if reg.hasOption(key.SKOptionNoTouchRequired) {
+		touchPolicy = keyid.NeverTouch
+	}
+	if touchPolicy != keyid.NeverTouch && flags&key.SKFlagUserPresence == 0 {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, "user presence is required for the security key")
+	}
+	if flags&key.SKFlagUserVerification == 0 && reg.hasOption(key.SKOptionVerifyRequired) {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, HandlerName, "user verification is required for the security key")
+	}
+
+	h.pubKey = reg.pubKey
+	h.touchPolicy = touchPolicy
+	return nil
+}
+
+// Generate implements csr.Generator.
+func (h *Handler) Generate(param *csr.ReqParam) ([]csr.AgentKey, error) {
+	err := param.Validate()
+	if err != nil {
+		return nil, gensign.NewError(gensign.InvalidParams, HandlerName, err)
+	}
+	if h.pubKey == nil {
+		return nil, gensign.NewErrorWithMsg(gensign.HandlerGenCSRErr, HandlerName, "the security key has not been authenticated")
+	}
+
+	kid := &keyid.KeyID{
+		Principals:    []string{param.LogName},
+		TransID:       param.TransID,
+		ReqUser:       param.ReqUser,
+		ReqIP:         param.ClientIP,
+		ReqHost:       param.ReqHost,
+		Version:       keyid.DefaultVersion,
+		IsFirefighter: false,
+		IsHWKey:       true,
+		IsHeadless:    false,
+		IsNonce:       false,
+		Usage:         keyid.AllUsage,
+		TouchPolicy:   h.touchPolicy,
+	}
+
+	certType := cert.TouchlessCert
+	if kid.TouchPolicy != keyid.NeverTouch {
+		certType = cert.TouchSudoCert
+	}
+
+	keyIdentifier, ok := h.conf.KeyIdentifiers[param.Attrs.CAPubKeyAlgo]
+	if !ok {
+		err := fmt.Errorf("unsupported CA public key algorithm %q", param.Attrs.CAPubKeyAlgo)
+		return nil, gensign.NewError(gensign.HandlerConfErr, HandlerName, err)
+	}
+
+	request := &proto.SSHCertificateSigningRequest{
+		KeyMeta:    &proto.KeyMeta{Identifier: keyIdentifier},
+		Extensions: crypki.GetDefaultExtension(),
+		Validity:   h.conf.CertValiditySec,
+		Principals: cert.GetPrincipals(kid.Principals, certType),
+		PublicKey:  string(ssh.MarshalAuthorizedKey(h.pubKey)),
+	}
+
+	request.KeyId, err = kid.Marshal()
+	if err != nil {
+		return nil, gensign.NewError(gensign.HandlerGenCSRErr, HandlerName, err)
+	}
+
+	agentKey := yubiagent.NewHardKey(h.agent)
+	agentKey.AddCSR(request)
+
+	log.Info().Str(logkey.TransIDField, param.TransID).
+		Str(logkey.HandlerField, HandlerName).
+		Strs(logkey.PrinsField, request.Principals).
+		Str(logkey.KeyidField, request.KeyId).
+		Msgf("CSRs successfully generated for security key %s", ssh.FingerprintSHA256(h.pubKey))
+
+	return []csr.AgentKey{agentKey}, nil
+}
+
+// verifyAttestation verifies the stored attestation of the registered security key.
+func (h *Handler) verifyAttestation(param *csr.ReqParam, pubKey ssh.PublicKey) error {
+	att, challenge, err := readAttestation(h.conf.AttestationDir, param.LogName)
+	if err != nil {
+		return err
+	}
+	result, err := h.verifier.Verify(att, pubKey, challenge)
+	if err != nil {
+		return fmt.Errorf("failed to verify attestation: %v", err)
+	}
+	log.Debug().Str(logkey.TransIDField, param.TransID).
+		Str(logkey.HandlerField, HandlerName).
+		Msgf("security key %x attested by %q", result.AuthData.AAGUID, result.Root.Subject)
+	return nil
+}
+
+// challengePubKey checks the private key of the security key is accessible through the agent,
+// and returns the flags of the signature.
+func (h *Handler) challengePubKey(pubKey ssh.PublicKey) (byte, error) {
+	sig, err := yubiagent.NewHardKey(h.agent).Challenge(pubKey)
+	if err != nil {
+		return 0, err
+	}
+	flags, _, err := key.SecurityKeySignatureFlags(sig)
+	return flags, err
+}
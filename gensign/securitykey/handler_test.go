@@ -0,0 +1,387 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package securitykey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/agent/yubiagent"
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/attestation/skattest"
+	"github.com/theparanoids/ysshra/attestation/skattest/softsk"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/csr/transid"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/keyid"
+	"github.com/theparanoids/ysshra/message"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"github.com/theparanoids/ysshra/sshutils/version"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/nettest"
+)
+
+var testChallenge = []byte("enrollment challenge")
+
+// newYubiAgent creates a yubiagent server forwarding to the agent of the security key,
+// and returns a client connected to it.
+func newYubiAgent(t *testing.T, token *softsk.Token) yubiagent.YubiAgent {
+	t.Helper()
+
+	listener, err := nettest.NewLocalListener("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	upstream := token.Agent()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(upstream, conn)
+		}
+	}()
+
+	piv, err := softpiv.New(softpiv.Option{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := yubiagent.NewServerWithBackend(listener.Addr().String(), piv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go yubiagent.ServeAgent(server, c1)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+		server.Close()
+	})
+	client, err := yubiagent.NewClientFromConn(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func newToken(t *testing.T, opt softsk.Option) *softsk.Token {
+	t.Helper()
+	token, err := softsk.New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newConf writes the registered key and the attestation of the token for user "dummy",
+// and returns the handler conf pointing to them.
+func newConf(t *testing.T, token *softsk.Token, options string) *conf {
+	t.Helper()
+
+	pubKeyDir, attestationDir := t.TempDir(), t.TempDir()
+	pubKeyLine := ssh.MarshalAuthorizedKey(token.PublicKey())
+	if options != "" {
+		pubKeyLine = append([]byte(options+" "), pubKeyLine...)
+	}
+	if err := os.WriteFile(path.Join(pubKeyDir, "dummy.pub"), pubKeyLine, 0400); err != nil {
+		t.Fatal(err)
+	}
+	att, err := token.Attest(testChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(attestationDir, "dummy"+attestationExt), att, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(attestationDir, "dummy"+challengeExt), testChallenge, 0400); err != nil {
+		t.Fatal(err)
+	}
+	return &conf{
+		PubKeyDir:          pubKeyDir,
+		AttestationDir:     attestationDir,
+		RequireAttestation: true,
+		KeyIdentifiers:     map[x509.PublicKeyAlgorithm]string{x509.ECDSA: "ecdsa-key"},
+		CertValiditySec:    defaultCertValiditySec,
+	}
+}
+
+func newVerifierWithRoots(roots ...*x509.Certificate) *skattest.Verifier {
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	return skattest.NewVerifier(pool)
+}
+
+func newParam(hardKey bool) *csr.ReqParam {
+	return &csr.ReqParam{
+		NamespacePolicy:  common.NoNamespace,
+		HandlerName:      HandlerName,
+		ClientIP:         "1.2.3.4",
+		LogName:          "dummy",
+		ReqUser:          "dummy",
+		ReqHost:          "dummy.com",
+		TransID:          transid.Generate(),
+		SSHClientVersion: version.New(8, 4),
+		Attrs: &message.Attributes{
+			Username:         "dummy",
+			Hostname:         "dummy.com",
+			SSHClientVersion: "8.4",
+			CAPubKeyAlgo:     x509.ECDSA,
+			HardKey:          hardKey,
+		},
+	}
+}
+
+func TestHandler_Authenticate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		params     *csr.ReqParam
+		GetHandler func(t *testing.T) *Handler
+		wantErr    bool
+	}{
+		"happy path": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, "")}
+			},
+		},
+		"attestation not required": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				c := newConf(t, token, "")
+				c.AttestationDir, c.RequireAttestation = "/nonexistent", false
+				return &Handler{agent: newYubiAgent(t, token), conf: c}
+			},
+		},
+		"nil param": {
+			GetHandler: func(t *testing.T) *Handler {
+				return &Handler{conf: newDefaultConf()}
+			},
+			wantErr: true,
+		},
+		"not a hard key": {
+			params: newParam(false),
+			GetHandler: func(t *testing.T) *Handler {
+				return &Handler{conf: newDefaultConf()}
+			},
+			wantErr: true,
+		},
+		"registered key is not a security key": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				_, pub, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c := newConf(t, token, "")
+				if err := os.WriteFile(path.Join(c.PubKeyDir, "dummy.pub"), ssh.MarshalAuthorizedKey(pub), 0400); err != nil {
+					t.Fatal(err)
+				}
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: c}
+			},
+			wantErr: true,
+		},
+		"untrusted attestation root": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				root, _, err := softpiv.NewRoot("Untrusted Root CA")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(root), conf: newConf(t, token, "")}
+			},
+			wantErr: true,
+		},
+		"missing attestation": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				c := newConf(t, token, "")
+				c.AttestationDir = t.TempDir()
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: c}
+			},
+			wantErr: true,
+		},
+		"key not in agent": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				otherToken := newToken(t, softsk.Option{})
+				return &Handler{agent: newYubiAgent(t, otherToken), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, "")}
+			},
+			wantErr: true,
+		},
+		"no touch without no-touch-required": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{NoTouch: true})
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, "")}
+			},
+			wantErr: true,
+		},
+		"no touch with no-touch-required": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{NoTouch: true})
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, key.SKOptionNoTouchRequired)}
+			},
+		},
+		"no verification with verify-required": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{})
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, key.SKOptionVerifyRequired)}
+			},
+			wantErr: true,
+		},
+		"verification with verify-required": {
+			params: newParam(true),
+			GetHandler: func(t *testing.T) *Handler {
+				token := newToken(t, softsk.Option{Verify: true})
+				return &Handler{agent: newYubiAgent(t, token), verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, key.SKOptionVerifyRequired)}
+			},
+		},
+	}
+
+	for name, test := range tests {
+		name, test := name, test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			h := test.GetHandler(t)
+			if err := h.Authenticate(test.params); (err != nil) != test.wantErr {
+				t.Errorf("Authenticate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// testSigner implements csr.Signer by signing the CSR with an in-memory CA key.
+type testSigner struct {
+	ca ssh.Signer
+}
+
+func (s *testSigner) Sign(_ context.Context, request *proto.SSHCertificateSigningRequest) ([]ssh.PublicKey, []string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		KeyId:           request.KeyId,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: request.Principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Duration(request.Validity) * time.Second).Unix()),
+		Permissions:     ssh.Permissions{Extensions: request.Extensions},
+	}
+	if err := cert.SignCert(rand.Reader, s.ca); err != nil {
+		return nil, nil, err
+	}
+	return []ssh.PublicKey{cert}, []string{HandlerName}, nil
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	caPriv, _, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		opt            softsk.Option
+		options        string
+		wantPolicy     keyid.TouchPolicy
+		wantPrincipals []string
+	}{
+		{
+			name:           "touch",
+			wantPolicy:     keyid.AlwaysTouch,
+			wantPrincipals: []string{"dummy:touch"},
+		},
+		{
+			name:           "no touch required",
+			opt:            softsk.Option{NoTouch: true},
+			options:        key.SKOptionNoTouchRequired,
+			wantPolicy:     keyid.NeverTouch,
+			wantPrincipals: []string{"dummy:notouch"},
+		},
+		{
+			// The key signs with user presence, but it is registered to sign without touch.
+			name:           "touched with no touch required",
+			options:        key.SKOptionNoTouchRequired,
+			wantPolicy:     keyid.NeverTouch,
+			wantPrincipals: []string{"dummy:notouch"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			token := newToken(t, tt.opt)
+			ag := newYubiAgent(t, token)
+			h := &Handler{agent: ag, verifier: newVerifierWithRoots(token.Root()), conf: newConf(t, token, tt.options)}
+			if err := gensign.Run(context.Background(), newParam(true), []gensign.Handler{h}, &testSigner{ca: ca}); err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+
+			keys, err := ag.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *ssh.Certificate
+			for _, k := range keys {
+				pk, err := ssh.ParsePublicKey(k.Blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c, ok := pk.(*ssh.Certificate); ok {
+					got = c
+				}
+			}
+			if got == nil {
+				t.Fatal("cannot find the certificate of the security key in the agent")
+			}
+			if !cmp.Equal(got.Key.Marshal(), token.PublicKey().Marshal()) {
+				t.Errorf("unexpected certificate key %s", got.Key.Type())
+			}
+			if !cmp.Equal(got.ValidPrincipals, tt.wantPrincipals) {
+				t.Errorf("unexpected principals: diff(-got,+want):\n%v", cmp.Diff(got.ValidPrincipals, tt.wantPrincipals))
+			}
+			kid, err := keyid.Unmarshal(got.KeyId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !kid.IsHWKey || kid.TouchPolicy != tt.wantPolicy {
+				t.Errorf("unexpected keyid: %+v", kid)
+			}
+		})
+	}
+}
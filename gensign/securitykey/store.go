@@ -0,0 +1,143 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package securitykey
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/theparanoids/ysshra/agent/yubiagent"
+	"github.com/theparanoids/ysshra/attestation/skattest"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// attestationExt is the file extension of the attestation written by `ssh-keygen -O write-attestation`.
+	attestationExt = ".att"
+	// challengeExt is the file extension of the challenge passed to `ssh-keygen -O challenge`.
+	challengeExt = ".chal"
+)
+
+// registration is the security key registered for a user.
+type registration struct {
+	pubKey  ssh.PublicKey
+	options []string
+}
+
+// hasOption checks if the registered key carries the authorized key option.
+func (r *registration) hasOption(option string) bool {
+	for _, o := range r.options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// readRegistration returns the security key registered for logName in pubKeyDir.
+func readRegistration(pubKeyDir string, logName string) (*registration, error) {
+	pubKeyBytes, err := yubiagent.ReadPubKey(pubKeyDir, logName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pubkey: %v", err)
+	}
+	return parseRegistration(pubKeyBytes)
+}
+
+// parseRegistration parses a security key in authorized keys format.
+func parseRegistration(pubKeyBytes []byte) (*registration, error) {
+	pubKey, _, options, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pubkey: %v, pubkey: %q", err, string(pubKeyBytes))
+	}
+	if !key.IsSecurityKey(pubKey) {
+		return nil, fmt.Errorf("the registered pubkey %s is not a security key", pubKey.Type())
+	}
+	return &registration{pubKey: pubKey, options: options}, nil
+}
+
+// readAttestation returns the attestation of the security key of logName in attestationDir,
+// together with the challenge used in the enrollment.
+func readAttestation(attestationDir string, logName string) (*skattest.Attestation, []byte, error) {
+	blob, err := os.ReadFile(path.Join(attestationDir, logName+attestationExt))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attestation: %v", err)
+	}
+	challenge, err := os.ReadFile(path.Join(attestationDir, logName+challengeExt))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attestation challenge: %v", err)
+	}
+	att, err := skattest.ParseAttestation(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return att, challenge, nil
+}
+
+// Register installs the security key of logName, in authorized keys format, into the public key store of the handler.
+// The attestation and the challenge are the files passed to `ssh-keygen -O write-attestation` and `-O challenge`
+// when the key is enrolled. They are verified and stored alongside the key if the handler requires attestation,
+// or if the attestation is provided.
+func Register(gensignConf *config.GensignConfig, logName string, authorizedKey, attestation, challenge []byte) error {
+	c := newDefaultConf()
+	if err := gensignConf.ExtractHandlerConf(HandlerName, c); err != nil {
+		return err
+	}
+	if logName == "" || filepath.Base(logName) != logName || logName == "." || logName == ".." {
+		return fmt.Errorf("invalid logname %q", logName)
+	}
+	reg, err := parseRegistration(authorizedKey)
+	if err != nil {
+		return err
+	}
+
+	if c.RequireAttestation && len(attestation) == 0 {
+		return errors.New("the attestation of the security key is required")
+	}
+	if len(attestation) != 0 {
+		verifier, err := newVerifier(c)
+		if err != nil {
+			return err
+		}
+		att, err := skattest.ParseAttestation(attestation)
+		if err != nil {
+			return err
+		}
+		if _, err := verifier.Verify(att, reg.pubKey, challenge); err != nil {
+			return fmt.Errorf("failed to verify attestation: %v", err)
+		}
+		if err := writeFile(path.Join(c.AttestationDir, logName+attestationExt), attestation); err != nil {
+			return err
+		}
+		if err := writeFile(path.Join(c.AttestationDir, logName+challengeExt), challenge); err != nil {
+			return err
+		}
+	}
+	return writeFile(path.Join(c.PubKeyDir, logName+".pub"), authorizedKey)
+}
+
+// writeFile replaces the file at filePath with data atomically.
+func writeFile(filePath string, data []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(filePath), "."+path.Base(filePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package securitykey
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/theparanoids/ysshra/agent/yubiagent/softpiv"
+	"github.com/theparanoids/ysshra/attestation/skattest/softsk"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/sshutils/key"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	rootCert, rootKey, err := softpiv.NewRoot("test root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPath := path.Join(t.TempDir(), "root.pem")
+	if err := os.WriteFile(rootPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw}), 0400); err != nil {
+		t.Fatal(err)
+	}
+	token := newToken(t, softsk.Option{RootCert: rootCert, RootKey: rootKey})
+	untrustedToken := newToken(t, softsk.Option{})
+	_, plainPub, err := key.GenerateKeyPair(key.ECDSAsecp256r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attest := func(token *softsk.Token) []byte {
+		att, err := token.Attest(testChallenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return att
+	}
+
+	tests := []struct {
+		name               string
+		logName            string
+		requireAttestation bool
+		authorizedKey      []byte
+		attestation        []byte
+		challenge          []byte
+		wantErr            bool
+	}{
+		{
+			name:               "attested",
+			logName:            "dummy",
+			requireAttestation: true,
+			authorizedKey:      ssh.MarshalAuthorizedKey(token.PublicKey()),
+			attestation:        attest(token),
+			challenge:          testChallenge,
+		},
+		{
+			name:          "attestation not required",
+			logName:       "dummy",
+			authorizedKey: append([]byte(key.SKOptionNoTouchRequired+" "), ssh.MarshalAuthorizedKey(token.PublicKey())...),
+		},
+		{
+			name:               "missing attestation",
+			logName:            "dummy",
+			requireAttestation: true,
+			authorizedKey:      ssh.MarshalAuthorizedKey(token.PublicKey()),
+			wantErr:            true,
+		},
+		{
+			name:               "wrong challenge",
+			logName:            "dummy",
+			requireAttestation: true,
+			authorizedKey:      ssh.MarshalAuthorizedKey(token.PublicKey()),
+			attestation:        attest(token),
+			challenge:          []byte("other"),
+			wantErr:            true,
+		},
+		{
+			name:          "untrusted attestation",
+			logName:       "dummy",
+			authorizedKey: ssh.MarshalAuthorizedKey(untrustedToken.PublicKey()),
+			attestation:   attest(untrustedToken),
+			challenge:     testChallenge,
+			wantErr:       true,
+		},
+		{
+			name:          "not a security key",
+			logName:       "dummy",
+			authorizedKey: ssh.MarshalAuthorizedKey(plainPub),
+			wantErr:       true,
+		},
+		{
+			name:          "invalid logname",
+			logName:       "../dummy",
+			authorizedKey: ssh.MarshalAuthorizedKey(token.PublicKey()),
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pubKeyDir, attestationDir := t.TempDir(), t.TempDir()
+			data := fmt.Sprintf(`{"handlers": {%q: {"pub_key_dir": %q, "attestation_dir": %q, "root_ca_paths": [%q], "require_attestation": %v}}}`,
+				HandlerName, pubKeyDir, attestationDir, rootPath, tt.requireAttestation)
+			gensignConf := &config.GensignConfig{}
+			if err := json.Unmarshal([]byte(data), gensignConf); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Register(gensignConf, tt.logName, tt.authorizedKey, tt.attestation, tt.challenge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			reg, err := readRegistration(pubKeyDir, tt.logName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(ssh.MarshalAuthorizedKey(reg.pubKey)) != string(ssh.MarshalAuthorizedKey(token.PublicKey())) {
+				t.Error("the registered key mismatches")
+			}
+			if len(tt.attestation) != 0 {
+				if _, _, err := readAttestation(attestationDir, tt.logName); err != nil {
+					t.Errorf("failed to read the registered attestation: %v", err)
+				}
+			}
+		})
+	}
+}
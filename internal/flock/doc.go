@@ -0,0 +1,5 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package flock provides the advisory file locks shared by the gensign processes serving concurrent requests.
+package flock
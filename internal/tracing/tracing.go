@@ -0,0 +1,37 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package tracing sets up the OpenTelemetry tracer provider of the ysshra commands.
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// InitTracerProvider sets up the global tracer provider exporting the spans to the OpenTelemetry collector,
+// and the global propagator of the W3C trace context.
+// The returned shutdown function flushes the pending spans.
+func InitTracerProvider(ctx context.Context, collectorEndpoint string, tlsConfig *tls.Config, res *resource.Resource) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(collectorEndpoint),
+		otlptracehttp.WithTLSClientConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tracerProvider.Shutdown, nil
+}
@@ -78,14 +78,8 @@ var requiredKeysByVersion = map[uint16][]string{
 	1: {"prins", "transID", "reqUser", "reqIP", "reqHost", "isFirefighter", "isHWKey", "isHeadless", "isNonce", "touchPolicy", "ver"},
 }
 
-var sanityCheckerByVersion = map[uint16]func(*KeyID) error{
-	1: func(id *KeyID) error {
-		err := sanityCheckerHeadless(id)
-		if err != nil {
-			return err
-		}
-		return sanityCheckerNonce(id)
-	},
+var sanityCheckersByVersion = map[uint16][]func(*KeyID) error{
+	1: {sanityCheckerHeadless, sanityCheckerNonce},
 }
 
 // KeyID contains all the fields in key ID.
@@ -117,11 +111,7 @@ func New() *KeyID {
 
 // Marshal encodes keyID to a string.
 func (kid *KeyID) Marshal() (string, error) {
-	sanityChecker, ok := sanityCheckerByVersion[kid.Version]
-	if !ok {
-		return "", fmt.Errorf(MsgUnsupportedVersion, kid.Version)
-	}
-	if err := sanityChecker(kid); err != nil {
+	if err := sanityCheck(kid); err != nil {
 		return "", err
 	}
 
@@ -156,17 +146,58 @@ func Unmarshal(kidStr string) (*KeyID, error) {
 		}
 	}
 
-	sanityChecker, ok := sanityCheckerByVersion[kid.Version]
-	if !ok {
-		return nil, fmt.Errorf(MsgUnsupportedVersion, kid.Version)
-	}
-	if err := sanityChecker(kid); err != nil {
+	if err := sanityCheck(kid); err != nil {
 		return nil, err
 	}
 
 	return kid, nil
 }
 
+// Inspect decodes the input string to a KeyID struct as Unmarshal does, but it does not stop at the first violation.
+// It returns the decoded KeyID with all the violations of the requirements of its version.
+// The returned KeyID is nil if the input string cannot be decoded.
+func Inspect(kidStr string) (*KeyID, []error) {
+	kid := &KeyID{}
+	if err := json.Unmarshal([]byte(kidStr), kid); err != nil {
+		return nil, []error{fmt.Errorf("fail to unmarshal keyid string: %v", err)}
+	}
+	requiredKeys, ok := requiredKeysByVersion[kid.Version]
+	if !ok {
+		return kid, []error{fmt.Errorf(MsgUnsupportedVersion, kid.Version)}
+	}
+
+	var violations []error
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(kidStr), &m); err != nil {
+		return kid, []error{fmt.Errorf("failed to unmarshal keyid string to map: %v", err)}
+	}
+	for _, key := range requiredKeys {
+		if _, ok := m[key]; !ok {
+			violations = append(violations, fmt.Errorf("missing key in keyid string: %s", key))
+		}
+	}
+	for _, check := range sanityCheckersByVersion[kid.Version] {
+		if err := check(kid); err != nil {
+			violations = append(violations, err)
+		}
+	}
+	return kid, violations
+}
+
+// sanityCheck returns the first violation of the sanity checkers for the version of kid.
+func sanityCheck(kid *KeyID) error {
+	checkers, ok := sanityCheckersByVersion[kid.Version]
+	if !ok {
+		return fmt.Errorf(MsgUnsupportedVersion, kid.Version)
+	}
+	for _, check := range checkers {
+		if err := check(kid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Clone returns a clone of the specified keyID.
 func Clone(k *KeyID) *KeyID {
 	kid := *k
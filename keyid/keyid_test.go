@@ -197,6 +197,54 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestInspect(t *testing.T) {
+	t.Parallel()
+	testcases := map[string]struct {
+		input          string
+		expectKid      bool
+		wantViolations int
+	}{
+		"valid": {
+			input:          `{"prins":["dummy"],"transID":"22dde224","reqUser":"dummy","reqIP":"1.1.1.1","reqHost":"dummyHost","isFirefighter":false,"isHWKey":true,"isHeadless":false,"isNonce":false,"usage":0,"touchPolicy":3,"ver":1}`,
+			expectKid:      true,
+			wantViolations: 0,
+		},
+		"invalid json": {
+			input:          `{"prins":`,
+			expectKid:      false,
+			wantViolations: 1,
+		},
+		"unsupported version": {
+			input:          `{"ver":2}`,
+			expectKid:      true,
+			wantViolations: 1,
+		},
+		"missing keys": {
+			input:          `{"prins":["dummy"],"transID":"22dde224","reqUser":"dummy","reqIP":"1.1.1.1","reqHost":"dummyHost","isFirefighter":false,"isHWKey":true,"isHeadless":false,"ver":1}`,
+			expectKid:      true,
+			wantViolations: 2,
+		},
+		"missing keys and failed sanity checks": {
+			input:          `{"prins":["dummy"],"transID":"22dde224","reqUser":"dummy","reqIP":"1.1.1.1","reqHost":"dummyHost","isFirefighter":true,"isHWKey":false,"isHeadless":true,"isNonce":true,"usage":0,"ver":1}`,
+			expectKid:      true,
+			wantViolations: 3,
+		},
+	}
+	for k, tt := range testcases {
+		tt := tt // capture range variable - see https://blog.golang.org/subtests
+		t.Run(k, func(t *testing.T) {
+			t.Parallel()
+			kid, violations := Inspect(tt.input)
+			if (kid != nil) != tt.expectKid {
+				t.Errorf("kid mismatch, got %+v, expect kid %v", kid, tt.expectKid)
+			}
+			if len(violations) != tt.wantViolations {
+				t.Errorf("violations mismatch, got %v, want %d violations", violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
 func TestSanityCheckerHeadless(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
@@ -0,0 +1,176 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/internal/logkey"
+	"golang.org/x/crypto/ssh"
+)
+
+// Sender sends the payload of an event to an external system.
+type Sender interface {
+	Send(ctx context.Context, payload *Payload) error
+}
+
+// notifier sends the events matching the filters by the sender.
+type notifier struct {
+	name      string
+	sender    Sender
+	handlers  map[string]bool
+	certTypes map[string]bool
+	mandatory bool
+	timeout   time.Duration
+}
+
+// filter returns the certificates of the event to be notified, and whether the event is notified.
+func (n *notifier) filter(event *gensign.Event) ([]*ssh.Certificate, bool) {
+	if len(n.handlers) != 0 && !n.handlers[event.Handler] {
+		return nil, false
+	}
+	if len(n.certTypes) == 0 {
+		return event.Certs, true
+	}
+	var certs []*ssh.Certificate
+	for _, c := range event.Certs {
+		if n.certTypes[typeLabel(c)] {
+			certs = append(certs, c)
+		}
+	}
+	return certs, len(certs) != 0
+}
+
+// Dispatcher notifies the events to the configured notifiers. It implements gensign.Notifier.
+type Dispatcher struct {
+	notifiers []*notifier
+	wg        sync.WaitGroup
+	now       func() time.Time
+}
+
+// NewDispatcher returns a Dispatcher notifying the events to the notifiers configured in confs.
+func NewDispatcher(confs []config.NotifierConfig) (*Dispatcher, error) {
+	d := &Dispatcher{now: time.Now}
+	for i, conf := range confs {
+		sender, err := newSender(conf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notifier %d (%s): %v", i, conf.Type, err)
+		}
+		d.add(conf, sender)
+	}
+	return d, nil
+}
+
+// add adds a notifier sending the events matching the filters in conf by the sender.
+func (d *Dispatcher) add(conf config.NotifierConfig, sender Sender) {
+	n := &notifier{
+		name:      conf.Type,
+		sender:    sender,
+		mandatory: conf.Mandatory,
+		timeout:   conf.Timeout,
+	}
+	if len(conf.Handlers) != 0 {
+		n.handlers = make(map[string]bool)
+		for _, h := range conf.Handlers {
+			n.handlers[h] = true
+		}
+	}
+	if len(conf.CertTypes) != 0 {
+		n.certTypes = make(map[string]bool)
+		for _, t := range conf.CertTypes {
+			n.certTypes[t] = true
+		}
+	}
+	d.notifiers = append(d.notifiers, n)
+}
+
+// newSender returns the sender configured in conf.
+func newSender(conf config.NotifierConfig) (Sender, error) {
+	switch conf.Type {
+	case config.NotifierWebhook:
+		if conf.URL == "" {
+			return nil, fmt.Errorf("no url configured")
+		}
+		var secret []byte
+		if conf.SecretPath != "" {
+			data, err := os.ReadFile(conf.SecretPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read webhook secret: %v", err)
+			}
+			secret = []byte(strings.TrimSpace(string(data)))
+		}
+		return NewWebhook(conf.URL, secret, conf.Retries), nil
+	case config.NotifierSyslog:
+		return NewSyslog(conf.Network, conf.Address, conf.Tag)
+	case config.NotifierExec:
+		if len(conf.Command) == 0 {
+			return nil, fmt.Errorf("no command configured")
+		}
+		return NewExec(conf.Command), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", conf.Type)
+	}
+}
+
+// NotifyMandatory sends the event to the mandatory notifiers whose filters match it.
+// The notifiers are called in sequence, and the first failure is returned.
+func (d *Dispatcher) NotifyMandatory(ctx context.Context, event *gensign.Event) error {
+	now := d.now()
+	for _, n := range d.notifiers {
+		if !n.mandatory {
+			continue
+		}
+		certs, ok := n.filter(event)
+		if !ok {
+			continue
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, n.timeout)
+		err := n.sender.Send(sendCtx, newPayload(event, certs, now))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s notifier failed: %v", n.name, err)
+		}
+	}
+	return nil
+}
+
+// Notify sends the event to the other notifiers whose filters match it.
+// The notifiers run in background; their failures are logged. Call Wait before the process exits.
+func (d *Dispatcher) Notify(_ context.Context, event *gensign.Event) {
+	now := d.now()
+	for _, n := range d.notifiers {
+		if n.mandatory {
+			continue
+		}
+		certs, ok := n.filter(event)
+		if !ok {
+			continue
+		}
+		payload := newPayload(event, certs, now)
+		d.wg.Add(1)
+		go func(n *notifier) {
+			defer d.wg.Done()
+			// The request may end before the notification, so the notification is not bound to ctx.
+			sendCtx, cancel := context.WithTimeout(context.Background(), n.timeout)
+			defer cancel()
+			if err := n.sender.Send(sendCtx, payload); err != nil {
+				log.Warn().Err(err).Str(logkey.TransIDField, payload.TransID).Msgf("%s notifier failed", n.name)
+			}
+		}(n)
+	}
+}
+
+// Wait waits for the notifications running in background.
+// It returns within the longest timeout of the notifiers.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
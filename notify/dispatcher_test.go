@@ -0,0 +1,222 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/keyid"
+	"golang.org/x/crypto/ssh"
+)
+
+var testParams = &csr.ReqParam{
+	TransID:  "a7af667d",
+	ReqUser:  "alice",
+	ReqHost:  "laptop",
+	LogName:  "alice",
+	ClientIP: "10.0.0.1",
+}
+
+// newTestCert returns a certificate with the key ID kid.
+func newTestCert(t *testing.T, kid *keyid.KeyID) *ssh.Certificate {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := kid.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          42,
+		KeyId:           keyID,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: kid.Principals,
+		ValidAfter:      1000,
+		ValidBefore:     2000,
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testSender records the payloads, and fails if err is not nil.
+type testSender struct {
+	mu       sync.Mutex
+	payloads []*Payload
+	err      error
+}
+
+func (s *testSender) Send(_ context.Context, payload *Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, payload)
+	return s.err
+}
+
+func TestDispatcher_Notify(t *testing.T) {
+	t.Parallel()
+	firefighter := newTestCert(t, &keyid.KeyID{Principals: []string{"alice"}, IsFirefighter: true, IsHWKey: true, Version: keyid.DefaultVersion})
+	regular := newTestCert(t, &keyid.KeyID{Principals: []string{"alice"}, TouchPolicy: keyid.NeverTouch, Version: keyid.DefaultVersion})
+	issued := &gensign.Event{Params: testParams, Handler: "paranoids.hardkey", Certs: []*ssh.Certificate{firefighter, regular}}
+	failed := &gensign.Event{Params: testParams, Handler: "paranoids.hardkey", Err: errors.New("approval is denied")}
+
+	tests := []struct {
+		name      string
+		conf      config.NotifierConfig
+		event     *gensign.Event
+		sendErr   error
+		wantCerts []string
+		wantEvent string
+		wantErr   bool
+	}{
+		{
+			name:      "all issued",
+			event:     issued,
+			wantEvent: EventIssued,
+			wantCerts: []string{"FireFighterSudo", "Touchless"},
+		},
+		{
+			name:      "failed",
+			event:     failed,
+			wantEvent: EventFailed,
+		},
+		{
+			name:  "other handler",
+			conf:  config.NotifierConfig{Handlers: []string{"paranoids.regular"}},
+			event: issued,
+		},
+		{
+			name:      "matched handler",
+			conf:      config.NotifierConfig{Handlers: []string{"paranoids.regular", "paranoids.hardkey"}},
+			event:     issued,
+			wantEvent: EventIssued,
+			wantCerts: []string{"FireFighterSudo", "Touchless"},
+		},
+		{
+			name:      "matched cert type",
+			conf:      config.NotifierConfig{CertTypes: []string{"FireFighterSudo"}},
+			event:     issued,
+			wantEvent: EventIssued,
+			wantCerts: []string{"FireFighterSudo"},
+		},
+		{
+			name:  "failed with cert type filter",
+			conf:  config.NotifierConfig{CertTypes: []string{"FireFighterSudo"}},
+			event: failed,
+		},
+		{
+			name:      "optional failure",
+			event:     issued,
+			sendErr:   errors.New("connection refused"),
+			wantEvent: EventIssued,
+			wantCerts: []string{"FireFighterSudo", "Touchless"},
+		},
+		{
+			name:      "mandatory failure",
+			conf:      config.NotifierConfig{Mandatory: true},
+			event:     issued,
+			sendErr:   errors.New("connection refused"),
+			wantEvent: EventIssued,
+			wantCerts: []string{"FireFighterSudo", "Touchless"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			sender := &testSender{err: tt.sendErr}
+			d := &Dispatcher{now: time.Now}
+			tt.conf.Type = "test"
+			tt.conf.Timeout = time.Second
+			d.add(tt.conf, sender)
+
+			err := d.NotifyMandatory(context.Background(), tt.event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NotifyMandatory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			d.Notify(context.Background(), tt.event)
+			d.Wait()
+
+			if tt.wantEvent == "" {
+				if len(sender.payloads) != 0 {
+					t.Errorf("got %d payloads, want none", len(sender.payloads))
+				}
+				return
+			}
+			if len(sender.payloads) != 1 {
+				t.Fatalf("got %d payloads, want 1", len(sender.payloads))
+			}
+			payload := sender.payloads[0]
+			if payload.Event != tt.wantEvent || payload.TransID != testParams.TransID ||
+				payload.Handler != "paranoids.hardkey" || payload.LogName != "alice" || payload.ClientIP != "10.0.0.1" {
+				t.Errorf("unexpected payload %+v", payload)
+			}
+			if tt.wantEvent == EventFailed && payload.Error != "approval is denied" {
+				t.Errorf("got error %q, want %q", payload.Error, "approval is denied")
+			}
+			var gotCerts []string
+			for _, c := range payload.Certs {
+				gotCerts = append(gotCerts, c.Type)
+			}
+			if len(gotCerts) != len(tt.wantCerts) {
+				t.Fatalf("got certs %v, want %v", gotCerts, tt.wantCerts)
+			}
+			for i := range gotCerts {
+				if gotCerts[i] != tt.wantCerts[i] {
+					t.Errorf("got certs %v, want %v", gotCerts, tt.wantCerts)
+				}
+			}
+		})
+	}
+}
+
+func TestNewDispatcher(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		confs   []config.NotifierConfig
+		wantErr bool
+	}{
+		{name: "no notifier"},
+		{
+			name: "valid",
+			confs: []config.NotifierConfig{
+				{Type: config.NotifierWebhook, URL: "https://example.com/hook"},
+				{Type: config.NotifierExec, Command: []string{"/usr/bin/logger"}},
+			},
+		},
+		{name: "unknown type", confs: []config.NotifierConfig{{Type: "email"}}, wantErr: true},
+		{name: "webhook without url", confs: []config.NotifierConfig{{Type: config.NotifierWebhook}}, wantErr: true},
+		{name: "missing secret", confs: []config.NotifierConfig{{Type: config.NotifierWebhook, URL: "https://example.com/hook", SecretPath: "/nonexistent"}}, wantErr: true},
+		{name: "exec without command", confs: []config.NotifierConfig{{Type: config.NotifierExec}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewDispatcher(tt.confs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewDispatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package notify notifies the certificates issued by gensign and the failed requests to external systems,
+// e.g. to alert the security team when a firefighter certificate is issued.
+//
+// A Dispatcher implements gensign.Notifier. It sends the events matching the filters of each notifier
+// by a webhook, syslog or an exec hook.
+package notify
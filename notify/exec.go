@@ -0,0 +1,36 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Exec runs a command for each payload. The command receives the payload in JSON from stdin.
+type Exec struct {
+	command []string
+}
+
+// NewExec returns an Exec running the command, which consists of the path and the arguments.
+func NewExec(command []string) *Exec {
+	return &Exec{command: command}
+}
+
+// Send runs the command with the payload. The command is killed if ctx is done before it exits.
+func (e *Exec) Send(ctx context.Context, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", e.command[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
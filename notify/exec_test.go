@@ -0,0 +1,54 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_Send(t *testing.T) {
+	t.Parallel()
+	out := filepath.Join(t.TempDir(), "event.json")
+	tests := []struct {
+		name    string
+		command []string
+		wantErr string
+	}{
+		{name: "success", command: []string{"/bin/sh", "-c", `cat > "$0"`, out}},
+		{name: "failure", command: []string{"/bin/sh", "-c", "echo denied >&2; exit 3"}, wantErr: "exit status 3: denied"},
+		{name: "not found", command: []string{"/nonexistent"}, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := NewExec(tt.command).Send(context.Background(), &Payload{Event: EventIssued, TransID: "a7af667d"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Send() got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send() unexpected error: %v", err)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload Payload
+			if err := json.Unmarshal(data, &payload); err != nil || payload.TransID != "a7af667d" {
+				t.Errorf("unexpected payload %s: %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"time"
+
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/sshutils/cert"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// EventIssued is the event of the issued certificates.
+	EventIssued = "issued"
+	// EventFailed is the event of a failed request.
+	EventFailed = "failed"
+)
+
+// Payload is the JSON representation of an event sent by the notifiers.
+type Payload struct {
+	// Event is either EventIssued or EventFailed.
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	TransID  string `json:"transID"`
+	Handler  string `json:"handler,omitempty"`
+	ReqUser  string `json:"reqUser"`
+	ReqHost  string `json:"reqHost"`
+	LogName  string `json:"logName"`
+	ClientIP string `json:"clientIP"`
+
+	// Certs are the issued certificates.
+	Certs []Cert `json:"certs,omitempty"`
+	// Error is the reason why the request fails.
+	Error string `json:"error,omitempty"`
+}
+
+// Cert describes an issued certificate.
+type Cert struct {
+	// Type is the label of the certificate type, e.g. "FireFighterSudo".
+	Type       string   `json:"type"`
+	Principals []string `json:"principals"`
+	KeyID      string   `json:"keyID"`
+	Serial     uint64   `json:"serial"`
+	// Fingerprint is the SHA256 fingerprint of the certificate.
+	Fingerprint string `json:"fingerprint"`
+	// ValidAfter and ValidBefore are the validity window of the certificate in unix time.
+	ValidAfter  uint64 `json:"validAfter"`
+	ValidBefore uint64 `json:"validBefore"`
+}
+
+// newPayload returns the payload of the event with the certificates certs.
+func newPayload(event *gensign.Event, certs []*ssh.Certificate, now time.Time) *Payload {
+	payload := &Payload{
+		Event:   EventIssued,
+		Time:    now.UTC(),
+		Handler: event.Handler,
+	}
+	if params := event.Params; params != nil {
+		payload.TransID = params.TransID
+		payload.ReqUser = params.ReqUser
+		payload.ReqHost = params.ReqHost
+		payload.LogName = params.LogName
+		payload.ClientIP = params.ClientIP
+	}
+	if event.Err != nil {
+		payload.Event = EventFailed
+		payload.Error = event.Err.Error()
+	}
+	for _, c := range certs {
+		payload.Certs = append(payload.Certs, Cert{
+			Type:        typeLabel(c),
+			Principals:  c.ValidPrincipals,
+			KeyID:       c.KeyId,
+			Serial:      c.Serial,
+			Fingerprint: ssh.FingerprintSHA256(c),
+			ValidAfter:  c.ValidAfter,
+			ValidBefore: c.ValidBefore,
+		})
+	}
+	return payload
+}
+
+// typeLabel returns the label of the certificate type of c.
+func typeLabel(c *ssh.Certificate) string {
+	if label := cert.GetType(c).String(); label != "" {
+		return label
+	}
+	return "Unknown"
+}
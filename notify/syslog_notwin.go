@@ -0,0 +1,44 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log/syslog"
+)
+
+// Syslog writes the payloads in JSON to syslog with the facility AUTHPRIV.
+// The issued certificates are written with the severity NOTICE, and the failed requests with WARNING.
+type Syslog struct {
+	network string
+	address string
+	tag     string
+}
+
+// NewSyslog returns a Syslog writing to the syslog server at address on network,
+// or the local syslog server if they are empty.
+func NewSyslog(network, address, tag string) (*Syslog, error) {
+	return &Syslog{network: network, address: address, tag: tag}, nil
+}
+
+// Send writes the payload to syslog.
+func (s *Syslog) Send(_ context.Context, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	w, err := syslog.Dial(s.network, s.address, syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, s.tag)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if payload.Event == EventFailed {
+		return w.Warning(string(body))
+	}
+	return w.Notice(string(body))
+}
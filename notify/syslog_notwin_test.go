@@ -0,0 +1,59 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+//go:build !windows
+// +build !windows
+
+package notify
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog_Send(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSyslog("udp", conn.LocalAddr().String(), "gensign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		event string
+		// wantPri is the priority of the message, i.e. LOG_AUTHPRIV (10<<3) plus the severity.
+		wantPri string
+	}{
+		{event: EventIssued, wantPri: "<85>"},
+		{event: EventFailed, wantPri: "<84>"},
+	}
+	// The subtests are not parallel, since they read from the same connection.
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.event, func(t *testing.T) {
+			if err := s.Send(context.Background(), &Payload{Event: tt.event, TransID: "a7af667d"}); err != nil {
+				t.Fatalf("Send() unexpected error: %v", err)
+			}
+			buf := make([]byte, 4096)
+			if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(buf[:n])
+			if !strings.HasPrefix(msg, tt.wantPri) || !strings.Contains(msg, "gensign") ||
+				!strings.Contains(msg, `"transID":"a7af667d"`) {
+				t.Errorf("unexpected message %q", msg)
+			}
+		})
+	}
+}
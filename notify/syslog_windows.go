@@ -0,0 +1,22 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"context"
+	"errors"
+)
+
+// Syslog is not supported on Windows.
+type Syslog struct{}
+
+// NewSyslog returns an error on Windows.
+func NewSyslog(_, _, _ string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
+
+// Send returns an error on Windows.
+func (s *Syslog) Send(context.Context, *Payload) error {
+	return errors.New("syslog is not supported on windows")
+}
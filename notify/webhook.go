@@ -0,0 +1,103 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/theparanoids/ysshra/internal/backoff"
+)
+
+// SignatureHeader is the header of the webhook requests carrying the HMAC-SHA256 signature of the body,
+// in the format "sha256=<hex encoded signature>".
+const SignatureHeader = "X-Ysshra-Signature-256"
+
+// webhookBackoff is the backoff between the retries of a webhook request.
+var webhookBackoff = backoff.Config{
+	BaseDelay:  500 * time.Millisecond,
+	Multiplier: 2.0,
+	MaxDelay:   5 * time.Second,
+	Jitter:     0.2,
+}
+
+// Webhook sends the payloads in JSON by POST requests.
+type Webhook struct {
+	url     string
+	secret  []byte
+	retries uint
+	backoff backoff.Config
+	client  *http.Client
+}
+
+// NewWebhook returns a Webhook posting the payloads to url.
+// The requests are signed by secret if it is not empty, and retried up to retries times on failures.
+func NewWebhook(url string, secret []byte, retries uint) *Webhook {
+	return &Webhook{
+		url:     url,
+		secret:  secret,
+		retries: retries,
+		backoff: webhookBackoff,
+		client:  http.DefaultClient,
+	}
+}
+
+// Send posts the payload to the webhook. The request is retried if it fails with
+// a network error, a server error or too many requests, until the retries are exhausted or ctx is done.
+func (w *Webhook) Send(ctx context.Context, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := uint(0); ; attempt++ {
+		retryable, err := w.post(ctx, body)
+		if err == nil || !retryable || attempt >= w.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v, last error: %v", ctx.Err(), err)
+		case <-time.After(w.backoff.Backoff(attempt)):
+		}
+	}
+}
+
+// post posts the body to the webhook, and returns whether the request can be retried if it fails.
+func (w *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) != 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("webhook responds %s", resp.Status)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of body by secret.
+// The receivers of the webhook verify the requests by comparing it with the signature in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/internal/backoff"
+)
+
+func TestWebhook_Send(t *testing.T) {
+	t.Parallel()
+	secret := []byte("s3cret")
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      uint
+		secret       []byte
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "success", statuses: []int{http.StatusNoContent}, secret: secret, wantAttempts: 1},
+		{name: "unsigned", statuses: []int{http.StatusOK}, wantAttempts: 1},
+		{
+			name:         "retried",
+			statuses:     []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK},
+			retries:      2,
+			secret:       secret,
+			wantAttempts: 3,
+		},
+		{
+			name:         "retries exhausted",
+			statuses:     []int{http.StatusServiceUnavailable},
+			retries:      2,
+			secret:       secret,
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "not retryable",
+			statuses:     []int{http.StatusBadRequest},
+			retries:      2,
+			secret:       secret,
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+				}
+				wantSig := ""
+				if len(tt.secret) != 0 {
+					wantSig = "sha256=" + Sign(tt.secret, body)
+				}
+				if got := r.Header.Get(SignatureHeader); got != wantSig {
+					t.Errorf("got signature %q, want %q", got, wantSig)
+				}
+				var payload Payload
+				if err := json.Unmarshal(body, &payload); err != nil || payload.TransID != "a7af667d" {
+					t.Errorf("unexpected payload %s: %v", body, err)
+				}
+				status := tt.statuses[len(tt.statuses)-1]
+				if int(n) <= len(tt.statuses) {
+					status = tt.statuses[n-1]
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			w := NewWebhook(srv.URL, tt.secret, tt.retries)
+			w.backoff = backoff.Config{BaseDelay: time.Millisecond, Multiplier: 1, MaxDelay: time.Millisecond}
+			err := w.Send(context.Background(), &Payload{Event: EventIssued, TransID: "a7af667d"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhook_SendTimeout(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, nil, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.Send(ctx, &Payload{Event: EventIssued}); err == nil {
+		t.Fatal("Send() expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send() returns after %v, want it to return when ctx is done", elapsed)
+	}
+}
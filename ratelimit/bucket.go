@@ -0,0 +1,62 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package ratelimit
+
+import (
+	"math"
+	"time"
+
+	"github.com/theparanoids/ysshra/config"
+)
+
+// bucket is a token bucket in the state file.
+type bucket struct {
+	// Tokens is the number of tokens in the bucket at Updated.
+	Tokens float64 `json:"tokens"`
+	// Updated is the unix time in nanoseconds when the bucket is updated.
+	Updated int64 `json:"updated"`
+	// Full is the unix time in nanoseconds when the bucket becomes full again.
+	// The bucket is removed from the state file after then, as it is the same as a new bucket.
+	Full int64 `json:"full"`
+}
+
+// refill returns the number of tokens in the bucket at now under the limit.
+// b is nil for a new bucket, which is full.
+func refill(b *bucket, limit config.RateLimit, now time.Time) float64 {
+	burst := float64(limit.Burst)
+	if b == nil {
+		return burst
+	}
+	elapsed := time.Duration(now.UnixNano() - b.Updated)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens := b.Tokens + elapsed.Hours()*limit.PerHour
+	if tokens > burst {
+		tokens = burst
+	}
+	return tokens
+}
+
+// wait returns the duration until the bucket with the tokens has one token under the limit.
+func wait(tokens float64, limit config.RateLimit) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	if limit.PerHour <= 0 {
+		// The bucket is never refilled.
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((1 - tokens) / limit.PerHour * float64(time.Hour))
+}
+
+// take returns the bucket after a token is taken at now from the bucket with the tokens.
+func take(tokens float64, limit config.RateLimit, now time.Time) *bucket {
+	tokens--
+	b := &bucket{Tokens: tokens, Updated: now.UnixNano(), Full: math.MaxInt64}
+	if limit.PerHour > 0 {
+		b.Full = now.Add(time.Duration((float64(limit.Burst) - tokens) / limit.PerHour * float64(time.Hour))).UnixNano()
+	}
+	return b
+}
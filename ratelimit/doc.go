@@ -0,0 +1,8 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package ratelimit implements the token bucket rate limits of gensign requests.
+// The buckets are stored in a state file updated under a lock file and replaced atomically,
+// so that the limits are enforced across the gensign processes serving concurrent requests.
+// A state file which cannot be read fails the requests instead of resetting the limits.
+package ratelimit
@@ -0,0 +1,215 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/internal/flock"
+)
+
+const (
+	// statePerm is the permission of the state file and its lock file. They are group-writable, so that the
+	// gensign processes of all the users can update them, see NewLimiter.
+	statePerm = 0660
+	// lockSuffix is the suffix of the lock file next to the state file.
+	// The state file is replaced on each update, so it cannot be locked itself.
+	lockSuffix = ".lock"
+)
+
+// state is the content of the state file.
+type state struct {
+	// Buckets are the token buckets keyed by the limit kind, the handler name and the requester.
+	Buckets map[string]*bucket `json:"buckets"`
+}
+
+// Limiter limits the requests to each handler by the token buckets per LogName, per client IP and global.
+// It implements gensign.RateLimiter.
+type Limiter struct {
+	path   string
+	limits map[string]config.HandlerRateLimit
+	mu     sync.Mutex
+	now    func() time.Time
+}
+
+// NewLimiter returns a Limiter enforcing the rate limits configured in the handler config of gensignConf,
+// with the state file at gensignConf.RateLimitStatePath.
+//
+// gensign runs as the login user, so the state file is shared by the gensign processes of all the users.
+// The state file is replaced atomically in its directory on each update, under the lock of the lock file next to it
+// (RateLimitStatePath with ".lock" suffix). The directory must be writable, and the files are created group-writable
+// regardless of the umask; set up the directory as the audit log directory, e.g. owned by a dedicated group, setgid,
+// and writable by gensign installed setgid to the group.
+func NewLimiter(gensignConf *config.GensignConfig) (*Limiter, error) {
+	limits := make(map[string]config.HandlerRateLimit)
+	for name := range gensignConf.HandlerConfig {
+		limit, err := gensignConf.ExtractHandlerRateLimit(name)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = limit
+	}
+	f, err := openLockFile(gensignConf.RateLimitStatePath + lockSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &Limiter{path: gensignConf.RateLimitStatePath, limits: limits, now: time.Now}, nil
+}
+
+// openLockFile opens the lock file at path, and creates it if it does not exist.
+func openLockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, statePerm)
+	switch {
+	case err == nil:
+		// The umask of the user may have removed the group write permission.
+		if err := f.Chmod(statePerm); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to set permission of rate limit lock: %v", err)
+		}
+		return f, nil
+	case errors.Is(err, os.ErrExist):
+		if f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+			return nil, fmt.Errorf("failed to open rate limit lock: %v", err)
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("failed to create rate limit lock: %v", err)
+	}
+}
+
+// Allow takes a token from each bucket of the request to the handler.
+// If any bucket is empty, no token is taken, and Allow returns the duration after which
+// the request can be retried. It returns an error if the state cannot be read or updated,
+// including a corrupted state file, which must be removed by the operator to reset the limits.
+func (l *Limiter) Allow(params *csr.ReqParam, handler string) (retryAfter time.Duration, err error) {
+	limit, ok := l.limits[handler]
+	if !ok {
+		return 0, nil
+	}
+	keys := map[string]config.RateLimit{
+		"user/" + handler + "/" + params.LogName:    limit.PerUser,
+		"source/" + handler + "/" + params.ClientIP: limit.PerSource,
+		"global/" + handler:                         limit.Global,
+	}
+	for key, rl := range keys {
+		if !rl.Enabled() {
+			delete(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, err := openLockFile(l.path + lockSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := flock.Lock(lock); err != nil {
+		return 0, fmt.Errorf("failed to lock rate limit state: %v", err)
+	}
+	defer flock.Unlock(lock)
+
+	st, err := readState(l.path)
+	if err != nil {
+		return 0, err
+	}
+	now := l.now()
+	st.prune(now)
+
+	tokens := make(map[string]float64, len(keys))
+	for key, limit := range keys {
+		tokens[key] = refill(st.Buckets[key], limit, now)
+		if w := wait(tokens[key], limit); w > retryAfter {
+			retryAfter = w
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+	for key, limit := range keys {
+		st.Buckets[key] = take(tokens[key], limit, now)
+	}
+	return 0, writeState(l.path, st)
+}
+
+// prune removes the buckets which are full at now.
+func (s *state) prune(now time.Time) {
+	if s.Buckets == nil {
+		s.Buckets = make(map[string]*bucket)
+	}
+	for key, b := range s.Buckets {
+		if b == nil || b.Full <= now.UnixNano() {
+			delete(s.Buckets, key)
+		}
+	}
+}
+
+// readState reads the state from the state file at path. A missing or empty file is an empty state.
+func readState(path string) (*state, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return new(state), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit state: %v", err)
+	}
+	st := new(state)
+	if len(data) == 0 {
+		return st, nil
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		// The state is replaced atomically, so it is not corrupted by a crash during the write.
+		return nil, fmt.Errorf("rate limit state %s is corrupted, remove it to reset the rate limits: %v", path, err)
+	}
+	return st, nil
+}
+
+// writeState replaces the state file at path with the state, by renaming a temporary file in the same directory.
+func writeState(path string, st *state) (err error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(statePerm); err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write rate limit state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+)
+
+const testHandler = "paranoids.regular"
+
+func newTestConf(t *testing.T, rateLimit map[string]interface{}) *config.GensignConfig {
+	t.Helper()
+	conf := &config.GensignConfig{
+		RateLimitStatePath: filepath.Join(t.TempDir(), "ratelimit.json"),
+	}
+	// Use JSON-like maps, the same as the config loaded from the file.
+	if err := jsonRoundTrip(map[string]interface{}{
+		"handlers": map[string]interface{}{
+			testHandler:           map[string]interface{}{"enable": true, "rate_limit": rateLimit},
+			"paranoids.unlimited": map[string]interface{}{"enable": true},
+		},
+	}, conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func newTestLimiter(t *testing.T, conf *config.GensignConfig, now *time.Time) *Limiter {
+	t.Helper()
+	l, err := NewLimiter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	t.Parallel()
+	alice := &csr.ReqParam{LogName: "alice", ClientIP: "10.0.0.1"}
+	aliceOtherHost := &csr.ReqParam{LogName: "alice", ClientIP: "10.0.0.2"}
+	bob := &csr.ReqParam{LogName: "bob", ClientIP: "10.0.0.1"}
+	carol := &csr.ReqParam{LogName: "carol", ClientIP: "10.0.0.3"}
+
+	type step struct {
+		params  *csr.ReqParam
+		handler string
+		// elapsed is the time elapsed since the previous step.
+		elapsed        time.Duration
+		wantRetryAfter time.Duration
+	}
+	tests := []struct {
+		name      string
+		rateLimit map[string]interface{}
+		steps     []step
+	}{
+		{
+			name:      "per user",
+			rateLimit: map[string]interface{}{"per_user": map[string]interface{}{"per_hour": 60, "burst": 2}},
+			steps: []step{
+				{params: alice, handler: testHandler},
+				{params: aliceOtherHost, handler: testHandler},
+				{params: alice, handler: testHandler, wantRetryAfter: time.Minute},
+				{params: bob, handler: testHandler},
+				{params: alice, handler: testHandler, elapsed: 30 * time.Second, wantRetryAfter: 30 * time.Second},
+				{params: alice, handler: testHandler, elapsed: 30 * time.Second},
+				{params: alice, handler: testHandler, wantRetryAfter: time.Minute},
+			},
+		},
+		{
+			name:      "per source",
+			rateLimit: map[string]interface{}{"per_source": map[string]interface{}{"per_hour": 1, "burst": 1}},
+			steps: []step{
+				{params: alice, handler: testHandler},
+				{params: bob, handler: testHandler, wantRetryAfter: time.Hour},
+				{params: aliceOtherHost, handler: testHandler},
+			},
+		},
+		{
+			name:      "global",
+			rateLimit: map[string]interface{}{"global": map[string]interface{}{"per_hour": 3600, "burst": 2}},
+			steps: []step{
+				{params: alice, handler: testHandler},
+				{params: bob, handler: testHandler},
+				{params: carol, handler: testHandler, wantRetryAfter: time.Second},
+				{params: carol, handler: "paranoids.unlimited"},
+				{params: carol, handler: testHandler, elapsed: time.Second},
+			},
+		},
+		{
+			name: "denied request takes no token",
+			rateLimit: map[string]interface{}{
+				"per_user":   map[string]interface{}{"per_hour": 60, "burst": 1},
+				"per_source": map[string]interface{}{"per_hour": 60, "burst": 2},
+			},
+			steps: []step{
+				{params: alice, handler: testHandler},
+				{params: alice, handler: testHandler, wantRetryAfter: time.Minute},
+				{params: alice, handler: testHandler, wantRetryAfter: time.Minute},
+				// The per source bucket still has a token.
+				{params: bob, handler: testHandler},
+			},
+		},
+		{
+			name:      "no limit",
+			rateLimit: map[string]interface{}{},
+			steps: []step{
+				{params: alice, handler: testHandler},
+				{params: alice, handler: testHandler},
+				{params: alice, handler: "paranoids.unknown"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			now := time.Unix(1700000000, 0)
+			l := newTestLimiter(t, newTestConf(t, tt.rateLimit), &now)
+			for i, s := range tt.steps {
+				now = now.Add(s.elapsed)
+				got, err := l.Allow(s.params, s.handler)
+				if err != nil {
+					t.Fatalf("step %d: unexpected error: %v", i, err)
+				}
+				if got.Round(time.Millisecond) != s.wantRetryAfter {
+					t.Errorf("step %d: got retry after %v, want %v", i, got, s.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_SharedState(t *testing.T) {
+	t.Parallel()
+	conf := newTestConf(t, map[string]interface{}{"per_user": map[string]interface{}{"per_hour": 1, "burst": 10}})
+	now := time.Unix(1700000000, 0)
+
+	// Limiters sharing the same state file emulate the concurrent gensign processes.
+	const limiters, requests = 4, 5
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < limiters; i++ {
+		l := newTestLimiter(t, conf, &now)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				retryAfter, err := l.Allow(&csr.ReqParam{LogName: "alice"}, testHandler)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if retryAfter == 0 {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Errorf("got %d allowed requests, want 10", allowed)
+	}
+}
+
+func TestLimiter_CorruptedState(t *testing.T) {
+	t.Parallel()
+	conf := newTestConf(t, map[string]interface{}{"per_user": map[string]interface{}{"per_hour": 1, "burst": 1}})
+	now := time.Unix(1700000000, 0)
+	l := newTestLimiter(t, conf, &now)
+	if err := os.WriteFile(conf.RateLimitStatePath, []byte(`{"buckets":`), statePerm); err != nil {
+		t.Fatal(err)
+	}
+	// The buckets must not be reset by a corrupted state.
+	for i := 0; i < 2; i++ {
+		if _, err := l.Allow(&csr.ReqParam{LogName: "alice"}, testHandler); err == nil || !strings.Contains(err.Error(), "corrupted") {
+			t.Errorf("request %d: got error %v, want corrupted state error", i, err)
+		}
+	}
+}
+
+func TestLimiter_StateFiles(t *testing.T) {
+	t.Parallel()
+	conf := newTestConf(t, map[string]interface{}{"per_user": map[string]interface{}{"per_hour": 60, "burst": 1}})
+	now := time.Unix(1700000000, 0)
+	l := newTestLimiter(t, conf, &now)
+	if _, err := l.Allow(&csr.ReqParam{LogName: "alice"}, testHandler); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{conf.RateLimitStatePath, conf.RateLimitStatePath + lockSuffix} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != statePerm {
+			t.Errorf("%s created with %v, want %v", path, info.Mode().Perm(), os.FileMode(statePerm))
+		}
+	}
+	// No temporary file is left after the state is replaced.
+	entries, err := os.ReadDir(filepath.Dir(conf.RateLimitStatePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files in the state directory, want 2", len(entries))
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	t.Parallel()
+	conf := newTestConf(t, map[string]interface{}{"per_user": map[string]interface{}{"per_hour": 60, "burst": 1}})
+	now := time.Unix(1700000000, 0)
+	l := newTestLimiter(t, conf, &now)
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := l.Allow(&csr.ReqParam{LogName: user}, testHandler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The bucket of alice is full again, and removed in the next update.
+	now = now.Add(time.Minute)
+	if _, err := l.Allow(&csr.ReqParam{LogName: "carol"}, testHandler); err != nil {
+		t.Fatal(err)
+	}
+	st, err := readState(conf.RateLimitStatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Buckets) != 1 {
+		t.Errorf("got buckets %v, want only the bucket of carol", st.Buckets)
+	}
+}
+
+func jsonRoundTrip(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprintExtension is the permission extension holding the fingerprint of the authenticated key.
+const fingerprintExtension = "pubkey-fp"
+
+// addressPatternChars are the characters allowed in the patterns of the from option.
+const addressPatternChars = "0123456789abcdefABCDEF.:*?/"
+
+// expiryTimeLayouts are the layouts of the expiry-time option, as accepted by OpenSSH.
+var expiryTimeLayouts = []string{"20060102", "200601021504", "20060102150405"}
+
+// noopKeyOptions are the authorized key options restricting the features which the server never provides,
+// e.g. ptys and port forwarding, so they are accepted without any effect.
+var noopKeyOptions = map[string]bool{
+	"no-port-forwarding": true,
+	"no-pty":             true,
+	"no-user-rc":         true,
+	"no-x11-forwarding":  true,
+	"port-forwarding":    true,
+	"pty":                true,
+	"user-rc":            true,
+	"x11-forwarding":     true,
+	"permitopen":         true,
+	"permitlisten":       true,
+	"environment":        true,
+	"tunnel":             true,
+	"no-touch-required":  true,
+}
+
+// PublicKeyCallback authenticates the public key of a client.
+type PublicKeyCallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+
+// AuthorizedKeysCallback returns a PublicKeyCallback which accepts the keys in the authorized_keys file of the user,
+// as OpenSSH does. The "%u" in pattern is replaced by the user name, e.g. "/home/%u/.ssh/authorized_keys".
+// Certificates are not accepted.
+//
+// The options of the key are enforced as follows:
+//   - from accepts the client addresses matching the patterns; host names are not supported.
+//   - expiry-time rejects the key after the time.
+//   - restrict and no-agent-forwarding reject the key, unless agent-forwarding follows restrict,
+//     since the agent must be forwarded to issue certificates.
+//   - the options of the features the server does not provide, e.g. no-pty and permitopen, have no effect.
+//
+// A key with any other option, e.g. command or verify-required, is rejected.
+func AuthorizedKeysCallback(pattern string) PublicKeyCallback {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		user := conn.User()
+		if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\\x00") {
+			return nil, fmt.Errorf("invalid user name %q", user)
+		}
+		data, err := os.ReadFile(strings.ReplaceAll(pattern, "%u", user))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read authorized keys of %s: %v", user, err)
+		}
+		// optionsErr is the reason why a matching key is rejected, reported if no other line accepts the key.
+		var optionsErr error
+		for len(data) > 0 {
+			var (
+				authorizedKey ssh.PublicKey
+				options       []string
+			)
+			authorizedKey, _, options, data, err = ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				// No more valid keys in the rest of the file.
+				break
+			}
+			if !bytes.Equal(authorizedKey.Marshal(), key.Marshal()) {
+				continue
+			}
+			if err := checkKeyOptions(options, conn.RemoteAddr(), time.Now()); err != nil {
+				optionsErr = fmt.Errorf("authorized key %s of %s rejected: %v", ssh.FingerprintSHA256(key), user, err)
+				continue
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{fingerprintExtension: ssh.FingerprintSHA256(key)},
+			}, nil
+		}
+		if optionsErr != nil {
+			return nil, optionsErr
+		}
+		return nil, errors.New("unauthorized public key")
+	}
+}
+
+// checkKeyOptions checks the options of an authorized key allow the client at remote to authenticate at now.
+func checkKeyOptions(options []string, remote net.Addr, now time.Time) error {
+	agentForwarding := true
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		name = strings.ToLower(name)
+		value = unquoteKeyOption(value)
+		switch {
+		case name == "from" && hasValue:
+			if err := checkFrom(value, remote); err != nil {
+				return err
+			}
+		case name == "expiry-time" && hasValue:
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return err
+			}
+			if now.After(expiry) {
+				return fmt.Errorf("the key expired at %s", expiry.Format(time.RFC3339))
+			}
+		case name == "restrict" && !hasValue, name == "no-agent-forwarding" && !hasValue:
+			agentForwarding = false
+		case name == "agent-forwarding" && !hasValue:
+			agentForwarding = true
+		case noopKeyOptions[name]:
+		default:
+			return fmt.Errorf("unsupported option %q", option)
+		}
+	}
+	if !agentForwarding {
+		return errors.New("agent forwarding is not permitted for the key")
+	}
+	return nil
+}
+
+// unquoteKeyOption removes the double quotes around the value of an option and unescapes the quotes in it.
+func unquoteKeyOption(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
+
+// checkFrom checks the address of remote matches the comma-separated patterns of the from option.
+// A pattern is an address with the wildcards "*" and "?", or an address/masklen in CIDR format,
+// and a pattern prefixed with "!" rejects the matching addresses.
+func checkFrom(patterns string, remote net.Addr) error {
+	var ip net.IP
+	if remote != nil {
+		host, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			host = remote.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return fmt.Errorf("unknown client address for from=%q", patterns)
+	}
+
+	matched := false
+	for _, p := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.ToLower(strings.TrimPrefix(p, "!"))
+		ok, err := matchAddress(p, ip)
+		if err != nil {
+			return err
+		}
+		if ok && negated {
+			return fmt.Errorf("client address %s is denied by from=%q", ip, patterns)
+		}
+		matched = matched || ok
+	}
+	if !matched {
+		return fmt.Errorf("client address %s is not allowed by from=%q", ip, patterns)
+	}
+	return nil
+}
+
+// matchAddress checks whether ip matches the address pattern p.
+func matchAddress(p string, ip net.IP) (bool, error) {
+	if p == "" || strings.Trim(p, addressPatternChars) != "" {
+		return false, fmt.Errorf("unsupported pattern %q in from, only addresses are supported", p)
+	}
+	if strings.Contains(p, "/") {
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q in from: %v", p, err)
+		}
+		return network.Contains(ip), nil
+	}
+	return path.Match(p, ip.String())
+}
+
+// parseExpiryTime parses the time of the expiry-time option, i.e. YYYYMMDD[HHMM[SS]] in the local time zone,
+// or in UTC with a "Z" suffix.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range expiryTimeLayouts {
+		if len(value) != len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
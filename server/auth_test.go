@@ -0,0 +1,158 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMetadata is a ssh.ConnMetadata with the user name and the client address only.
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user   string
+	remote net.Addr
+}
+
+func (c testConnMetadata) User() string {
+	return c.user
+}
+
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestAuthorizedKeysCallback(t *testing.T) {
+	t.Parallel()
+	_, alice := newSigner(t)
+	_, bob := newSigner(t)
+	dir := t.TempDir()
+	writeAuthorizedKeys(t, dir, "alice", bob.PublicKey(), alice.PublicKey())
+	callback := AuthorizedKeysCallback(filepath.Join(dir, "%u", "authorized_keys"))
+
+	tests := []struct {
+		name    string
+		user    string
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{name: "authorized", user: "alice", key: alice.PublicKey()},
+		{name: "another authorized key", user: "alice", key: bob.PublicKey()},
+		{name: "no authorized keys", user: "bob", key: bob.PublicKey(), wantErr: true},
+		{name: "path traversal", user: "../alice", key: alice.PublicKey(), wantErr: true},
+		{name: "empty user", key: alice.PublicKey(), wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			perms, err := callback(testConnMetadata{user: tt.user}, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("callback error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && perms.Extensions[fingerprintExtension] != ssh.FingerprintSHA256(tt.key) {
+				t.Errorf("unexpected permissions %+v", perms)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysCallback_Options(t *testing.T) {
+	t.Parallel()
+	_, alice := newSigner(t)
+	_, bob := newSigner(t)
+	_, carol := newSigner(t)
+	authorizedKey := func(options string, key ssh.PublicKey) string {
+		return options + " " + string(ssh.MarshalAuthorizedKey(key))
+	}
+	dir := t.TempDir()
+	data := authorizedKey(`from="10.0.0.0/8,!10.0.0.66"`, alice.PublicKey()) +
+		authorizedKey(`restrict`, bob.PublicKey()) +
+		authorizedKey(`command="/bin/true"`, carol.PublicKey()) +
+		authorizedKey(`from="192.0.2.*",no-pty`, carol.PublicKey())
+	if err := os.MkdirAll(filepath.Join(dir, "alice"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alice", "authorized_keys"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	callback := AuthorizedKeysCallback(filepath.Join(dir, "%u", "authorized_keys"))
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		remote  string
+		wantErr string
+	}{
+		{name: "from allowed", key: alice.PublicKey(), remote: "10.1.2.3:22"},
+		{name: "from denied", key: alice.PublicKey(), remote: "10.0.0.66:22", wantErr: "denied by from"},
+		{name: "from not allowed", key: alice.PublicKey(), remote: "192.0.2.1:22", wantErr: "not allowed by from"},
+		{name: "restrict", key: bob.PublicKey(), remote: "10.1.2.3:22", wantErr: "agent forwarding is not permitted"},
+		{name: "another line accepts", key: carol.PublicKey(), remote: "192.0.2.1:22"},
+		{name: "no line accepts", key: carol.PublicKey(), remote: "10.1.2.3:22", wantErr: "rejected"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			remote, err := net.ResolveTCPAddr("tcp", tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = callback(testConnMetadata{user: "alice", remote: remote}, tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("callback unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("callback error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckKeyOptions(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22}
+	tests := []struct {
+		name    string
+		options []string
+		wantErr bool
+	}{
+		{name: "no options"},
+		{name: "noop options", options: []string{"no-pty", "no-port-forwarding", "no-X11-forwarding", `permitopen="localhost:80"`}},
+		{name: "restrict with agent forwarding", options: []string{"restrict", "agent-forwarding"}},
+		{name: "agent forwarding restricted again", options: []string{"agent-forwarding", "restrict"}, wantErr: true},
+		{name: "no agent forwarding", options: []string{"no-agent-forwarding"}, wantErr: true},
+		{name: "ipv6 cidr", options: []string{`from="2001:db8::/32"`}},
+		{name: "ipv6 wildcard", options: []string{`from="2001:DB8::*"`}},
+		{name: "host name pattern", options: []string{`from="*.example.com"`}, wantErr: true},
+		{name: "invalid cidr", options: []string{`from="2001:db8::/129"`}, wantErr: true},
+		{name: "not expired", options: []string{`expiry-time="20220601120100Z"`}},
+		{name: "expired", options: []string{`expiry-time="202206011159Z"`}, wantErr: true},
+		{name: "expired date", options: []string{`expiry-time="20220601Z"`}, wantErr: true},
+		{name: "invalid expiry time", options: []string{`expiry-time="2022-06-01"`}, wantErr: true},
+		{name: "forced command", options: []string{`command="gensign"`}, wantErr: true},
+		{name: "verify required", options: []string{"verify-required"}, wantErr: true},
+		{name: "cert authority", options: []string{"cert-authority"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if err := checkKeyOptions(tt.options, remote, now); (err != nil) != tt.wantErr {
+				t.Errorf("checkKeyOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// channelConn adapts the forwarded agent channel to net.Conn, which is required to create gensign handlers.
+// The deadlines are not supported by ssh channels, so they are ignored.
+type channelConn struct {
+	ssh.Channel
+	local, remote net.Addr
+}
+
+// LocalAddr returns the local address of the underlying SSH connection.
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the underlying SSH connection.
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline is a no-op.
+func (c *channelConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op.
+func (c *channelConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op.
+func (c *channelConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,7 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+// Package server implements an SSH front-end of gensign. It authenticates the clients, opens the forwarded
+// agent channel of each request, and runs gensign in-process, so that gensign can be served without
+// OpenSSH ForceCommand and a process per request.
+package server
@@ -0,0 +1,374 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/theparanoids/ysshra/common"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	"github.com/theparanoids/ysshra/internal/logkey"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// agentRequestType and agentChannelType are defined in OpenSSH PROTOCOL for agent forwarding.
+	agentRequestType = "auth-agent-req@openssh.com"
+	agentChannelType = "auth-agent@openssh.com"
+
+	defaultHandlerKeyword   = "ALL_MODULES"
+	defaultMaxConcurrency   = 32
+	defaultHandshakeTimeout = 30 * time.Second
+)
+
+// ErrServerClosed is returned by Serve after the server is closed.
+var ErrServerClosed = errors.New("server: server closed")
+
+// Option encapsulates the parameters of New function that create new Server objects.
+type Option struct {
+	// HostKeys are the host keys of the server. Required.
+	HostKeys []ssh.Signer
+	// PublicKeyCallback authenticates the clients. Required.
+	PublicKeyCallback PublicKeyCallback
+	// Config is the gensign configuration. Required.
+	Config *config.GensignConfig
+	// HandlerCreators create the handlers in Config for each request. Required.
+	HandlerCreators map[string]gensign.CreateHandler
+	// Signer signs the CSRs. It is shared by all the requests. Required.
+	Signer csr.Signer
+	// NamespacePolicy and HandlerKeyword are the arguments passed to gensign in the ForceCommand of OpenSSH.
+	// The default values are common.NoNamespace and "ALL_MODULES".
+	NamespacePolicy common.NamespacePolicy
+	HandlerKeyword  string
+	// MaxConcurrency is the maximum number of the requests running at the same time.
+	// Other requests wait until a running request finishes. The default value is 32.
+	MaxConcurrency int
+	// HandshakeTimeout is the timeout of the SSH handshake, including the authentication.
+	// The default value is 30 seconds.
+	HandshakeTimeout time.Duration
+	// Auditor records the issued certificates and the denied requests. Optional.
+	Auditor gensign.Auditor
+	// RateLimiter limits the requests to each handler. Optional.
+	RateLimiter gensign.RateLimiter
+	// ApprovalQueue stores the requests which require a second person to approve. Optional.
+	ApprovalQueue gensign.ApprovalQueue
+	// ApprovalWait is the duration for a request to wait for the approval.
+	ApprovalWait time.Duration
+	// Notifier notifies the issued certificates and the failed requests. Optional.
+	Notifier gensign.Notifier
+}
+
+// Server serves gensign requests over SSH.
+type Server struct {
+	opt       Option
+	sshConfig *ssh.ServerConfig
+	// sem limits the number of the running requests.
+	sem chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// New returns a new Server. The missing optional fields in opt are filled with the default values.
+func New(opt Option) (*Server, error) {
+	if len(opt.HostKeys) == 0 {
+		return nil, errors.New("no host key provided")
+	}
+	if opt.PublicKeyCallback == nil {
+		return nil, errors.New("public key callback cannot be nil")
+	}
+	if opt.Config == nil {
+		return nil, errors.New("gensign configuration cannot be nil")
+	}
+	if opt.Signer == nil {
+		return nil, errors.New("signer cannot be nil")
+	}
+	if opt.NamespacePolicy == "" {
+		opt.NamespacePolicy = common.NoNamespace
+	}
+	if !common.ValidNamespacePolicy(opt.NamespacePolicy) {
+		return nil, fmt.Errorf("invalid namespace policy %q", opt.NamespacePolicy)
+	}
+	if opt.HandlerKeyword == "" {
+		opt.HandlerKeyword = defaultHandlerKeyword
+	}
+	if opt.MaxConcurrency <= 0 {
+		opt.MaxConcurrency = defaultMaxConcurrency
+	}
+	if opt.HandshakeTimeout <= 0 {
+		opt.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	sshConfig := &ssh.ServerConfig{PublicKeyCallback: opt.PublicKeyCallback}
+	for _, hostKey := range opt.HostKeys {
+		sshConfig.AddHostKey(hostKey)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		opt:       opt,
+		sshConfig: sshConfig,
+		sem:       make(chan struct{}, opt.MaxConcurrency),
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts the connections on the listener l, and serves each of them in a new goroutine.
+// It always returns a non-nil error, which is ErrServerClosed after Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(nil, conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops the listeners, cancels the running requests and closes all the connections.
+// It waits for the connections to be released.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// track adds the listener or the connection to the server. It returns false if the server is closed.
+func (s *Server) track(l net.Listener, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		s.listeners[l] = struct{}{}
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+// untrack removes the listener or the connection from the server.
+func (s *Server) untrack(l net.Listener, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	delete(s.conns, conn)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// serveConn performs the SSH handshake of conn and serves the session channels.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(s.opt.HandshakeTimeout)); err != nil {
+		log.Warn().Err(err).Msg("failed to set handshake deadline")
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		log.Info().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("ssh handshake failed")
+		return
+	}
+	defer sshConn.Close()
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Warn().Err(err).Msg("failed to clear handshake deadline")
+	}
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to accept session channel")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(sshConn, channel, requests)
+		}()
+	}
+}
+
+// serveSession serves the requests of a session channel.
+// Only one exec request is served, and the agent must be forwarded before it.
+func (s *Server) serveSession(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var (
+		forwarded bool
+		done      chan struct{}
+	)
+	for req := range requests {
+		switch req.Type {
+		case agentRequestType:
+			forwarded = true
+			_ = req.Reply(true, nil)
+		case "exec":
+			var msg struct{ Command string }
+			if done != nil || ssh.Unmarshal(req.Payload, &msg) != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			done = make(chan struct{})
+			go func(forwarded bool) {
+				defer close(done)
+				status := s.exec(sshConn, channel, msg.Command, forwarded)
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				_ = channel.CloseWrite()
+				channel.Close()
+			}(forwarded)
+		default:
+			// Interactive sessions, environment variables and others are not supported.
+			_ = req.Reply(false, nil)
+		}
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+// exec runs gensign for the command, and returns the exit status.
+func (s *Server) exec(sshConn *ssh.ServerConn, channel ssh.Channel, cmd string, forwarded bool) uint32 {
+	stderr := channel.Stderr()
+	if !forwarded {
+		fmt.Fprintln(stderr, "agent forwarding is required")
+		return 1
+	}
+	params, err := s.reqParam(sshConn, cmd)
+	if err != nil {
+		log.Warn().Err(err).Str("user", sshConn.User()).Msg("failed to create request parameter")
+		fmt.Fprintf(stderr, "invalid request: %v\n", err)
+		return 1
+	}
+	if err := s.run(params, sshConn); err != nil {
+		log.Error().Str(logkey.TransIDField, params.TransID).Err(err).Msg("failed to run gensign")
+		writeError(stderr, params, err)
+		return 1
+	}
+	return 0
+}
+
+// run runs gensign in-process with the handlers created on the forwarded agent.
+func (s *Server) run(params *csr.ReqParam, sshConn *ssh.ServerConn) (err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.opt.Config.RequestTimeout)
+	defer cancel()
+	defer func() {
+		gensign.ExportGensignRunMetric(ctx, err)
+	}()
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-ctx.Done():
+		return gensign.NewErr(gensign.Unknown, fmt.Errorf("failed to wait for a request slot: %v", ctx.Err()))
+	}
+
+	agentChannel, reqs, err := sshConn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return gensign.NewErr(gensign.Unknown, fmt.Errorf("failed to open forwarded agent: %v", err))
+	}
+	defer agentChannel.Close()
+	go ssh.DiscardRequests(reqs)
+	conn := &channelConn{Channel: agentChannel, local: sshConn.LocalAddr(), remote: sshConn.RemoteAddr()}
+
+	handlers := gensign.NewHandlers(s.opt.Config, s.opt.HandlerCreators, conn)
+	return gensign.RunWithOption(ctx, params, handlers, s.opt.Signer, gensign.RunOption{
+		Auditor:       s.opt.Auditor,
+		RateLimiter:   s.opt.RateLimiter,
+		ApprovalQueue: s.opt.ApprovalQueue,
+		ApprovalWait:  s.opt.ApprovalWait,
+		Notifier:      s.opt.Notifier,
+	})
+}
+
+// reqParam constructs the request parameter from the SSH connection,
+// in the same way as gensign invoked by OpenSSH ForceCommand.
+func (s *Server) reqParam(sshConn *ssh.ServerConn, cmd string) (*csr.ReqParam, error) {
+	env := map[string]string{
+		"SSH_ORIGINAL_COMMAND": cmd,
+		"LOGNAME":              sshConn.User(),
+		"SSH_CONNECTION":       sshConnection(sshConn.RemoteAddr(), sshConn.LocalAddr()),
+	}
+	args := []string{"gensign", string(s.opt.NamespacePolicy), s.opt.HandlerKeyword}
+	return csr.NewReqParam(func(key string) string {
+		return env[key]
+	}, func() []string {
+		return args
+	})
+}
+
+// sshConnection formats the addresses as the SSH_CONNECTION variable of OpenSSH,
+// i.e. "client_ip client_port server_ip server_port".
+func sshConnection(remote, local net.Addr) string {
+	remoteHost, remotePort, _ := net.SplitHostPort(remote.String())
+	localHost, localPort, _ := net.SplitHostPort(local.String())
+	return fmt.Sprintf("%s %s %s %s", remoteHost, remotePort, localHost, localPort)
+}
+
+// writeError writes the gensign error to the user.
+// The debug stack of a panic is not sent to the user.
+func writeError(w io.Writer, params *csr.ReqParam, err error) {
+	if gensign.IsErrorOfType(err, gensign.Panic) {
+		fmt.Fprintf(w, "failed to run gensign: internal error, transaction ID %s\n", params.TransID)
+		return
+	}
+	fmt.Fprintf(w, "failed to run gensign: %v, transaction ID %s\n", err, params.TransID)
+}
@@ -0,0 +1,319 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/crypki/proto"
+	"github.com/theparanoids/ysshra/client"
+	"github.com/theparanoids/ysshra/config"
+	"github.com/theparanoids/ysshra/csr"
+	"github.com/theparanoids/ysshra/gensign"
+	"golang.org/x/crypto/ssh"
+	ag "golang.org/x/crypto/ssh/agent"
+)
+
+// testHandler issues a certificate of a new key to the users in allowed.
+type testHandler struct {
+	agent   ag.Agent
+	allowed map[string]bool
+}
+
+func (h *testHandler) Name() string {
+	return "test"
+}
+
+func (h *testHandler) Authenticate(params *csr.ReqParam) error {
+	if !h.allowed[params.LogName] {
+		return gensign.NewErrorWithMsg(gensign.HandlerAuthN, h.Name(), "user not allowed")
+	}
+	return nil
+}
+
+func (h *testHandler) Generate(params *csr.ReqParam) ([]csr.AgentKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	return []csr.AgentKey{&testAgentKey{
+		agent: h.agent,
+		priv:  priv,
+		csr: &proto.SSHCertificateSigningRequest{
+			PublicKey:  string(ssh.MarshalAuthorizedKey(pub)),
+			Principals: []string{params.LogName},
+			KeyId:      params.TransID,
+			Validity:   3600,
+		},
+	}}, nil
+}
+
+type testAgentKey struct {
+	agent ag.Agent
+	priv  ed25519.PrivateKey
+	csr   *proto.SSHCertificateSigningRequest
+}
+
+func (k *testAgentKey) CSRs() []*proto.SSHCertificateSigningRequest {
+	return []*proto.SSHCertificateSigningRequest{k.csr}
+}
+
+func (k *testAgentKey) AddCertsToAgent(certs []ssh.PublicKey, comments []string) error {
+	for i, cert := range certs {
+		if err := k.agent.Add(ag.AddedKey{PrivateKey: k.priv, Certificate: cert.(*ssh.Certificate), Comment: comments[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testSigner signs the CSRs by a CA key in memory.
+type testSigner struct {
+	ca ssh.Signer
+}
+
+func (s *testSigner) Sign(_ context.Context, req *proto.SSHCertificateSigningRequest) ([]ssh.PublicKey, []string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		KeyId:           req.KeyId,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Unix()) + req.Validity,
+	}
+	if err := cert.SignCert(rand.Reader, s.ca); err != nil {
+		return nil, nil, err
+	}
+	return []ssh.PublicKey{cert}, []string{"test"}, nil
+}
+
+func newSigner(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, signer
+}
+
+// writeAuthorizedKeys writes the authorized_keys of user under dir.
+func writeAuthorizedKeys(t *testing.T, dir, user string, keys ...ssh.PublicKey) {
+	t.Helper()
+	data := []byte("# comment\n\n")
+	for _, key := range keys {
+		data = append(data, ssh.MarshalAuthorizedKey(key)...)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, user), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, user, "authorized_keys"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestServer starts a server with testHandler allowing the users in allowed,
+// and returns the server and its address.
+func startTestServer(t *testing.T, hostKey ssh.Signer, authorizedKeysDir string, allowed ...string) (*Server, string) {
+	t.Helper()
+	confPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(confPath, []byte(`{"handlers":{"test":{}},"request_timeout":10}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.NewGensignConfig(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedUsers := make(map[string]bool)
+	for _, user := range allowed {
+		allowedUsers[user] = true
+	}
+	_, ca := newSigner(t)
+
+	s, err := New(Option{
+		HostKeys:          []ssh.Signer{hostKey},
+		PublicKeyCallback: AuthorizedKeysCallback(filepath.Join(authorizedKeysDir, "%u", "authorized_keys")),
+		Config:            conf,
+		HandlerCreators: map[string]gensign.CreateHandler{
+			"test": func(_ *config.GensignConfig, conn net.Conn) (gensign.Handler, error) {
+				return &testHandler{agent: ag.NewClient(conn), allowed: allowedUsers}, nil
+			},
+		},
+		Signer:         &testSigner{ca: ca},
+		MaxConcurrency: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listener) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve() returned %v, want %v", err, ErrServerClosed)
+		}
+	})
+	return s, listener.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	_, hostKey := newSigner(t)
+	alicePriv, alice := newSigner(t)
+	bobPriv, bob := newSigner(t)
+	_, mallory := newSigner(t)
+	authorizedKeysDir := t.TempDir()
+	writeAuthorizedKeys(t, authorizedKeysDir, "alice", mallory.PublicKey(), alice.PublicKey())
+	writeAuthorizedKeys(t, authorizedKeysDir, "bob", bob.PublicKey())
+	_, address := startTestServer(t, hostKey, authorizedKeysDir, "alice")
+
+	tests := []struct {
+		name    string
+		user    string
+		key     ed25519.PrivateKey
+		wantErr string
+	}{
+		{name: "certificate issued", user: "alice", key: alicePriv},
+		{name: "handler authentication failed", user: "bob", key: bobPriv, wantErr: "all authentications failed"},
+		{name: "unauthorized key", user: "alice", key: bobPriv, wantErr: "unable to authenticate"},
+		{name: "unknown user", user: "carol", key: bobPriv, wantErr: "unable to authenticate"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			keyring := ag.NewKeyring()
+			if err := keyring.Add(ag.AddedKey{PrivateKey: tt.key}); err != nil {
+				t.Fatal(err)
+			}
+			c, err := client.New(client.Option{
+				Address:          address,
+				HostKeyCallback:  ssh.FixedHostKey(hostKey.PublicKey()),
+				Agent:            keyring,
+				Username:         tt.user,
+				Hostname:         "laptop",
+				SSHClientVersion: "8.9",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			result, err := c.Run(ctx, client.Request{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() unexpected error: %v", err)
+			}
+			if len(result.Certificates) != 1 {
+				t.Fatalf("got %d certificates, want 1", len(result.Certificates))
+			}
+			if got := result.Certificates[0].ValidPrincipals; len(got) != 1 || got[0] != tt.user {
+				t.Errorf("got principals %v, want [%s]", got, tt.user)
+			}
+		})
+	}
+}
+
+func TestServer_NoAgentForwarding(t *testing.T) {
+	t.Parallel()
+	_, hostKey := newSigner(t)
+	_, alice := newSigner(t)
+	authorizedKeysDir := t.TempDir()
+	writeAuthorizedKeys(t, authorizedKeysDir, "alice", alice.PublicKey())
+	_, address := startTestServer(t, hostKey, authorizedKeysDir, "alice")
+
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(alice)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(`{"ifVer":7,"username":"alice","hostname":"laptop","sshClientVersion":"8.9"}`)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Fatalf("got error %v, want exit status 1", err)
+	}
+	if !strings.Contains(string(output), "agent forwarding is required") {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+	_, hostKey := newSigner(t)
+	_, ca := newSigner(t)
+	valid := func() Option {
+		return Option{
+			HostKeys:          []ssh.Signer{hostKey},
+			PublicKeyCallback: AuthorizedKeysCallback("/nonexistent/%u"),
+			Config:            &config.GensignConfig{},
+			Signer:            &testSigner{ca: ca},
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(opt *Option)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(opt *Option) {}},
+		{name: "no host key", modify: func(opt *Option) { opt.HostKeys = nil }, wantErr: true},
+		{name: "no public key callback", modify: func(opt *Option) { opt.PublicKeyCallback = nil }, wantErr: true},
+		{name: "no config", modify: func(opt *Option) { opt.Config = nil }, wantErr: true},
+		{name: "no signer", modify: func(opt *Option) { opt.Signer = nil }, wantErr: true},
+		{name: "invalid namespace policy", modify: func(opt *Option) { opt.NamespacePolicy = "ANY" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			opt := valid()
+			tt.modify(&opt)
+			s, err := New(opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (s.opt.HandlerKeyword != defaultHandlerKeyword || cap(s.sem) != defaultMaxConcurrency) {
+				t.Errorf("unexpected default option %+v", s.opt)
+			}
+		})
+	}
+}
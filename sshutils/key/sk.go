@@ -0,0 +1,97 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package key
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Flags of a security key (sk-*) signature.
+// Ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.u2f
+const (
+	// SKFlagUserPresence indicates the user touched the security key for the signature.
+	SKFlagUserPresence byte = 0x01
+	// SKFlagUserVerification indicates the user was verified (e.g. by PIN) for the signature.
+	SKFlagUserVerification byte = 0x04
+)
+
+// Options of a security key in authorized keys file.
+// Ref: https://man.openbsd.org/sshd.8#AUTHORIZED_KEYS_FILE_FORMAT
+const (
+	// SKOptionNoTouchRequired allows the signatures without user presence.
+	SKOptionNoTouchRequired = "no-touch-required"
+	// SKOptionVerifyRequired requires the signatures with user verification.
+	SKOptionVerifyRequired = "verify-required"
+)
+
+// IsSecurityKey checks if the public key is a FIDO security key (sk-*) public key.
+func IsSecurityKey(pub ssh.PublicKey) bool {
+	if pub == nil {
+		return false
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// SecurityKeyApplication returns the FIDO application (relying party ID) of a security key, e.g. "ssh:".
+func SecurityKeyApplication(pub ssh.PublicKey) (string, error) {
+	switch pub.Type() {
+	case ssh.KeyAlgoSKECDSA256:
+		var w struct {
+			Name        string
+			ID          string
+			Key         []byte
+			Application string
+		}
+		if err := ssh.Unmarshal(pub.Marshal(), &w); err != nil {
+			return "", err
+		}
+		return w.Application, nil
+	case ssh.KeyAlgoSKED25519:
+		var w struct {
+			Name        string
+			KeyBytes    []byte
+			Application string
+		}
+		if err := ssh.Unmarshal(pub.Marshal(), &w); err != nil {
+			return "", err
+		}
+		return w.Application, nil
+	}
+	return "", fmt.Errorf("%s is not a security key", pub.Type())
+}
+
+// SecurityKeyCryptoPublicKey returns the underlying ECDSA or ED25519 public key of a security key.
+func SecurityKeyCryptoPublicKey(pub ssh.PublicKey) (crypto.PublicKey, error) {
+	if !IsSecurityKey(pub) {
+		return nil, fmt.Errorf("%s is not a security key", pub.Type())
+	}
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("cannot extract the public key")
+	}
+	return cpk.CryptoPublicKey(), nil
+}
+
+// SecurityKeySignatureFlags returns the flags and the counter of a security key signature.
+func SecurityKeySignatureFlags(sig *ssh.Signature) (flags byte, counter uint32, err error) {
+	var w struct {
+		Flags   byte
+		Counter uint32
+	}
+	if sig == nil {
+		return 0, 0, errors.New("null signature provided")
+	}
+	if err := ssh.Unmarshal(sig.Rest, &w); err != nil {
+		return 0, 0, fmt.Errorf("invalid security key signature: %v", err)
+	}
+	return w.Flags, w.Counter, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Yahoo Inc.
+// Licensed under the terms of the Apache License 2.0. Please see LICENSE file in project root for terms.
+
+package key
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSKEd25519Key(t *testing.T, application string) (ssh.PublicKey, ed25519.PublicKey) {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, application}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub, pub
+}
+
+func newSKECDSAKey(t *testing.T, application string) (ssh.PublicKey, *ecdsa.PublicKey) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		ID          string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKECDSA256, "nistp256", elliptic.Marshal(elliptic.P256(), priv.X, priv.Y), application}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub, &priv.PublicKey
+}
+
+func TestSecurityKey(t *testing.T) {
+	t.Parallel()
+	edPub, edCrypto := newSKEd25519Key(t, "ssh:")
+	ecPub, ecCrypto := newSKECDSAKey(t, "ssh:test")
+	_, plainPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPub, err := ssh.NewPublicKey(plainPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pub     ssh.PublicKey
+		wantSK  bool
+		wantApp string
+	}{
+		{name: "sk-ed25519", pub: edPub, wantSK: true, wantApp: "ssh:"},
+		{name: "sk-ecdsa", pub: ecPub, wantSK: true, wantApp: "ssh:test"},
+		{name: "ed25519", pub: plainPub, wantSK: false},
+		{name: "nil", pub: nil, wantSK: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := IsSecurityKey(tt.pub); got != tt.wantSK {
+				t.Fatalf("IsSecurityKey() = %v, want %v", got, tt.wantSK)
+			}
+			if tt.pub == nil {
+				return
+			}
+			app, err := SecurityKeyApplication(tt.pub)
+			if (err != nil) == tt.wantSK {
+				t.Fatalf("SecurityKeyApplication() error = %v", err)
+			}
+			if app != tt.wantApp {
+				t.Errorf("SecurityKeyApplication() = %q, want %q", app, tt.wantApp)
+			}
+			if _, err := SecurityKeyCryptoPublicKey(tt.pub); (err != nil) == tt.wantSK {
+				t.Errorf("SecurityKeyCryptoPublicKey() error = %v", err)
+			}
+		})
+	}
+
+	if got, err := SecurityKeyCryptoPublicKey(edPub); err != nil || !edCrypto.Equal(got) {
+		t.Errorf("SecurityKeyCryptoPublicKey() = %v, %v, want %v", got, err, edCrypto)
+	}
+	if got, err := SecurityKeyCryptoPublicKey(ecPub); err != nil || !ecCrypto.Equal(got) {
+		t.Errorf("SecurityKeyCryptoPublicKey() = %v, %v, want %v", got, err, ecCrypto)
+	}
+}
+
+func TestSecurityKeySignatureFlags(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		sig         *ssh.Signature
+		wantFlags   byte
+		wantCounter uint32
+		wantErr     bool
+	}{
+		{
+			name:        "touch and verify",
+			sig:         &ssh.Signature{Rest: []byte{0x05, 0x00, 0x00, 0x01, 0x00}},
+			wantFlags:   SKFlagUserPresence | SKFlagUserVerification,
+			wantCounter: 256,
+		},
+		{name: "no flags", sig: &ssh.Signature{Rest: []byte{0x00, 0x00, 0x00, 0x00, 0x01}}, wantCounter: 1},
+		{name: "truncated", sig: &ssh.Signature{Rest: []byte{0x01}}, wantErr: true},
+		{name: "nil", sig: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			flags, counter, err := SecurityKeySignatureFlags(tt.sig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SecurityKeySignatureFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if flags != tt.wantFlags || counter != tt.wantCounter {
+				t.Errorf("SecurityKeySignatureFlags() = %#x, %d, want %#x, %d", flags, counter, tt.wantFlags, tt.wantCounter)
+			}
+		})
+	}
+}